@@ -0,0 +1,249 @@
+// Package bench measures tokenization throughput and latency over a corpus
+// and compares it against a saved baseline
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LineFunc - Tokenizes the next line of a file, keeping the state of the
+// previous lines
+type LineFunc func(line string) error
+
+// Tokenizer - Returns a LineFunc positioned at the start of a file
+type Tokenizer func() LineFunc
+
+// Corpus - Files to tokenize, split in lines
+type Corpus struct {
+	Files [][]string
+	Lines int
+	Bytes int64 // Without line breaks
+}
+
+// LoadCorpus - Reads the files; line breaks are not part of any line
+func LoadCorpus(files []string) (*Corpus, error) {
+	c := &Corpus{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text := strings.TrimSuffix(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+		if text == "" {
+			continue
+		}
+		lines := strings.Split(text, "\n")
+		for _, line := range lines {
+			c.Bytes += int64(len(line))
+		}
+		c.Lines += len(lines)
+		c.Files = append(c.Files, lines)
+	}
+	return c, nil
+}
+
+// Result - Measurements of one tokenizer over the corpus
+type Result struct {
+	Name          string  `json:"name"`
+	Lines         int     `json:"lines"` // Lines tokenized, over every pass
+	Bytes         int64   `json:"bytes"`
+	Seconds       float64 `json:"seconds"`
+	LinesPerSec   float64 `json:"lines_per_sec"`
+	BytesPerSec   float64 `json:"bytes_per_sec"`
+	AllocsPerLine float64 `json:"allocs_per_line"`
+	P50           int64   `json:"p50_ns"` // Per-line latency
+	P99           int64   `json:"p99_ns"`
+}
+
+// Run tokenizes the corpus passes times, after one warm-up pass that is not
+// measured. Latencies are per line; allocations are counted over the whole
+// run, so they include whatever the tokenizer allocates per file.
+func Run(name string, tok Tokenizer, corpus *Corpus, passes int) (*Result, error) {
+	if passes < 1 {
+		passes = 1
+	}
+	if corpus.Lines == 0 {
+		return nil, fmt.Errorf("empty corpus")
+	}
+	if err := pass(tok, corpus, nil); err != nil {
+		return nil, err
+	}
+
+	latencies := make([]time.Duration, 0, corpus.Lines*passes)
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for i := 0; i < passes; i++ {
+		if err := pass(tok, corpus, &latencies); err != nil {
+			return nil, err
+		}
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	lines := corpus.Lines * passes
+	seconds := elapsed.Seconds()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return &Result{
+		Name:          name,
+		Lines:         lines,
+		Bytes:         corpus.Bytes * int64(passes),
+		Seconds:       seconds,
+		LinesPerSec:   float64(lines) / seconds,
+		BytesPerSec:   float64(corpus.Bytes*int64(passes)) / seconds,
+		AllocsPerLine: float64(after.Mallocs-before.Mallocs) / float64(lines),
+		P50:           int64(percentile(latencies, 50)),
+		P99:           int64(percentile(latencies, 99)),
+	}, nil
+}
+
+func pass(tok Tokenizer, corpus *Corpus, latencies *[]time.Duration) error {
+	for _, file := range corpus.Files {
+		next := tok()
+		for _, line := range file {
+			start := time.Now()
+			if err := next(line); err != nil {
+				return err
+			}
+			if latencies != nil {
+				*latencies = append(*latencies, time.Since(start))
+			}
+		}
+	}
+	return nil
+}
+
+// percentile - Nearest-rank percentile of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Baseline - Saved results, compared against by later runs
+type Baseline struct {
+	Results []Result `json:"results"`
+}
+
+// Find - Result of the named tokenizer, nil if missing
+func (b *Baseline) Find(name string) *Result {
+	for i := range b.Results {
+		if b.Results[i].Name == name {
+			return &b.Results[i]
+		}
+	}
+	return nil
+}
+
+// LoadBaseline reads a baseline written by SaveBaseline
+func LoadBaseline(path string) (*Baseline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var b Baseline
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("invalid baseline %s: %w", path, err)
+	}
+	return &b, nil
+}
+
+// SaveBaseline writes results as JSON
+func SaveBaseline(path string, results []*Result) error {
+	b := Baseline{}
+	for _, r := range results {
+		b.Results = append(b.Results, *r)
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Change - One metric against its baseline value
+type Change struct {
+	Metric     string
+	Baseline   float64
+	Current    float64
+	Percent    float64 // Positive when worse
+	Regression bool    // Worse by more than the threshold
+}
+
+// Compare - Changes of every metric of current against base; threshold is
+// the tolerated slowdown in percent
+func Compare(base, current *Result, threshold float64) []Change {
+	metrics := []struct {
+		name           string
+		base, current  float64
+		higherIsBetter bool
+	}{
+		{"lines/s", base.LinesPerSec, current.LinesPerSec, true},
+		{"bytes/s", base.BytesPerSec, current.BytesPerSec, true},
+		{"allocs/line", base.AllocsPerLine, current.AllocsPerLine, false},
+		{"p99", float64(base.P99), float64(current.P99), false},
+	}
+
+	changes := make([]Change, 0, len(metrics))
+	for _, m := range metrics {
+		c := Change{Metric: m.name, Baseline: m.base, Current: m.current}
+		if m.base != 0 {
+			c.Percent = 100 * (m.current - m.base) / m.base
+			if m.higherIsBetter {
+				c.Percent = -c.Percent
+			}
+		} else if m.current > 0 && !m.higherIsBetter {
+			c.Percent = 100
+		}
+		c.Regression = c.Percent > threshold
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// WriteText - One row per result; with several results the first one is
+// compared against the others
+func WriteText(w io.Writer, corpus *Corpus, results []*Result) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Corpus: %d files, %d lines, %d bytes\n", len(corpus.Files), corpus.Lines, corpus.Bytes)
+	fmt.Fprintf(&b, "%-10s %14s %14s %12s %10s %10s\n", "", "lines/s", "bytes/s", "allocs/line", "p50", "p99")
+	for _, r := range results {
+		fmt.Fprintf(&b, "%-10s %14.0f %14.0f %12.1f %10s %10s\n", r.Name, r.LinesPerSec, r.BytesPerSec,
+			r.AllocsPerLine, time.Duration(r.P50), time.Duration(r.P99))
+	}
+	for i := 1; i < len(results); i++ {
+		r := results[i]
+		fmt.Fprintf(&b, "%s is %.2fx faster than %s\n", results[0].Name, results[0].LinesPerSec/r.LinesPerSec, r.Name)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteChanges - Comparison against the baseline, regressions marked with
+// "!"
+func WriteChanges(w io.Writer, name string, changes []Change) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Baseline comparison (%s, + is worse):\n", name)
+	for _, c := range changes {
+		mark := " "
+		if c.Regression {
+			mark = "!"
+		}
+		fmt.Fprintf(&b, "%s %-12s %14.1f -> %14.1f  %+6.1f%%\n", mark, c.Metric, c.Baseline, c.Current, c.Percent)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,75 @@
+package bench
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompare(t *testing.T) {
+	base := &Result{LinesPerSec: 1000, BytesPerSec: 50000, AllocsPerLine: 10, P99: 2000}
+	tests := []struct {
+		name    string
+		current Result
+		want    []string // Metrics reported as regressions
+	}{
+		{"same", *base, nil},
+		{"faster", Result{LinesPerSec: 2000, BytesPerSec: 100000, AllocsPerLine: 5, P99: 1000}, nil},
+		{"within threshold", Result{LinesPerSec: 950, BytesPerSec: 47500, AllocsPerLine: 10.5, P99: 2100}, nil},
+		{"slower", Result{LinesPerSec: 800, BytesPerSec: 40000, AllocsPerLine: 10, P99: 2000}, []string{"lines/s", "bytes/s"}},
+		{"more allocs and latency", Result{LinesPerSec: 1000, BytesPerSec: 50000, AllocsPerLine: 12, P99: 3000}, []string{"allocs/line", "p99"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, c := range Compare(base, &tt.current, 10) {
+				if c.Regression {
+					got = append(got, c.Metric)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("regressions = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("regressions = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	corpus := &Corpus{Files: [][]string{{"a", "bb"}, {"ccc"}}, Lines: 3, Bytes: 6}
+	files := 0
+	var seen []string
+	r, err := Run("test", func() LineFunc {
+		files++
+		return func(line string) error {
+			seen = append(seen, line)
+			return nil
+		}
+	}, corpus, 2)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	// One warm-up pass and two measured ones
+	if files != 6 || len(seen) != 9 {
+		t.Errorf("Run() tokenized %d files, %d lines, want 6 and 9", files, len(seen))
+	}
+	if r.Lines != 6 || r.Bytes != 12 || r.LinesPerSec <= 0 || r.P99 < r.P50 {
+		t.Errorf("Run() = %+v", r)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var d []time.Duration
+	for i := 1; i <= 100; i++ {
+		d = append(d, time.Duration(i))
+	}
+	if p := percentile(d, 99); p != 99 {
+		t.Errorf("percentile(99) = %d, want 99", p)
+	}
+	if p := percentile(d[:1], 99); p != 1 {
+		t.Errorf("percentile(99) of one = %d, want 1", p)
+	}
+}
@@ -2,31 +2,110 @@ package cli
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"regexp"
+	"time"
 
 	"github.com/alecthomas/kong"
 
+	"github.com/ferchd/tm2hsl/internal/bench"
 	"github.com/ferchd/tm2hsl/internal/compiler"
+	"github.com/ferchd/tm2hsl/internal/coverage"
+	"github.com/ferchd/tm2hsl/internal/diff"
+	"github.com/ferchd/tm2hsl/internal/disasm"
+	"github.com/ferchd/tm2hsl/internal/fuzz"
+	"github.com/ferchd/tm2hsl/internal/highlight"
+	"github.com/ferchd/tm2hsl/internal/optimizer"
+	"github.com/ferchd/tm2hsl/internal/reference"
 	"github.com/ferchd/tm2hsl/internal/tester"
+	"github.com/ferchd/tm2hsl/pkg/engine"
+	"github.com/ferchd/tm2hsl/pkg/hsl"
 )
 
 type CLI struct {
-	Compile struct {
-		Config       string `arg:"" name:"config" help:"Path to language.toml"`
-		Output       string `short:"o" help:"Output HSL file" default:"output.hsl"`
-		ValidateOnly bool   `short:"v" help:"Only validate without generating bytecode"`
-		Verbose      bool   `short:"V" help:"Enable verbose output"`
-	} `cmd:"" help:"Compile a TextMate grammar to HSL bytecode"`
+	Compile   CompileCmd   `cmd:"" help:"Compile a TextMate grammar to HSL bytecode"`
+	Test      TestCmd      `cmd:"" help:"Run tokenization tests"`
+	Disasm    DisasmCmd    `cmd:"" help:"Print a readable listing of an HSL file"`
+	Diff      DiffCmd      `cmd:"" help:"Compare two HSL files structurally"`
+	Highlight HighlightCmd `cmd:"" help:"Tokenize a file with a compiled grammar and render it"`
+	Difftest  DifftestCmd  `cmd:"" help:"Compare compiled tokens against the reference interpreter"`
+	Fuzz      FuzzCmd      `cmd:"" help:"Check tokenizer invariants on random inputs"`
+	Bench     BenchCmd     `cmd:"" help:"Measure tokenization speed over a corpus"`
+	Version   VersionCmd   `cmd:"" help:"Show version"`
+}
+
+type CompileCmd struct {
+	Config       string   `arg:"" name:"config" help:"Path to language.toml"`
+	Output       string   `short:"o" help:"Output HSL file" default:"output.hsl"`
+	ValidateOnly bool     `short:"v" help:"Only validate without generating bytecode"`
+	Verbose      bool     `short:"V" help:"Enable verbose output"`
+	OptLevel     int      `short:"O" name:"opt-level" help:"Optimization level 0-3 (default: [compiler] section, else 2)" default:"-1"`
+	Passes       []string `help:"Run exactly these optimization passes, in order" sep:","`
+	PrintAfter   []string `name:"print-after" help:"Dump the IR to stderr after these optimization passes (or all)" sep:","`
+}
+
+type TestCmd struct {
+	Config       string `arg:"" name:"config" help:"Path to language.toml"`
+	SpecDir      string `short:"s" help:"Directory with TOML test specs" default:"specs/"`
+	Snapshots    string `help:"Directory of input files compared against their .snap token dumps"`
+	Update       bool   `short:"u" help:"Rewrite .snap files instead of comparing them"`
+	Report       string `help:"Machine-readable report: junit, tap or json" enum:",junit,tap,json" default:""`
+	ReportFile   string `help:"Write the report to a file instead of stdout"`
+	Filter       string `name:"run" help:"Only run tests whose file/case name matches this regex"`
+	Parallel     int    `short:"p" help:"Number of tests run at once" default:"1"`
+	FailFast     bool   `help:"Stop after the first failing test"`
+	Coverage     bool   `help:"Report how often each grammar rule matched"`
+	CoverageHTML string `name:"coverage-html" help:"Write an HTML view of the grammar with rule coverage (implies --coverage)"`
+}
+
+type DisasmCmd struct {
+	File string `arg:"" name:"file" help:"Compiled .hsl file" type:"existingfile"`
+	JSON bool   `help:"Print the listing as JSON"`
+}
+
+type DiffCmd struct {
+	Old string `arg:"" name:"old" help:"Original .hsl file" type:"existingfile"`
+	New string `arg:"" name:"new" help:"Updated .hsl file" type:"existingfile"`
+}
+
+type HighlightCmd struct {
+	Grammar string `required:"" help:"Compiled .hsl grammar" type:"existingfile"`
+	Theme   string `help:"VS Code or TextMate JSON theme" type:"existingfile"`
+	Format  string `short:"f" help:"Output format: ansi, html or json" enum:"ansi,html,json" default:"ansi"`
+	Output  string `short:"o" help:"Output file (default: stdout)"`
+	File    string `arg:"" name:"file" help:"File to highlight" type:"existingfile"`
+}
 
-	Test struct {
-		Config  string `arg:"" name:"config" help:"Path to language.toml"`
-		SpecDir string `short:"s" help:"Directory with TOML test specs" default:"specs/"`
-	} `cmd:"" help:"Run tokenization tests"`
+type DifftestCmd struct {
+	Config string   `arg:"" name:"config" help:"Path to language.toml"`
+	Corpus []string `arg:"" name:"corpus" help:"Files or directories to tokenize" type:"path"`
+}
 
-	Version struct{} `cmd:"" help:"Show version"`
+type FuzzCmd struct {
+	Config     string        `arg:"" name:"config" help:"Path to language.toml"`
+	SpecDir    string        `short:"s" help:"Directory with TOML test specs, used as seeds" default:"specs/"`
+	Iterations int           `short:"n" help:"Number of inputs to try (0: until --duration)" default:"10000"`
+	Duration   time.Duration `short:"d" help:"Stop after this long (0: no limit)" default:"0"`
+	Seed       int64         `help:"Random seed" default:"1"`
+	Steps      int           `help:"Regex step budget per search" default:"1000000"`
+	Out        string        `short:"o" help:"Directory for the spec file of minimized crashes (default: --spec-dir)"`
 }
 
+type BenchCmd struct {
+	Grammar   string   `required:"" help:"Compiled .hsl grammar" type:"existingfile"`
+	Corpus    []string `arg:"" name:"corpus" help:"Files or directories to tokenize" type:"path"`
+	Count     int      `short:"n" help:"Measured passes over the corpus" default:"5"`
+	Reference string   `help:"language.toml of the grammar, to also measure the reference interpreter"`
+	Baseline  string   `help:"Baseline JSON to compare against" type:"existingfile"`
+	Save      string   `help:"Write the results as a baseline JSON"`
+	Threshold float64  `help:"Tolerated regression against the baseline, in percent" default:"10"`
+}
+
+type VersionCmd struct{}
+
 var version = "0.0.1-alpha"
 
 func Execute() error {
@@ -36,61 +115,375 @@ func Execute() error {
 		kong.Description("Compilador de lenguajes léxicos TextMate a HSL"),
 		kong.UsageOnError())
 
-	return ctx.Run(context.Background())
+	// Kong prefixes command errors with the method name; report the
+	// command's own error instead
+	if err := ctx.Run(context.Background()); err != nil {
+		if inner := errors.Unwrap(err); inner != nil {
+			return inner
+		}
+		return err
+	}
+	return nil
 }
 
-func (c *CLI) RunCompile(ctx *kong.Context) error {
-	configPath, _ := filepath.Abs(c.Compile.Config)
+func (c *CompileCmd) Run(ctx *kong.Context) error {
+	configPath, _ := filepath.Abs(c.Config)
 
 	cmp := compiler.NewCompiler()
+	cmp.OptLevel = c.OptLevel
+	cmp.Passes = c.Passes
+	cmp.PrintAfter = c.PrintAfter
+	cmp.IRDump = os.Stderr
 	result, err := cmp.Compile(configPath)
 	if err != nil {
 		return fmt.Errorf("compilation error: %w", err)
 	}
 
-	if c.Compile.ValidateOnly {
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+
+	if c.ValidateOnly {
 		fmt.Println("Grammar validated successfully")
 		return nil
 	}
 
-	outputPath := c.Compile.Output
+	outputPath := c.Output
 	if err := result.WriteToFile(outputPath); err != nil {
 		return fmt.Errorf("error writing bytecode: %w", err)
 	}
 
-	if c.Compile.Verbose {
-		fmt.Printf("Compilation stats: %d regex, %d states, %d rules\n",
-			result.Stats.RegexCount, result.Stats.StateCount, result.Stats.RuleCount)
+	if c.Verbose {
+		fmt.Printf("Compilation stats: %d regex (%d keyword lists), %d states, %d rules, %d injections\n",
+			result.Stats.RegexCount, result.Stats.KeywordCount, result.Stats.StateCount, result.Stats.RuleCount,
+			result.Stats.InjectionCount)
+		printPassStats(result.Passes)
 	}
 	fmt.Printf("HSL bytecode generated: %s\n", outputPath)
 
 	return nil
 }
 
-func (c *CLI) RunTest(ctx *kong.Context) error {
-	configPath, _ := filepath.Abs(c.Test.Config)
-	specDir := c.Test.SpecDir
+// printPassStats - Optimizer runs with their timing and table sizes
+func printPassStats(passes []optimizer.PassStats) {
+	fmt.Printf("%-4s %-26s %-8s %10s  %s\n", "ITER", "PASS", "CHANGED", "TIME", "STATES RULES REGEX")
+	for _, p := range passes {
+		fmt.Printf("%-4d %-26s %-8v %10s  %d/%d %d/%d %d/%d\n", p.Iteration, p.Pass, p.Changed, p.Duration,
+			p.Before.StateCount, p.After.StateCount, p.Before.RuleCount, p.After.RuleCount,
+			p.Before.RegexCount, p.After.RegexCount)
+	}
+}
+
+func (c *TestCmd) Run(ctx *kong.Context) error {
+	configPath, _ := filepath.Abs(c.Config)
+	specDir := c.SpecDir
 
 	tstr := tester.NewTester()
+	tstr.SnapshotDir = c.Snapshots
+	tstr.Update = c.Update
+	tstr.Parallel = c.Parallel
+	tstr.FailFast = c.FailFast
+	tstr.Coverage = c.Coverage || c.CoverageHTML != ""
+	if c.Filter != "" {
+		filter, err := regexp.Compile(c.Filter)
+		if err != nil {
+			return fmt.Errorf("invalid --run pattern: %w", err)
+		}
+		tstr.Filter = filter
+	}
 	report, err := tstr.Run(configPath, specDir)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Test results: %d passed, %d failed\n",
-		report.Passed, report.Failed)
+	switch {
+	case c.Report != "" && c.ReportFile == "":
+		// The report replaces the text output
+		if err := tester.WriteReport(os.Stdout, c.Report, report, filepath.Base(c.Config)); err != nil {
+			return err
+		}
+	default:
+		if c.Report != "" {
+			if err := writeTestReport(c.ReportFile, c.Report, report, filepath.Base(c.Config)); err != nil {
+				return fmt.Errorf("error writing report: %w", err)
+			}
+		}
 
-	if report.Failed > 0 {
+		fmt.Printf("Test results: %d passed, %d failed\n",
+			report.Passed, report.Failed)
+		if report.Skipped > 0 {
+			fmt.Printf("Skipped after failure: %d\n", report.Skipped)
+		}
+		if report.Updated > 0 {
+			fmt.Printf("Snapshots updated: %d\n", report.Updated)
+		}
 		for _, failure := range report.Failures {
 			fmt.Printf("FAILED %s: %s\n", failure.TestName, failure.Error)
+			if failure.Diff != "" {
+				fmt.Println(failure.Diff)
+			}
+		}
+		if c.Coverage {
+			if err := coverage.WriteText(os.Stdout, report.Coverage); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.CoverageHTML != "" {
+		f, err := os.Create(c.CoverageHTML)
+		if err != nil {
+			return err
 		}
+		defer f.Close()
+		if err := coverage.WriteHTML(f, report.Coverage); err != nil {
+			return fmt.Errorf("error writing coverage: %w", err)
+		}
+	}
+
+	if report.Failed > 0 {
 		return fmt.Errorf("tests failed")
 	}
+	return nil
+}
+
+func writeTestReport(path, format string, report *tester.TestReport, name string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := tester.WriteReport(f, format, report, name); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *DisasmCmd) Run(ctx *kong.Context) error {
+	bc, err := hsl.ReadFile(c.File)
+	if err != nil {
+		return fmt.Errorf("error reading bytecode: %w", err)
+	}
+
+	listing := disasm.Disassemble(bc)
+	if c.JSON {
+		return disasm.WriteJSON(os.Stdout, listing)
+	}
+	return disasm.WriteText(os.Stdout, listing)
+}
+
+func (c *DiffCmd) Run(ctx *kong.Context) error {
+	oldBC, err := hsl.ReadFile(c.Old)
+	if err != nil {
+		return fmt.Errorf("error reading bytecode: %w", err)
+	}
+	newBC, err := hsl.ReadFile(c.New)
+	if err != nil {
+		return fmt.Errorf("error reading bytecode: %w", err)
+	}
+
+	report := diff.Compare(oldBC, newBC)
+	if err := diff.WriteText(os.Stdout, report); err != nil {
+		return err
+	}
+
+	// Non-zero exit so CI can gate on grammar changes
+	if n := report.Differences(); n > 0 {
+		return fmt.Errorf("%d structural differences", n)
+	}
+	return nil
+}
+
+func (c *HighlightCmd) Run(ctx *kong.Context) error {
+	bc, err := hsl.ReadFile(c.Grammar)
+	if err != nil {
+		return fmt.Errorf("error reading bytecode: %w", err)
+	}
+	eng, err := engine.New(bc)
+	if err != nil {
+		return fmt.Errorf("error loading grammar: %w", err)
+	}
+	for _, warning := range eng.Warnings() {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+
+	theme := highlight.DefaultTheme()
+	if c.Theme != "" {
+		if theme, err = highlight.LoadTheme(c.Theme); err != nil {
+			return err
+		}
+	}
 
+	source, err := os.ReadFile(c.File)
+	if err != nil {
+		return err
+	}
+	lines, err := eng.Tokenize(string(source))
+	if err != nil {
+		return fmt.Errorf("tokenization error: %w", err)
+	}
+
+	out := os.Stdout
+	if c.Output != "" {
+		f, err := os.Create(c.Output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return highlight.Render(out, c.Format, lines, theme, filepath.Base(c.File))
+}
+
+func (c *DifftestCmd) Run(ctx *kong.Context) error {
+	eng, err := tester.LoadGrammar(c.Config)
+	if err != nil {
+		return err
+	}
+	ref, err := reference.Load(c.Config)
+	if err != nil {
+		return fmt.Errorf("error loading reference grammar: %w", err)
+	}
+
+	files, err := reference.CorpusFiles(c.Corpus)
+	if err != nil {
+		return err
+	}
+	results, err := reference.DiffTest(eng, ref, files)
+	if err != nil {
+		return err
+	}
+
+	failed, err := reference.WriteText(os.Stdout, results)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d divergent files", failed)
+	}
+	return nil
+}
+
+func (c *FuzzCmd) Run(ctx *kong.Context) error {
+	eng, err := tester.LoadGrammar(c.Config)
+	if err != nil {
+		return err
+	}
+	eng.SetStepLimit(c.Steps)
+
+	seeds, err := tester.SpecInputs(c.SpecDir)
+	if err != nil {
+		return err
+	}
+	result := fuzz.Run(eng, seeds, fuzz.Options{
+		Iterations: c.Iterations,
+		Duration:   c.Duration,
+		Seed:       c.Seed,
+	})
+
+	fmt.Printf("Fuzzing: %d inputs from %d seeds, %d crashes\n", result.Iterations, len(seeds), len(result.Crashes))
+	if len(result.Crashes) == 0 {
+		return nil
+	}
+	for _, crash := range result.Crashes {
+		fmt.Printf("CRASH %s\n  input: %q\n", crash.Violation, crash.Input)
+	}
+
+	out := c.Out
+	if out == "" {
+		out = c.SpecDir
+	}
+	path, err := tester.WriteFuzzSpec(out, result.Crashes)
+	if err != nil {
+		return fmt.Errorf("error writing spec: %w", err)
+	}
+	fmt.Printf("Spec cases written: %s\n", path)
+	return fmt.Errorf("%d invariant violations", len(result.Crashes))
+}
+
+func (c *BenchCmd) Run(ctx *kong.Context) error {
+	bc, err := hsl.ReadFile(c.Grammar)
+	if err != nil {
+		return fmt.Errorf("error reading bytecode: %w", err)
+	}
+	eng, err := engine.New(bc)
+	if err != nil {
+		return fmt.Errorf("error loading grammar: %w", err)
+	}
+
+	files, err := reference.CorpusFiles(c.Corpus)
+	if err != nil {
+		return err
+	}
+	corpus, err := bench.LoadCorpus(files)
+	if err != nil {
+		return err
+	}
+
+	result, err := bench.Run("hsl", func() bench.LineFunc {
+		var stack *engine.StateStack
+		return func(line string) (err error) {
+			_, stack, err = eng.TokenizeLine(line, stack)
+			return err
+		}
+	}, corpus, c.Count)
+	if err != nil {
+		return err
+	}
+	results := []*bench.Result{result}
+
+	if c.Reference != "" {
+		ref, err := reference.Load(c.Reference)
+		if err != nil {
+			return fmt.Errorf("error loading reference grammar: %w", err)
+		}
+		refResult, err := bench.Run("reference", func() bench.LineFunc {
+			lt := ref.NewLineTokenizer()
+			return func(line string) error {
+				lt.TokenizeLine(line)
+				return nil
+			}
+		}, corpus, c.Count)
+		if err != nil {
+			return err
+		}
+		results = append(results, refResult)
+	}
+
+	if err := bench.WriteText(os.Stdout, corpus, results); err != nil {
+		return err
+	}
+
+	if c.Save != "" {
+		if err := bench.SaveBaseline(c.Save, results); err != nil {
+			return fmt.Errorf("error writing baseline: %w", err)
+		}
+	}
+
+	if c.Baseline == "" {
+		return nil
+	}
+	baseline, err := bench.LoadBaseline(c.Baseline)
+	if err != nil {
+		return err
+	}
+	base := baseline.Find(result.Name)
+	if base == nil {
+		return fmt.Errorf("baseline %s has no %q result", c.Baseline, result.Name)
+	}
+	changes := bench.Compare(base, result, c.Threshold)
+	if err := bench.WriteChanges(os.Stdout, result.Name, changes); err != nil {
+		return err
+	}
+	for _, change := range changes {
+		if change.Regression {
+			return fmt.Errorf("performance regression over %.0f%%", c.Threshold)
+		}
+	}
 	return nil
 }
 
-func (c *CLI) RunVersion(ctx *kong.Context) error {
+func (c *VersionCmd) Run(ctx *kong.Context) error {
 	fmt.Printf("tm2hsl v%s\n", version)
 	return nil
 }
@@ -1,11 +1,14 @@
 package codegen
 
 import (
-	"encoding/binary"
+	"errors"
+	"fmt"
 	"hash/crc32"
+	"math"
 
 	"github.com/ferchd/tm2hsl/internal/ir"
 	"github.com/ferchd/tm2hsl/pkg/hsl"
+	"github.com/ferchd/tm2hsl/pkg/regex"
 )
 
 type BytecodeGenerator struct {
@@ -37,19 +40,41 @@ func (g *BytecodeGenerator) Generate() (*hsl.Bytecode, error) {
 	g.generateStateTable()
 
 	// 6. Tabla de reglas
-	g.generateRuleTable()
+	if err := g.generateRuleTable(); err != nil {
+		return nil, err
+	}
+
+	// 7. Tabla de inyecciones
+	g.generateInjectionTable()
+
+	// 8. Tabla de scanners
+	if err := g.generateScannerTable(); err != nil {
+		return nil, err
+	}
 
-	// 7. Calcular checksum
+	// 9. Tabla de prefiltros
+	if err := g.generatePrefilterTable(); err != nil {
+		return nil, err
+	}
+
+	// 10. Tabla de palabras clave
+	g.generateKeywordTable()
+
+	// 11. Calcular checksum
 	g.calculateChecksum()
 
 	return g.bytecode, nil
 }
 
 func (g *BytecodeGenerator) generateHeader() {
+	flags := uint32(hsl.FlagValidated)
+	if g.program.Optimized {
+		flags |= hsl.FlagOptimized
+	}
 	g.bytecode.Header = hsl.Header{
 		Magic:             [4]byte{'H', 'S', 'L', '1'},
-		Version:           g.program.Version,
-		HeaderSize:        uint16(binary.Size(hsl.Header{})),
+		Version:           hsl.FormatVersion,
+		HeaderSize:        hsl.HeaderSize,
 		StringTableOffset: 0,
 		RegexTableOffset:  0,
 		ScopeTableOffset:  0,
@@ -57,7 +82,9 @@ func (g *BytecodeGenerator) generateHeader() {
 		RuleTableOffset:   0,
 		TotalSize:         0,
 		Checksum:          0,
-		Flags:             hsl.FlagValidated | hsl.FlagOptimized,
+		Flags:             flags,
+		NameID:            g.findStringID(g.program.Name),
+		ScopeNameID:       g.findStringID(g.program.Scope),
 	}
 
 	// Metadata
@@ -87,14 +114,14 @@ func (g *BytecodeGenerator) generateRegexTable() {
 	regexes := make([]hsl.RegexEntry, len(g.program.RegexTable))
 
 	for i, re := range g.program.RegexTable {
-		// Compilar regex a bytecode interno si es posible
-		bytecode := g.compileRegexToBytecode(re.Pattern)
+		bytecode, flags := g.compileRegexToBytecode(re.Pattern)
 
 		regexes[i] = hsl.RegexEntry{
 			ID:          re.ID,
 			PatternHash: g.hashString(re.Pattern),
 			Bytecode:    bytecode,
-			Flags:       0,
+			Flags:       flags,
+			PatternID:   g.findStringID(re.Pattern),
 		}
 	}
 
@@ -104,10 +131,15 @@ func (g *BytecodeGenerator) generateRegexTable() {
 	}
 }
 
-func (g *BytecodeGenerator) compileRegexToBytecode(pattern string) []byte {
-	// Implementación simplificada
-	// En producción, usar un compilador de regex a DFA
-	return []byte(pattern) // Placeholder
+// compileRegexToBytecode - Programa de instrucciones del patrón, para que el
+// motor no tenga que compilarlo. Un patrón que no compila queda sin programa
+// y el motor informa el error al cargar, como antes.
+func (g *BytecodeGenerator) compileRegexToBytecode(pattern string) ([]byte, uint8) {
+	re, err := regex.Compile(pattern)
+	if err != nil {
+		return nil, 0
+	}
+	return re.Encode(), hsl.RegexProgram
 }
 
 func (g *BytecodeGenerator) generateScopeTable() {
@@ -139,6 +171,7 @@ func (g *BytecodeGenerator) generateStateTable() {
 			RuleOffset: state.RuleOffset,
 			RuleCount:  state.RuleCount,
 			Flags:      uint8(state.Flags),
+			ScopeID:    state.ScopeID,
 		}
 	}
 
@@ -148,10 +181,16 @@ func (g *BytecodeGenerator) generateStateTable() {
 	}
 }
 
-func (g *BytecodeGenerator) generateRuleTable() {
+// generateRuleTable - Tabla de reglas. NextState ocupa 2 bytes con signo en
+// el formato, así que un estado destino por encima de math.MaxInt16 es un
+// error en lugar de truncarse a otro estado.
+func (g *BytecodeGenerator) generateRuleTable() error {
 	rules := make([]hsl.RuleEntry, len(g.program.RuleTable))
 
 	for i, rule := range g.program.RuleTable {
+		if rule.NextState > math.MaxInt16 || rule.NextState < math.MinInt16 {
+			return fmt.Errorf("rule %d: next state %d does not fit the format (at most %d states)", i, rule.NextState, math.MaxInt16+1)
+		}
 		rules[i] = hsl.RuleEntry{
 			RegexID:      rule.RegexID,
 			Action:       uint8(rule.Action),
@@ -159,6 +198,10 @@ func (g *BytecodeGenerator) generateRuleTable() {
 			ScopeID:      rule.ScopeID,
 			Priority:     rule.Priority,
 			CaptureCount: uint8(len(rule.CaptureMap)),
+			SourceID:     hsl.NoString,
+		}
+		if rule.Source != "" {
+			rules[i].SourceID = g.findStringID(rule.Source)
 		}
 
 		// Añadir mapeos de captura si existen
@@ -176,6 +219,168 @@ func (g *BytecodeGenerator) generateRuleTable() {
 		Count:   uint32(len(rules)),
 		Entries: rules,
 	}
+	return nil
+}
+
+func (g *BytecodeGenerator) generateInjectionTable() {
+	injections := make([]hsl.InjectionEntry, len(g.program.InjectionTable))
+
+	for i, injection := range g.program.InjectionTable {
+		injections[i] = hsl.InjectionEntry{
+			SelectorID: g.findStringID(injection.Selector),
+			StateID:    injection.StateID,
+			Priority:   injection.Priority,
+		}
+	}
+
+	selectorID := hsl.NoString
+	if g.program.InjectionSelector != "" {
+		selectorID = g.findStringID(g.program.InjectionSelector)
+	}
+
+	g.bytecode.InjectionTable = hsl.InjectionTable{
+		SelectorID: selectorID,
+		Count:      uint32(len(injections)),
+		Entries:    injections,
+	}
+}
+
+// generateScannerTable - Tabla de scanners. Los pases que mueven reglas
+// descartan los scanners, así que uno cuyas reglas ya no tienen los patrones
+// con los que se construyó es un error del optimizador: el motor elegiría
+// reglas equivocadas.
+func (g *BytecodeGenerator) generateScannerTable() error {
+	var scanners []hsl.ScannerEntry
+
+	for _, sc := range g.program.Scanners {
+		if err := g.scannerStale(sc); err != nil {
+			return fmt.Errorf("scanner of state %d: %w", sc.StateID, err)
+		}
+		t := sc.Scanner.Tables()
+		entry := hsl.ScannerEntry{
+			StateID:   sc.StateID,
+			Rules:     sc.Rules,
+			Atoms:     t.Atoms,
+			AtomCount: uint16(t.AtomCount),
+			Starts:    t.Starts,
+			Next:      t.Next,
+			Accept:    t.Accept,
+		}
+		for i := 0; i < len(t.Ranges); i += 2 {
+			entry.Lows = append(entry.Lows, uint32(t.Ranges[i]))
+		}
+		scanners = append(scanners, entry)
+	}
+
+	g.bytecode.ScannerTable = hsl.ScannerTable{
+		Count:   uint32(len(scanners)),
+		Entries: scanners,
+	}
+	return nil
+}
+
+// scannerStale - Por qué sc ya no corresponde a las reglas de su estado;
+// nil si sigue vigente
+func (g *BytecodeGenerator) scannerStale(sc ir.ScannerEntry) error {
+	switch {
+	case sc.Scanner == nil:
+		return errors.New("no DFA")
+	case int(sc.StateID) >= len(g.program.StateTable):
+		return fmt.Errorf("state out of range (%d states)", len(g.program.StateTable))
+	case len(sc.Rules) != len(sc.Regexes):
+		return fmt.Errorf("%d rules for %d regexes", len(sc.Rules), len(sc.Regexes))
+	}
+	rules := g.program.Rules(sc.StateID)
+	for i, r := range sc.Rules {
+		switch {
+		case int(r) >= len(rules):
+			return fmt.Errorf("covers rule %d, the state has %d", r, len(rules))
+		case rules[r].RegexID != sc.Regexes[i]:
+			return fmt.Errorf("rule %d holds regex %d, built from %d", r, rules[r].RegexID, sc.Regexes[i])
+		}
+	}
+	return nil
+}
+
+// generatePrefilterTable - Tabla de prefiltros. Como con los scanners, un
+// prefiltro calculado sobre reglas que ya no son las de su estado es un
+// error: el motor saltaría posiciones donde alguna regla sí coincide.
+func (g *BytecodeGenerator) generatePrefilterTable() error {
+	var prefilters []hsl.PrefilterEntry
+
+	for _, pf := range g.program.Prefilters {
+		if err := g.prefilterStale(pf); err != nil {
+			return fmt.Errorf("prefilter of state %d: %w", pf.StateID, err)
+		}
+		entry := hsl.PrefilterEntry{StateID: pf.StateID}
+		if pf.FirstBytes != nil {
+			entry.Flags |= hsl.PrefilterFirstBytes
+			entry.FirstBytes = *pf.FirstBytes
+		}
+		if pf.Literals != nil {
+			entry.Flags |= hsl.PrefilterLiterals
+			for _, l := range pf.Literals {
+				entry.Literals = append(entry.Literals, []byte(l))
+			}
+		}
+		prefilters = append(prefilters, entry)
+	}
+
+	g.bytecode.PrefilterTable = hsl.PrefilterTable{
+		Count:   uint32(len(prefilters)),
+		Entries: prefilters,
+	}
+	return nil
+}
+
+// prefilterStale - Por qué pf ya no corresponde a las reglas de su estado;
+// nil si sigue vigente
+func (g *BytecodeGenerator) prefilterStale(pf ir.PrefilterEntry) error {
+	if int(pf.StateID) >= len(g.program.StateTable) {
+		return fmt.Errorf("state out of range (%d states)", len(g.program.StateTable))
+	}
+	rules := g.program.Rules(pf.StateID)
+	if len(rules) != len(pf.Regexes) {
+		return fmt.Errorf("computed from %d rules, the state has %d", len(pf.Regexes), len(rules))
+	}
+	for i, r := range rules {
+		if r.RegexID != pf.Regexes[i] {
+			return fmt.Errorf("rule %d holds regex %d, computed from %d", i, r.RegexID, pf.Regexes[i])
+		}
+	}
+	return nil
+}
+
+// generateKeywordTable - Tries de las regex que equivalen a una lista de
+// palabras clave, para que el motor las pruebe sin ejecutar la regex
+func (g *BytecodeGenerator) generateKeywordTable() {
+	var keywords []hsl.KeywordEntry
+
+	for i, re := range g.program.RegexTable {
+		kw := re.Keywords
+		if kw == nil {
+			continue
+		}
+		t := regex.NewKeywords(kw.Words, kw.Fold).Tables()
+		entry := hsl.KeywordEntry{RegexID: uint32(i), Groups: uint16(kw.Groups)}
+		if t.Fold {
+			entry.Flags |= hsl.KeywordFold
+		}
+		for n, final := range t.Final {
+			lo, hi := t.Edges[n], t.Edges[n+1]
+			entry.Nodes = append(entry.Nodes, hsl.KeywordNode{
+				Final:  final,
+				Labels: t.Labels[lo:hi],
+				Next:   t.Next[lo:hi],
+			})
+		}
+		keywords = append(keywords, entry)
+	}
+
+	g.bytecode.KeywordTable = hsl.KeywordTable{
+		Count:   uint32(len(keywords)),
+		Entries: keywords,
+	}
 }
 
 func (g *BytecodeGenerator) calculateChecksum() {
@@ -192,12 +397,10 @@ func (g *BytecodeGenerator) serializeForChecksum() []byte {
 }
 
 func (g *BytecodeGenerator) findStringID(str string) uint32 {
-	for i, s := range g.program.StringTable {
-		if s == str {
-			return uint32(i)
-		}
+	if id, ok := g.program.StringID(str); ok {
+		return id
 	}
-	return 0xFFFFFFFF
+	return hsl.NoString
 }
 
 func (g *BytecodeGenerator) hashString(str string) uint32 {
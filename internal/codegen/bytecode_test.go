@@ -0,0 +1,154 @@
+package codegen
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ferchd/tm2hsl/internal/ir"
+	"github.com/ferchd/tm2hsl/pkg/regex"
+)
+
+// newTestProgram - Un estado con una regla por patrón, en orden
+func newTestProgram(patterns ...string) *ir.Program {
+	p := ir.NewProgram("T", "source.t")
+	var rules []ir.RuleEntry
+	for _, pattern := range patterns {
+		rules = append(rules, ir.RuleEntry{
+			RegexID:   p.AddRegex(pattern),
+			Action:    ir.RuleActionMatch,
+			NextState: -2,
+			ScopeID:   ir.NoScope,
+		})
+	}
+	p.AddState(rules, 0)
+	return p
+}
+
+func TestGenerate_NextStateRange(t *testing.T) {
+	tests := []struct {
+		next    int32
+		wantErr bool
+	}{
+		{-2, false},
+		{-1, false},
+		{math.MaxInt16, false},
+		{math.MaxInt16 + 1, true},
+		{1 << 20, true},
+	}
+	for _, tt := range tests {
+		p := newTestProgram("a")
+		p.RuleTable[0].NextState = tt.next
+		bc, err := NewGenerator(p).Generate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Generate() with next state %d: %v, want error %v", tt.next, err, tt.wantErr)
+			continue
+		}
+		if err == nil && int32(bc.RuleTable.Entries[0].NextState) != tt.next {
+			t.Errorf("NextState = %d, want %d", bc.RuleTable.Entries[0].NextState, tt.next)
+		}
+	}
+}
+
+func TestGenerate_StaleScanner(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(p *ir.Program, sc *ir.ScannerEntry)
+		wantErr string
+	}{
+		{
+			name: "current",
+			edit: func(p *ir.Program, sc *ir.ScannerEntry) {},
+		},
+		{
+			name: "rules reordered",
+			edit: func(p *ir.Program, sc *ir.ScannerEntry) {
+				p.RuleTable[0], p.RuleTable[1] = p.RuleTable[1], p.RuleTable[0]
+			},
+			wantErr: "rule 0 holds regex 1, built from 0",
+		},
+		{
+			name:    "rule removed",
+			edit:    func(p *ir.Program, sc *ir.ScannerEntry) { p.StateTable[0].RuleCount = 1 },
+			wantErr: "covers rule 1, the state has 1",
+		},
+		{
+			name:    "state removed",
+			edit:    func(p *ir.Program, sc *ir.ScannerEntry) { sc.StateID = 1 },
+			wantErr: "state out of range",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProgram("a", "b")
+			sc, err := regex.BuildScanner([]*regex.Tree{regex.MustCompile("a").Syntax(), regex.MustCompile("b").Syntax()})
+			if err != nil {
+				t.Fatalf("BuildScanner: %v", err)
+			}
+			entry := ir.ScannerEntry{StateID: 0, Rules: []uint16{0, 1}, Regexes: []uint32{0, 1}, Scanner: sc}
+			tt.edit(p, &entry)
+			p.Scanners = []ir.ScannerEntry{entry}
+
+			bc, err := NewGenerator(p).Generate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Generate: %v", err)
+			case tt.wantErr == "" && bc.ScannerTable.Count != 1:
+				t.Errorf("ScannerTable.Count = %d, want 1", bc.ScannerTable.Count)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Generate() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGenerate_StalePrefilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(p *ir.Program, pf *ir.PrefilterEntry)
+		wantErr string
+	}{
+		{
+			name: "current",
+			edit: func(p *ir.Program, pf *ir.PrefilterEntry) {},
+		},
+		{
+			name: "rules reordered",
+			edit: func(p *ir.Program, pf *ir.PrefilterEntry) {
+				p.RuleTable[0], p.RuleTable[1] = p.RuleTable[1], p.RuleTable[0]
+			},
+			wantErr: "rule 0 holds regex 1, computed from 0",
+		},
+		{
+			name:    "rule removed",
+			edit:    func(p *ir.Program, pf *ir.PrefilterEntry) { p.StateTable[0].RuleCount = 1 },
+			wantErr: "computed from 2 rules, the state has 1",
+		},
+		{
+			name:    "state removed",
+			edit:    func(p *ir.Program, pf *ir.PrefilterEntry) { pf.StateID = 1 },
+			wantErr: "state out of range",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProgram("a", "b")
+			var first regex.ByteSet
+			first.Add('a')
+			first.Add('b')
+			entry := ir.PrefilterEntry{StateID: 0, Regexes: []uint32{0, 1}, FirstBytes: &first}
+			tt.edit(p, &entry)
+			p.Prefilters = []ir.PrefilterEntry{entry}
+
+			bc, err := NewGenerator(p).Generate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Generate: %v", err)
+			case tt.wantErr == "" && bc.PrefilterTable.Count != 1:
+				t.Errorf("PrefilterTable.Count = %d, want 1", bc.PrefilterTable.Count)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Generate() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
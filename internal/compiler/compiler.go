@@ -2,8 +2,10 @@ package compiler
 
 import (
 	"fmt"
+	"io"
 	"os"
 
+	"github.com/ferchd/tm2hsl/internal/codegen"
 	"github.com/ferchd/tm2hsl/internal/config"
 	"github.com/ferchd/tm2hsl/internal/ir"
 	"github.com/ferchd/tm2hsl/internal/normalizer"
@@ -14,15 +16,21 @@ import (
 )
 
 type Compiler struct {
-	config       *config.LanguageConfig
-	grammar      *parser.TextMateAST
-	stateMachine *ir.StateMachine
-	irProgram    *ir.Program
-	bytecode     *hsl.Bytecode
+	OptLevel   int       // 0-3; < 0 uses the [compiler] section or the default
+	Passes     []string  // Explicit pass pipeline, overrides every level
+	PrintAfter []string  // Optimization passes whose output IR is dumped
+	IRDump     io.Writer // Destination of PrintAfter dumps
+
+	config    *config.LanguageConfig
+	grammar   *parser.TextMateAST
+	irProgram *ir.Program
+	bytecode  *hsl.Bytecode
+	warnings  []string
+	passes    []optimizer.PassStats
 }
 
 func NewCompiler() *Compiler {
-	return &Compiler{}
+	return &Compiler{OptLevel: -1}
 }
 
 func (c *Compiler) Compile(configPath string) (*CompilationResult, error) {
@@ -38,29 +46,30 @@ func (c *Compiler) Compile(configPath string) (*CompilationResult, error) {
 		return nil, err
 	}
 
-	// 3. Normalize to state machine
-	if err = c.normalize(); err != nil {
-		return nil, err
-	}
-
-	// 4. Convert to IR
+	// 3. Convert to IR
 	if err = c.buildIR(); err != nil {
 		return nil, err
 	}
 
-	// 5. Optimize
+	// Reglas que nunca se ejecutan, antes de que el optimizador las quite
+	c.analyzeRules()
+
+	// 4. Optimize
 	if err = c.optimize(); err != nil {
 		return nil, err
 	}
 
-	// 6. Generar bytecode
+	// 5. Generar bytecode
 	if err = c.generateBytecode(); err != nil {
 		return nil, err
 	}
 
 	return &CompilationResult{
 		Bytecode: c.bytecode,
+		Grammar:  c.grammar,
 		Stats:    c.irProgram.Statistics(),
+		Warnings: c.warnings,
+		Passes:   c.passes,
 	}, nil
 }
 
@@ -93,43 +102,82 @@ func (c *Compiler) parseGrammar() error {
 	return nil
 }
 
-func (c *Compiler) normalize() error {
+func (c *Compiler) buildIR() error {
 	norm := normalizer.NewNormalizer()
-	machine, err := norm.Normalize(c.grammar)
+	program, err := norm.Lower(c.grammar, c.config.Name, c.config.Scope)
 	if err != nil {
-		return fmt.Errorf("normalization failed: %w", err)
+		return fmt.Errorf("IR construction failed: %w", err)
 	}
-	c.stateMachine = machine
+	c.irProgram = program
+	c.warnings = append(c.warnings, norm.Warnings()...)
 	return nil
 }
 
-func (c *Compiler) buildIR() error {
-	c.irProgram = ir.NewProgram(c.config.Name, c.config.Scope)
-
-	// Convert state machine to IR
-	// Simplified implementation
-	return nil
+// analyzeRules - Warns about shadowed and empty-match rules. A grammar rule
+// included from several places is reported once.
+func (c *Compiler) analyzeRules() {
+	seen := make(map[string]bool)
+	for _, issue := range optimizer.AnalyzeRules(c.irProgram) {
+		msg := issue.String()
+		if !seen[msg] {
+			seen[msg] = true
+			c.warnings = append(c.warnings, msg)
+		}
+	}
 }
 
 func (c *Compiler) optimize() error {
-	opt := optimizer.NewOptimizer()
+	opt, err := c.newOptimizer()
+	if err != nil {
+		return fmt.Errorf("invalid optimization pipeline: %w", err)
+	}
+	opt.PrintAfter = c.PrintAfter
+	opt.Dump = c.IRDump
 	optimized, err := opt.Optimize(c.irProgram)
 	if err != nil {
 		return fmt.Errorf("optimization failed: %w", err)
 	}
 	c.irProgram = optimized
+	c.passes = opt.Stats()
+	if !opt.Converged() {
+		c.warnings = append(c.warnings, fmt.Sprintf("optimizer stopped after %d iterations without reaching a fixpoint", optimizer.DefaultMaxIterations))
+	}
 	return nil
 }
 
+// newOptimizer - Pipeline from, by precedence: Passes, OptLevel, the
+// [compiler] passes and opt_level, the default level
+func (c *Compiler) newOptimizer() (*optimizer.Optimizer, error) {
+	cfg := c.config.Compiler
+	switch {
+	case c.Passes != nil:
+		return optimizer.NewOptimizerPasses(c.Passes)
+	case c.OptLevel >= 0:
+		return optimizer.NewOptimizerLevel(c.OptLevel)
+	case cfg.Passes != nil:
+		return optimizer.NewOptimizerPasses(cfg.Passes)
+	case cfg.OptLevel != nil:
+		return optimizer.NewOptimizerLevel(*cfg.OptLevel)
+	}
+	return optimizer.NewOptimizerLevel(optimizer.LevelDefault)
+}
+
 func (c *Compiler) generateBytecode() error {
-	ser := serializer.NewSerializer()
-	c.bytecode = ser.ConvertToBytecode(c.stateMachine)
+	gen := codegen.NewGenerator(c.irProgram)
+	bytecode, err := gen.Generate()
+	if err != nil {
+		return fmt.Errorf("bytecode generation failed: %w", err)
+	}
+	c.bytecode = bytecode
 	return nil
 }
 
 type CompilationResult struct {
 	Bytecode *hsl.Bytecode
+	Grammar  *parser.TextMateAST // Source of the bytecode, for rule paths
 	Stats    ir.ProgramStats
+	Warnings []string // Grammar constructs skipped during compilation
+	Passes   []optimizer.PassStats
 }
 
 func (r *CompilationResult) WriteToFile(path string) error {
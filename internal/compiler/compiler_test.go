@@ -0,0 +1,164 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ferchd/tm2hsl/internal/serializer"
+	"github.com/ferchd/tm2hsl/pkg/hsl"
+)
+
+const testGrammar = `{
+  "scopeName": "source.t",
+  "patterns": [{"match": "\\bif\\b", "name": "keyword.t"}, {"begin": "\"", "end": "\"", "name": "string.t"}]
+}`
+
+// writeConfig - language.toml with the given [compiler] section
+func writeConfig(t *testing.T, section string) string {
+	return writeGrammarConfig(t, testGrammar, section)
+}
+
+// writeGrammarConfig - language.toml for grammar with the given [compiler]
+// section
+func writeGrammarConfig(t testing.TB, grammar, section string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "grammar.json"), []byte(grammar), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := "name = \"T\"\nscope = \"source.t\"\ngrammar = \"grammar.json\"\n" + section
+	path := filepath.Join(dir, "language.toml")
+	if err := os.WriteFile(path, []byte(cfg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCompiler_Pipeline(t *testing.T) {
+	tests := []struct {
+		name      string
+		section   string
+		optLevel  int
+		passes    []string
+		want      []string // Passes run in the first iteration
+		optimized bool
+	}{
+		{"default level", "", -1, nil, []string{"remove-unreachable-states", "merge-equivalent-states", "reorder-by-priority", "combine-scanners", "build-prefilters"}, true},
+		{"O3", "", 3, nil, []string{"remove-unreachable-states", "merge-equivalent-states", "simplify-transitions", "reorder-by-priority", "combine-scanners", "build-prefilters"}, true},
+		{"O0", "", 0, nil, nil, false},
+		{"O1", "", 1, nil, []string{"remove-unreachable-states", "reorder-by-priority"}, true},
+		{"config level", "[compiler]\nopt_level = 0\n", -1, nil, nil, false},
+		{"config passes", "[compiler]\npasses = [\"reorder-by-priority\"]\n", -1, nil, []string{"reorder-by-priority"}, true},
+		{"flag over config", "[compiler]\nopt_level = 0\n", 1, nil, []string{"remove-unreachable-states", "reorder-by-priority"}, true},
+		{"passes over level", "", 0, []string{"simplify-transitions"}, []string{"simplify-transitions"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmp := NewCompiler()
+			cmp.OptLevel, cmp.Passes = tt.optLevel, tt.passes
+			result, err := cmp.Compile(writeConfig(t, tt.section))
+			if err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+			var got []string
+			for _, p := range result.Passes {
+				if p.Iteration == 1 {
+					got = append(got, p.Pass)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("passes = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("passes = %v, want %v", got, tt.want)
+				}
+			}
+			if optimized := result.Bytecode.Header.Flags&hsl.FlagOptimized != 0; optimized != tt.optimized {
+				t.Errorf("FlagOptimized = %v, want %v", optimized, tt.optimized)
+			}
+		})
+	}
+}
+
+func TestCompiler_O0Reproducible(t *testing.T) {
+	path := writeConfig(t, "")
+	var outputs [][]byte
+	for i := 0; i < 3; i++ {
+		cmp := NewCompiler()
+		cmp.OptLevel = 0
+		result, err := cmp.Compile(path)
+		if err != nil {
+			t.Fatalf("Compile: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := serializer.NewSerializer().Serialize(result.Bytecode, &buf); err != nil {
+			t.Fatalf("Serialize: %v", err)
+		}
+		outputs = append(outputs, buf.Bytes())
+	}
+	for i := 1; i < len(outputs); i++ {
+		if !bytes.Equal(outputs[0], outputs[i]) {
+			t.Fatalf("-O0 output %d differs from the first one", i)
+		}
+	}
+}
+
+func TestCompiler_InvalidPipeline(t *testing.T) {
+	for _, section := range []string{"[compiler]\nopt_level = 7\n", "[compiler]\npasses = [\"nope\"]\n"} {
+		if _, err := NewCompiler().Compile(writeConfig(t, section)); err == nil {
+			t.Errorf("Compile(%q) succeeded, want error", section)
+		}
+	}
+}
+
+// largeGrammar - Synthetic grammar of n keyword, begin/end and capture rules
+// spread over repository entries, each with its own scopes
+func largeGrammar(n int) string {
+	var b strings.Builder
+	b.WriteString(`{"scopeName": "source.big", "patterns": [`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"include": "#r%d"}`, i)
+	}
+	b.WriteString(`], "repository": {"escape": {"match": "\\\\.", "name": "constant.character.escape.big"}`)
+	for i := 0; i < n; i++ {
+		switch i % 3 {
+		case 0:
+			fmt.Fprintf(&b, `, "r%d": {"match": "\\b(kw%da|kw%db)\\b", "name": "keyword.k%d.big"}`, i, i, i, i)
+		case 1:
+			fmt.Fprintf(&b, `, "r%d": {"begin": "<%d<", "end": ">%d>", "name": "string.s%d.big", "patterns": [{"include": "#escape"}]}`, i, i, i, i)
+		default:
+			fmt.Fprintf(&b, `, "r%d": {"match": "(f%d)\\s*(\\()", "captures": {"1": {"name": "entity.name.function.f%d.big"}, "2": {"name": "punctuation.big"}}}`, i, i, i)
+		}
+	}
+	b.WriteString("}}")
+	return b.String()
+}
+
+// BenchmarkCompiler_LargeGrammar - Compile end to end (loading, lowering,
+// rule analysis, optimizer and code generation) of thousands of rules at
+// -O0 and -O2; time per op should grow linearly with the size
+func BenchmarkCompiler_LargeGrammar(b *testing.B) {
+	for _, level := range []int{0, 2} {
+		for _, n := range []int{1000, 2000, 4000, 8000} {
+			b.Run(fmt.Sprintf("O%d/rules=%d", level, n), func(b *testing.B) {
+				path := writeGrammarConfig(b, largeGrammar(n), "")
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					cmp := NewCompiler()
+					cmp.OptLevel = level
+					if _, err := cmp.Compile(path); err != nil {
+						b.Fatalf("Compile: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -16,12 +16,20 @@ type LanguageConfig struct {
 	Snippets   []string          `toml:"snippets,omitempty"`
 	Repository map[string]string `toml:"repository,omitempty"`
 	Metadata   map[string]string `toml:"metadata,omitempty"`
+	Compiler   CompilerConfig    `toml:"compiler"`
 
 	// Campos calculados
 	baseDir     string
 	grammarPath string
 }
 
+// CompilerConfig - [compiler] section: optimization pipeline of the
+// language. Command-line flags take precedence.
+type CompilerConfig struct {
+	OptLevel *int     `toml:"opt_level"` // 0-3, nil for the default level
+	Passes   []string `toml:"passes"`    // Explicit pipeline, overrides opt_level
+}
+
 func LoadConfig(configPath string) (*LanguageConfig, error) {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
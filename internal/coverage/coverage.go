@@ -0,0 +1,97 @@
+// Package coverage maps rule hits of the tokenizer back to the grammar
+// rules they were compiled from
+package coverage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/internal/parser"
+	"github.com/ferchd/tm2hsl/pkg/hsl"
+)
+
+// Report - Hits per grammar rule
+type Report struct {
+	Name    string
+	Rules   []Rule              // In rule table order
+	Grammar *parser.TextMateAST // Source grammar, for the HTML view
+}
+
+// Rule - Grammar rule with the hits of every rule table entry compiled
+// from it. A repository rule included from several states has one entry
+// per state.
+type Rule struct {
+	Source  string // Path in the grammar, "rule N" when unknown
+	Kind    string // match, begin or end
+	Pattern string
+	Hits    uint64
+}
+
+// New - Aggregates hits (indexed like bc.RuleTable.Entries) by source path
+func New(bc *hsl.Bytecode, grammar *parser.TextMateAST, hits []uint64) *Report {
+	r := &Report{Name: bc.Name, Grammar: grammar}
+	index := make(map[string]int)
+
+	for i, entry := range bc.RuleTable.Entries {
+		source, ok := bc.StringAt(entry.SourceID)
+		if !ok || source == "" {
+			source = fmt.Sprintf("rule %d", i)
+		}
+		j, seen := index[source]
+		if !seen {
+			j = len(r.Rules)
+			index[source] = j
+			r.Rules = append(r.Rules, Rule{
+				Source:  source,
+				Kind:    kindOf(entry.Action),
+				Pattern: bc.RegexPattern(entry.RegexID),
+			})
+		}
+		if i < len(hits) {
+			r.Rules[j].Hits += hits[i]
+		}
+	}
+	return r
+}
+
+func kindOf(action uint8) string {
+	switch action {
+	case hsl.ActionPushScope:
+		return "begin"
+	case hsl.ActionPopScope:
+		return "end"
+	}
+	return "match"
+}
+
+// Covered - Number of rules matched at least once
+func (r *Report) Covered() int {
+	n := 0
+	for _, rule := range r.Rules {
+		if rule.Hits > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Percent - Covered rules over all rules, 100 for an empty grammar
+func (r *Report) Percent() float64 {
+	if len(r.Rules) == 0 {
+		return 100
+	}
+	return 100 * float64(r.Covered()) / float64(len(r.Rules))
+}
+
+// WriteText - Summary line and one row per rule
+func WriteText(w io.Writer, r *Report) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Rule coverage: %d/%d (%.1f%%)\n", r.Covered(), len(r.Rules), r.Percent())
+	fmt.Fprintf(&b, "%8s  %-5s  %s\n", "HITS", "KIND", "RULE")
+	for _, rule := range r.Rules {
+		fmt.Fprintf(&b, "%8d  %-5s  %s\n", rule.Hits, rule.Kind, rule.Source)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,156 @@
+package coverage
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/internal/parser"
+)
+
+// WriteHTML - Standalone page showing the grammar tree, with the hits of
+// every pattern. Patterns never matched are highlighted; rules that were
+// not compiled (never included) are dimmed.
+func WriteHTML(w io.Writer, r *Report) error {
+	if r.Grammar == nil {
+		return fmt.Errorf("coverage report has no grammar")
+	}
+
+	hits := make(map[string]uint64, len(r.Rules))
+	for _, rule := range r.Rules {
+		hits[rule.Source] = rule.Hits
+	}
+	p := &htmlPrinter{hits: hits}
+
+	title := fmt.Sprintf("%s rule coverage", r.Name)
+	fmt.Fprintf(&p.b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n", html.EscapeString(title))
+	p.b.WriteString(htmlStyle)
+	p.b.WriteString("</head>\n<body>\n")
+	fmt.Fprintf(&p.b, "<h1>%s</h1>\n", html.EscapeString(title))
+	fmt.Fprintf(&p.b, "<p class=\"summary\">%d of %d rules matched (%.1f%%)</p>\n", r.Covered(), len(r.Rules), r.Percent())
+
+	g := r.Grammar
+	p.section("patterns")
+	for i := range g.Patterns {
+		p.rule(&g.Patterns[i], fmt.Sprintf("patterns[%d]", i))
+	}
+	p.b.WriteString("</section>\n")
+
+	if len(g.Repository) > 0 {
+		p.section("repository")
+		for _, key := range sortedKeys(g.Repository) {
+			def := g.Repository[key]
+			p.rule(&def, "repository."+key)
+		}
+		p.b.WriteString("</section>\n")
+	}
+
+	if len(g.Injections) > 0 {
+		p.section("injections")
+		for _, key := range sortedKeys(g.Injections) {
+			def := g.Injections[key]
+			p.rule(&def, fmt.Sprintf("injections[%s]", key))
+		}
+		p.b.WriteString("</section>\n")
+	}
+
+	p.b.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, p.b.String())
+	return err
+}
+
+type htmlPrinter struct {
+	b    strings.Builder
+	hits map[string]uint64
+}
+
+func (p *htmlPrinter) section(name string) {
+	fmt.Fprintf(&p.b, "<section>\n<h2>%s</h2>\n", name)
+}
+
+// rule - One grammar rule; path follows the normalizer's source paths
+func (p *htmlPrinter) rule(def *parser.GrammarRule, path string) {
+	class := "container"
+	if def.Match != "" || def.Begin != "" {
+		class = p.status(path)
+		if def.Begin != "" && def.Match == "" && class == "hit" {
+			class = p.status(path + ".end")
+		}
+	}
+
+	fmt.Fprintf(&p.b, "<div class=\"rule %s\">\n<div class=\"path\">%s", class, html.EscapeString(path))
+	if def.Name != "" {
+		fmt.Fprintf(&p.b, " <span class=\"scope\">%s</span>", html.EscapeString(def.Name))
+	}
+	p.b.WriteString("</div>\n")
+
+	switch {
+	case def.Match != "":
+		p.pattern("match", def.Match, path)
+	case def.Begin != "":
+		p.pattern("begin", def.Begin, path)
+		p.pattern("end", def.End, path+".end")
+		if def.ContentName != "" {
+			fmt.Fprintf(&p.b, "<div class=\"field\">contentName <span class=\"scope\">%s</span></div>\n", html.EscapeString(def.ContentName))
+		}
+	}
+	if def.Include != "" {
+		fmt.Fprintf(&p.b, "<div class=\"field\">include <code>%s</code></div>\n", html.EscapeString(def.Include))
+	}
+
+	// Patterns of match rules are ignored by the compiler, as in TextMate
+	if def.Match == "" {
+		for i := range def.Patterns {
+			p.rule(&def.Patterns[i], fmt.Sprintf("%s.patterns[%d]", path, i))
+		}
+	}
+	p.b.WriteString("</div>\n")
+}
+
+func (p *htmlPrinter) pattern(field, pattern, source string) {
+	class := p.status(source)
+	label := "not compiled"
+	if n, ok := p.hits[source]; ok {
+		label = fmt.Sprintf("%d hits", n)
+	}
+	fmt.Fprintf(&p.b, "<div class=\"field %s\">%s <code>%s</code> <span class=\"hits\">%s</span></div>\n",
+		class, field, html.EscapeString(pattern), label)
+}
+
+// status - hit, miss, or unused when the rule is not in the bytecode
+func (p *htmlPrinter) status(source string) string {
+	n, ok := p.hits[source]
+	switch {
+	case !ok:
+		return "unused"
+	case n == 0:
+		return "miss"
+	}
+	return "hit"
+}
+
+func sortedKeys(m map[string]parser.GrammarRule) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+const htmlStyle = `<style>
+body { margin: 2em; font-family: system-ui, sans-serif; color: #1f2328; }
+code { font-family: ui-monospace, monospace; background: #f6f8fa; padding: 0 .2em; }
+.rule { margin: .4em 0 .4em 1.2em; padding: .3em .6em; border-left: 3px solid #d0d7de; }
+.rule.hit { border-color: #2da44e; }
+.rule.miss { border-color: #cf222e; background: #ffebe9; }
+.rule.unused { opacity: .5; }
+.path { font-weight: 600; }
+.scope { font-weight: normal; color: #0550ae; }
+.field { margin-left: 1em; }
+.field.miss .hits { color: #cf222e; font-weight: 600; }
+.hits { color: #57606a; font-size: .9em; }
+</style>
+`
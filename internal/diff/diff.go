@@ -0,0 +1,412 @@
+// Package diff compares two compiled HSL files structurally
+package diff
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/internal/disasm"
+	"github.com/ferchd/tm2hsl/pkg/hsl"
+)
+
+// Report - Differences between two bytecodes
+type Report struct {
+	Regexes    SetChange
+	Scopes     SetChange
+	States     SetChange // State keys, see stateKeys
+	Injections SetChange
+	Scanners   SetChange // Per state: covered rules and DFA size
+	Prefilters SetChange // Per state: first bytes and literals
+	Keywords   SetChange // Keyword list regexes and their words
+	Rules      []RuleChange
+	Sizes      []SizeDelta
+}
+
+// SetChange - Entries present in only one side
+type SetChange struct {
+	Added   []string
+	Removed []string
+}
+
+func (c SetChange) empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0
+}
+
+// ChangeKind - Kind of rule difference
+type ChangeKind string
+
+const (
+	RuleAdded   ChangeKind = "added"
+	RuleRemoved ChangeKind = "removed"
+	RuleChanged ChangeKind = "changed"
+)
+
+// RuleChange - Difference in one rule of a state present on both sides
+type RuleChange struct {
+	State   string
+	Rule    string // Source path, or regex when the rule has no source
+	Kind    ChangeKind
+	Details []string // Changed fields, for RuleChanged
+}
+
+// SizeDelta - Encoded size of a table on each side
+type SizeDelta struct {
+	Table string
+	Old   int
+	New   int
+}
+
+// Differences - Number of reported differences, counting every table whose
+// size changed (the total excluded, it follows the tables)
+func (r *Report) Differences() int {
+	n := len(r.Rules)
+	for _, c := range []SetChange{r.Regexes, r.Scopes, r.States, r.Injections, r.Scanners, r.Prefilters, r.Keywords} {
+		n += len(c.Added) + len(c.Removed)
+	}
+	for _, size := range r.Sizes {
+		if size.Table != "total" && size.Old != size.New {
+			n++
+		}
+	}
+	return n
+}
+
+// Compare - Aligns states by the rule that enters them and rules by
+// grammar source path (regex text when missing), then reports changes
+func Compare(a, b *hsl.Bytecode) *Report {
+	la, lb := disasm.Disassemble(a), disasm.Disassemble(b)
+	report := &Report{
+		Regexes: compareSets(regexSet(la), regexSet(lb)),
+		Scopes:  compareSets(scopeSet(la), scopeSet(lb)),
+		Sizes:   compareSizes(a.Header, b.Header),
+	}
+
+	keysA, keysB := stateKeys(la), stateKeys(lb)
+	report.States = compareSets(keySet(keysA), keySet(keysB))
+	report.Injections = compareSets(injectionSet(la, keysA), injectionSet(lb, keysB))
+	report.Scanners = compareSets(scannerSet(la, keysA), scannerSet(lb, keysB))
+	report.Prefilters = compareSets(prefilterSet(la, keysA), prefilterSet(lb, keysB))
+	report.Keywords = compareSets(keywordSet(la), keywordSet(lb))
+
+	statesB := make(map[string]disasm.State)
+	for i, key := range keysB {
+		statesB[key] = lb.States[i]
+	}
+	for i, key := range keysA {
+		if sb, ok := statesB[key]; ok {
+			report.Rules = append(report.Rules, compareRules(key, la.States[i], sb, keysA, keysB)...)
+		}
+	}
+
+	return report
+}
+
+// stateKeys - Stable names for states: the root, the source of the begin
+// rule entering the state, or the selectors injecting it
+func stateKeys(l *disasm.Listing) []string {
+	keys := make([]string, len(l.States))
+	for _, inj := range l.Injections {
+		if int(inj.State) < len(keys) && keys[inj.State] == "" {
+			keys[inj.State] = "injection " + inj.Selector
+		}
+	}
+	for _, state := range l.States {
+		for _, rule := range state.Rules {
+			next := int(rule.NextState)
+			if next >= 0 && next < len(keys) && keys[next] == "" && next != 0 {
+				keys[next] = ruleKey(rule)
+			}
+		}
+	}
+	if len(keys) > 0 {
+		keys[0] = "root"
+	}
+
+	seen := make(map[string]int)
+	for i, key := range keys {
+		if key == "" {
+			key = fmt.Sprintf("state %d", i)
+		}
+		seen[key]++
+		if seen[key] > 1 {
+			key = fmt.Sprintf("%s#%d", key, seen[key])
+		}
+		keys[i] = key
+	}
+	return keys
+}
+
+func ruleKey(rule disasm.Rule) string {
+	if rule.Source != "" {
+		return rule.Source
+	}
+	return fmt.Sprintf("%s /%s/", rule.Action, rule.Regex)
+}
+
+func compareRules(state string, a, b disasm.State, keysA, keysB []string) []RuleChange {
+	rulesA, orderA := indexRules(a.Rules)
+	rulesB, orderB := indexRules(b.Rules)
+
+	var changes []RuleChange
+	for _, key := range orderA {
+		ra := rulesA[key]
+		rb, ok := rulesB[key]
+		if !ok {
+			changes = append(changes, RuleChange{State: state, Rule: key, Kind: RuleRemoved})
+			continue
+		}
+		if details := ruleDetails(ra, rb, keysA, keysB); len(details) > 0 {
+			changes = append(changes, RuleChange{State: state, Rule: key, Kind: RuleChanged, Details: details})
+		}
+	}
+	for _, key := range orderB {
+		if _, ok := rulesA[key]; !ok {
+			changes = append(changes, RuleChange{State: state, Rule: key, Kind: RuleAdded})
+		}
+	}
+	return changes
+}
+
+// indexedRule - Rule with its position inside the state
+type indexedRule struct {
+	disasm.Rule
+	position int
+}
+
+func indexRules(rules []disasm.Rule) (map[string]indexedRule, []string) {
+	index := make(map[string]indexedRule)
+	order := make([]string, 0, len(rules))
+	seen := make(map[string]int)
+	for i, rule := range rules {
+		key := ruleKey(rule)
+		seen[key]++
+		if seen[key] > 1 {
+			key = fmt.Sprintf("%s#%d", key, seen[key])
+		}
+		index[key] = indexedRule{Rule: rule, position: i}
+		order = append(order, key)
+	}
+	return index, order
+}
+
+func ruleDetails(a, b indexedRule, keysA, keysB []string) []string {
+	var details []string
+	field := func(name, va, vb string) {
+		if va != vb {
+			details = append(details, fmt.Sprintf("%s: %s -> %s", name, va, vb))
+		}
+	}
+
+	field("position", fmt.Sprint(a.position), fmt.Sprint(b.position))
+	field("action", a.Action, b.Action)
+	field("regex", "/"+a.Regex+"/", "/"+b.Regex+"/")
+	field("next", nextKey(a.NextState, keysA), nextKey(b.NextState, keysB))
+	field("scope", a.Scope, b.Scope)
+	field("priority", fmt.Sprint(a.Priority), fmt.Sprint(b.Priority))
+	field("captures", captureList(a.Captures), captureList(b.Captures))
+	return details
+}
+
+func nextKey(next int16, keys []string) string {
+	if next >= 0 && int(next) < len(keys) {
+		return keys[next]
+	}
+	return disasm.NextStateName(next)
+}
+
+func captureList(captures []disasm.Capture) string {
+	parts := make([]string, len(captures))
+	for i, c := range captures {
+		parts[i] = fmt.Sprintf("%d=%s", c.Group, c.Scope)
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+func regexSet(l *disasm.Listing) map[string]bool {
+	set := make(map[string]bool)
+	for _, re := range l.Regexes {
+		set[re.Pattern] = true
+	}
+	return set
+}
+
+func scopeSet(l *disasm.Listing) map[string]bool {
+	set := make(map[string]bool)
+	for _, scope := range l.Scopes {
+		set[scope.Name] = true
+	}
+	return set
+}
+
+func keySet(keys []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, key := range keys {
+		set[key] = true
+	}
+	return set
+}
+
+func injectionSet(l *disasm.Listing, keys []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, inj := range l.Injections {
+		set[fmt.Sprintf("%s:%s -> %s", inj.Priority, inj.Selector, nextKey(int16(inj.State), keys))] = true
+	}
+	return set
+}
+
+func scannerSet(l *disasm.Listing, keys []string) map[string]bool {
+	set := make(map[string]bool)
+	for i, state := range l.States {
+		sc := state.Scanner
+		if sc == nil {
+			continue
+		}
+		names := make(map[uint32]string)
+		for _, rule := range state.Rules {
+			names[rule.Index] = ruleKey(rule)
+		}
+		rules := make([]string, len(sc.Rules))
+		for j, index := range sc.Rules {
+			rules[j] = names[index]
+		}
+		set[fmt.Sprintf("%s: %s (%d DFA states, %d atoms)", keys[i], strings.Join(rules, ", "), sc.States, sc.Atoms)] = true
+	}
+	return set
+}
+
+func prefilterSet(l *disasm.Listing, keys []string) map[string]bool {
+	set := make(map[string]bool)
+	for i, state := range l.States {
+		if pf := state.Prefilter; pf != nil {
+			entry := keys[i] + ":"
+			if pf.FirstBytes != "" {
+				entry += " first=" + pf.FirstBytes
+			}
+			if pf.Literals != nil {
+				literals := make([]string, len(pf.Literals))
+				for j, lit := range pf.Literals {
+					literals[j] = strconv.Quote(lit)
+				}
+				entry += " literals=" + strings.Join(literals, ",")
+			}
+			set[entry] = true
+		}
+	}
+	return set
+}
+
+func keywordSet(l *disasm.Listing) map[string]bool {
+	set := make(map[string]bool)
+	for _, re := range l.Regexes {
+		if kw := re.Keywords; kw != nil {
+			set[fmt.Sprintf("/%s/ -> %s", re.Pattern, strings.Join(kw.Words, " "))] = true
+		}
+	}
+	return set
+}
+
+func compareSets(a, b map[string]bool) SetChange {
+	var change SetChange
+	for key := range b {
+		if !a[key] {
+			change.Added = append(change.Added, key)
+		}
+	}
+	for key := range a {
+		if !b[key] {
+			change.Removed = append(change.Removed, key)
+		}
+	}
+	sort.Strings(change.Added)
+	sort.Strings(change.Removed)
+	return change
+}
+
+// compareSizes - Table sizes derived from the header offsets
+func compareSizes(a, b hsl.Header) []SizeDelta {
+	sa, sb := tableSizes(a), tableSizes(b)
+	deltas := make([]SizeDelta, len(sa))
+	for i := range sa {
+		deltas[i] = SizeDelta{Table: tableNames[i], Old: sa[i], New: sb[i]}
+	}
+	return deltas
+}
+
+var tableNames = []string{"strings", "regexes", "scopes", "states", "rules", "injections", "scanners", "prefilters", "keywords", "total"}
+
+func tableSizes(h hsl.Header) []int {
+	bounds := []uint32{
+		h.StringTableOffset, h.RegexTableOffset, h.ScopeTableOffset,
+		h.StateTableOffset, h.RuleTableOffset, h.InjectionOffset,
+		h.ScannerOffset, h.PrefilterOffset, h.KeywordOffset, h.TotalSize,
+	}
+	// An absent optional table is empty and starts where the next one does
+	for i := len(bounds) - 2; i >= 0; i-- {
+		if bounds[i] == 0 {
+			bounds[i] = bounds[i+1]
+		}
+	}
+	sizes := make([]int, 0, len(bounds))
+	for i := 0; i+1 < len(bounds); i++ {
+		sizes = append(sizes, int(bounds[i+1])-int(bounds[i]))
+	}
+	return append(sizes, int(h.TotalSize))
+}
+
+// WriteText - Human-readable report
+func WriteText(w io.Writer, r *Report) error {
+	var b strings.Builder
+
+	sets := []struct {
+		name   string
+		change SetChange
+	}{
+		{"states", r.States},
+		{"regexes", r.Regexes},
+		{"scopes", r.Scopes},
+		{"injections", r.Injections},
+		{"scanners", r.Scanners},
+		{"prefilters", r.Prefilters},
+		{"keywords", r.Keywords},
+	}
+	for _, set := range sets {
+		if set.change.empty() {
+			continue
+		}
+		fmt.Fprintf(&b, "%s:\n", set.name)
+		for _, item := range set.change.Removed {
+			fmt.Fprintf(&b, "  - %s\n", item)
+		}
+		for _, item := range set.change.Added {
+			fmt.Fprintf(&b, "  + %s\n", item)
+		}
+	}
+
+	if len(r.Rules) > 0 {
+		fmt.Fprintf(&b, "rules:\n")
+		for _, rule := range r.Rules {
+			mark := map[ChangeKind]string{RuleAdded: "+", RuleRemoved: "-", RuleChanged: "~"}[rule.Kind]
+			fmt.Fprintf(&b, "  %s [%s] %s\n", mark, rule.State, rule.Rule)
+			for _, detail := range rule.Details {
+				fmt.Fprintf(&b, "      %s\n", detail)
+			}
+		}
+	}
+
+	fmt.Fprintf(&b, "sizes:\n")
+	for _, size := range r.Sizes {
+		fmt.Fprintf(&b, "  %-10s %8d -> %8d  (%+d)\n", size.Table, size.Old, size.New, size.New-size.Old)
+	}
+
+	if n := r.Differences(); n == 0 {
+		fmt.Fprintf(&b, "no structural differences\n")
+	} else {
+		fmt.Fprintf(&b, "%d differences\n", n)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
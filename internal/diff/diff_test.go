@@ -0,0 +1,92 @@
+package diff
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ferchd/tm2hsl/internal/compiler"
+	"github.com/ferchd/tm2hsl/internal/serializer"
+	"github.com/ferchd/tm2hsl/pkg/hsl"
+)
+
+// compileExample - Example grammar at the given level, as read back from
+// its serialized form
+func compileExample(t *testing.T, level int) *hsl.Bytecode {
+	t.Helper()
+	cmp := compiler.NewCompiler()
+	cmp.OptLevel = level
+	result, err := cmp.Compile("../../examples/language.toml")
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	return reload(t, result.Bytecode)
+}
+
+// reload - bc serialized and decoded again, with real table offsets
+func reload(t *testing.T, bc *hsl.Bytecode) *hsl.Bytecode {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := serializer.NewSerializer().Serialize(bc, &buf); err != nil {
+		t.Fatalf("Serialize: %v", err)
+	}
+	decoded, err := hsl.Decode(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	return decoded
+}
+
+func TestCompare(t *testing.T) {
+	o0, o2 := compileExample(t, 0), compileExample(t, 2)
+
+	// The first rule with a scope gets the next scope of the table
+	renamed := reload(t, o0)
+	for i, rule := range renamed.RuleTable.Entries {
+		if rule.ScopeID != hsl.NoScope {
+			renamed.RuleTable.Entries[i].ScopeID = (rule.ScopeID + 1) % uint16(len(renamed.ScopeTable.Entries))
+			break
+		}
+	}
+	noKeywords := reload(t, o0)
+	noKeywords.KeywordTable = hsl.KeywordTable{}
+	noKeywords = reload(t, noKeywords)
+
+	tests := []struct {
+		name   string
+		a, b   *hsl.Bytecode
+		want   int
+		report func(r *Report) bool
+	}{
+		{"identical", o2, compileExample(t, 2), 0, func(r *Report) bool { return true }},
+		{"scanners and prefilters", o0, o2, 8, func(r *Report) bool {
+			// Two scanners, four prefilters, and the size of both tables
+			return len(r.Scanners.Added) == 2 && len(r.Prefilters.Added) == 4 && len(r.Rules) == 0
+		}},
+		{"keywords", o0, noKeywords, 3, func(r *Report) bool {
+			return len(r.Keywords.Removed) == 2 && r.Keywords.Removed[0] == `/\b(function|if|else|return)\b/ -> else function if return`
+		}},
+		{"rule scope", o0, renamed, 1, func(r *Report) bool {
+			return len(r.Rules) == 1 && r.Rules[0].Kind == RuleChanged && strings.HasPrefix(r.Rules[0].Details[0], "scope: ")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Compare(tt.a, tt.b)
+			var text strings.Builder
+			if err := WriteText(&text, r); err != nil {
+				t.Fatalf("WriteText: %v", err)
+			}
+			if got := r.Differences(); got != tt.want || !tt.report(r) {
+				t.Errorf("%d differences, want %d:\n%s", got, tt.want, text.String())
+			}
+			last := "no structural differences\n"
+			if tt.want > 0 {
+				last = "differences\n"
+			}
+			if !strings.HasSuffix(text.String(), last) {
+				t.Errorf("report does not end with %q:\n%s", last, text.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,401 @@
+// Package disasm renders compiled HSL bytecode as a readable listing
+package disasm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/pkg/hsl"
+	"github.com/ferchd/tm2hsl/pkg/regex"
+)
+
+// Listing - Bytecode with every table index resolved to its string
+type Listing struct {
+	Name              string      `json:"name"`
+	Scope             string      `json:"scope"`
+	Header            Header      `json:"header"`
+	Strings           []string    `json:"strings"`
+	Regexes           []Regex     `json:"regexes"`
+	Scopes            []Scope     `json:"scopes"`
+	States            []State     `json:"states"`
+	InjectionSelector string      `json:"injectionSelector,omitempty"`
+	Injections        []Injection `json:"injections"`
+}
+
+type Header struct {
+	Version   uint16            `json:"version"`
+	Flags     []string          `json:"flags"`
+	TotalSize uint32            `json:"totalSize"`
+	Checksum  uint32            `json:"checksum"`
+	Offsets   map[string]uint32 `json:"offsets"`
+}
+
+type Regex struct {
+	ID       uint32    `json:"id"`
+	Pattern  string    `json:"pattern"`
+	Hash     uint32    `json:"hash"`
+	Flags    uint8     `json:"flags"`
+	Bytecode int       `json:"bytecodeSize"`
+	Keywords *Keywords `json:"keywords,omitempty"`
+}
+
+// Keywords - Trie standing in for a keyword list regex
+type Keywords struct {
+	Words []string `json:"words"` // Folded when Fold
+	Fold  bool     `json:"fold,omitempty"`
+	Nodes int      `json:"nodes"`
+}
+
+type Scope struct {
+	ID     uint16 `json:"id"`
+	Name   string `json:"name"`
+	Parent string `json:"parent,omitempty"`
+}
+
+type State struct {
+	ID           uint32     `json:"id"`
+	Flags        []string   `json:"flags"`
+	ContentScope string     `json:"contentScope,omitempty"`
+	RuleOffset   uint32     `json:"ruleOffset"`
+	Rules        []Rule     `json:"rules"`
+	Scanner      *Scanner   `json:"scanner,omitempty"`
+	Prefilter    *Prefilter `json:"prefilter,omitempty"`
+}
+
+// Prefilter - What every match of the rules of a state starts with
+type Prefilter struct {
+	FirstBytes string   `json:"firstBytes,omitempty"` // As ranges, [0-9a-z]
+	Literals   []string `json:"literals,omitempty"`
+}
+
+// Scanner - DFA matching several rules of a state at once
+type Scanner struct {
+	Rules  []uint32 `json:"rules"` // Rule table indices
+	States int      `json:"states"`
+	Atoms  int      `json:"atoms"`
+	Ranges int      `json:"ranges"`
+}
+
+type Rule struct {
+	Index     uint32    `json:"index"`
+	Action    string    `json:"action"`
+	RegexID   uint32    `json:"regexId"`
+	Regex     string    `json:"regex"`
+	NextState int16     `json:"nextState"`
+	Scope     string    `json:"scope,omitempty"`
+	Priority  uint8     `json:"priority"`
+	Captures  []Capture `json:"captures,omitempty"`
+	Source    string    `json:"source,omitempty"`
+}
+
+type Capture struct {
+	Group uint8  `json:"group"`
+	Scope string `json:"scope"`
+}
+
+type Injection struct {
+	Selector string `json:"selector"`
+	Priority string `json:"priority"`
+	State    uint32 `json:"state"`
+}
+
+// Disassemble - Builds the listing of a decoded bytecode
+func Disassemble(bc *hsl.Bytecode) *Listing {
+	h := bc.Header
+	l := &Listing{
+		Name:  bc.Name,
+		Scope: bc.Scope,
+		Header: Header{
+			Version:   h.Version,
+			Flags:     headerFlags(h.Flags),
+			TotalSize: h.TotalSize,
+			Checksum:  h.Checksum,
+			Offsets: map[string]uint32{
+				"strings":    h.StringTableOffset,
+				"regexes":    h.RegexTableOffset,
+				"scopes":     h.ScopeTableOffset,
+				"states":     h.StateTableOffset,
+				"rules":      h.RuleTableOffset,
+				"injections": h.InjectionOffset,
+				"scanners":   h.ScannerOffset,
+				"prefilters": h.PrefilterOffset,
+				"keywords":   h.KeywordOffset,
+			},
+		},
+		Strings:    make([]string, len(bc.StringTable.Offsets)),
+		Regexes:    make([]Regex, len(bc.RegexTable.Entries)),
+		Scopes:     make([]Scope, len(bc.ScopeTable.Entries)),
+		States:     make([]State, len(bc.StateTable.Entries)),
+		Injections: make([]Injection, len(bc.InjectionTable.Entries)),
+	}
+
+	for i := range l.Strings {
+		l.Strings[i], _ = bc.StringAt(uint32(i))
+	}
+
+	for i, re := range bc.RegexTable.Entries {
+		l.Regexes[i] = Regex{
+			ID:       re.ID,
+			Pattern:  bc.RegexPattern(uint32(i)),
+			Hash:     re.PatternHash,
+			Flags:    re.Flags,
+			Bytecode: len(re.Bytecode),
+		}
+	}
+	for _, entry := range bc.KeywordTable.Entries {
+		if int(entry.RegexID) < len(l.Regexes) {
+			l.Regexes[entry.RegexID].Keywords = disassembleKeywords(entry)
+		}
+	}
+
+	for i, scope := range bc.ScopeTable.Entries {
+		name, _ := bc.StringAt(scope.NameID)
+		l.Scopes[i] = Scope{ID: scope.ID, Name: name, Parent: bc.ScopeName(scope.ParentID)}
+	}
+
+	for i, state := range bc.StateTable.Entries {
+		s := State{
+			ID:           state.ID,
+			Flags:        stateFlags(state.Flags),
+			ContentScope: bc.ScopeName(state.ScopeID),
+			RuleOffset:   state.RuleOffset,
+			Rules:        []Rule{},
+		}
+		for j, rule := range bc.StateRules(uint32(i)) {
+			s.Rules = append(s.Rules, disassembleRule(bc, state.RuleOffset+uint32(j), rule))
+		}
+		l.States[i] = s
+	}
+
+	for _, sc := range bc.ScannerTable.Entries {
+		if int(sc.StateID) >= len(l.States) {
+			continue
+		}
+		s := &l.States[sc.StateID]
+		s.Scanner = &Scanner{
+			States: len(sc.Accept) / hsl.ScannerContexts,
+			Atoms:  int(sc.AtomCount),
+			Ranges: len(sc.Lows),
+		}
+		for _, r := range sc.Rules {
+			s.Scanner.Rules = append(s.Scanner.Rules, s.RuleOffset+uint32(r))
+		}
+	}
+
+	for _, pf := range bc.PrefilterTable.Entries {
+		if int(pf.StateID) >= len(l.States) {
+			continue
+		}
+		p := &Prefilter{}
+		if pf.Flags&hsl.PrefilterFirstBytes != 0 {
+			first := regex.ByteSet(pf.FirstBytes)
+			p.FirstBytes = first.String()
+		}
+		if pf.Flags&hsl.PrefilterLiterals != 0 {
+			for _, lit := range pf.Literals {
+				p.Literals = append(p.Literals, string(lit))
+			}
+		}
+		l.States[pf.StateID].Prefilter = p
+	}
+
+	l.InjectionSelector, _ = bc.StringAt(bc.InjectionTable.SelectorID)
+	for i, inj := range bc.InjectionTable.Entries {
+		selector, _ := bc.StringAt(inj.SelectorID)
+		l.Injections[i] = Injection{
+			Selector: selector,
+			Priority: priorityName(inj.Priority),
+			State:    inj.StateID,
+		}
+	}
+
+	return l
+}
+
+// disassembleKeywords - Words of a keyword trie; nil if the trie is invalid
+func disassembleKeywords(entry hsl.KeywordEntry) *Keywords {
+	t := regex.KeywordTables{Fold: entry.Flags&hsl.KeywordFold != 0, Edges: []uint32{0}}
+	for _, n := range entry.Nodes {
+		t.Labels = append(t.Labels, n.Labels...)
+		t.Next = append(t.Next, n.Next...)
+		t.Edges = append(t.Edges, uint32(len(t.Labels)))
+		t.Final = append(t.Final, n.Final)
+	}
+	trie, err := regex.NewKeywordsTables(t)
+	if err != nil {
+		return nil
+	}
+	return &Keywords{Words: trie.Words(), Fold: t.Fold, Nodes: trie.Nodes()}
+}
+
+func disassembleRule(bc *hsl.Bytecode, index uint32, rule hsl.RuleEntry) Rule {
+	r := Rule{
+		Index:     index,
+		Action:    ActionName(rule.Action),
+		RegexID:   rule.RegexID,
+		Regex:     bc.RegexPattern(rule.RegexID),
+		NextState: rule.NextState,
+		Scope:     bc.ScopeName(rule.ScopeID),
+		Priority:  rule.Priority,
+	}
+	r.Source, _ = bc.StringAt(rule.SourceID)
+	for _, c := range rule.Captures {
+		r.Captures = append(r.Captures, Capture{Group: c.Group, Scope: bc.ScopeName(c.ScopeID)})
+	}
+	return r
+}
+
+// ActionName - Mnemonic of a rule action
+func ActionName(action uint8) string {
+	switch action {
+	case hsl.ActionMatch:
+		return "match"
+	case hsl.ActionPushScope:
+		return "push"
+	case hsl.ActionPopScope:
+		return "pop"
+	case hsl.ActionTransition:
+		return "transition"
+	}
+	return fmt.Sprintf("action(%d)", action)
+}
+
+// NextStateName - "stay", "pop" or the target state
+func NextStateName(next int16) string {
+	switch {
+	case next == hsl.NextStatePop:
+		return "pop"
+	case next == hsl.NextStateStay:
+		return "stay"
+	case next < 0:
+		return fmt.Sprintf("invalid(%d)", next)
+	}
+	return fmt.Sprintf("state %d", next)
+}
+
+func priorityName(priority int8) string {
+	switch {
+	case priority < 0:
+		return "L"
+	case priority > 0:
+		return "R"
+	}
+	return "default"
+}
+
+func headerFlags(flags uint32) []string {
+	names := []string{"validated", "optimized", "deterministic", "linear-time"}
+	return flagNames(flags, names)
+}
+
+func stateFlags(flags uint8) []string {
+	names := []string{"final", "push", "pop", "injection"}
+	return flagNames(uint32(flags), names)
+}
+
+func flagNames(flags uint32, names []string) []string {
+	result := []string{}
+	for i, name := range names {
+		if flags&(1<<i) != 0 {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// WriteJSON - Listing as indented JSON, for tooling
+func WriteJSON(w io.Writer, l *Listing) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(l)
+}
+
+// WriteText - Human-readable listing
+func WriteText(w io.Writer, l *Listing) error {
+	p := &printer{w: w}
+
+	p.printf("; %s (%s)\n", l.Name, l.Scope)
+	p.printf("; version %d, %d bytes, checksum 0x%08x, flags [%s]\n",
+		l.Header.Version, l.Header.TotalSize, l.Header.Checksum, strings.Join(l.Header.Flags, " "))
+	p.printf("; %d strings, %d regexes, %d scopes, %d states, %d injections\n",
+		len(l.Strings), len(l.Regexes), len(l.Scopes), len(l.States), len(l.Injections))
+
+	for _, state := range l.States {
+		p.printf("\nstate %d [%s]", state.ID, strings.Join(state.Flags, " "))
+		if state.ContentScope != "" {
+			p.printf(" content=%s", state.ContentScope)
+		}
+		p.printf("\n")
+		if sc := state.Scanner; sc != nil {
+			rules := make([]string, len(sc.Rules))
+			for i, r := range sc.Rules {
+				rules[i] = fmt.Sprint(r)
+			}
+			p.printf("  scanner rules=%s, %d DFA states, %d atoms, %d ranges\n", strings.Join(rules, ","), sc.States, sc.Atoms, sc.Ranges)
+		}
+		if pf := state.Prefilter; pf != nil {
+			p.printf("  prefilter")
+			if pf.FirstBytes != "" {
+				p.printf(" first=%s", pf.FirstBytes)
+			}
+			if pf.Literals != nil {
+				quoted := make([]string, len(pf.Literals))
+				for i, lit := range pf.Literals {
+					quoted[i] = strconv.Quote(lit)
+				}
+				p.printf(" literals=%s", strings.Join(quoted, ","))
+			}
+			p.printf("\n")
+		}
+
+		for _, rule := range state.Rules {
+			p.printf("  %4d  %-5s /%s/ -> %s", rule.Index, rule.Action, rule.Regex, NextStateName(rule.NextState))
+			if int(rule.RegexID) < len(l.Regexes) {
+				if kw := l.Regexes[rule.RegexID].Keywords; kw != nil {
+					p.printf("  keywords=%d (%d trie nodes)", len(kw.Words), kw.Nodes)
+				}
+			}
+			if rule.Scope != "" {
+				p.printf("  scope=%s", rule.Scope)
+			}
+			if rule.Priority != 0 {
+				p.printf("  priority=%d", rule.Priority)
+			}
+			if rule.Source != "" {
+				p.printf("  ; %s", rule.Source)
+			}
+			p.printf("\n")
+			for _, c := range rule.Captures {
+				p.printf("          capture %d -> %s\n", c.Group, c.Scope)
+			}
+		}
+	}
+
+	if len(l.Injections) > 0 || l.InjectionSelector != "" {
+		p.printf("\ninjections")
+		if l.InjectionSelector != "" {
+			p.printf(" (grammar injects into %s)", l.InjectionSelector)
+		}
+		p.printf("\n")
+		for _, inj := range l.Injections {
+			p.printf("  %-7s %s -> state %d\n", inj.Priority, inj.Selector, inj.State)
+		}
+	}
+
+	return p.err
+}
+
+// printer - Keeps the first write error
+type printer struct {
+	w   io.Writer
+	err error
+}
+
+func (p *printer) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
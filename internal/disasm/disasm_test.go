@@ -0,0 +1,66 @@
+package disasm
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ferchd/tm2hsl/internal/compiler"
+	"github.com/ferchd/tm2hsl/internal/serializer"
+	"github.com/ferchd/tm2hsl/pkg/hsl"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestListing - Listings of the example grammar at -O2, as `tm2hsl disasm`
+// prints them from the written file; -update rewrites testdata after an
+// intended change
+func TestListing(t *testing.T) {
+	cmp := compiler.NewCompiler()
+	cmp.OptLevel = 2
+	result, err := cmp.Compile("../../examples/language.toml")
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := serializer.NewSerializer().Serialize(result.Bytecode, &buf); err != nil {
+		t.Fatalf("Serialize: %v", err)
+	}
+	bc, err := hsl.Decode(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	listing := Disassemble(bc)
+
+	tests := []struct {
+		golden string
+		write  func(b *bytes.Buffer) error
+	}{
+		{"language.txt", func(b *bytes.Buffer) error { return WriteText(b, listing) }},
+		{"language.json", func(b *bytes.Buffer) error { return WriteJSON(b, listing) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			var got bytes.Buffer
+			if err := tt.write(&got); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			path := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err := os.WriteFile(path, got.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("listing differs from %s (run with -update after an intended change):\n%s", path, got.String())
+			}
+		})
+	}
+}
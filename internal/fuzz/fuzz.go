@@ -0,0 +1,268 @@
+// Package fuzz checks tokenizer invariants of a compiled grammar on random
+// inputs derived from spec inputs
+package fuzz
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/ferchd/tm2hsl/pkg/engine"
+	"github.com/ferchd/tm2hsl/pkg/regex"
+)
+
+// Invariants checked on every input
+const (
+	InvariantPanic     = "panic"
+	InvariantCoverage  = "coverage"  // Tokens cover each line exactly
+	InvariantOffsets   = "offsets"   // Token offsets increase
+	InvariantStack     = "stack"     // Scope stack keeps the root scope
+	InvariantStepLimit = "steplimit" // Regex searches stay within the budget
+	InvariantError     = "error"     // Any other tokenization error
+)
+
+// Violation - Input breaking an invariant
+type Violation struct {
+	Invariant string
+	Line      int // 1-based, 0 when not tied to a line
+	Message   string
+}
+
+func (v *Violation) Error() string {
+	if v.Line > 0 {
+		return fmt.Sprintf("%s: line %d: %s", v.Invariant, v.Line, v.Message)
+	}
+	return fmt.Sprintf("%s: %s", v.Invariant, v.Message)
+}
+
+// Check tokenizes input line by line and returns the first broken
+// invariant, or nil. Panics are recovered and reported as violations.
+func Check(eng *engine.Engine, input string) (v *Violation) {
+	defer func() {
+		if r := recover(); r != nil {
+			v = &Violation{Invariant: InvariantPanic, Message: fmt.Sprint(r)}
+		}
+	}()
+
+	lines := strings.Split(strings.TrimSuffix(input, "\n"), "\n")
+	if input == "" {
+		lines = nil
+	}
+	root := eng.ScopeName()
+
+	var stack *engine.StateStack
+	for i, line := range lines {
+		tokens, next, err := eng.TokenizeLine(line, stack)
+		if err != nil {
+			if errors.Is(err, regex.ErrStepLimit) {
+				return &Violation{Invariant: InvariantStepLimit, Line: i + 1, Message: err.Error()}
+			}
+			return &Violation{Invariant: InvariantError, Line: i + 1, Message: err.Error()}
+		}
+		if v := checkLine(line, tokens, root); v != nil {
+			v.Line = i + 1
+			return v
+		}
+		if next == nil || len(next.Scopes()) == 0 || next.Scopes()[0] != root {
+			return &Violation{Invariant: InvariantStack, Line: i + 1, Message: "state after the line lost the root scope"}
+		}
+		stack = next
+	}
+	return nil
+}
+
+func checkLine(line string, tokens []engine.Token, root string) *Violation {
+	pos := 0
+	for _, tok := range tokens {
+		if tok.Start < pos || tok.End <= tok.Start {
+			return &Violation{Invariant: InvariantOffsets, Message: fmt.Sprintf("token %d-%d after offset %d", tok.Start, tok.End, pos)}
+		}
+		if tok.Start > pos {
+			return &Violation{Invariant: InvariantCoverage, Message: fmt.Sprintf("bytes %d-%d have no token", pos, tok.Start)}
+		}
+		if len(tok.Scopes) == 0 || tok.Scopes[0] != root {
+			return &Violation{Invariant: InvariantStack, Message: fmt.Sprintf("token %d-%d has scopes %v", tok.Start, tok.End, tok.Scopes)}
+		}
+		pos = tok.End
+	}
+	if pos != len(line) {
+		return &Violation{Invariant: InvariantCoverage, Message: fmt.Sprintf("tokens end at %d, line has %d bytes", pos, len(line))}
+	}
+	return nil
+}
+
+// Options - Limits of a fuzzing run
+type Options struct {
+	Iterations int           // Inputs to try; 0 for no limit
+	Duration   time.Duration // Time budget; 0 for no limit
+	Seed       int64
+}
+
+// Crash - Minimized input breaking an invariant
+type Crash struct {
+	Input     string
+	Violation *Violation
+}
+
+// Result - Outcome of a fuzzing run
+type Result struct {
+	Iterations int
+	Crashes    []Crash // One per kind of violation
+}
+
+// kind - Key telling violations apart: the invariant, and for step limits
+// the message naming the slow pattern. Other messages quote offsets and
+// values that change as the input shrinks.
+func (v *Violation) kind() string {
+	if v.Invariant == InvariantStepLimit {
+		return v.Invariant + "\x00" + v.Message
+	}
+	return v.Invariant
+}
+
+// Run mutates the seeds and checks every input. Each new kind of violation
+// is minimized and kept once, as reported on the minimized input.
+func Run(eng *engine.Engine, seeds []string, opts Options) *Result {
+	rng := rand.New(rand.NewSource(opts.Seed))
+	if len(seeds) == 0 {
+		seeds = []string{""}
+	}
+	deadline := time.Time{}
+	if opts.Duration > 0 {
+		deadline = time.Now().Add(opts.Duration)
+	}
+
+	result := &Result{}
+	seen := make(map[string]bool)
+	corpus := append([]string(nil), seeds...)
+
+	for i := 0; opts.Iterations == 0 || i < opts.Iterations; i++ {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			break
+		}
+		if opts.Iterations == 0 && deadline.IsZero() {
+			break // Nothing bounds the run
+		}
+
+		var input string
+		if i < len(seeds) {
+			input = seeds[i]
+		} else {
+			input = Mutate(rng, corpus[rng.Intn(len(corpus))], corpus)
+		}
+		result.Iterations++
+
+		v := Check(eng, input)
+		if v == nil {
+			// Keep some passing inputs so mutations compound
+			if len(corpus) < 1000 && rng.Intn(8) == 0 {
+				corpus = append(corpus, input)
+			}
+			continue
+		}
+
+		if seen[v.kind()] {
+			continue
+		}
+		seen[v.kind()] = true
+
+		// Shrink while the same kind of violation happens, wherever in the
+		// input
+		minimized := Minimize(input, func(s string) bool {
+			w := Check(eng, s)
+			return w != nil && w.kind() == v.kind()
+		})
+		result.Crashes = append(result.Crashes, Crash{Input: minimized, Violation: Check(eng, minimized)})
+	}
+	return result
+}
+
+// alphabet - Characters grammars commonly give a meaning to
+const alphabet = "\"'`/\\*#()[]{}<>$@%&|!?=+-_.,:; \t\n0123456789abcxyzABCXYZé中\U0001F600"
+
+// Mutate returns a random edit of input; other inputs of the corpus may be
+// spliced in
+func Mutate(rng *rand.Rand, input string, corpus []string) string {
+	b := []byte(input)
+	pos := func() int { return rng.Intn(len(b) + 1) }
+
+	switch op := rng.Intn(7); {
+	case op == 0 || len(b) == 0:
+		// Insert characters
+		runes := []rune(alphabet)
+		var ins []byte
+		for n := 1 + rng.Intn(4); n > 0; n-- {
+			ins = append(ins, string(runes[rng.Intn(len(runes))])...)
+		}
+		p := pos()
+		b = append(b[:p], append(ins, b[p:]...)...)
+	case op == 1:
+		// Delete a range
+		p := rng.Intn(len(b))
+		q := p + 1 + rng.Intn(min(len(b)-p, 16))
+		b = append(b[:p], b[q:]...)
+	case op == 2:
+		// Duplicate a range
+		p := rng.Intn(len(b))
+		q := p + 1 + rng.Intn(min(len(b)-p, 32))
+		chunk := append([]byte(nil), b[p:q]...)
+		at := pos()
+		b = append(b[:at], append(chunk, b[at:]...)...)
+	case op == 3:
+		// Repeat a range many times, for deep nesting and slow patterns
+		p := rng.Intn(len(b))
+		q := p + 1 + rng.Intn(min(len(b)-p, 8))
+		chunk := strings.Repeat(string(b[p:q]), 2+rng.Intn(64))
+		b = append(b[:q], append([]byte(chunk), b[q:]...)...)
+	case op == 4:
+		// Replace a byte, possibly breaking UTF-8
+		b[rng.Intn(len(b))] = byte(rng.Intn(256))
+	case op == 5:
+		// Splice with another input
+		other := corpus[rng.Intn(len(corpus))]
+		p := pos()
+		q := rng.Intn(len(other) + 1)
+		b = append(b[:p:p], other[q:]...)
+	default:
+		// Swap two lines
+		lines := strings.Split(string(b), "\n")
+		i, j := rng.Intn(len(lines)), rng.Intn(len(lines))
+		lines[i], lines[j] = lines[j], lines[i]
+		b = []byte(strings.Join(lines, "\n"))
+	}
+
+	// Keep inputs small enough to minimize quickly
+	if len(b) > 4096 {
+		b = b[:4096]
+	}
+	return string(b)
+}
+
+// Minimize shrinks input while fails keeps returning true: first whole
+// lines, then byte ranges of decreasing size
+func Minimize(input string, fails func(string) bool) string {
+	lines := strings.Split(input, "\n")
+	for i := 0; i < len(lines) && len(lines) > 1; {
+		candidate := append(append([]string(nil), lines[:i]...), lines[i+1:]...)
+		if fails(strings.Join(candidate, "\n")) {
+			lines = candidate
+			continue
+		}
+		i++
+	}
+	s := strings.Join(lines, "\n")
+
+	for size := len(s) / 2; size > 0; size /= 2 {
+		for start := 0; start+size <= len(s); {
+			candidate := s[:start] + s[start+size:]
+			if fails(candidate) {
+				s = candidate
+				continue
+			}
+			start += size
+		}
+	}
+	return s
+}
@@ -0,0 +1,98 @@
+package fuzz
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ferchd/tm2hsl/internal/testgrammar"
+	"github.com/ferchd/tm2hsl/pkg/engine"
+)
+
+var testSeeds = []string{
+	"if x else y",
+	"say(\"a \\\" b\") # TODO: later",
+	"<<EOF\nbody\nEOF\nafter",
+	"((f(x)) \"unterminated\n",
+	"\xff\xfe é 中 \U0001F600",
+}
+
+func newTestEngine(t testing.TB) *engine.Engine {
+	t.Helper()
+	e, err := engine.New(testgrammar.Compile(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return e
+}
+
+func FuzzTokenize(f *testing.F) {
+	for _, seed := range testSeeds {
+		f.Add(seed)
+	}
+	eng := newTestEngine(f)
+	eng.SetStepLimit(20000)
+	f.Fuzz(func(t *testing.T, input string) {
+		// (a|aa)+$ is slow on purpose, TestCheck covers the step limit
+		if v := Check(eng, input); v != nil && v.Invariant != InvariantStepLimit {
+			t.Fatal(v)
+		}
+	})
+}
+
+func TestCheck(t *testing.T) {
+	eng := newTestEngine(t)
+	if v := Check(eng, strings.Join(testSeeds, "\n")); v != nil {
+		t.Fatalf("Check(seeds) = %v", v)
+	}
+
+	eng.SetStepLimit(20000)
+	v := Check(eng, "ok\n"+strings.Repeat("a", 40)+"b")
+	if v == nil || v.Invariant != InvariantStepLimit || v.Line != 2 {
+		t.Fatalf("Check(slow input) = %v, want a step limit violation on line 2", v)
+	}
+}
+
+func TestRun(t *testing.T) {
+	eng := newTestEngine(t)
+	eng.SetStepLimit(20000)
+
+	result := Run(eng, testSeeds, Options{Iterations: 2000, Seed: 1})
+	if result.Iterations != 2000 {
+		t.Errorf("Iterations = %d, want 2000", result.Iterations)
+	}
+	slow := false
+	for _, c := range result.Crashes {
+		if c.Violation.Invariant != InvariantStepLimit {
+			t.Errorf("crash %q: %v, want only step limit violations", c.Input, c.Violation)
+		}
+		if w := Check(eng, c.Input); w == nil || w.Message != c.Violation.Message {
+			t.Errorf("minimized input %q: %v, want %v", c.Input, w, c.Violation)
+		}
+		if strings.Contains(c.Violation.Message, "(a|aa)+$") && len(c.Input) <= 40 {
+			slow = true
+		}
+	}
+	if !slow {
+		t.Errorf("Run() found %d crashes, want a minimized one for (a|aa)+$", len(result.Crashes))
+	}
+}
+
+func TestMinimize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		fails func(string) bool
+		want  string
+	}{
+		{"substring", "abcXYZdef", func(s string) bool { return strings.Contains(s, "XYZ") }, "XYZ"},
+		{"lines", "a\nb\nbad\nc", func(s string) bool { return strings.Contains(s, "bad") }, "bad"},
+		{"two parts", "x(yy)z", func(s string) bool { return strings.Contains(s, "(") && strings.Contains(s, ")") }, "()"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Minimize(tt.input, tt.fails); got != tt.want {
+				t.Errorf("Minimize() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
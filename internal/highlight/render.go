@@ -0,0 +1,217 @@
+package highlight
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/pkg/engine"
+)
+
+// Formats accepted by Render
+const (
+	FormatANSI = "ansi"
+	FormatHTML = "html"
+	FormatJSON = "json"
+)
+
+// Render - Writes tokenized lines in the given format. title is used by
+// the HTML document.
+func Render(w io.Writer, format string, lines []engine.Line, theme *Theme, title string) error {
+	switch format {
+	case FormatANSI:
+		return WriteANSI(w, lines, theme)
+	case FormatHTML:
+		return WriteHTML(w, lines, theme, title)
+	case FormatJSON:
+		return WriteJSON(w, lines)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// span - Run of text with one style; adjacent tokens with equal scopes
+// are merged
+type span struct {
+	text   string
+	style  Style
+	scopes []string
+}
+
+func spans(line engine.Line, theme *Theme) []span {
+	var result []span
+	pos := 0
+	emit := func(text string, scopes []string) {
+		style := theme.Resolve(scopes)
+		if n := len(result); n > 0 && strings.Join(result[n-1].scopes, " ") == strings.Join(scopes, " ") {
+			result[n-1].text += text
+			return
+		}
+		result = append(result, span{text: text, style: style, scopes: scopes})
+	}
+	for _, tok := range line.Tokens {
+		if tok.Start > pos {
+			emit(line.Text[pos:tok.Start], nil)
+		}
+		emit(line.Text[tok.Start:tok.End], tok.Scopes)
+		pos = tok.End
+	}
+	if pos < len(line.Text) {
+		emit(line.Text[pos:], nil)
+	}
+	return result
+}
+
+// WriteANSI - Terminal output with 24-bit color escape sequences
+func WriteANSI(w io.Writer, lines []engine.Line, theme *Theme) error {
+	var b strings.Builder
+	for _, line := range lines {
+		for _, s := range spans(line, theme) {
+			codes := ansiCodes(s.style, theme)
+			if codes == "" {
+				b.WriteString(s.text)
+				continue
+			}
+			fmt.Fprintf(&b, "\x1b[%sm%s\x1b[0m", codes, s.text)
+		}
+		b.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func ansiCodes(style Style, theme *Theme) string {
+	var codes []string
+	if style.Bold {
+		codes = append(codes, "1")
+	}
+	if style.Italic {
+		codes = append(codes, "3")
+	}
+	if style.Underline {
+		codes = append(codes, "4")
+	}
+	if r, g, b, ok := parseColor(style.Foreground); ok {
+		codes = append(codes, fmt.Sprintf("38;2;%d;%d;%d", r, g, b))
+	}
+	if style.Background != theme.Background {
+		if r, g, b, ok := parseColor(style.Background); ok {
+			codes = append(codes, fmt.Sprintf("48;2;%d;%d;%d", r, g, b))
+		}
+	}
+	return strings.Join(codes, ";")
+}
+
+// parseColor - #rgb, #rrggbb or #rrggbbaa (alpha ignored); every digit
+// must be hexadecimal
+func parseColor(color string) (r, g, b uint8, ok bool) {
+	if !strings.HasPrefix(color, "#") {
+		return 0, 0, 0, false
+	}
+	hex := color[1:]
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 && len(hex) != 8 {
+		return 0, 0, 0, false
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	if len(hex) == 8 {
+		v >>= 8
+	}
+	return uint8(v >> 16), uint8(v >> 8), uint8(v), true
+}
+
+// WriteHTML - Standalone HTML document with inline styles; each span
+// carries its scope stack in the title attribute
+func WriteHTML(w io.Writer, lines []engine.Line, theme *Theme, title string) error {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&b, "<title>%s</title>\n", html.EscapeString(title))
+	fmt.Fprintf(&b, "<style>\nbody { margin: 0; background: %s; color: %s; }\n",
+		cssColor(theme.Background, "#ffffff"), cssColor(theme.Foreground, "#000000"))
+	b.WriteString("pre { margin: 0; padding: 1em; font-family: ui-monospace, monospace; }\n</style>\n")
+	b.WriteString("</head>\n<body>\n<pre>")
+
+	for _, line := range lines {
+		for _, s := range spans(line, theme) {
+			text := html.EscapeString(s.text)
+			css := cssStyle(s.style)
+			if css == "" && len(s.scopes) == 0 {
+				b.WriteString(text)
+				continue
+			}
+			b.WriteString("<span")
+			if css != "" {
+				fmt.Fprintf(&b, " style=\"%s\"", html.EscapeString(css))
+			}
+			fmt.Fprintf(&b, " title=\"%s\">%s</span>", html.EscapeString(strings.Join(s.scopes, " ")), text)
+		}
+		b.WriteByte('\n')
+	}
+
+	b.WriteString("</pre>\n</body>\n</html>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func cssColor(color, fallback string) string {
+	if _, _, _, ok := parseColor(color); ok {
+		return color
+	}
+	return fallback
+}
+
+func cssStyle(style Style) string {
+	var rules []string
+	if _, _, _, ok := parseColor(style.Foreground); ok {
+		rules = append(rules, "color: "+style.Foreground)
+	}
+	if _, _, _, ok := parseColor(style.Background); ok {
+		rules = append(rules, "background: "+style.Background)
+	}
+	if style.Bold {
+		rules = append(rules, "font-weight: bold")
+	}
+	if style.Italic {
+		rules = append(rules, "font-style: italic")
+	}
+	if style.Underline {
+		rules = append(rules, "text-decoration: underline")
+	}
+	return strings.Join(rules, "; ")
+}
+
+// JSONToken - One token of the JSON stream; lines are 1-based, columns are
+// byte offsets in the line
+type JSONToken struct {
+	Line   int      `json:"line"`
+	Start  int      `json:"start"`
+	End    int      `json:"end"`
+	Text   string   `json:"text"`
+	Scopes []string `json:"scopes"`
+}
+
+// WriteJSON - Token stream with the scope stack of every range
+func WriteJSON(w io.Writer, lines []engine.Line) error {
+	tokens := []JSONToken{}
+	for i, line := range lines {
+		for _, tok := range line.Tokens {
+			tokens = append(tokens, JSONToken{
+				Line:   i + 1,
+				Start:  tok.Start,
+				End:    tok.End,
+				Text:   line.Text[tok.Start:tok.End],
+				Scopes: tok.Scopes,
+			})
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(tokens)
+}
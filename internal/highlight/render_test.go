@@ -0,0 +1,123 @@
+package highlight
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ferchd/tm2hsl/pkg/engine"
+)
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		color   string
+		r, g, b uint8
+		ok      bool
+	}{
+		{"#fa0", 0xff, 0xaa, 0x00, true},
+		{"#12AB9f", 0x12, 0xab, 0x9f, true},
+		{"#12ab9f80", 0x12, 0xab, 0x9f, true},
+		{"#12ab9fzz", 0, 0, 0, false},
+		{"#000000\">", 0, 0, 0, false},
+		{"fff", 0, 0, 0, false},
+		{"123456", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		r, g, b, ok := parseColor(tt.color)
+		if r != tt.r || g != tt.g || b != tt.b || ok != tt.ok {
+			t.Errorf("parseColor(%q) = %d, %d, %d, %v", tt.color, r, g, b, ok)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	theme, err := ParseTheme([]byte(`{
+  "colors": {"editor.foreground": "#eeeeee", "editor.background": "#111111"},
+  "tokenColors": [
+    {"scope": "keyword", "settings": {"foreground": "#c586c0", "fontStyle": "bold"}},
+    {"scope": "string", "settings": {"foreground": "#000000\">", "background": "#22334455"}},
+    {"scope": "comment", "settings": {"foreground": "fff", "fontStyle": "italic"}}
+  ]
+}`))
+	if err != nil {
+		t.Fatalf("ParseTheme: %v", err)
+	}
+	lines := []engine.Line{
+		{Text: `if "<a>"`, Tokens: []engine.Token{
+			{Start: 0, End: 2, Scopes: []string{"source.t", "keyword.control.t"}},
+			{Start: 3, End: 8, Scopes: []string{"source.t", "string.quoted.t"}},
+		}},
+		{Text: "# x", Tokens: []engine.Token{
+			{Start: 0, End: 3, Scopes: []string{"source.t", "comment.line.t"}},
+		}},
+	}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{FormatANSI, "\x1b[1;38;2;197;134;192mif\x1b[0m \x1b[48;2;34;51;68m\"<a>\"\x1b[0m\n" +
+			"\x1b[3m# x\x1b[0m\n"},
+		{FormatHTML, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>a &amp; b</title>
+<style>
+body { margin: 0; background: #111111; color: #eeeeee; }
+pre { margin: 0; padding: 1em; font-family: ui-monospace, monospace; }
+</style>
+</head>
+<body>
+<pre><span style="color: #c586c0; font-weight: bold" title="source.t keyword.control.t">if</span> <span style="background: #22334455" title="source.t string.quoted.t">&#34;&lt;a&gt;&#34;</span>
+<span style="font-style: italic" title="source.t comment.line.t"># x</span>
+</pre>
+</body>
+</html>
+`},
+		{FormatJSON, `[
+  {
+    "line": 1,
+    "start": 0,
+    "end": 2,
+    "text": "if",
+    "scopes": [
+      "source.t",
+      "keyword.control.t"
+    ]
+  },
+  {
+    "line": 1,
+    "start": 3,
+    "end": 8,
+    "text": "\"\u003ca\u003e\"",
+    "scopes": [
+      "source.t",
+      "string.quoted.t"
+    ]
+  },
+  {
+    "line": 2,
+    "start": 0,
+    "end": 3,
+    "text": "# x",
+    "scopes": [
+      "source.t",
+      "comment.line.t"
+    ]
+  }
+]
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var b strings.Builder
+			if err := Render(&b, tt.format, lines, theme, "a & b"); err != nil {
+				t.Fatalf("Render: %v", err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// Package highlight renders engine tokens with a color theme
+package highlight
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/pkg/selector"
+)
+
+// Style - Resolved presentation of a token
+type Style struct {
+	Foreground string // #rrggbb, "" for the theme default
+	Background string
+	Bold       bool
+	Italic     bool
+	Underline  bool
+}
+
+// Theme - Scope selectors mapped to styles, VS Code semantics: for each
+// property the most specific matching rule wins, later rules win ties
+type Theme struct {
+	Name       string
+	Foreground string
+	Background string
+	rules      []themeRule
+}
+
+type themeRule struct {
+	selector   *selector.Selector
+	foreground string
+	background string
+	fontStyle  *string // nil when the rule does not set it
+}
+
+// themeFile - VS Code color theme, or the JSON form of a .tmTheme
+// ("settings" instead of "tokenColors")
+type themeFile struct {
+	Name        string            `json:"name"`
+	Colors      map[string]string `json:"colors"`
+	TokenColors []themeEntry      `json:"tokenColors"`
+	Settings    []themeEntry      `json:"settings"`
+}
+
+type themeEntry struct {
+	Scope    json.RawMessage `json:"scope"`
+	Settings struct {
+		Foreground string  `json:"foreground"`
+		Background string  `json:"background"`
+		FontStyle  *string `json:"fontStyle"`
+	} `json:"settings"`
+}
+
+// LoadTheme - Reads a JSON theme file
+func LoadTheme(path string) (*Theme, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	theme, err := ParseTheme(data)
+	if err != nil {
+		return nil, fmt.Errorf("theme %s: %w", path, err)
+	}
+	return theme, nil
+}
+
+// ParseTheme - Parses a VS Code or TextMate JSON theme
+func ParseTheme(data []byte) (*Theme, error) {
+	var file themeFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid theme JSON: %w", err)
+	}
+
+	theme := &Theme{
+		Name:       file.Name,
+		Foreground: file.Colors["editor.foreground"],
+		Background: file.Colors["editor.background"],
+	}
+
+	for _, entry := range append(file.Settings, file.TokenColors...) {
+		scopes, err := entryScopes(entry.Scope)
+		if err != nil {
+			return nil, err
+		}
+		if scopes == "" {
+			// Entry without scope: global defaults
+			if entry.Settings.Foreground != "" {
+				theme.Foreground = entry.Settings.Foreground
+			}
+			if entry.Settings.Background != "" {
+				theme.Background = entry.Settings.Background
+			}
+			continue
+		}
+
+		sel, err := selector.Parse(scopes)
+		if err != nil {
+			return nil, err
+		}
+		theme.rules = append(theme.rules, themeRule{
+			selector:   sel,
+			foreground: entry.Settings.Foreground,
+			background: entry.Settings.Background,
+			fontStyle:  entry.Settings.FontStyle,
+		})
+	}
+
+	return theme, nil
+}
+
+// entryScopes - "scope" is a selector string or a list of selectors
+func entryScopes(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return strings.TrimSpace(single), nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return "", fmt.Errorf("invalid scope %s", raw)
+	}
+	return strings.Join(list, ", "), nil
+}
+
+// Resolve - Style of a token with the given scope stack
+func (t *Theme) Resolve(scopes []string) Style {
+	var style Style
+	var fg, bg, font selector.Rank
+	hasFg, hasBg, hasFont := false, false, false
+
+	for _, rule := range t.rules {
+		rank, ok := rule.selector.Rank(scopes)
+		if !ok {
+			continue
+		}
+		if rule.foreground != "" && (!hasFg || rank.Compare(fg) >= 0) {
+			style.Foreground, fg, hasFg = rule.foreground, rank, true
+		}
+		if rule.background != "" && (!hasBg || rank.Compare(bg) >= 0) {
+			style.Background, bg, hasBg = rule.background, rank, true
+		}
+		if rule.fontStyle != nil && (!hasFont || rank.Compare(font) >= 0) {
+			font, hasFont = rank, true
+			style.Bold = strings.Contains(*rule.fontStyle, "bold")
+			style.Italic = strings.Contains(*rule.fontStyle, "italic")
+			style.Underline = strings.Contains(*rule.fontStyle, "underline")
+		}
+	}
+	return style
+}
+
+// DefaultTheme - Dark theme used when no --theme is given
+func DefaultTheme() *Theme {
+	theme, err := ParseTheme([]byte(defaultTheme))
+	if err != nil {
+		panic(err)
+	}
+	return theme
+}
+
+const defaultTheme = `{
+  "name": "tm2hsl dark",
+  "colors": {"editor.foreground": "#D4D4D4", "editor.background": "#1E1E1E"},
+  "tokenColors": [
+    {"scope": "comment", "settings": {"foreground": "#6A9955", "fontStyle": "italic"}},
+    {"scope": "string", "settings": {"foreground": "#CE9178"}},
+    {"scope": "constant.numeric", "settings": {"foreground": "#B5CEA8"}},
+    {"scope": "constant.language", "settings": {"foreground": "#569CD6"}},
+    {"scope": "constant.character, constant.other", "settings": {"foreground": "#D7BA7D"}},
+    {"scope": "keyword", "settings": {"foreground": "#C586C0"}},
+    {"scope": "keyword.operator", "settings": {"foreground": "#D4D4D4"}},
+    {"scope": "storage, storage.type", "settings": {"foreground": "#569CD6"}},
+    {"scope": "entity.name.function, support.function", "settings": {"foreground": "#DCDCAA"}},
+    {"scope": "entity.name.type, entity.name.class, support.type, support.class", "settings": {"foreground": "#4EC9B0"}},
+    {"scope": "entity.name.tag", "settings": {"foreground": "#569CD6"}},
+    {"scope": "entity.other.attribute-name", "settings": {"foreground": "#9CDCFE"}},
+    {"scope": "variable", "settings": {"foreground": "#9CDCFE"}},
+    {"scope": "punctuation.definition.comment", "settings": {"foreground": "#6A9955"}},
+    {"scope": "markup.heading", "settings": {"foreground": "#569CD6", "fontStyle": "bold"}},
+    {"scope": "markup.bold", "settings": {"fontStyle": "bold"}},
+    {"scope": "markup.italic", "settings": {"fontStyle": "italic"}},
+    {"scope": "markup.underline", "settings": {"fontStyle": "underline"}},
+    {"scope": "invalid", "settings": {"foreground": "#F44747"}}
+  ]
+}`
@@ -0,0 +1,37 @@
+package highlight
+
+import "testing"
+
+func TestTheme_Resolve(t *testing.T) {
+	theme, err := ParseTheme([]byte(`{
+  "tokenColors": [
+    {"scope": "string", "settings": {"foreground": "#111111"}},
+    {"scope": ["string.quoted", "constant"], "settings": {"foreground": "#222222", "fontStyle": "bold"}},
+    {"scope": "source string", "settings": {"fontStyle": "italic"}},
+    {"scope": "comment", "settings": {"foreground": "#333333"}},
+    {"scope": "comment", "settings": {"foreground": "#444444"}}
+  ]
+}`))
+	if err != nil {
+		t.Fatalf("ParseTheme: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		scopes []string
+		want   Style
+	}{
+		{"deeper atom wins", []string{"source.x", "string.quoted.double"}, Style{Foreground: "#222222", Bold: true}},
+		{"longer path wins font style", []string{"source.x", "string.unquoted"}, Style{Foreground: "#111111", Italic: true}},
+		{"later rule wins ties", []string{"comment.line"}, Style{Foreground: "#444444"}},
+		{"no match", []string{"source.x"}, Style{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := theme.Resolve(tt.scopes); got != tt.want {
+				t.Errorf("Resolve(%v) = %+v, want %+v", tt.scopes, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package ir
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/pkg/regex"
+)
+
+// Dump - Readable listing of the program, in the layout of `tm2hsl disasm`
+// but with IR indices, for debugging optimization passes
+func (p *Program) Dump(w io.Writer) error {
+	var b strings.Builder
+	s := p.Statistics()
+	fmt.Fprintf(&b, "; %s (%s)\n", p.Name, p.Scope)
+	fmt.Fprintf(&b, "; %d strings, %d regexes, %d scopes, %d states, %d rules, %d injections\n",
+		s.StringCount, s.RegexCount, s.ScopeCount, s.StateCount, s.RuleCount, s.InjectionCount)
+
+	scanners := make(map[uint32]ScannerEntry)
+	for _, sc := range p.Scanners {
+		scanners[sc.StateID] = sc
+	}
+
+	prefilters := make(map[uint32]PrefilterEntry)
+	for _, pf := range p.Prefilters {
+		prefilters[pf.StateID] = pf
+	}
+
+	for id, state := range p.StateTable {
+		fmt.Fprintf(&b, "\nstate %d [%s]", id, state.Flags)
+		if state.ScopeID != NoScope {
+			fmt.Fprintf(&b, " content=%s", p.ScopeName(state.ScopeID))
+		}
+		b.WriteString("\n")
+		if sc, ok := scanners[uint32(id)]; ok {
+			fmt.Fprintf(&b, "  scanner rules=%s, %d DFA states\n", scannerRules(state.RuleOffset, sc.Rules), sc.Scanner.States())
+		}
+		if pf, ok := prefilters[uint32(id)]; ok {
+			fmt.Fprintf(&b, "  prefilter %s\n", PrefilterString(pf.FirstBytes, pf.Literals))
+		}
+
+		for i, rule := range p.Rules(uint32(id)) {
+			fmt.Fprintf(&b, "  %4d  %-5s /%s/ -> %s", state.RuleOffset+uint32(i), rule.Action,
+				p.RegexTable[rule.RegexID].Pattern, nextStateName(rule.NextState))
+			if kw := p.RegexTable[rule.RegexID].Keywords; kw != nil {
+				fmt.Fprintf(&b, "  keywords=%d", len(kw.Words))
+			}
+			if rule.ScopeID != NoScope {
+				fmt.Fprintf(&b, "  scope=%s", p.ScopeName(rule.ScopeID))
+			}
+			if rule.Priority != 0 {
+				fmt.Fprintf(&b, "  priority=%d", rule.Priority)
+			}
+			if rule.Source != "" {
+				fmt.Fprintf(&b, "  ; %s", rule.Source)
+			}
+			b.WriteString("\n")
+			for _, c := range rule.CaptureMap {
+				fmt.Fprintf(&b, "          capture %d -> %s\n", c.Group, p.ScopeName(c.ScopeID))
+			}
+		}
+	}
+
+	if len(p.InjectionTable) > 0 {
+		b.WriteString("\ninjections\n")
+		for _, inj := range p.InjectionTable {
+			fmt.Fprintf(&b, "  %2d %s -> state %d\n", inj.Priority, inj.Selector, inj.StateID)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f StateFlags) String() string {
+	var names []string
+	for i, name := range []string{"final", "push", "pop", "injection"} {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func (a RuleAction) String() string {
+	switch a {
+	case RuleActionMatch:
+		return "match"
+	case RuleActionPushScope:
+		return "push"
+	case RuleActionPopScope:
+		return "pop"
+	case RuleActionTransition:
+		return "transition"
+	}
+	return fmt.Sprintf("action(%d)", uint8(a))
+}
+
+// PrefilterString - "first=[...] literals=a|b" of a prefilter, for listings
+func PrefilterString(first *regex.ByteSet, literals []string) string {
+	var parts []string
+	if first != nil {
+		parts = append(parts, "first="+first.String())
+	}
+	if literals != nil {
+		quoted := make([]string, len(literals))
+		for i, l := range literals {
+			quoted[i] = strconv.Quote(l)
+		}
+		parts = append(parts, "literals="+strings.Join(quoted, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+// scannerRules - Rule table indices covered by a scanner, as "3,4,7"
+func scannerRules(offset uint32, rules []uint16) string {
+	names := make([]string, len(rules))
+	for i, r := range rules {
+		names[i] = fmt.Sprint(offset + uint32(r))
+	}
+	return strings.Join(names, ",")
+}
+
+func nextStateName(next int32) string {
+	switch {
+	case next == -1:
+		return "pop"
+	case next == -2:
+		return "stay"
+	case next < 0:
+		return fmt.Sprintf("invalid(%d)", next)
+	}
+	return fmt.Sprintf("state %d", next)
+}
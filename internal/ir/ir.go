@@ -2,17 +2,60 @@ package ir
 
 import (
 	"regexp"
+
+	"github.com/ferchd/tm2hsl/pkg/regex"
 )
 
 type Program struct {
-	Version     uint16
-	Name        string
-	Scope       string
-	RegexTable  []RegexEntry
-	StateTable  []StateEntry
-	RuleTable   []RuleEntry
-	ScopeTable  []ScopeEntry
-	StringTable []string
+	Version        uint16
+	Name           string
+	Scope          string
+	RegexTable     []RegexEntry
+	StateTable     []StateEntry
+	RuleTable      []RuleEntry
+	ScopeTable     []ScopeEntry
+	StringTable    []string
+	InjectionTable []InjectionEntry
+
+	// Combined DFAs matching several rules of a state at once
+	Scanners []ScannerEntry
+
+	// Positions where no rule of a state can start a match
+	Prefilters []PrefilterEntry
+
+	// Selector of the grammars this grammar injects into (injectionSelector)
+	InjectionSelector string
+
+	// Optimized is set once optimization passes ran over the program
+	Optimized bool
+
+	// Índices de internado de AddRegex, AddScope y AddString
+	regexIndex  tableIndex
+	scopeIndex  tableIndex
+	stringIndex tableIndex
+}
+
+// tableIndex - ID of the first entry with each key of a table, for
+// interning in constant time. Tables only grow: entries appended without
+// going through Add* are indexed on the next lookup.
+type tableIndex struct {
+	ids     map[string]uint32
+	indexed int // Table entries already in ids
+}
+
+// lookup - ID of key in a table of n entries whose keys keyAt returns
+func (x *tableIndex) lookup(key string, n int, keyAt func(int) string) (uint32, bool) {
+	if x.ids == nil || x.indexed > n {
+		x.ids, x.indexed = make(map[string]uint32, n), 0
+	}
+	for ; x.indexed < n; x.indexed++ {
+		k := keyAt(x.indexed)
+		if _, ok := x.ids[k]; !ok {
+			x.ids[k] = uint32(x.indexed)
+		}
+	}
+	id, ok := x.ids[key]
+	return id, ok
 }
 
 type RegexEntry struct {
@@ -20,6 +63,10 @@ type RegexEntry struct {
 	Pattern  string
 	Compiled *regexp.Regexp
 	Bytecode []byte // Para regex compiladas a bytecode
+
+	// Keyword list the pattern is equivalent to, matched with a trie; nil
+	// for any other pattern
+	Keywords *KeywordPredicate
 }
 
 type StateEntry struct {
@@ -27,6 +74,7 @@ type StateEntry struct {
 	RuleOffset uint32
 	RuleCount  uint16
 	Flags      StateFlags
+	ScopeID    uint16 // contentName scope applied inside the state
 }
 
 type StateFlags uint8
@@ -35,8 +83,12 @@ const (
 	StateFinal StateFlags = 1 << iota
 	StatePush
 	StatePop
+	StateInjection // Holds injected rules, entered through the injection table
 )
 
+// NoScope - ScopeID of rules and states without a scope
+const NoScope uint16 = 0xFFFF
+
 type RuleEntry struct {
 	RegexID    uint32
 	Action     RuleAction
@@ -44,6 +96,7 @@ type RuleEntry struct {
 	ScopeID    uint16
 	Priority   uint8
 	CaptureMap []CaptureMapping
+	Source     string // Path of the rule in the grammar, for diagnostics
 }
 
 type CaptureMapping struct {
@@ -56,6 +109,32 @@ type ScopeEntry struct {
 	Name string
 }
 
+// InjectionEntry - Rules injected wherever the scope stack matches Selector
+type InjectionEntry struct {
+	Selector string // Scope selector without priority prefix
+	Priority int8   // -1: L: (wins ties), 0: default, 1: R:
+	StateID  uint32 // State holding the injected rules
+}
+
+// ScannerEntry - DFA matching the covered rules of a state together in one
+// pass over the line; the other rules of the state are still matched one by
+// one
+type ScannerEntry struct {
+	StateID uint32
+	Rules   []uint16 // Positions of the covered rules in the state, ascending
+	Regexes []uint32 // Regex of each covered rule, to detect stale entries
+	Scanner *regex.Scanner
+}
+
+// PrefilterEntry - What every match of every rule of a state starts with,
+// so positions where none can start are skipped without trying the rules
+type PrefilterEntry struct {
+	StateID    uint32
+	Regexes    []uint32       // Regex of every rule of the state, to detect stale entries
+	FirstBytes *regex.ByteSet // First byte of every match; nil if unknown
+	Literals   []string       // Every match starts with one of these; nil if unknown
+}
+
 type RuleAction uint8
 
 const (
@@ -66,7 +145,7 @@ const (
 )
 
 func NewProgram(name, scope string) *Program {
-	return &Program{
+	program := &Program{
 		Version:     1,
 		Name:        name,
 		Scope:       scope,
@@ -75,20 +154,29 @@ func NewProgram(name, scope string) *Program {
 		RuleTable:   []RuleEntry{},
 		ScopeTable:  []ScopeEntry{},
 		StringTable: []string{},
+
+		InjectionTable: []InjectionEntry{},
 	}
+
+	// Metadatos referenciados desde la cabecera
+	program.AddString(name)
+	program.AddString(scope)
+
+	return program
 }
 
 func (p *Program) AddRegex(pattern string) uint32 {
 	// Buscar regex duplicada
-	for i, entry := range p.RegexTable {
-		if entry.Pattern == pattern {
-			return uint32(i)
-		}
+	if id, ok := p.regexIndex.lookup(pattern, len(p.RegexTable), func(i int) string { return p.RegexTable[i].Pattern }); ok {
+		return id
 	}
 
 	id := uint32(len(p.RegexTable))
 	compiled, _ := regexp.Compile(pattern)
 
+	// El patrón original se conserva para motores y depuración
+	p.AddString(pattern)
+
 	p.RegexTable = append(p.RegexTable, RegexEntry{
 		ID:       id,
 		Pattern:  pattern,
@@ -104,6 +192,12 @@ func (p *Program) AddState(rules []RuleEntry, flags StateFlags) uint32 {
 	ruleOffset := uint32(len(p.RuleTable))
 	p.RuleTable = append(p.RuleTable, rules...)
 
+	for _, rule := range rules {
+		if rule.Source != "" {
+			p.AddString(rule.Source)
+		}
+	}
+
 	p.StateTable = append(p.StateTable, StateEntry{
 		ID:         stateID,
 		RuleOffset: ruleOffset,
@@ -116,10 +210,8 @@ func (p *Program) AddState(rules []RuleEntry, flags StateFlags) uint32 {
 
 func (p *Program) AddScope(name string) uint16 {
 	// Buscar scope duplicado
-	for i, scope := range p.ScopeTable {
-		if scope.Name == name {
-			return uint16(i)
-		}
+	if id, ok := p.scopeIndex.lookup(name, len(p.ScopeTable), func(i int) string { return p.ScopeTable[i].Name }); ok {
+		return uint16(id)
 	}
 
 	id := uint16(len(p.ScopeTable))
@@ -136,10 +228,8 @@ func (p *Program) AddScope(name string) uint16 {
 
 func (p *Program) AddString(str string) uint32 {
 	// Buscar string duplicada
-	for i, s := range p.StringTable {
-		if s == str {
-			return uint32(i)
-		}
+	if id, ok := p.StringID(str); ok {
+		return id
 	}
 
 	id := uint32(len(p.StringTable))
@@ -147,13 +237,69 @@ func (p *Program) AddString(str string) uint32 {
 	return id
 }
 
+// StringID - Index of str in StringTable, without adding it
+func (p *Program) StringID(str string) (uint32, bool) {
+	return p.stringIndex.lookup(str, len(p.StringTable), func(i int) string { return p.StringTable[i] })
+}
+
+func (p *Program) AddInjection(selector string, priority int8, stateID uint32) {
+	p.AddString(selector)
+	p.InjectionTable = append(p.InjectionTable, InjectionEntry{
+		Selector: selector,
+		Priority: priority,
+		StateID:  stateID,
+	})
+}
+
+// Rules - Rule slice of a state, in match order
+func (p *Program) Rules(stateID uint32) []RuleEntry {
+	state := p.StateTable[stateID]
+	return p.RuleTable[state.RuleOffset : state.RuleOffset+uint32(state.RuleCount)]
+}
+
+// ScopeName - Name of a scope ID, "" for NoScope
+func (p *Program) ScopeName(id uint16) string {
+	if int(id) >= len(p.ScopeTable) {
+		return ""
+	}
+	return p.ScopeTable[id].Name
+}
+
+// Clone - Deep copy, so passes can be checked against the original
+func (p *Program) Clone() *Program {
+	c := *p
+	c.RegexTable = append([]RegexEntry(nil), p.RegexTable...)
+	c.StateTable = append([]StateEntry(nil), p.StateTable...)
+	c.RuleTable = append([]RuleEntry(nil), p.RuleTable...)
+	for i := range c.RuleTable {
+		c.RuleTable[i].CaptureMap = append([]CaptureMapping(nil), c.RuleTable[i].CaptureMap...)
+	}
+	c.ScopeTable = append([]ScopeEntry(nil), p.ScopeTable...)
+	c.StringTable = append([]string(nil), p.StringTable...)
+	c.InjectionTable = append([]InjectionEntry(nil), p.InjectionTable...)
+	c.Scanners = append([]ScannerEntry(nil), p.Scanners...) // Scanners are immutable
+	c.Prefilters = append([]PrefilterEntry(nil), p.Prefilters...)
+	c.regexIndex, c.scopeIndex, c.stringIndex = tableIndex{}, tableIndex{}, tableIndex{}
+	return &c
+}
+
 func (p *Program) Statistics() ProgramStats {
+	keywords := 0
+	for _, re := range p.RegexTable {
+		if re.Keywords != nil {
+			keywords++
+		}
+	}
 	return ProgramStats{
 		RegexCount:  len(p.RegexTable),
 		StateCount:  len(p.StateTable),
 		RuleCount:   len(p.RuleTable),
 		ScopeCount:  len(p.ScopeTable),
 		StringCount: len(p.StringTable),
+
+		InjectionCount: len(p.InjectionTable),
+		ScannerCount:   len(p.Scanners),
+		KeywordCount:   keywords,
 	}
 }
 
@@ -163,4 +309,8 @@ type ProgramStats struct {
 	RuleCount   int
 	ScopeCount  int
 	StringCount int
+
+	InjectionCount int
+	ScannerCount   int
+	KeywordCount   int // Regexes matched as keyword lists
 }
@@ -0,0 +1,41 @@
+package ir
+
+import "testing"
+
+func TestProgram_Interning(t *testing.T) {
+	p := NewProgram("T", "source.t")
+
+	// IDs follow insertion order and duplicates get the first one
+	a, b := p.AddRegex("a"), p.AddRegex("b")
+	if a != 0 || b != 1 || p.AddRegex("a") != a {
+		t.Errorf("regex IDs = %d, %d, %d", a, b, p.AddRegex("a"))
+	}
+	s1, s2 := p.AddScope("x"), p.AddScope("y")
+	if s1 != 0 || s2 != 1 || p.AddScope("y") != s2 {
+		t.Errorf("scope IDs = %d, %d", s1, s2)
+	}
+	want := []string{"T", "source.t", "a", "b", "x", "y"}
+	if len(p.StringTable) != len(want) {
+		t.Fatalf("strings = %q, want %q", p.StringTable, want)
+	}
+	for i, s := range want {
+		if id, ok := p.StringID(s); !ok || id != uint32(i) || p.StringTable[i] != s {
+			t.Errorf("StringID(%q) = %d, %v, want %d", s, id, ok, i)
+		}
+	}
+
+	// Entries appended directly are found too
+	p.StringTable = append(p.StringTable, "z")
+	if id := p.AddString("z"); id != uint32(len(want)) || len(p.StringTable) != len(want)+1 {
+		t.Errorf("AddString(z) = %d with %d strings", id, len(p.StringTable))
+	}
+
+	// A clone interns on its own
+	c := p.Clone()
+	if id := c.AddRegex("c"); id != 2 {
+		t.Errorf("clone AddRegex(c) = %d", id)
+	}
+	if id := p.AddRegex("d"); id != 2 || p.RegexTable[2].Pattern != "d" {
+		t.Errorf("AddRegex(d) = %d after cloning", id)
+	}
+}
@@ -3,6 +3,9 @@ package ir
 import (
 	"fmt"
 	"regexp"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/pkg/regex"
 )
 
 // Predicate - Interface for transition conditions
@@ -25,6 +28,7 @@ const (
 	PredicateEOF                             // End of file
 	PredicateLookahead                       // Positive/negative lookahead
 	PredicateLookbehind                      // Positive/negative lookbehind
+	PredicateKeywords                        // Keyword list \b(if|else)\b
 )
 
 // CharPredicate - Single character predicate
@@ -34,6 +38,12 @@ type CharPredicate struct {
 
 func (p *CharPredicate) Type() PredicateType { return PredicateChar }
 func (p *CharPredicate) String() string      { return fmt.Sprintf("char('%c')", p.Char) }
+func (p *CharPredicate) Equal(other Predicate) bool {
+	if o, ok := other.(*CharPredicate); ok {
+		return p.Char == o.Char
+	}
+	return false
+}
 
 // CharSetPredicate - Character set
 type CharSetPredicate struct {
@@ -46,6 +56,76 @@ type CharRange struct {
 	Start, End rune
 }
 
+func (p *CharSetPredicate) Type() PredicateType { return PredicateCharSet }
+func (p *CharSetPredicate) String() string {
+	var b strings.Builder
+	b.WriteString("set[")
+	if p.Negated {
+		b.WriteByte('^')
+	}
+	b.WriteString(p.Chars)
+	for _, r := range p.Ranges {
+		fmt.Fprintf(&b, "%c-%c", r.Start, r.End)
+	}
+	b.WriteString("]")
+	return b.String()
+}
+func (p *CharSetPredicate) Equal(other Predicate) bool {
+	o, ok := other.(*CharSetPredicate)
+	if !ok || p.Chars != o.Chars || p.Negated != o.Negated || len(p.Ranges) != len(o.Ranges) {
+		return false
+	}
+	for i := range p.Ranges {
+		if p.Ranges[i] != o.Ranges[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// StringPredicate - String literal
+type StringPredicate struct {
+	Value string
+}
+
+func (p *StringPredicate) Type() PredicateType { return PredicateString }
+func (p *StringPredicate) String() string      { return fmt.Sprintf("string(%q)", p.Value) }
+func (p *StringPredicate) Equal(other Predicate) bool {
+	if o, ok := other.(*StringPredicate); ok {
+		return p.Value == o.Value
+	}
+	return false
+}
+
+// KeywordPredicate - Whole word out of a keyword list, \b(if|else|while)\b,
+// matched with a trie instead of the regex
+type KeywordPredicate struct {
+	Words  []string // Sorted; folded with regex.FoldRune when Fold
+	Fold   bool     // Case-insensitive (?i)
+	Groups int      // Capturing groups, each spanning the whole word
+}
+
+func (p *KeywordPredicate) Type() PredicateType { return PredicateKeywords }
+func (p *KeywordPredicate) String() string {
+	prefix := ""
+	if p.Fold {
+		prefix = "(?i)"
+	}
+	return fmt.Sprintf("keywords(%s%s)", prefix, strings.Join(p.Words, "|"))
+}
+func (p *KeywordPredicate) Equal(other Predicate) bool {
+	o, ok := other.(*KeywordPredicate)
+	if !ok || p.Fold != o.Fold || p.Groups != o.Groups || len(p.Words) != len(o.Words) {
+		return false
+	}
+	for i := range p.Words {
+		if p.Words[i] != o.Words[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // RegexPredicate - Compiled regular expression
 type RegexPredicate struct {
 	Pattern  string
@@ -119,6 +199,8 @@ func (b *PredicateBuilder) simplifyRegex(pattern string) (Predicate, error) {
 		return b.buildCharClassPredicate(pattern)
 	case isLiteral(pattern):
 		return b.buildLiteralPredicate(pattern)
+	case isKeywordList(pattern):
+		return b.buildKeywordPredicate(pattern)
 	default:
 		// Keep as generic regex
 		return &RegexPredicate{
@@ -131,26 +213,90 @@ func (b *PredicateBuilder) simplifyRegex(pattern string) (Predicate, error) {
 
 // Helper functions
 func containsUnsupportedRegex(pattern string) bool {
-	// TODO: Implement unsupported regex detection
-	return false
+	_, err := regex.Parse(pattern)
+	return err != nil
 }
 
+// isCharClass - Pattern matching a single character of a class: [a-z],
+// \w, \d, or one case-insensitive letter
 func isCharClass(pattern string) bool {
-	// TODO: Implement character class detection
-	return false
+	t, err := regex.Parse(pattern)
+	if err != nil {
+		return false
+	}
+	_, ok := regex.SingleClass(t)
+	return ok
 }
 
 func (b *PredicateBuilder) buildCharClassPredicate(pattern string) (Predicate, error) {
-	// TODO: Implement character class predicate building
-	return &AnyPredicate{}, nil
+	t, err := regex.Parse(pattern)
+	if err != nil {
+		return nil, err
+	}
+	class, ok := regex.SingleClass(t)
+	if !ok {
+		return nil, fmt.Errorf("not a character class: %s", pattern)
+	}
+
+	// Negated classes come already complemented
+	set := &CharSetPredicate{}
+	var chars []rune
+	for i := 0; i < len(class.Ranges); i += 2 {
+		lo, hi := class.Ranges[i], class.Ranges[i+1]
+		if lo == hi {
+			chars = append(chars, lo)
+		} else {
+			set.Ranges = append(set.Ranges, CharRange{Start: lo, End: hi})
+		}
+	}
+	set.Chars = string(chars)
+	return set, nil
 }
 
+// isLiteral - Pattern matching one fixed string
 func isLiteral(pattern string) bool {
-	// TODO: Implement literal detection
-	return false
+	t, err := regex.Parse(pattern)
+	if err != nil {
+		return false
+	}
+	_, ok := regex.LiteralString(t)
+	return ok
 }
 
 func (b *PredicateBuilder) buildLiteralPredicate(pattern string) (Predicate, error) {
-	// TODO: Implement literal predicate building
-	return &AnyPredicate{}, nil
+	t, err := regex.Parse(pattern)
+	if err != nil {
+		return nil, err
+	}
+	literal, ok := regex.LiteralString(t)
+	if !ok {
+		return nil, fmt.Errorf("not a literal: %s", pattern)
+	}
+	if runes := []rune(literal); len(runes) == 1 {
+		return &CharPredicate{Char: runes[0]}, nil
+	}
+	return &StringPredicate{Value: literal}, nil
+}
+
+// isKeywordList - Pattern matching whole words out of a list, like
+// \b(if|else|while)\b
+func isKeywordList(pattern string) bool {
+	t, err := regex.Parse(pattern)
+	if err != nil {
+		return false
+	}
+	_, _, _, ok := regex.KeywordList(t)
+	return ok
+}
+
+func (b *PredicateBuilder) buildKeywordPredicate(pattern string) (Predicate, error) {
+	t, err := regex.Parse(pattern)
+	if err != nil {
+		return nil, err
+	}
+	words, fold, groups, ok := regex.KeywordList(t)
+	if !ok {
+		return nil, fmt.Errorf("not a keyword list: %s", pattern)
+	}
+	return &KeywordPredicate{Words: words, Fold: fold, Groups: groups}, nil
 }
@@ -0,0 +1,282 @@
+package normalizer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/internal/ir"
+	"github.com/ferchd/tm2hsl/internal/parser"
+	"github.com/ferchd/tm2hsl/pkg/selector"
+)
+
+// Lower - Builds the rule-table program executed by HSL engines.
+//
+// State 0 holds the top-level patterns. Every begin/end rule gets its own
+// state, entered by the begin rule, whose first rule is the end rule
+// followed by the nested patterns. Each injection gets a state referenced
+// from the injection table.
+func (n *Normalizer) Lower(ast *parser.TextMateAST, name, scope string) (*ir.Program, error) {
+	n.warnings = nil
+	b := &programBuilder{
+		normalizer: n,
+		ast:        ast,
+		program:    ir.NewProgram(name, scope),
+		predicates: ir.NewPredicateBuilder(false),
+		ruleStates: make(map[string]uint32),
+	}
+
+	root := b.newState(ir.StateFinal, ir.NoScope)
+	b.states[root].rules = b.buildRules(b.expandTopLevel(make(map[string]bool)))
+
+	if err := b.lowerInjections(); err != nil {
+		return nil, err
+	}
+	if ast.InjectionSelector != "" {
+		b.program.InjectionSelector = ast.InjectionSelector
+		b.program.AddString(ast.InjectionSelector)
+	}
+
+	for _, state := range b.states {
+		id := b.program.AddState(state.rules, state.flags)
+		b.program.StateTable[id].ScopeID = state.scope
+	}
+
+	return b.program, nil
+}
+
+// Warnings - Grammar constructs skipped by the last Lower call
+func (n *Normalizer) Warnings() []string {
+	return n.warnings
+}
+
+// programBuilder - Lowering state for a single grammar
+type programBuilder struct {
+	normalizer *Normalizer
+	ast        *parser.TextMateAST
+	program    *ir.Program
+	predicates *ir.PredicateBuilder
+	states     []pendingState
+	ruleStates map[string]uint32 // Begin rule path -> state it enters
+}
+
+// pendingState - State whose rules are appended to the program at the end,
+// so that state IDs can be reserved before their rules are known
+type pendingState struct {
+	rules []ir.RuleEntry
+	flags ir.StateFlags
+	scope uint16
+}
+
+// sourceRule - Grammar rule with its path in the grammar file
+type sourceRule struct {
+	rule parser.GrammarRule
+	path string
+}
+
+func (b *programBuilder) warn(format string, args ...interface{}) {
+	b.normalizer.warnings = append(b.normalizer.warnings, fmt.Sprintf(format, args...))
+}
+
+func (b *programBuilder) newState(flags ir.StateFlags, scope uint16) uint32 {
+	b.states = append(b.states, pendingState{flags: flags, scope: scope})
+	return uint32(len(b.states) - 1)
+}
+
+func (b *programBuilder) lowerInjections() error {
+	selectors := make([]string, 0, len(b.ast.Injections))
+	for key := range b.ast.Injections {
+		selectors = append(selectors, key)
+	}
+	sort.Strings(selectors)
+
+	for _, key := range selectors {
+		sel, err := selector.Parse(key)
+		if err != nil {
+			return fmt.Errorf("injection: %w", err)
+		}
+
+		path := fmt.Sprintf("injections[%s]", key)
+		state := b.newState(ir.StateInjection, ir.NoScope)
+		rules := b.expand([]sourceRule{{rule: b.ast.Injections[key], path: path}}, make(map[string]bool))
+		b.states[state].rules = b.buildRules(rules)
+
+		// One entry per comma group, each with its own priority prefix
+		for _, group := range sel.Groups {
+			b.program.AddInjection(group.String(), int8(group.Priority), state)
+		}
+	}
+
+	return nil
+}
+
+func (b *programBuilder) expandTopLevel(visited map[string]bool) []sourceRule {
+	rules := make([]sourceRule, len(b.ast.Patterns))
+	for i, rule := range b.ast.Patterns {
+		rules[i] = sourceRule{rule: rule, path: fmt.Sprintf("patterns[%d]", i)}
+	}
+	return b.expand(rules, visited)
+}
+
+// expand - Resolves includes and flattens pattern containers until only
+// match and begin rules remain
+func (b *programBuilder) expand(rules []sourceRule, visited map[string]bool) []sourceRule {
+	var expanded []sourceRule
+	for _, sr := range rules {
+		switch {
+		case sr.rule.Include != "":
+			expanded = append(expanded, b.resolveInclude(sr, visited)...)
+		case sr.rule.Match == "" && sr.rule.Begin == "":
+			expanded = append(expanded, b.expand(childRules(sr), visited)...)
+		default:
+			expanded = append(expanded, sr)
+		}
+	}
+	return expanded
+}
+
+func (b *programBuilder) resolveInclude(sr sourceRule, visited map[string]bool) []sourceRule {
+	include := sr.rule.Include
+
+	var key string
+	switch {
+	case include == "$self" || include == "$base":
+		// A single grammar is compiled, so $base is the grammar itself
+		key = "$self"
+	case strings.HasPrefix(include, "#"):
+		key = strings.TrimPrefix(include, "#")
+	case strings.Contains(include, "."):
+		b.warn("%s: external include %q is not supported", sr.path, include)
+		return nil
+	default:
+		key = include
+	}
+
+	// Includes cycling without an intermediate begin rule add nothing new
+	if visited[key] {
+		return nil
+	}
+	visited[key] = true
+	defer delete(visited, key)
+
+	if key == "$self" {
+		return b.expandTopLevel(visited)
+	}
+
+	rule, ok := b.ast.Repository[key]
+	if !ok {
+		b.warn("%s: unresolved include %q", sr.path, include)
+		return nil
+	}
+	return b.expand([]sourceRule{{rule: rule, path: "repository." + key}}, visited)
+}
+
+func childRules(sr sourceRule) []sourceRule {
+	rules := make([]sourceRule, len(sr.rule.Patterns))
+	for i, rule := range sr.rule.Patterns {
+		rules[i] = sourceRule{rule: rule, path: fmt.Sprintf("%s.patterns[%d]", sr.path, i)}
+	}
+	return rules
+}
+
+func (b *programBuilder) buildRules(rules []sourceRule) []ir.RuleEntry {
+	entries := make([]ir.RuleEntry, 0, len(rules))
+	for _, sr := range rules {
+		rule := sr.rule
+		switch {
+		case rule.Match != "":
+			entries = append(entries, ir.RuleEntry{
+				RegexID:    b.regex(rule.Match),
+				Action:     ir.RuleActionMatch,
+				NextState:  -2,
+				ScopeID:    b.scope(rule.Name),
+				CaptureMap: b.captures(rule.Captures),
+				Source:     sr.path,
+			})
+		case rule.End == "":
+			b.warn("%s: begin rule without end is not supported", sr.path)
+		default:
+			captures := rule.BeginCaptures
+			if captures == nil {
+				captures = rule.Captures
+			}
+			entries = append(entries, ir.RuleEntry{
+				RegexID:    b.regex(rule.Begin),
+				Action:     ir.RuleActionPushScope,
+				NextState:  int32(b.stateFor(sr)),
+				ScopeID:    b.scope(rule.Name),
+				CaptureMap: b.captures(captures),
+				Source:     sr.path,
+			})
+		}
+	}
+	return entries
+}
+
+// stateFor - State entered by a begin rule, shared by every include of it
+func (b *programBuilder) stateFor(sr sourceRule) uint32 {
+	if id, ok := b.ruleStates[sr.path]; ok {
+		return id
+	}
+
+	rule := sr.rule
+	id := b.newState(ir.StatePush, b.scope(rule.ContentName))
+	b.ruleStates[sr.path] = id
+
+	captures := rule.EndCaptures
+	if captures == nil {
+		captures = rule.Captures
+	}
+	rules := []ir.RuleEntry{{
+		RegexID:    b.regex(rule.End),
+		Action:     ir.RuleActionPopScope,
+		NextState:  -1,
+		ScopeID:    b.scope(rule.Name),
+		CaptureMap: b.captures(captures),
+		Source:     sr.path + ".end",
+	}}
+	rules = append(rules, b.buildRules(b.expand(childRules(sr), make(map[string]bool)))...)
+	b.states[id].rules = rules
+
+	return id
+}
+
+// regex - Adds a pattern, recording the keyword list it is equivalent to so
+// engines can match it with a trie
+func (b *programBuilder) regex(pattern string) uint32 {
+	known := len(b.program.RegexTable)
+	id := b.program.AddRegex(pattern)
+	if int(id) == known {
+		if pred, err := b.predicates.FromTextMateMatch(pattern); err == nil {
+			b.program.RegexTable[id].Keywords, _ = pred.(*ir.KeywordPredicate)
+		}
+	}
+	return id
+}
+
+func (b *programBuilder) scope(name string) uint16 {
+	if name == "" {
+		return ir.NoScope
+	}
+	return b.program.AddScope(name)
+}
+
+// captures - Capture mappings in group order, for deterministic output
+func (b *programBuilder) captures(captures map[int]parser.Capture) []ir.CaptureMapping {
+	groups := make([]int, 0, len(captures))
+	for group, capture := range captures {
+		if capture.Name != "" {
+			groups = append(groups, group)
+		}
+	}
+	sort.Ints(groups)
+
+	var mappings []ir.CaptureMapping
+	for _, group := range groups {
+		mappings = append(mappings, ir.CaptureMapping{
+			Group:   uint8(group),
+			ScopeID: b.program.AddScope(captures[group].Name),
+		})
+	}
+	return mappings
+}
@@ -0,0 +1,100 @@
+package normalizer
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ferchd/tm2hsl/internal/ir"
+	"github.com/ferchd/tm2hsl/internal/parser"
+)
+
+const injectionGrammar = `{
+  "scopeName": "source.test",
+  "patterns": [
+    {"include": "#comments"},
+    {"begin": "\"", "end": "\"", "name": "string.quoted.test"}
+  ],
+  "repository": {
+    "comments": {"match": "//.*$", "name": "comment.line.test"}
+  },
+  "injections": {
+    "L:comment, R:string": {"patterns": [{"match": "TODO", "name": "keyword.todo.test"}]}
+  },
+  "injectionSelector": "L:source.host"
+}`
+
+func TestNormalizer_LowerInjections(t *testing.T) {
+	ast, err := parser.LoadGrammar(strings.NewReader(injectionGrammar))
+	if err != nil {
+		t.Fatalf("LoadGrammar: %v", err)
+	}
+
+	program, err := NewNormalizer().Lower(ast, "test", "source.test")
+	if err != nil {
+		t.Fatalf("Lower: %v", err)
+	}
+
+	// Root state, string state, injection state
+	if got := len(program.StateTable); got != 3 {
+		t.Fatalf("states = %d, want 3", got)
+	}
+	root := program.StateTable[0]
+	if root.RuleCount != 2 {
+		t.Errorf("root rules = %d, want 2", root.RuleCount)
+	}
+	if got := program.RuleTable[0].Source; got != "repository.comments" {
+		t.Errorf("include source = %q", got)
+	}
+
+	want := []ir.InjectionEntry{
+		{Selector: "comment", Priority: -1, StateID: 2},
+		{Selector: "string", Priority: 1, StateID: 2},
+	}
+	if len(program.InjectionTable) != len(want) {
+		t.Fatalf("injections = %+v, want %+v", program.InjectionTable, want)
+	}
+	for i, w := range want {
+		if program.InjectionTable[i] != w {
+			t.Errorf("injection %d = %+v, want %+v", i, program.InjectionTable[i], w)
+		}
+	}
+
+	injected := program.StateTable[2]
+	if injected.Flags&ir.StateInjection == 0 || injected.RuleCount != 1 {
+		t.Errorf("injection state = %+v", injected)
+	}
+	if program.InjectionSelector != "L:source.host" {
+		t.Errorf("injection selector = %q", program.InjectionSelector)
+	}
+}
+
+func TestNormalizer_LowerKeywords(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string // KeywordPredicate, "" if the pattern stays a regex
+	}{
+		{`\b(if|else|while)\b`, "keywords(else|if|while)"},
+		{`(?i)\b(?:select|from)\b`, "keywords((?i)FROM|SELECT)"},
+		{`\b(if|else)`, ""},
+		{`\b[a-z]+\b`, ""},
+	}
+	for _, tt := range tests {
+		grammar := `{"scopeName": "source.test", "patterns": [{"match": ` + strconv.Quote(tt.pattern) + `}]}`
+		ast, err := parser.LoadGrammar(strings.NewReader(grammar))
+		if err != nil {
+			t.Fatalf("LoadGrammar: %v", err)
+		}
+		program, err := NewNormalizer().Lower(ast, "test", "source.test")
+		if err != nil {
+			t.Fatalf("Lower: %v", err)
+		}
+		got := ""
+		if kw := program.RegexTable[program.RuleTable[0].RegexID].Keywords; kw != nil {
+			got = kw.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: keywords = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
@@ -14,22 +14,25 @@ import (
 type Normalizer struct {
 	supportedFeatures map[string]bool
 	strictMode        bool
+	warnings          []string
 }
 
 func NewNormalizer() *Normalizer {
 	return &Normalizer{
 		supportedFeatures: map[string]bool{
-			"match":        true,
-			"begin-end":    true,
-			"captures":     true,
-			"contentName":  true,
-			"include-self": true, // $self
-			"include-base": true, // $base
+			"match":              true,
+			"begin-end":          true,
+			"captures":           true,
+			"contentName":        true,
+			"include-self":       true, // $self
+			"include-base":       true, // $base
+			"include-repository": true,
+			"begin-captures":     true,
+			"end-captures":       true,
+			"injections":         true,
 			// Features not supported in v0:
-			// "include-repository": false,
-			// "begin-captures":     false,
-			// "end-captures":       false,
-			// "while":              false,
+			// "include-external": false,
+			// "while":            false,
 		},
 		strictMode: true,
 	}
@@ -69,11 +72,6 @@ func (n *Normalizer) Normalize(ast *parser.TextMateAST) (*ir.StateMachine, error
 func (n *Normalizer) validateAST(ast *parser.TextMateAST) error {
 	var unsupported []string
 
-	// Check repository (not supported in v0)
-	if len(ast.Repository) > 0 {
-		unsupported = append(unsupported, "repository")
-	}
-
 	// Check complex includes
 	if hasComplexIncludes(ast) {
 		unsupported = append(unsupported, "complex-includes")
@@ -201,7 +199,7 @@ func (n *Normalizer) convertMatchPattern(pattern parser.GrammarRule, machine *ir
 	// Create predicate
 	predicate := &ir.RegexPredicate{
 		Pattern:  pattern.Match,
-		Compiled: regexp.MustCompile(pattern.Match),
+		Compiled: compileRegex(pattern.Match),
 	}
 
 	// Create actions from captures
@@ -259,7 +257,7 @@ func (n *Normalizer) convertBeginEndPattern(pattern parser.GrammarRule, machine
 	// Begin transition: from start to intermediate
 	beginPredicate := &ir.RegexPredicate{
 		Pattern:  pattern.Begin,
-		Compiled: regexp.MustCompile(pattern.Begin),
+		Compiled: compileRegex(pattern.Begin),
 	}
 	var beginActions []ir.ActionID
 	if pattern.Name != "" {
@@ -286,7 +284,7 @@ func (n *Normalizer) convertBeginEndPattern(pattern parser.GrammarRule, machine
 	// End transition: from intermediate to end
 	endPredicate := &ir.RegexPredicate{
 		Pattern:  pattern.End,
-		Compiled: regexp.MustCompile(pattern.End),
+		Compiled: compileRegex(pattern.End),
 	}
 	var endActions []ir.ActionID
 	endActions = append(endActions, n.createActionsFromCaptures(pattern.EndCaptures, machine)...)
@@ -329,6 +327,16 @@ func (n *Normalizer) optimizeTransitionOrder(machine *ir.StateMachine) {
 	// TODO: implement
 }
 
+// compileRegex - Compiled form kept for reference; Oniguruma-only syntax
+// (lookbehind, backreferences) yields nil instead of failing
+func compileRegex(pattern string) *regexp.Regexp {
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil
+	}
+	return compiled
+}
+
 // createActionsFromCaptures - Creates IR actions from capture definitions
 func (n *Normalizer) createActionsFromCaptures(captures map[int]parser.Capture, machine *ir.StateMachine) []ir.ActionID {
 	var actions []ir.ActionID
@@ -0,0 +1,102 @@
+package optimizer
+
+import (
+	"fmt"
+
+	"github.com/ferchd/tm2hsl/internal/ir"
+)
+
+// Equivalent - Checks that two programs tokenize alike: starting from
+// state 0 and from every injection, paired states must try the same rules
+// in the same order, with the same patterns, actions, scopes and captures,
+// and lead to paired states. The order is the rule table order, the one
+// pkg/engine tries rules in; Priority is not part of it. IDs may differ,
+// so the check holds across renumbering passes.
+func Equivalent(a, b *ir.Program) error {
+	if len(a.InjectionTable) != len(b.InjectionTable) {
+		return fmt.Errorf("%d injections, expected %d", len(b.InjectionTable), len(a.InjectionTable))
+	}
+
+	c := &equivalence{a: a, b: b, paired: make(map[[2]uint32]bool)}
+	if len(a.StateTable) > 0 || len(b.StateTable) > 0 {
+		c.pair(0, 0)
+	}
+	for i, ia := range a.InjectionTable {
+		ib := b.InjectionTable[i]
+		if ia.Selector != ib.Selector || ia.Priority != ib.Priority {
+			return fmt.Errorf("injection %d: %q (%d), expected %q (%d)", i, ib.Selector, ib.Priority, ia.Selector, ia.Priority)
+		}
+		c.pair(ia.StateID, ib.StateID)
+	}
+
+	for len(c.queue) > 0 {
+		p := c.queue[0]
+		c.queue = c.queue[1:]
+		if err := c.states(p[0], p[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type equivalence struct {
+	a, b   *ir.Program
+	paired map[[2]uint32]bool // State of a, state of b
+	queue  [][2]uint32
+}
+
+// pair - Records that state sa of a must behave as sb of b
+func (c *equivalence) pair(sa, sb uint32) {
+	p := [2]uint32{sa, sb}
+	if !c.paired[p] {
+		c.paired[p] = true
+		c.queue = append(c.queue, p)
+	}
+}
+
+func (c *equivalence) states(sa, sb uint32) error {
+	if int(sa) >= len(c.a.StateTable) || int(sb) >= len(c.b.StateTable) {
+		return fmt.Errorf("state %d/%d out of range", sa, sb)
+	}
+	stA, stB := c.a.StateTable[sa], c.b.StateTable[sb]
+	if stA.Flags != stB.Flags || c.a.ScopeName(stA.ScopeID) != c.b.ScopeName(stB.ScopeID) {
+		return fmt.Errorf("state %d (now %d): flags or content scope differ", sa, sb)
+	}
+
+	rulesA, rulesB := c.a.Rules(sa), c.b.Rules(sb)
+	if len(rulesA) != len(rulesB) {
+		return fmt.Errorf("state %d (now %d): %d rules, expected %d", sa, sb, len(rulesB), len(rulesA))
+	}
+	for i := range rulesA {
+		ra, rb := rulesA[i], rulesB[i]
+		if msg := c.ruleDiff(ra, rb); msg != "" {
+			return fmt.Errorf("state %d (now %d): rule %d (%s): %s", sa, sb, i, ra.Source, msg)
+		}
+		if ra.NextState >= 0 {
+			c.pair(uint32(ra.NextState), uint32(rb.NextState))
+		}
+	}
+	return nil
+}
+
+func (c *equivalence) ruleDiff(ra, rb ir.RuleEntry) string {
+	switch {
+	case c.a.RegexTable[ra.RegexID].Pattern != c.b.RegexTable[rb.RegexID].Pattern:
+		return fmt.Sprintf("pattern %q, expected %q", c.b.RegexTable[rb.RegexID].Pattern, c.a.RegexTable[ra.RegexID].Pattern)
+	case ra.Action != rb.Action:
+		return fmt.Sprintf("action %d, expected %d", rb.Action, ra.Action)
+	case (ra.NextState >= 0) != (rb.NextState >= 0) || (ra.NextState < 0 && ra.NextState != rb.NextState):
+		return fmt.Sprintf("next state %d, expected %d", rb.NextState, ra.NextState)
+	case c.a.ScopeName(ra.ScopeID) != c.b.ScopeName(rb.ScopeID):
+		return fmt.Sprintf("scope %q, expected %q", c.b.ScopeName(rb.ScopeID), c.a.ScopeName(ra.ScopeID))
+	case len(ra.CaptureMap) != len(rb.CaptureMap):
+		return "captures differ"
+	}
+	for i, capA := range ra.CaptureMap {
+		capB := rb.CaptureMap[i]
+		if capA.Group != capB.Group || c.a.ScopeName(capA.ScopeID) != c.b.ScopeName(capB.ScopeID) {
+			return fmt.Sprintf("capture %d differs", capA.Group)
+		}
+	}
+	return ""
+}
@@ -3,38 +3,135 @@ package optimizer
 
 import (
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/ferchd/tm2hsl/internal/ir"
 )
 
+// DefaultMaxIterations - Rounds over the pipeline before giving up on a
+// fixpoint
+const DefaultMaxIterations = 8
+
 // Optimizer - Does not understand scopes or semantics
 type Optimizer struct {
 	// Purely structural optimization rules
 	passes []OptimizationPass
+
+	MaxIterations int       // Rounds over the passes; <= 0 uses DefaultMaxIterations
+	PrintAfter    []string  // Passes whose output is dumped to Dump, "all" for every pass
+	Dump          io.Writer // Destination of PrintAfter dumps
+
+	stats     []PassStats
+	converged bool
+}
+
+// PassStats - One run of a pass
+type PassStats struct {
+	Pass      string
+	Iteration int // 1-based round over the pipeline
+	Changed   bool
+	Duration  time.Duration
+	Before    ir.ProgramStats
+	After     ir.ProgramStats
 }
 
+// NewOptimizer - Pipeline of LevelDefault; see Register for adding passes
 func NewOptimizer() *Optimizer {
-	return &Optimizer{
-		passes: []OptimizationPass{
-			&RemoveUnreachableStates{},
-			&MergeEquivalentStates{},
-			&SimplifyTransitions{},
-			&ReorderByPriority{},
-		},
-	}
+	o, _ := NewOptimizerLevel(LevelDefault)
+	return o
 }
 
-// Optimize - Applies steps without changing semantics
+// Optimize - Applies steps without changing semantics. The passes run in
+// rounds until a whole round changes nothing (a fixpoint) or MaxIterations
+// rounds have run.
 func (o *Optimizer) Optimize(program *ir.Program) (*ir.Program, error) {
-	for _, pass := range o.passes {
-		changed, err := pass.Apply(program)
-		if err != nil {
-			return nil, fmt.Errorf("pass %s failed: %w", pass.Name(), err)
+	maxIterations := o.MaxIterations
+	if maxIterations <= 0 {
+		maxIterations = DefaultMaxIterations
+	}
+	o.stats = nil
+	o.converged = false
+	for _, name := range o.PrintAfter {
+		if name != "all" && findPass(name) == nil && !o.hasPass(name) {
+			return nil, fmt.Errorf("unknown pass %q in print-after", name)
+		}
+	}
+
+	for iteration := 1; iteration <= maxIterations; iteration++ {
+		changed := false
+		for _, pass := range o.passes {
+			before := program.Statistics()
+			start := time.Now()
+			passChanged, err := pass.Apply(program)
+			if err != nil {
+				return nil, fmt.Errorf("pass %s failed: %w", pass.Name(), err)
+			}
+			o.stats = append(o.stats, PassStats{
+				Pass:      pass.Name(),
+				Iteration: iteration,
+				Changed:   passChanged,
+				Duration:  time.Since(start),
+				Before:    before,
+				After:     program.Statistics(),
+			})
+			changed = changed || passChanged
+
+			if err := o.dump(pass.Name(), iteration, program); err != nil {
+				return nil, err
+			}
 		}
 		if !changed {
-			// If nothing changed, we can stop
+			o.converged = true
 			break
 		}
 	}
+	if len(o.passes) > 0 {
+		program.Optimized = true
+	}
 	return program, nil
 }
+
+func (o *Optimizer) dump(pass string, iteration int, program *ir.Program) error {
+	if o.Dump == nil {
+		return nil
+	}
+	for _, name := range o.PrintAfter {
+		if name == pass || name == "all" {
+			if _, err := fmt.Fprintf(o.Dump, "; *** IR after %s (iteration %d) ***\n", pass, iteration); err != nil {
+				return err
+			}
+			return program.Dump(o.Dump)
+		}
+	}
+	return nil
+}
+
+// Stats - Runs of the last Optimize call, in order
+func (o *Optimizer) Stats() []PassStats {
+	return o.stats
+}
+
+// Converged - Whether the last Optimize call reached a fixpoint before
+// MaxIterations
+func (o *Optimizer) Converged() bool {
+	return o.converged
+}
+
+func (o *Optimizer) hasPass(name string) bool {
+	for _, pass := range o.passes {
+		if pass.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Passes - Names of the pipeline passes, in order
+func (o *Optimizer) Passes() []string {
+	names := make([]string, len(o.passes))
+	for i, pass := range o.passes {
+		names[i] = pass.Name()
+	}
+	return names
+}
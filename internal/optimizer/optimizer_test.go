@@ -0,0 +1,478 @@
+package optimizer
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ferchd/tm2hsl/internal/ir"
+)
+
+// rule - Match rule spec for test programs: pattern and priority
+type rule struct {
+	pattern  string
+	priority uint8
+}
+
+// newTestProgram - One state per entry of states; state 0 enters every
+// other state through a trailing begin rule
+func newTestProgram(states ...[]rule) *ir.Program {
+	p := ir.NewProgram("T", "source.t")
+	for i, specs := range states {
+		var rules []ir.RuleEntry
+		for _, r := range specs {
+			rules = append(rules, ir.RuleEntry{
+				RegexID:   p.AddRegex(r.pattern),
+				Action:    ir.RuleActionMatch,
+				NextState: -2,
+				ScopeID:   ir.NoScope,
+				Priority:  r.priority,
+				Source:    r.pattern,
+			})
+		}
+		if i == 0 {
+			for next := 1; next < len(states); next++ {
+				rules = append(rules, ir.RuleEntry{
+					RegexID:   p.AddRegex("begin"),
+					Action:    ir.RuleActionPushScope,
+					NextState: int32(next),
+					ScopeID:   ir.NoScope,
+				})
+			}
+		}
+		p.AddState(rules, 0)
+	}
+	return p
+}
+
+func patterns(p *ir.Program, state uint32) string {
+	var out []string
+	for _, r := range p.Rules(state) {
+		out = append(out, p.RegexTable[r.RegexID].Pattern)
+	}
+	return strings.Join(out, " ")
+}
+
+func TestReorderByPriority(t *testing.T) {
+	tests := []struct {
+		name    string
+		states  [][]rule
+		changed bool
+		want    []string // Patterns of every state after the pass
+	}{
+		{
+			name:   "equal priorities keep TextMate order",
+			states: [][]rule{{{"b", 0}, {"a", 0}}, {{"d", 0}, {"c", 0}}},
+			want:   []string{"b a begin", "d c"},
+		},
+		{
+			// Only equal rules trade places
+			name:    "stable within each state",
+			states:  [][]rule{{{"a", 0}, {"a", 1}, {"b", 0}}, {{"e", 0}, {"e", 2}}},
+			changed: true,
+			want:    []string{"a a b begin", "e e"},
+		},
+		{
+			// "a" and "b" never match at the same position
+			name:    "distinct patterns with different priorities",
+			states:  [][]rule{{{"a", 0}, {"b", 1}}, {{";", 0}, {`\d+`, 3}, {`[a-z]+`, 2}}},
+			changed: true,
+			want:    []string{"b a begin", `\d+ [a-z]+ ;`},
+		},
+		{
+			// The engine tries rules in table order, so "\bif\b" would
+			// win where "\w+" won before
+			name:    "overlapping patterns keep their order",
+			states:  [][]rule{{{`\w+`, 0}, {`\bif\b`, 1}}, {{"d", 0}, {"e", 1}}},
+			changed: true,
+			want:    []string{`\w+ \bif\b begin`, "e d"},
+		},
+		{
+			name:   "unparsable pattern keeps its state",
+			states: [][]rule{{{"(", 0}, {"b", 1}}},
+			want:   []string{"( b"},
+		},
+		{
+			name:   "already sorted",
+			states: [][]rule{{{"a", 2}, {"b", 1}}},
+			want:   []string{"a b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProgram(tt.states...)
+			offsets := append([]ir.StateEntry(nil), p.StateTable...)
+
+			changed, err := (&ReorderByPriority{}).Apply(p)
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if changed != tt.changed {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+			for i, want := range tt.want {
+				if got := patterns(p, uint32(i)); got != want {
+					t.Errorf("state %d = %q, want %q", i, got, want)
+				}
+				if p.StateTable[i] != offsets[i] {
+					t.Errorf("state %d entry = %+v, want %+v", i, p.StateTable[i], offsets[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEquivalent(t *testing.T) {
+	base := newTestProgram([]rule{{"a", 0}, {"b", 0}}, []rule{{"c", 0}})
+
+	tests := []struct {
+		name    string
+		other   *ir.Program
+		wantErr string
+	}{
+		{"identical", newTestProgram([]rule{{"a", 0}, {"b", 0}}, []rule{{"c", 0}}), ""},
+		{"swapped rules", newTestProgram([]rule{{"b", 0}, {"a", 0}}, []rule{{"c", 0}}), "pattern"},
+		{"different child", newTestProgram([]rule{{"a", 0}, {"b", 0}}, []rule{{"x", 0}}), "state 1"},
+		{"missing rule", newTestProgram([]rule{{"a", 0}}, []rule{{"c", 0}}), "rules"},
+		{"priority does not reorder", newTestProgram([]rule{{"b", 1}, {"a", 0}}, []rule{{"c", 0}}), "pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Equivalent(base, tt.other)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Equivalent() = %v, want nil", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Equivalent() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// countdownPass - Reports a change on its first n runs
+type countdownPass struct {
+	name string
+	n    int
+	runs int
+}
+
+func (p *countdownPass) Name() string { return p.name }
+
+func (p *countdownPass) Apply(program *ir.Program) (bool, error) {
+	p.runs++
+	return p.runs <= p.n, nil
+}
+
+func TestOptimizer_Fixpoint(t *testing.T) {
+	tests := []struct {
+		name          string
+		changes       []int // Changing runs of each pass
+		maxIterations int
+		wantRuns      int // Runs of every pass
+		converged     bool
+	}{
+		{"no changes", []int{0, 0}, 0, 1, true},
+		{"later passes run after an unchanged one", []int{0, 2}, 0, 3, true},
+		{"iteration cap", []int{100, 0}, 3, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var passes []*countdownPass
+			o := &Optimizer{MaxIterations: tt.maxIterations}
+			for i, n := range tt.changes {
+				p := &countdownPass{name: fmt.Sprintf("pass%d", i), n: n}
+				passes = append(passes, p)
+				o.passes = append(o.passes, p)
+			}
+
+			var dump strings.Builder
+			o.PrintAfter, o.Dump = []string{"pass1"}, &dump
+			if _, err := o.Optimize(newTestProgram([]rule{{"a", 0}})); err != nil {
+				t.Fatalf("Optimize: %v", err)
+			}
+			for _, p := range passes {
+				if p.runs != tt.wantRuns {
+					t.Errorf("%s ran %d times, want %d", p.name, p.runs, tt.wantRuns)
+				}
+			}
+			if o.Converged() != tt.converged {
+				t.Errorf("Converged() = %v, want %v", o.Converged(), tt.converged)
+			}
+			if got := len(o.Stats()); got != tt.wantRuns*len(passes) {
+				t.Errorf("%d stats, want %d", got, tt.wantRuns*len(passes))
+			}
+			if got := strings.Count(dump.String(), "IR after pass1"); got != tt.wantRuns {
+				t.Errorf("%d dumps after pass1, want %d", got, tt.wantRuns)
+			}
+		})
+	}
+}
+
+func TestMergeEquivalentStates(t *testing.T) {
+	tests := []struct {
+		name       string
+		states     [][]rule
+		injections []uint32 // Injection states
+		wantStates int
+	}{
+		{"distinct", [][]rule{{{"a", 0}}, {{"b", 0}}, {{"c", 0}}}, nil, 3},
+		{"duplicates", [][]rule{{{"a", 0}}, {{"b", 0}}, {{"c", 0}}, {{"b", 0}}, {{"c", 0}}}, nil, 3},
+		{"rule order matters", [][]rule{{{"a", 0}}, {{"b", 0}, {"c", 0}}, {{"c", 0}, {"b", 0}}}, nil, 3},
+		{"priority matters", [][]rule{{{"a", 0}}, {{"b", 0}}, {{"b", 1}}}, nil, 3},
+		{"injection remapped", [][]rule{{{"a", 0}}, {{"b", 0}}, {{"b", 0}}}, []uint32{2}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProgram(tt.states...)
+			for _, state := range tt.injections {
+				p.AddInjection("comment", 0, state)
+			}
+			before := p.Clone()
+
+			changed, err := (&MergeEquivalentStates{}).Apply(p)
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if got := len(p.StateTable); got != tt.wantStates {
+				t.Errorf("%d states, want %d", got, tt.wantStates)
+			}
+			if changed != (tt.wantStates < len(tt.states)) {
+				t.Errorf("changed = %v", changed)
+			}
+			if err := Equivalent(before, p); err != nil {
+				t.Errorf("Equivalent: %v", err)
+			}
+			for i, state := range p.StateTable {
+				if state.ID != uint32(i) {
+					t.Errorf("state %d has ID %d", i, state.ID)
+				}
+			}
+			for _, inj := range p.InjectionTable {
+				if int(inj.StateID) >= len(p.StateTable) {
+					t.Errorf("injection state %d out of range", inj.StateID)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeEquivalentStates_Nested(t *testing.T) {
+	// Two begin rules entering states whose only difference is the state
+	// they push, which are themselves equivalent
+	p := ir.NewProgram("T", "source.t")
+	re := func(s string) uint32 { return p.AddRegex(s) }
+	push := func(pattern string, next int32) ir.RuleEntry {
+		return ir.RuleEntry{RegexID: re(pattern), Action: ir.RuleActionPushScope, NextState: next, ScopeID: ir.NoScope}
+	}
+	pop := ir.RuleEntry{RegexID: re("end"), Action: ir.RuleActionPopScope, NextState: -1, ScopeID: ir.NoScope}
+	p.AddState([]ir.RuleEntry{push("x", 1), push("y", 2)}, ir.StateFinal)
+	p.AddState([]ir.RuleEntry{pop, push("(", 3)}, ir.StatePush)
+	p.AddState([]ir.RuleEntry{pop, push("(", 4)}, ir.StatePush)
+	p.AddState([]ir.RuleEntry{pop}, ir.StatePush)
+	p.AddState([]ir.RuleEntry{pop}, ir.StatePush)
+	before := p.Clone()
+
+	if _, err := (&MergeEquivalentStates{}).Apply(p); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if len(p.StateTable) != 3 {
+		t.Errorf("%d states, want 3", len(p.StateTable))
+	}
+	if got := patterns(p, 0); got != "x y" {
+		t.Errorf("state 0 = %q", got)
+	}
+	if r := p.Rules(0); r[0].NextState != r[1].NextState {
+		t.Errorf("begin rules enter states %d and %d, want the same", r[0].NextState, r[1].NextState)
+	}
+	if err := Equivalent(before, p); err != nil {
+		t.Errorf("Equivalent: %v", err)
+	}
+}
+
+func TestAnalyzeRules(t *testing.T) {
+	// Thousands of distinct rules, the last one a repeat of an early one
+	var large []rule
+	for i := 0; i < 3000; i++ {
+		large = append(large, rule{fmt.Sprintf("kw%d;", i), 0})
+	}
+	large = append(large, rule{"kw7;", 0})
+
+	tests := []struct {
+		name  string
+		rules []rule
+		want  []string // Issues as "kind source[<by]"
+	}{
+		{"keyword after identifier", []rule{{`\w+`, 0}, {`\bif\b`, 0}}, []string{`shadowed \bif\b<\w+`}},
+		{"keyword first", []rule{{`\bif\b`, 0}, {`\w+`, 0}}, nil},
+		{"priority decides", []rule{{`\bif\b`, 1}, {`\w+`, 0}}, nil},
+		{"lookahead is not analyzed", []rule{{`\w+(?=\()`, 0}, {`\w+\(`, 0}}, nil},
+		{"empty match", []rule{{`a`, 0}, {`\s*`, 0}}, []string{`empty \s*`}},
+		{"prefix extended", []rule{{`ab`, 0}, {`abc`, 0}}, []string{`shadowed abc<ab`}},
+		{"prefixes apart", []rule{{`abc`, 0}, {`abd`, 0}, {`ab[de]`, 0}}, nil},
+		{"empty match first", []rule{{`a*`, 0}, {`b`, 0}}, []string{`empty a*`, `shadowed b<a*`}},
+		{"large state", large, []string{`shadowed kw7;<kw7;`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, issue := range AnalyzeRules(newTestProgram(tt.rules)) {
+				switch issue.Kind {
+				case IssueShadowed:
+					got = append(got, "shadowed "+issue.Source+"<"+issue.BySource)
+				case IssueEmptyLoop:
+					got = append(got, "empty "+issue.Source)
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("issues = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSimplifyTransitions(t *testing.T) {
+	p := newTestProgram(
+		[]rule{{`\w+`, 0}, {`\bif\b`, 0}, {`"`, 0}},
+		[]rule{{`\d+`, 0}, {`\d+\.\d+`, 0}, {`\.`, 0}},
+	)
+	changed, err := (&SimplifyTransitions{}).Apply(p)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if !changed {
+		t.Error("changed = false")
+	}
+	// The begin rule entering state 1 is shadowed too; the state is left for
+	// remove-unreachable-states
+	for i, want := range []string{`\w+ "`, `\d+ \.`} {
+		if got := patterns(p, uint32(i)); got != want {
+			t.Errorf("state %d = %q, want %q", i, got, want)
+		}
+	}
+	if changed, _ := (&SimplifyTransitions{}).Apply(p); changed {
+		t.Error("second run changed the program")
+	}
+}
+
+func TestCombineScanners(t *testing.T) {
+	p := newTestProgram(
+		[]rule{{`\bif\b`, 0}, {`(?<=\.)\w+`, 0}, {`\w+`, 0}},
+		[]rule{{`\d+`, 0}, {`(a)\1`, 0}},
+		[]rule{{`"`, 0}, {`\\.`, 0}},
+	)
+	changed, err := (&CombineScanners{}).Apply(p)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if !changed {
+		t.Error("changed = false")
+	}
+	// Lookbehind and backreferences stay out; state 1 has a single
+	// compatible rule left and gets no scanner
+	want := map[uint32]string{0: "[0 2 3 4]", 2: "[0 1]"}
+	got := make(map[uint32]string)
+	for _, sc := range p.Scanners {
+		got[sc.StateID] = fmt.Sprint(sc.Rules)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("scanners = %v, want %v", got, want)
+	}
+
+	first := p.Scanners[0].Scanner
+	if changed, _ := (&CombineScanners{}).Apply(p); changed || p.Scanners[0].Scanner != first {
+		t.Error("second run rebuilt the scanners")
+	}
+}
+
+// TestOptimizer_StateTablesFollowRenumbering - Scanners and prefilters
+// built before a pass renumbering states or rules must not go stale, even
+// when the iteration cap stops the pipeline right after that pass
+func TestOptimizer_StateTablesFollowRenumbering(t *testing.T) {
+	for _, pass := range []string{"remove-unreachable-states", "merge-equivalent-states", "simplify-transitions", "reorder-by-priority"} {
+		for _, rounds := range []int{1, 0} {
+			t.Run(fmt.Sprintf("%s/%d rounds", pass, rounds), func(t *testing.T) {
+				// State 2 merges into 1, state 4 is unreachable and `\bif\b`
+				// is shadowed; the equal rules of state 3 trade places
+				p := newTestProgram(
+					[]rule{{`\w+`, 0}, {`\bif\b`, 0}, {`"`, 0}},
+					[]rule{{"c", 0}, {"d", 0}},
+					[]rule{{"c", 0}, {"d", 0}},
+					[]rule{{"x", 0}, {"x", 1}, {"y", 0}},
+				)
+				p.AddState([]ir.RuleEntry{
+					{RegexID: p.AddRegex("p"), Action: ir.RuleActionMatch, NextState: -2, ScopeID: ir.NoScope},
+					{RegexID: p.AddRegex("q"), Action: ir.RuleActionMatch, NextState: -2, ScopeID: ir.NoScope},
+				}, 0)
+
+				o, err := NewOptimizerPasses([]string{"combine-scanners", "build-prefilters", pass})
+				if err != nil {
+					t.Fatalf("NewOptimizerPasses: %v", err)
+				}
+				o.MaxIterations = rounds
+				if _, err := o.Optimize(p); err != nil {
+					t.Fatalf("Optimize: %v", err)
+				}
+				if st := o.Stats(); !st[2].Changed {
+					t.Fatal("the pass changed nothing")
+				}
+				if rounds == 0 && (len(p.Scanners) == 0 || len(p.Prefilters) == 0) {
+					t.Errorf("%d scanners and %d prefilters, want them rebuilt", len(p.Scanners), len(p.Prefilters))
+				}
+
+				for _, sc := range p.Scanners {
+					if int(sc.StateID) >= len(p.StateTable) {
+						t.Fatalf("scanner of state %d out of range", sc.StateID)
+					}
+					rules := p.Rules(sc.StateID)
+					for k, pos := range sc.Rules {
+						if int(pos) >= len(rules) || rules[pos].RegexID != sc.Regexes[k] {
+							t.Errorf("scanner of state %d: rule %d is not regex %d", sc.StateID, pos, sc.Regexes[k])
+						}
+					}
+				}
+				for _, pf := range p.Prefilters {
+					if int(pf.StateID) >= len(p.StateTable) {
+						t.Fatalf("prefilter of state %d out of range", pf.StateID)
+					}
+					var ids []uint32
+					for _, r := range p.Rules(pf.StateID) {
+						ids = append(ids, r.RegexID)
+					}
+					if fmt.Sprint(pf.Regexes) != fmt.Sprint(ids) {
+						t.Errorf("prefilter of state %d covers regexes %v, want %v", pf.StateID, pf.Regexes, ids)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestBuildPrefilters(t *testing.T) {
+	p := newTestProgram(
+		[]rule{{`\b(if|else)\b`, 0}, {`"`, 0}},
+		[]rule{{`\d+`, 0}, {`//`, 0}},
+		[]rule{{`x`, 0}, {`a*`, 0}},
+	)
+	changed, err := (&BuildPrefilters{}).Apply(p)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if !changed {
+		t.Error("changed = false")
+	}
+	// State 2 can match "" anywhere and gets none
+	want := map[uint32]string{
+		0: `first=["bei] literals="if","else","\"","begin"`,
+		1: `first=[/-9\xd9\xdb\xdf-\xe1\xea\xef-\xf0]`, // \d is Unicode
+	}
+	got := make(map[uint32]string)
+	for _, pf := range p.Prefilters {
+		got[pf.StateID] = ir.PrefilterString(pf.FirstBytes, pf.Literals)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("prefilters = %v, want %v", got, want)
+	}
+	if changed, _ := (&BuildPrefilters{}).Apply(p); changed {
+		t.Error("second run changed the program")
+	}
+}
@@ -1,9 +1,12 @@
 package optimizer
 
 import (
+	"fmt"
 	"sort"
+	"strings"
 
 	"github.com/ferchd/tm2hsl/internal/ir"
+	"github.com/ferchd/tm2hsl/pkg/regex"
 )
 
 // OptimizationPass - Optimization step
@@ -12,6 +15,15 @@ type OptimizationPass interface {
 	Apply(program *ir.Program) (bool, error)
 }
 
+// dropStateTables - Scanners and prefilters are keyed by state ID, and
+// scanners cover rules by position in their state; passes that renumber
+// states or move rules drop both tables. The pipeline runs until nothing
+// changes, so combine-scanners and build-prefilters rebuild them whatever
+// the order of the passes.
+func dropStateTables(program *ir.Program) {
+	program.Scanners, program.Prefilters = nil, nil
+}
+
 // RemoveUnreachableStates - Removes unreachable states
 type RemoveUnreachableStates struct{}
 
@@ -41,6 +53,9 @@ func (p *RemoveUnreachableStates) Apply(program *ir.Program) (bool, error) {
 		}
 	}
 	visit(0) // assume initial state is 0
+	for _, injection := range program.InjectionTable {
+		visit(injection.StateID)
+	}
 
 	// Create new tables
 	newStateTable := []ir.StateEntry{}
@@ -79,9 +94,17 @@ func (p *RemoveUnreachableStates) Apply(program *ir.Program) (bool, error) {
 		ruleOffset += uint32(len(newRules))
 	}
 
+	for i := range program.InjectionTable {
+		program.InjectionTable[i].StateID = stateMap[program.InjectionTable[i].StateID]
+	}
+
+	changed := len(newStateTable) < len(program.StateTable)
 	program.StateTable = newStateTable
 	program.RuleTable = newRuleTable
-	return len(newStateTable) < len(program.StateTable), nil
+	if changed {
+		dropStateTables(program)
+	}
+	return changed, nil
 }
 
 // MergeEquivalentStates - Merges equivalent states
@@ -89,30 +112,372 @@ type MergeEquivalentStates struct{}
 
 func (p *MergeEquivalentStates) Name() string { return "merge-equivalent-states" }
 
+// Apply - Partition refinement over the state table: states start grouped
+// by flags, content scope and their rules in order (regex, action, scope,
+// priority, captures), and groups split until rules entering states lead
+// to the same group. Each group keeps its lowest state, so state 0 stays
+// the initial state. Source paths are diagnostics and do not prevent a
+// merge; merged rules keep the path of the kept state.
 func (p *MergeEquivalentStates) Apply(program *ir.Program) (bool, error) {
-	// TODO: Implement equivalent state merging
-	return false, nil
+	n := len(program.StateTable)
+	if n < 2 {
+		return false, nil
+	}
+
+	class := make([]int, n)
+	classes := 1
+	for {
+		next := make([]int, n)
+		index := make(map[string]int)
+		for id := range program.StateTable {
+			sig := programStateSignature(program, uint32(id), class)
+			c, ok := index[sig]
+			if !ok {
+				c = len(index)
+				index[sig] = c
+			}
+			next[id] = c
+		}
+		class = next
+		if len(index) == classes {
+			break
+		}
+		classes = len(index)
+	}
+	if classes == n {
+		return false, nil
+	}
+
+	before := program.Clone()
+
+	// Classes are numbered by their lowest state, so new IDs keep the
+	// original order
+	var newStates []ir.StateEntry
+	var newRules []ir.RuleEntry
+	for id, state := range program.StateTable {
+		if class[id] != len(newStates) {
+			continue // Not the first state of its class
+		}
+		rules := append([]ir.RuleEntry(nil), program.Rules(uint32(id))...)
+		for i := range rules {
+			if rules[i].NextState >= 0 {
+				rules[i].NextState = int32(class[rules[i].NextState])
+			}
+		}
+		state.ID = uint32(len(newStates))
+		state.RuleOffset = uint32(len(newRules))
+		newStates = append(newStates, state)
+		newRules = append(newRules, rules...)
+	}
+	program.StateTable = newStates
+	program.RuleTable = newRules
+	for i := range program.InjectionTable {
+		program.InjectionTable[i].StateID = uint32(class[program.InjectionTable[i].StateID])
+	}
+
+	if err := Equivalent(before, program); err != nil {
+		return false, fmt.Errorf("merging changed the program: %w", err)
+	}
+	dropStateTables(program)
+	return true, nil
 }
 
-// SimplifyTransitions - Simplifies redundant transitions
+// programStateSignature - Everything that makes a state behave differently,
+// with target states replaced by their current class. The state's own class
+// comes first, so every round refines the previous partition.
+func programStateSignature(program *ir.Program, id uint32, class []int) string {
+	state := program.StateTable[id]
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %d/%d", class[id], state.Flags, state.ScopeID)
+	for _, r := range program.Rules(id) {
+		next := int(r.NextState)
+		if r.NextState >= 0 {
+			next = class[r.NextState]
+		}
+		fmt.Fprintf(&b, "|%d %d %d %d %d", r.RegexID, r.Action, r.ScopeID, r.Priority, next)
+		for _, c := range r.CaptureMap {
+			fmt.Fprintf(&b, " %d:%d", c.Group, c.ScopeID)
+		}
+	}
+	return b.String()
+}
+
+// SimplifyTransitions - Removes rules that can never fire because an
+// earlier rule of the same state always matches first (see AnalyzeRules).
+// States only entered through removed rules become unreachable and are
+// dropped by remove-unreachable-states on the next round.
 type SimplifyTransitions struct{}
 
 func (p *SimplifyTransitions) Name() string { return "simplify-transitions" }
 
 func (p *SimplifyTransitions) Apply(program *ir.Program) (bool, error) {
-	// TODO: Implement transition simplification
-	return false, nil
+	removed := make(map[uint32]bool)
+	for _, issue := range AnalyzeRules(program) {
+		if issue.Kind == IssueShadowed {
+			removed[issue.Rule] = true
+		}
+	}
+	if len(removed) == 0 {
+		return false, nil
+	}
+
+	var newRules []ir.RuleEntry
+	for id := range program.StateTable {
+		state := &program.StateTable[id]
+		offset := uint32(len(newRules))
+		for i := state.RuleOffset; i < state.RuleOffset+uint32(state.RuleCount); i++ {
+			if !removed[i] {
+				newRules = append(newRules, program.RuleTable[i])
+			}
+		}
+		state.RuleOffset = offset
+		state.RuleCount = uint16(uint32(len(newRules)) - offset)
+	}
+	program.RuleTable = newRules
+	dropStateTables(program)
+	return true, nil
 }
 
-// ReorderByPriority - Reorders rules by priority
+// maxReorderChecks - Overlap tests ReorderByPriority runs per state before
+// leaving the state in TextMate order
+const maxReorderChecks = 2048
+
+// ReorderByPriority - Sorts the rules of each state by priority, higher
+// first. The sort is stable and stays inside every state's slice of the
+// rule table, so RuleOffset/RuleCount ranges remain valid. The engine tries
+// rules in table order and never reads Priority, so a state is only sorted
+// when every pair of rules trading places either differs in nothing but
+// Priority or cannot match at the same position (regex.Overlaps); any other
+// state keeps its order.
 type ReorderByPriority struct{}
 
 func (p *ReorderByPriority) Name() string { return "reorder-by-priority" }
 
 func (p *ReorderByPriority) Apply(program *ir.Program) (bool, error) {
-	// Sort rules by priority descending (higher priority first)
-	sort.Slice(program.RuleTable, func(i, j int) bool {
-		return program.RuleTable[i].Priority > program.RuleTable[j].Priority
-	})
-	return true, nil // Always reorder for now
+	langs := make(map[uint32]*regex.Language) // By regex ID; nil if it does not parse
+	lang := func(id uint32) *regex.Language {
+		l, ok := langs[id]
+		if !ok {
+			if t, err := regex.Parse(program.RegexTable[id].Pattern); err == nil {
+				l = regex.NewLanguage(t)
+			}
+			langs[id] = l
+		}
+		return l
+	}
+	disjoint := func(a, b ir.RuleEntry) bool {
+		la, lb := lang(a.RegexID), lang(b.RegexID)
+		if la == nil || lb == nil {
+			return false
+		}
+		overlaps, err := la.Overlaps(lb)
+		return err == nil && !overlaps
+	}
+
+	changed := false
+	for id := range program.StateTable {
+		rules := program.Rules(uint32(id))
+		if sort.SliceIsSorted(rules, func(i, j int) bool { return rules[i].Priority > rules[j].Priority }) {
+			continue
+		}
+
+		// Every later rule with a higher priority moves ahead of the
+		// earlier one
+		safe, checks := true, 0
+	pairs:
+		for i := range rules {
+			for j := i + 1; j < len(rules); j++ {
+				if rules[j].Priority <= rules[i].Priority || samePriorityAside(program, rules[i], rules[j]) {
+					continue
+				}
+				if checks++; checks > maxReorderChecks || !disjoint(rules[i], rules[j]) {
+					safe = false
+					break pairs
+				}
+			}
+		}
+		if !safe {
+			continue
+		}
+		sort.SliceStable(rules, func(i, j int) bool { return rules[i].Priority > rules[j].Priority })
+		changed = true
+	}
+	if changed {
+		dropStateTables(program)
+	}
+	return changed, nil
+}
+
+// samePriorityAside - Whether a and b behave the same in the engine: equal
+// pattern, action, next state, scope and captures
+func samePriorityAside(program *ir.Program, a, b ir.RuleEntry) bool {
+	if program.RegexTable[a.RegexID].Pattern != program.RegexTable[b.RegexID].Pattern ||
+		a.Action != b.Action || a.NextState != b.NextState || a.ScopeID != b.ScopeID ||
+		len(a.CaptureMap) != len(b.CaptureMap) {
+		return false
+	}
+	for i := range a.CaptureMap {
+		if a.CaptureMap[i] != b.CaptureMap[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// minScannerRules - Fewest covered rules worth a scanner: a single pattern
+// is searched as fast on its own
+const minScannerRules = 2
+
+// CombineScanners - Compiles the RE2-compatible rules of each state into
+// one DFA (regex.Scanner). Scanner.Match reads the line once, running the
+// automaton from every start position together, and reports the leftmost
+// match and the lowest rule matching there, instead of running every
+// covered regex at each position.
+// Rules needing backtracking (lookaround, backreferences, atomic groups, \G)
+// are left out and still matched one by one; states whose DFA grows too
+// large keep every rule out.
+type CombineScanners struct{}
+
+func (p *CombineScanners) Name() string { return "combine-scanners" }
+
+func (p *CombineScanners) Apply(program *ir.Program) (bool, error) {
+	existing := make(map[uint32]ir.ScannerEntry)
+	for _, sc := range program.Scanners {
+		existing[sc.StateID] = sc
+	}
+
+	trees := make(map[uint32]*regex.Tree) // By regex ID; nil if not compatible
+	compatible := func(id uint32) *regex.Tree {
+		t, ok := trees[id]
+		if !ok {
+			if parsed, err := regex.Parse(program.RegexTable[id].Pattern); err == nil && regex.ScannerCompatible(parsed) {
+				t = parsed
+			}
+			trees[id] = t
+		}
+		return t
+	}
+
+	var scanners []ir.ScannerEntry
+	for id := range program.StateTable {
+		entry := ir.ScannerEntry{StateID: uint32(id)}
+		var patterns []*regex.Tree
+		for i, rule := range program.Rules(uint32(id)) {
+			if t := compatible(rule.RegexID); t != nil {
+				entry.Rules = append(entry.Rules, uint16(i))
+				entry.Regexes = append(entry.Regexes, rule.RegexID)
+				patterns = append(patterns, t)
+			}
+		}
+		if len(patterns) < minScannerRules {
+			continue
+		}
+		if old, ok := existing[uint32(id)]; ok && sameCoverage(old, entry) {
+			scanners = append(scanners, old)
+			continue
+		}
+		sc, err := regex.BuildScanner(patterns)
+		if err != nil {
+			continue // Too large: the rules are matched one by one
+		}
+		entry.Scanner = sc
+		scanners = append(scanners, entry)
+	}
+
+	changed := len(scanners) != len(program.Scanners)
+	for i := 0; !changed && i < len(scanners); i++ {
+		changed = scanners[i].StateID != program.Scanners[i].StateID || !sameCoverage(scanners[i], program.Scanners[i])
+	}
+	program.Scanners = scanners
+	return changed, nil
+}
+
+// sameCoverage - Whether two scanners cover the same patterns at the same
+// positions of their state
+func sameCoverage(a, b ir.ScannerEntry) bool {
+	if len(a.Rules) != len(b.Rules) {
+		return false
+	}
+	for i := range a.Rules {
+		if a.Rules[i] != b.Rules[i] || a.Regexes[i] != b.Regexes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// maxPrefilterLiterals - Largest literal set of a state; past it only the
+// first bytes are kept
+const maxPrefilterLiterals = 256
+
+// BuildPrefilters - Records, for each state, the first bytes and literal
+// prefixes every match of its rules starts with (regex.FirstBytes,
+// regex.Prefixes), so the engine can jump to the next position where a rule
+// may match. A state with a rule that can match the empty string, or whose
+// pattern does not parse, gets no prefilter.
+type BuildPrefilters struct{}
+
+func (p *BuildPrefilters) Name() string { return "build-prefilters" }
+
+func (p *BuildPrefilters) Apply(program *ir.Program) (bool, error) {
+	type ruleFilter struct {
+		first    *regex.ByteSet
+		literals []string
+	}
+	filters := make(map[uint32]ruleFilter) // By regex ID
+	filter := func(id uint32) ruleFilter {
+		f, ok := filters[id]
+		if !ok {
+			if t, err := regex.Parse(program.RegexTable[id].Pattern); err == nil {
+				if first, ok := regex.FirstBytes(t); ok {
+					f.first = &first
+				}
+				f.literals, _ = regex.Prefixes(t)
+			}
+			filters[id] = f
+		}
+		return f
+	}
+
+	var prefilters []ir.PrefilterEntry
+	for id := range program.StateTable {
+		rules := program.Rules(uint32(id))
+		if len(rules) == 0 {
+			continue
+		}
+		entry := ir.PrefilterEntry{StateID: uint32(id), FirstBytes: &regex.ByteSet{}, Literals: []string{}}
+		seen := make(map[string]bool)
+		for _, rule := range rules {
+			entry.Regexes = append(entry.Regexes, rule.RegexID)
+			f := filter(rule.RegexID)
+			if f.first == nil {
+				entry.FirstBytes = nil
+			} else if entry.FirstBytes != nil {
+				entry.FirstBytes.Union(*f.first)
+			}
+			if f.literals == nil {
+				entry.Literals = nil
+			}
+			for _, l := range f.literals {
+				if entry.Literals != nil && !seen[l] {
+					seen[l] = true
+					entry.Literals = append(entry.Literals, l)
+				}
+			}
+		}
+		if len(entry.Literals) > maxPrefilterLiterals {
+			entry.Literals = nil
+		}
+		if entry.FirstBytes != nil || entry.Literals != nil {
+			prefilters = append(prefilters, entry)
+		}
+	}
+
+	changed := len(prefilters) != len(program.Prefilters)
+	for i := 0; !changed && i < len(prefilters); i++ {
+		a, b := prefilters[i], program.Prefilters[i]
+		changed = a.StateID != b.StateID || fmt.Sprint(a.Regexes) != fmt.Sprint(b.Regexes)
+	}
+	program.Prefilters = prefilters
+	return changed, nil
 }
@@ -0,0 +1,104 @@
+package optimizer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Optimization levels, as -O0..-O3
+const (
+	LevelNone    = 0 // No passes: the IR is emitted as lowered
+	LevelBasic   = 1 // Cheap cleanups
+	LevelDefault = 2
+	LevelMax     = 3 // Everything, including expensive analyses
+)
+
+// PassFactory - Creates a fresh instance of a pass for one pipeline
+type PassFactory func() OptimizationPass
+
+// registeredPass - Pass available to pipelines, enabled from Level up
+type registeredPass struct {
+	name    string
+	level   int
+	factory PassFactory
+}
+
+// registry - Passes in pipeline order, the order they were registered
+var registry []registeredPass
+
+// Register - Adds a pass to the pipeline of every level >= level. Passes
+// run in registration order; registering a name twice panics.
+func Register(name string, level int, factory PassFactory) {
+	for _, p := range registry {
+		if p.name == name {
+			panic(fmt.Sprintf("optimizer: pass %q registered twice", name))
+		}
+	}
+	registry = append(registry, registeredPass{name: name, level: level, factory: factory})
+}
+
+// RegisteredPasses - Names of every registered pass, in pipeline order
+func RegisteredPasses() []string {
+	names := make([]string, len(registry))
+	for i, p := range registry {
+		names[i] = p.name
+	}
+	return names
+}
+
+// LevelPasses - Passes enabled at an optimization level
+func LevelPasses(level int) ([]string, error) {
+	if level < LevelNone || level > LevelMax {
+		return nil, fmt.Errorf("invalid optimization level %d (0-%d)", level, LevelMax)
+	}
+	var names []string
+	for _, p := range registry {
+		if p.level <= level {
+			names = append(names, p.name)
+		}
+	}
+	return names, nil
+}
+
+// NewOptimizerLevel - Pipeline of an optimization level
+func NewOptimizerLevel(level int) (*Optimizer, error) {
+	names, err := LevelPasses(level)
+	if err != nil {
+		return nil, err
+	}
+	return NewOptimizerPasses(names)
+}
+
+// NewOptimizerPasses - Pipeline running the named passes in the given order
+func NewOptimizerPasses(names []string) (*Optimizer, error) {
+	o := &Optimizer{}
+	for _, name := range names {
+		p := findPass(name)
+		if p == nil {
+			available := RegisteredPasses()
+			sort.Strings(available)
+			return nil, fmt.Errorf("unknown optimization pass %q (available: %s)", name, strings.Join(available, ", "))
+		}
+		o.passes = append(o.passes, p.factory())
+	}
+	return o, nil
+}
+
+func findPass(name string) *registeredPass {
+	for i := range registry {
+		if registry[i].name == name {
+			return &registry[i]
+		}
+	}
+	return nil
+}
+
+func init() {
+	Register("remove-unreachable-states", LevelBasic, func() OptimizationPass { return &RemoveUnreachableStates{} })
+	Register("merge-equivalent-states", LevelDefault, func() OptimizationPass { return &MergeEquivalentStates{} })
+	Register("simplify-transitions", LevelMax, func() OptimizationPass { return &SimplifyTransitions{} })
+	Register("reorder-by-priority", LevelBasic, func() OptimizationPass { return &ReorderByPriority{} })
+	Register("combine-scanners", LevelDefault, func() OptimizationPass { return &CombineScanners{} })
+	Register("build-prefilters", LevelDefault, func() OptimizationPass { return &BuildPrefilters{} })
+}
@@ -0,0 +1,307 @@
+package optimizer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/internal/ir"
+	"github.com/ferchd/tm2hsl/pkg/regex"
+)
+
+// RuleIssueKind - Problem found by AnalyzeRules
+type RuleIssueKind uint8
+
+const (
+	IssueShadowed  RuleIssueKind = iota // An earlier rule always matches first
+	IssueEmptyLoop                      // The rule can match "" without leaving the state
+)
+
+// RuleIssue - Rule of a state that can never fire or cannot make progress
+type RuleIssue struct {
+	Kind     RuleIssueKind
+	State    uint32
+	Rule     uint32 // Index in the rule table
+	By       uint32 // Shadowing rule, for IssueShadowed
+	Source   string
+	BySource string
+}
+
+func (i RuleIssue) String() string {
+	if i.Kind == IssueShadowed {
+		return fmt.Sprintf("%s: rule can never match, %s always matches first", i.Source, i.BySource)
+	}
+	return fmt.Sprintf("%s: pattern can match the empty string without consuming input and would loop forever", i.Source)
+}
+
+// Budgets of the shadowing check per state; past them the remaining rules
+// of the state are not checked
+const (
+	maxShadowChecks = 2048    // Inclusion tests
+	maxShadowPairs  = 1 << 16 // Candidate pairs compared by their starts
+)
+
+// AnalyzeRules - Finds shadowed rules, whose every match is also a match of
+// a rule tried before them at the same position (`\w+` before `\bif\b`),
+// and empty-match loops: rules staying in their state that can match "",
+// and begin rules that can match "" entering a state whose end pattern
+// always matches "". Patterns the language check cannot handle exactly are
+// never reported as shadowed.
+//
+// A rule is only compared with the earlier rules whose first bytes and
+// literal prefixes allow shadowing it, found through an index, and the
+// inclusion test runs within the budgets above, so grammars with thousands
+// of rules stay fast; past the budgets shadowed rules may go unreported.
+func AnalyzeRules(program *ir.Program) []RuleIssue {
+	a := &ruleAnalysis{
+		program: program,
+		langs:   make(map[uint32]*regex.Language),
+		starts:  make(map[uint32]ruleStart),
+		shadows: make(map[[2]uint32]bool),
+	}
+	var issues []RuleIssue
+	for id, state := range program.StateTable {
+		a.checks, a.pairs = 0, 0
+		earlier := newShadowIndex()
+		for _, j := range ruleIndices(program, uint32(id)) {
+			rule := program.RuleTable[j]
+			if a.emptyLoop(rule) {
+				issues = append(issues, RuleIssue{Kind: IssueEmptyLoop, State: uint32(id), Rule: j, Source: rule.Source})
+			}
+			start := a.start(rule.RegexID)
+			// The end rule is part of the state, not shadowed by its rules
+			if state.Flags&ir.StatePush == 0 || j != state.RuleOffset {
+				for _, i := range earlier.candidates(start) {
+					if a.pairs++; a.pairs > maxShadowPairs {
+						break
+					}
+					if a.shadowedBy(rule, program.RuleTable[i]) {
+						issues = append(issues, RuleIssue{
+							Kind: IssueShadowed, State: uint32(id), Rule: j, By: i,
+							Source: rule.Source, BySource: program.RuleTable[i].Source,
+						})
+						break
+					}
+				}
+			}
+			earlier.add(j, start)
+		}
+	}
+	return issues
+}
+
+// shadowIndex - Rules of a state seen so far, by what their matches start
+// with
+type shadowIndex struct {
+	empty []uint32            // May match ""
+	first [256][]uint32       // By each of their first bytes
+	loose [256][]uint32       // Same, for rules with no literal prefixes
+	words map[string][]uint32 // By each literal prefix
+	stems map[string][]uint32 // By every non-empty start of a literal prefix
+}
+
+func newShadowIndex() *shadowIndex {
+	return &shadowIndex{words: make(map[string][]uint32), stems: make(map[string][]uint32)}
+}
+
+// appendRule - list with rule at the end; rules are added in order, so a
+// duplicate can only be the last one
+func appendRule(list []uint32, rule uint32) []uint32 {
+	if n := len(list); n > 0 && list[n-1] == rule {
+		return list
+	}
+	return append(list, rule)
+}
+
+func (x *shadowIndex) add(rule uint32, s ruleStart) {
+	switch {
+	case !s.parsed:
+	case s.first == nil:
+		x.empty = append(x.empty, rule)
+	default:
+		for b := 0; b < 256; b++ {
+			if s.first.Has(byte(b)) {
+				x.first[b] = append(x.first[b], rule)
+				if s.prefixes == nil {
+					x.loose[b] = append(x.loose[b], rule)
+				}
+			}
+		}
+		for _, p := range s.prefixes {
+			x.words[p] = appendRule(x.words[p], rule)
+			for i := 1; i <= len(p); i++ {
+				x.stems[p[:i]] = appendRule(x.stems[p[:i]], rule)
+			}
+		}
+	}
+}
+
+// candidates - Rules seen so far that mayShadow may accept for a rule
+// starting as s, ascending: those that can match "", those whose literal
+// prefixes extend the first one of s or are extended by it, and, without
+// literal prefixes on either side, those sharing a first byte of s
+func (x *shadowIndex) candidates(s ruleStart) []uint32 {
+	if !s.parsed {
+		return nil
+	}
+	out := append([]uint32(nil), x.empty...)
+	if s.first == nil {
+		return out
+	}
+	index := &x.first
+	if s.prefixes != nil {
+		w := s.prefixes[0]
+		out = append(out, x.stems[w]...)
+		for i := 1; i < len(w); i++ {
+			out = append(out, x.words[w[:i]]...)
+		}
+		index = &x.loose
+	}
+	// Every first byte of s is one of theirs; the shortest list will do
+	var best []uint32
+	found := false
+	for b := 0; b < 256; b++ {
+		if s.first.Has(byte(b)) && (!found || len(index[b]) < len(best)) {
+			best, found = index[b], true
+		}
+	}
+	out = append(out, best...)
+
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	unique := out[:0]
+	for i, r := range out {
+		if i == 0 || r != out[i-1] {
+			unique = append(unique, r)
+		}
+	}
+	return unique
+}
+
+// ruleIndices - Rule table indices of a state, in the order the engine
+// tries them
+func ruleIndices(program *ir.Program, id uint32) []uint32 {
+	state := program.StateTable[id]
+	order := make([]uint32, state.RuleCount)
+	for i := range order {
+		order[i] = state.RuleOffset + uint32(i)
+	}
+	return order
+}
+
+type ruleAnalysis struct {
+	program *ir.Program
+	langs   map[uint32]*regex.Language // By regex ID; nil if the pattern does not parse
+	starts  map[uint32]ruleStart       // By regex ID
+	shadows map[[2]uint32]bool         // Shadows(first, later) by regex IDs
+	checks  int                        // Inclusion tests run in the current state
+	pairs   int                        // Candidate pairs compared in the current state
+}
+
+// ruleStart - What every match of a pattern starts with
+type ruleStart struct {
+	parsed   bool
+	first    *regex.ByteSet // nil if the pattern can match ""
+	prefixes []string       // nil if unknown
+}
+
+func (a *ruleAnalysis) start(id uint32) ruleStart {
+	s, ok := a.starts[id]
+	if !ok {
+		if t, err := regex.Parse(a.program.RegexTable[id].Pattern); err == nil {
+			s.parsed = true
+			if first, ok := regex.FirstBytes(t); ok {
+				s.first = &first
+			}
+			s.prefixes, _ = regex.Prefixes(t)
+		}
+		a.starts[id] = s
+	}
+	return s
+}
+
+// mayShadow - Whether first can match a prefix of every match of later, as
+// far as their first bytes and literal prefixes tell. A non-empty prefix of
+// a match starts with its first byte, and both matches' literal prefixes
+// are prefixes of the same text, so one extends the other.
+func (a *ruleAnalysis) mayShadow(later, first ir.RuleEntry) bool {
+	sl, sf := a.start(later.RegexID), a.start(first.RegexID)
+	if !sl.parsed || !sf.parsed {
+		return false
+	}
+	if sf.first == nil {
+		return true // first may match "", a prefix of anything
+	}
+	if sl.first == nil {
+		return false // later may match "", first cannot
+	}
+	for i := range sl.first {
+		if sl.first[i]&^sf.first[i] != 0 {
+			return false
+		}
+	}
+	if sl.prefixes == nil || sf.prefixes == nil {
+		return true
+	}
+	for _, w := range sl.prefixes {
+		extends := false
+		for _, p := range sf.prefixes {
+			if strings.HasPrefix(w, p) || strings.HasPrefix(p, w) {
+				extends = true
+				break
+			}
+		}
+		if !extends {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *ruleAnalysis) lang(id uint32) *regex.Language {
+	l, ok := a.langs[id]
+	if !ok {
+		if t, err := regex.Parse(a.program.RegexTable[id].Pattern); err == nil {
+			l = regex.NewLanguage(t)
+		}
+		a.langs[id] = l
+	}
+	return l
+}
+
+func (a *ruleAnalysis) shadowedBy(later, first ir.RuleEntry) bool {
+	key := [2]uint32{first.RegexID, later.RegexID}
+	shadowed, ok := a.shadows[key]
+	if !ok {
+		if !a.mayShadow(later, first) {
+			return false
+		}
+		if a.checks >= maxShadowChecks {
+			return false
+		}
+		a.checks++
+		if lf, ll := a.lang(first.RegexID), a.lang(later.RegexID); lf != nil && ll != nil {
+			shadowed, _ = lf.Shadows(ll)
+		}
+		a.shadows[key] = shadowed
+	}
+	return shadowed
+}
+
+func (a *ruleAnalysis) emptyLoop(rule ir.RuleEntry) bool {
+	l := a.lang(rule.RegexID)
+	if l == nil {
+		return false
+	}
+	switch {
+	case rule.NextState == -2:
+		return l.MatchesEmpty() != regex.EmptyNever
+	case rule.NextState >= 0 && int(rule.NextState) < len(a.program.StateTable):
+		target := a.program.StateTable[rule.NextState]
+		if target.Flags&ir.StatePush == 0 || target.RuleCount == 0 || l.MatchesEmpty() == regex.EmptyNever {
+			return false
+		}
+		end := a.lang(a.program.RuleTable[target.RuleOffset].RegexID)
+		return end != nil && end.MatchesEmpty() == regex.EmptyAlways
+	}
+	return false
+}
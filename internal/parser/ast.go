@@ -19,6 +19,11 @@ type TextMateAST struct {
 	FoldingStartMarker string                 `json:"foldingStartMarker" xml:"foldingStartMarker"`
 	FoldingStopMarker  string                 `json:"foldingStopMarker" xml:"foldingStopMarker"`
 
+	// Injections - Patterns injected into scopes matching the selector key
+	Injections map[string]GrammarRule `json:"injections,omitempty" xml:"-"`
+	// InjectionSelector - Scopes of other grammars this grammar injects into
+	InjectionSelector string `json:"injectionSelector,omitempty" xml:"injectionSelector,omitempty"`
+
 	// Fields ignored in normalization but preserved
 	HiddenFields map[string]interface{} `json:"-" xml:"-"`
 }
@@ -0,0 +1,206 @@
+package reference
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/pkg/engine"
+)
+
+// Divergence - First token where the compiled grammar and the reference
+// disagree; Line and Column are 1-based, Column counts bytes
+type Divergence struct {
+	File      string
+	Line      int
+	Column    int
+	Text      string   // Text of the reference token
+	Compiled  []string // Scope stack from the bytecode
+	Reference []string // Scope stack from the reference interpreter
+}
+
+// Result - Outcome for one corpus file
+type Result struct {
+	File       string
+	Lines      int
+	Divergence *Divergence // nil when both agree
+	Err        error       // Tokenization error of the compiled grammar
+}
+
+// FirstDivergence - Compares two tokenizations of the same text position
+// by position. Adjacent tokens with the same scope stack are merged first,
+// so only the scopes assigned to each byte matter.
+func FirstDivergence(compiled, reference []engine.Line) *Divergence {
+	for i := 0; i < len(compiled) && i < len(reference); i++ {
+		text := reference[i].Text
+		got := mergeTokens(compiled[i].Tokens)
+		want := mergeTokens(reference[i].Tokens)
+
+		pos := 0
+		for pos < len(text) {
+			g, w := scopesAt(got, pos), scopesAt(want, pos)
+			if !equalScopes(g.Scopes, w.Scopes) {
+				end := w.End
+				if w.Scopes == nil {
+					end = g.End
+				}
+				if end <= pos {
+					end = len(text)
+				}
+				return &Divergence{
+					Line:      i + 1,
+					Column:    pos + 1,
+					Text:      text[pos:end],
+					Compiled:  g.Scopes,
+					Reference: w.Scopes,
+				}
+			}
+			// Next boundary on either side
+			next := len(text)
+			if g.End > pos && g.End < next {
+				next = g.End
+			}
+			if w.End > pos && w.End < next {
+				next = w.End
+			}
+			pos = next
+		}
+	}
+	return nil
+}
+
+func mergeTokens(tokens []engine.Token) []engine.Token {
+	var out []engine.Token
+	for _, tok := range tokens {
+		if n := len(out); n > 0 && out[n-1].End == tok.Start && equalScopes(out[n-1].Scopes, tok.Scopes) {
+			out[n-1].End = tok.End
+			continue
+		}
+		out = append(out, tok)
+	}
+	return out
+}
+
+// scopesAt - Token covering pos, or the gap up to the next token
+func scopesAt(tokens []engine.Token, pos int) engine.Token {
+	for _, tok := range tokens {
+		if tok.Start > pos {
+			return engine.Token{Start: pos, End: tok.Start}
+		}
+		if pos < tok.End {
+			return tok
+		}
+	}
+	return engine.Token{Start: pos, End: -1}
+}
+
+func equalScopes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// CorpusFiles - Files under the given paths; directories are walked
+// recursively and hidden entries skipped
+func CorpusFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if p != path && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.IsDir() {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// DiffTest - Tokenizes every file with both implementations
+func DiffTest(eng *engine.Engine, ref *Grammar, files []string) ([]Result, error) {
+	results := make([]Result, 0, len(files))
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, diffText(eng, ref, file, string(source)))
+	}
+	return results, nil
+}
+
+func diffText(eng *engine.Engine, ref *Grammar, file, text string) Result {
+	result := Result{File: file}
+	compiled, err := eng.Tokenize(text)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	reference := ref.Tokenize(text)
+	result.Lines = len(reference)
+	if d := FirstDivergence(compiled, reference); d != nil {
+		d.File = file
+		result.Divergence = d
+	}
+	return result
+}
+
+// WriteText - Report with one entry per divergent file and a summary;
+// returns the number of failing files
+func WriteText(w io.Writer, results []Result) (int, error) {
+	var b strings.Builder
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			failed++
+			fmt.Fprintf(&b, "%s: error: %v\n", r.File, r.Err)
+		case r.Divergence != nil:
+			failed++
+			d := r.Divergence
+			fmt.Fprintf(&b, "%s:%d:%d: divergent token %q\n", d.File, d.Line, d.Column, d.Text)
+			fmt.Fprintf(&b, "  compiled:  %s\n", formatScopes(d.Compiled))
+			fmt.Fprintf(&b, "  reference: %s\n", formatScopes(d.Reference))
+		}
+	}
+	fmt.Fprintf(&b, "%d files, %d divergent\n", len(results), failed)
+	_, err := io.WriteString(w, b.String())
+	return failed, err
+}
+
+func formatScopes(scopes []string) string {
+	if len(scopes) == 0 {
+		return "(none)"
+	}
+	return strings.Join(scopes, " ")
+}
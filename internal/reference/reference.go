@@ -0,0 +1,221 @@
+// Package reference tokenizes text directly from a TextMate grammar AST,
+// following vscode-textmate: rules are resolved from the grammar on demand,
+// includes are expanded when a rule is scanned and every open begin rule
+// keeps its own stack frame. It shares no code with the compiler pipeline
+// beyond the regex engine, so it can serve as an oracle for the bytecode.
+package reference
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ferchd/tm2hsl/internal/config"
+	"github.com/ferchd/tm2hsl/internal/parser"
+	"github.com/ferchd/tm2hsl/pkg/regex"
+	"github.com/ferchd/tm2hsl/pkg/selector"
+)
+
+// Grammar - Grammar ready to tokenize
+type Grammar struct {
+	ast        *parser.TextMateAST
+	scopeName  string
+	root       *rule
+	repository map[string]*parser.GrammarRule
+	rules      map[*parser.GrammarRule]*rule
+	injections []injection
+
+	mu      sync.Mutex
+	regexes map[string]*regex.Regexp
+}
+
+type ruleKind int
+
+const (
+	matchRule ruleKind = iota
+	beginEndRule
+	includeOnlyRule
+)
+
+// rule - Grammar rule as vscode-textmate's RuleFactory classifies it:
+// match wins over begin, rules without begin are pattern containers
+type rule struct {
+	kind ruleKind
+	def  *parser.GrammarRule
+
+	// Patterns scanned inside a begin/end rule (or a container), with
+	// includes resolved; built on first use
+	patterns []*rule
+	resolved bool
+}
+
+type injection struct {
+	group    selector.Group
+	priority selector.Priority
+	rule     *rule
+}
+
+// Load - Reads the grammar of a language config. The root scope is the
+// configured scope, as in the compiled bytecode.
+func Load(configPath string) (*Grammar, error) {
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(cfg.GrammarPath())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ast, err := parser.LoadGrammar(file)
+	if err != nil {
+		return nil, err
+	}
+	return New(ast, cfg.Scope)
+}
+
+// New - Prepares a parsed grammar; scopeName is the root scope of tokens
+func New(ast *parser.TextMateAST, scopeName string) (*Grammar, error) {
+	g := &Grammar{
+		ast:        ast,
+		scopeName:  scopeName,
+		repository: make(map[string]*parser.GrammarRule),
+		rules:      make(map[*parser.GrammarRule]*rule),
+		regexes:    make(map[string]*regex.Regexp),
+	}
+
+	for name := range ast.Repository {
+		def := ast.Repository[name]
+		g.repository[name] = &def
+	}
+	g.root = g.ruleFor(&parser.GrammarRule{Patterns: ast.Patterns})
+
+	keys := make([]string, 0, len(ast.Injections))
+	for key := range ast.Injections {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sel, err := selector.Parse(key)
+		if err != nil {
+			return nil, fmt.Errorf("injection: %w", err)
+		}
+		def := ast.Injections[key]
+		r := g.ruleFor(&def)
+		for _, group := range sel.Groups {
+			g.injections = append(g.injections, injection{group: group, priority: group.Priority, rule: r})
+		}
+	}
+	sort.SliceStable(g.injections, func(i, j int) bool {
+		return g.injections[i].priority < g.injections[j].priority
+	})
+
+	return g, nil
+}
+
+func (g *Grammar) ruleFor(def *parser.GrammarRule) *rule {
+	if r, ok := g.rules[def]; ok {
+		return r
+	}
+	r := &rule{def: def}
+	switch {
+	case def.Match != "":
+		r.kind = matchRule
+	case def.Begin == "":
+		r.kind = includeOnlyRule
+	default:
+		r.kind = beginEndRule
+	}
+	g.rules[def] = r
+	return r
+}
+
+// children - Patterns of a rule, or its include when it has none
+func children(def *parser.GrammarRule) []*parser.GrammarRule {
+	if isInclude(def) {
+		return []*parser.GrammarRule{{Include: def.Include}}
+	}
+	defs := make([]*parser.GrammarRule, len(def.Patterns))
+	for i := range def.Patterns {
+		defs[i] = &def.Patterns[i]
+	}
+	return defs
+}
+
+// scanPatterns - Match and begin rules tried inside r, includes expanded
+func (g *Grammar) scanPatterns(r *rule) []*rule {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !r.resolved {
+		r.patterns = g.collect(children(r.def), make(map[*parser.GrammarRule]bool))
+		r.resolved = true
+	}
+	return r.patterns
+}
+
+func (g *Grammar) collect(defs []*parser.GrammarRule, visiting map[*parser.GrammarRule]bool) []*rule {
+	var out []*rule
+	for _, def := range defs {
+		if isInclude(def) {
+			if visiting[def] {
+				continue
+			}
+			visiting[def] = true
+			if target := g.resolveInclude(def.Include); target != nil {
+				out = append(out, g.collect([]*parser.GrammarRule{target}, visiting)...)
+			}
+			delete(visiting, def)
+			continue
+		}
+
+		r := g.ruleFor(def)
+		if r.kind == includeOnlyRule {
+			if visiting[def] {
+				continue
+			}
+			visiting[def] = true
+			out = append(out, g.collect(children(def), visiting)...)
+			delete(visiting, def)
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// isInclude - Reference to another rule, without patterns of its own
+func isInclude(def *parser.GrammarRule) bool {
+	return def.Match == "" && def.Begin == "" && def.Include != "" && len(def.Patterns) == 0
+}
+
+// resolveInclude - $self/$base, #name or name in the repository; other
+// grammars are not available
+func (g *Grammar) resolveInclude(include string) *parser.GrammarRule {
+	switch {
+	case include == "$self" || include == "$base":
+		return g.root.def
+	case strings.HasPrefix(include, "#"):
+		return g.repository[include[1:]]
+	case strings.Contains(include, "."):
+		return nil
+	}
+	return g.repository[include]
+}
+
+// compile - Cached regex; nil for patterns that do not compile
+func (g *Grammar) compile(pattern string) *regex.Regexp {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if re, ok := g.regexes[pattern]; ok {
+		return re
+	}
+	re, err := regex.Compile(pattern)
+	if err != nil {
+		re = nil
+	}
+	g.regexes[pattern] = re
+	return re
+}
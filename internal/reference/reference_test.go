@@ -0,0 +1,89 @@
+package reference
+
+import (
+	"testing"
+
+	"github.com/ferchd/tm2hsl/internal/testgrammar"
+	"github.com/ferchd/tm2hsl/pkg/engine"
+)
+
+// setup - Compiled engine and reference grammar for the shared test
+// grammar
+func setup(t *testing.T) (*engine.Engine, *Grammar) {
+	t.Helper()
+	eng, err := engine.New(testgrammar.Compile(t))
+	if err != nil {
+		t.Fatalf("engine.New: %v", err)
+	}
+	ref, err := New(testgrammar.Load(t), testgrammar.ScopeName)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return eng, ref
+}
+
+func TestGrammar_AgreesWithEngine(t *testing.T) {
+	eng, ref := setup(t)
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"keywords", "if x else y"},
+		{"escapes", `"a\"b" if`},
+		{"captures", "call(if) # TODO later"},
+		{"heredoc", "<<EOF\nif \"x\"\nEOF\nelse"},
+		{"unterminated", "\"open\nstill (open"},
+		{"nested self", "f((g(if)))"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := diffText(eng, ref, tt.name, tt.input)
+			if result.Err != nil {
+				t.Fatalf("Tokenize: %v", result.Err)
+			}
+			if d := result.Divergence; d != nil {
+				t.Errorf("%d:%d %q: compiled %v, reference %v", d.Line, d.Column, d.Text, d.Compiled, d.Reference)
+			}
+		})
+	}
+}
+
+func TestFirstDivergence(t *testing.T) {
+	a := []string{"source.t"}
+	b := []string{"source.t", "keyword.t"}
+	line := func(tokens ...engine.Token) []engine.Line {
+		return []engine.Line{{Text: "if x", Tokens: tokens}}
+	}
+
+	tests := []struct {
+		name      string
+		compiled  []engine.Line
+		reference []engine.Line
+		column    int // 0 when equal
+	}{
+		{"equal", line(engine.Token{Start: 0, End: 2, Scopes: b}, engine.Token{Start: 2, End: 4, Scopes: a}),
+			line(engine.Token{Start: 0, End: 2, Scopes: b}, engine.Token{Start: 2, End: 4, Scopes: a}), 0},
+		{"split tokens merge", line(engine.Token{Start: 0, End: 1, Scopes: a}, engine.Token{Start: 1, End: 4, Scopes: a}),
+			line(engine.Token{Start: 0, End: 4, Scopes: a}), 0},
+		{"different scope", line(engine.Token{Start: 0, End: 4, Scopes: a}),
+			line(engine.Token{Start: 0, End: 2, Scopes: b}, engine.Token{Start: 2, End: 4, Scopes: a}), 1},
+		{"different boundary", line(engine.Token{Start: 0, End: 3, Scopes: b}, engine.Token{Start: 3, End: 4, Scopes: a}),
+			line(engine.Token{Start: 0, End: 2, Scopes: b}, engine.Token{Start: 2, End: 4, Scopes: a}), 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := FirstDivergence(tt.compiled, tt.reference)
+			switch {
+			case tt.column == 0 && d != nil:
+				t.Errorf("unexpected divergence at column %d", d.Column)
+			case tt.column != 0 && d == nil:
+				t.Errorf("expected divergence at column %d", tt.column)
+			case d != nil && d.Column != tt.column:
+				t.Errorf("column = %d, want %d", d.Column, tt.column)
+			}
+		})
+	}
+}
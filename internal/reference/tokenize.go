@@ -0,0 +1,448 @@
+package reference
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/internal/parser"
+	"github.com/ferchd/tm2hsl/pkg/engine"
+	"github.com/ferchd/tm2hsl/pkg/regex"
+)
+
+// stackElement - Open rule, as vscode-textmate's StateStack
+type stackElement struct {
+	parent           *stackElement
+	rule             *rule
+	enterPos         int
+	anchorPos        int
+	beginCapturedEOL bool
+	endRule          string // End pattern with backreferences resolved
+	nameScopes       []string
+	contentScopes    []string
+}
+
+// reset - Positions only make sense on the line a frame was pushed
+func (s *stackElement) reset() {
+	for el := s; el != nil; el = el.parent {
+		el.enterPos = -1
+		el.anchorPos = -1
+	}
+}
+
+func (s *stackElement) safePop() *stackElement {
+	if s.parent != nil {
+		return s.parent
+	}
+	return s
+}
+
+func (s *stackElement) hasSameRuleAs(other *stackElement) bool {
+	for el := s; el != nil && el.enterPos == other.enterPos; el = el.parent {
+		if el.rule == other.rule {
+			return true
+		}
+	}
+	return false
+}
+
+// Tokenize - Tokens of every line of text
+func (g *Grammar) Tokenize(text string) []engine.Line {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if text == "" {
+		lines = nil
+	}
+
+	lt := g.NewLineTokenizer()
+	result := make([]engine.Line, 0, len(lines))
+	for _, line := range lines {
+		result = append(result, engine.Line{Text: line, Tokens: lt.TokenizeLine(line)})
+	}
+	return result
+}
+
+// LineTokenizer - Tokenizes a text one line at a time, keeping the rule
+// stack between lines
+type LineTokenizer struct {
+	g     *Grammar
+	stack *stackElement
+	first bool
+}
+
+// NewLineTokenizer - Tokenizer positioned at the start of a text
+func (g *Grammar) NewLineTokenizer() *LineTokenizer {
+	root := []string{g.scopeName}
+	return &LineTokenizer{
+		g:     g,
+		stack: &stackElement{rule: g.root, enterPos: -1, anchorPos: -1, nameScopes: root, contentScopes: root},
+		first: true,
+	}
+}
+
+// TokenizeLine - Tokens of the next line, without its line break
+func (t *LineTokenizer) TokenizeLine(line string) []engine.Token {
+	if !t.first {
+		t.stack.reset()
+	}
+	lt := &lineTokens{}
+	t.stack = t.g.tokenizeString(line+"\n", t.first, t.stack, lt)
+	t.first = false
+	return lt.result(len(line))
+}
+
+// lineTokens - Token accumulator, as vscode-textmate's LineTokens
+type lineTokens struct {
+	tokens []engine.Token
+	last   int
+}
+
+func (lt *lineTokens) produce(scopes []string, end int) {
+	if lt.last >= end {
+		return
+	}
+	lt.tokens = append(lt.tokens, engine.Token{Start: lt.last, End: end, Scopes: scopes})
+	lt.last = end
+}
+
+// result - Tokens clipped to the line, without its line break
+func (lt *lineTokens) result(length int) []engine.Token {
+	var out []engine.Token
+	for _, tok := range lt.tokens {
+		if tok.End > length {
+			tok.End = length
+		}
+		if tok.Start < tok.End {
+			out = append(out, tok)
+		}
+	}
+	return out
+}
+
+type matchResult struct {
+	rule     *rule
+	caps     []int
+	isEnd    bool
+	priority bool // L: injection
+}
+
+func (g *Grammar) tokenizeString(line string, isFirstLine bool, stack *stackElement, lt *lineTokens) *stackElement {
+	lineLength := len(line)
+	linePos := 0
+	anchorPosition := -1
+
+	for {
+		m := g.matchRuleOrInjections(line, isFirstLine, linePos, stack, anchorPosition)
+		if m == nil {
+			lt.produce(stack.contentScopes, lineLength)
+			return stack
+		}
+
+		caps := m.caps
+		hasAdvanced := caps[1] > linePos
+
+		if m.isEnd {
+			popped := stack
+			lt.produce(stack.contentScopes, caps[0])
+			// The end match is outside contentName
+			g.handleCaptures(line, popped.nameScopes, lt, endCaptures(popped.rule.def), caps)
+			lt.produce(popped.nameScopes, caps[1])
+
+			stack = popped.parent
+			anchorPosition = popped.anchorPos
+
+			if !hasAdvanced && popped.enterPos == linePos {
+				// Grammar pushed & popped a rule without advancing
+				stack = popped
+				lt.produce(stack.contentScopes, lineLength)
+				return stack
+			}
+		} else {
+			r := m.rule
+			lt.produce(stack.contentScopes, caps[0])
+			beforePush := stack
+			nameScopes := pushScopes(stack.contentScopes, replaceCaptures(r.def.Name, line, caps))
+
+			if r.kind == beginEndRule {
+				pushed := &stackElement{
+					parent:           stack,
+					rule:             r,
+					enterPos:         linePos,
+					anchorPos:        anchorPosition,
+					beginCapturedEOL: caps[1] == lineLength,
+					nameScopes:       nameScopes,
+					contentScopes:    nameScopes,
+				}
+				g.handleCaptures(line, nameScopes, lt, beginCaptures(r.def), caps)
+				lt.produce(nameScopes, caps[1])
+				anchorPosition = caps[1]
+
+				pushed.contentScopes = pushScopes(nameScopes, replaceCaptures(r.def.ContentName, line, caps))
+				if hasBackReferences(r.def.End) {
+					pushed.endRule = resolveBackReferences(r.def.End, line, caps)
+				} else {
+					pushed.endRule = r.def.End
+				}
+				stack = pushed
+
+				if !hasAdvanced && beforePush.hasSameRuleAs(stack) {
+					// Grammar pushed the same rule without advancing
+					stack = beforePush
+					lt.produce(stack.contentScopes, lineLength)
+					return stack
+				}
+			} else {
+				g.handleCaptures(line, nameScopes, lt, r.def.Captures, caps)
+				lt.produce(nameScopes, caps[1])
+
+				if !hasAdvanced {
+					// Match rule that does not advance
+					stack = stack.safePop()
+					lt.produce(stack.contentScopes, lineLength)
+					return stack
+				}
+			}
+		}
+
+		if caps[1] > linePos {
+			linePos = caps[1]
+			isFirstLine = false
+		}
+	}
+}
+
+func beginCaptures(def *parser.GrammarRule) map[int]parser.Capture {
+	if def.BeginCaptures != nil {
+		return def.BeginCaptures
+	}
+	return def.Captures
+}
+
+func endCaptures(def *parser.GrammarRule) map[int]parser.Capture {
+	if def.EndCaptures != nil {
+		return def.EndCaptures
+	}
+	return def.Captures
+}
+
+func (g *Grammar) matchRuleOrInjections(line string, isFirstLine bool, linePos int, stack *stackElement, anchorPosition int) *matchResult {
+	m := g.matchRule(line, isFirstLine, linePos, stack, anchorPosition)
+
+	inj := g.matchInjections(line, isFirstLine, linePos, stack, anchorPosition)
+	if inj == nil {
+		return m
+	}
+	if m == nil {
+		return inj
+	}
+	if inj.caps[0] < m.caps[0] || (inj.priority && inj.caps[0] == m.caps[0]) {
+		return inj
+	}
+	return m
+}
+
+// matchRule - First leftmost match among the patterns of the top rule;
+// a begin/end rule tries its end pattern first
+func (g *Grammar) matchRule(line string, isFirstLine bool, linePos int, stack *stackElement, anchorPosition int) *matchResult {
+	var best *matchResult
+	try := func(pattern string, r *rule, isEnd bool) bool {
+		re := g.compile(pattern)
+		if re == nil {
+			return false
+		}
+		caps, _ := re.Search(line, linePos, regex.SearchOptions{
+			Anchor:      anchorPosition,
+			NoTextStart: !isFirstLine,
+			StepLimit:   regex.DefaultStepLimit,
+		})
+		if caps != nil && (best == nil || caps[0] < best.caps[0]) {
+			best = &matchResult{rule: r, caps: caps, isEnd: isEnd}
+			return caps[0] == linePos
+		}
+		return false
+	}
+
+	if stack.rule.kind == beginEndRule && try(stack.endRule, stack.rule, true) {
+		return best
+	}
+	for _, r := range g.scanPatterns(stack.rule) {
+		pattern := r.def.Match
+		if r.kind == beginEndRule {
+			pattern = r.def.Begin
+		}
+		if try(pattern, r, false) {
+			break
+		}
+	}
+	return best
+}
+
+func (g *Grammar) matchInjections(line string, isFirstLine bool, linePos int, stack *stackElement, anchorPosition int) *matchResult {
+	var best *matchResult
+	for _, inj := range g.injections {
+		if !inj.group.Match(stack.contentScopes) {
+			continue
+		}
+		frame := &stackElement{rule: inj.rule}
+		m := g.matchRule(line, isFirstLine, linePos, frame, anchorPosition)
+		if m == nil {
+			continue
+		}
+		if best == nil || m.caps[0] < best.caps[0] {
+			best = m
+			best.priority = inj.priority < 0
+			if m.caps[0] == linePos {
+				break
+			}
+		}
+	}
+	return best
+}
+
+// handleCaptures - Capture tokens; a capture inside a previous one nests
+// its scopes under it
+func (g *Grammar) handleCaptures(line string, base []string, lt *lineTokens, captures map[int]parser.Capture, caps []int) {
+	if len(captures) == 0 {
+		return
+	}
+
+	type localStackElement struct {
+		scopes []string
+		end    int
+	}
+	var local []localStackElement
+	lineLength := len(line)
+
+	for i := 0; 2*i+1 < len(caps); i++ {
+		capture, ok := captures[i]
+		if !ok || capture.Name == "" {
+			continue
+		}
+		start, end := caps[2*i], caps[2*i+1]
+		if start < 0 || end-start == 0 {
+			continue
+		}
+		if start > lineLength {
+			break
+		}
+
+		for len(local) > 0 && local[len(local)-1].end <= start {
+			top := local[len(local)-1]
+			lt.produce(top.scopes, top.end)
+			local = local[:len(local)-1]
+		}
+
+		parent := base
+		if len(local) > 0 {
+			parent = local[len(local)-1].scopes
+		}
+		lt.produce(parent, start)
+		local = append(local, localStackElement{scopes: pushScopes(parent, replaceCaptures(capture.Name, line, caps)), end: end})
+	}
+
+	for len(local) > 0 {
+		top := local[len(local)-1]
+		lt.produce(top.scopes, top.end)
+		local = local[:len(local)-1]
+	}
+}
+
+func pushScopes(scopes []string, name string) []string {
+	if name == "" {
+		return scopes
+	}
+	out := append([]string(nil), scopes...)
+	return append(out, strings.Fields(name)...)
+}
+
+// replaceCaptures - $n and ${n:/downcase|upcase} in scope names
+func replaceCaptures(name, line string, caps []int) string {
+	if !strings.Contains(name, "$") {
+		return name
+	}
+	text := func(group int) string {
+		if 2*group+1 >= len(caps) || caps[2*group] < 0 {
+			return ""
+		}
+		s := line[caps[2*group]:caps[2*group+1]]
+		for strings.HasPrefix(s, ".") {
+			s = s[1:]
+		}
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); {
+		if name[i] == '$' {
+			j := i + 1
+			for j < len(name) && name[j] >= '0' && name[j] <= '9' {
+				j++
+			}
+			if j > i+1 {
+				group, _ := strconv.Atoi(name[i+1 : j])
+				b.WriteString(text(group))
+				i = j
+				continue
+			}
+			if strings.HasPrefix(name[i:], "${") {
+				if end := strings.IndexByte(name[i:], '}'); end > 0 {
+					body := name[i+2 : i+end]
+					if k := strings.Index(body, ":/"); k > 0 {
+						if group, err := strconv.Atoi(body[:k]); err == nil {
+							switch body[k+2:] {
+							case "downcase":
+								b.WriteString(strings.ToLower(text(group)))
+								i += end + 1
+								continue
+							case "upcase":
+								b.WriteString(strings.ToUpper(text(group)))
+								i += end + 1
+								continue
+							}
+						}
+					}
+				}
+			}
+		}
+		b.WriteByte(name[i])
+		i++
+	}
+	return b.String()
+}
+
+func hasBackReferences(pattern string) bool {
+	for i := 0; i+1 < len(pattern); i++ {
+		if pattern[i] == '\\' {
+			if c := pattern[i+1]; c >= '0' && c <= '9' {
+				return true
+			}
+			i++
+		}
+	}
+	return false
+}
+
+// resolveBackReferences - \n in an end pattern becomes the escaped text
+// of begin capture n
+func resolveBackReferences(pattern, line string, caps []int) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '\\' || i+1 == len(pattern) {
+			b.WriteByte(pattern[i])
+			continue
+		}
+		j := i + 1
+		for j < len(pattern) && pattern[j] >= '0' && pattern[j] <= '9' {
+			j++
+		}
+		if j == i+1 {
+			b.WriteString(pattern[i : i+2])
+			i++
+			continue
+		}
+		group, _ := strconv.Atoi(pattern[i+1 : j])
+		if 2*group+1 < len(caps) && caps[2*group] >= 0 {
+			b.WriteString(regex.QuoteMeta(line[caps[2*group]:caps[2*group+1]]))
+		}
+		i = j - 1
+	}
+	return b.String()
+}
@@ -1,7 +1,9 @@
 package serializer
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"os"
 
@@ -20,69 +22,59 @@ func NewSerializer() *Serializer {
 }
 
 func (s *Serializer) Serialize(bytecode *hsl.Bytecode, w io.Writer) error {
-	// 1. Header
-	if err := binary.Write(w, s.byteOrder, &bytecode.Header); err != nil {
-		return err
-	}
-
-	// 2. Write dynamic offsets (will be updated later)
-	offsets := struct {
-		StringTable uint32
-		RegexTable  uint32
-		ScopeTable  uint32
-		StateTable  uint32
-		RuleTable   uint32
-	}{}
-
-	offsetPos, _ := w.(io.Seeker).Seek(0, io.SeekCurrent)
-	if err := binary.Write(w, s.byteOrder, &offsets); err != nil {
-		return err
+	// Tables are written to a buffer first so the header can record their
+	// offsets, the total size and the checksum of everything after it
+	body := &bytes.Buffer{}
+	header := &bytecode.Header
+	sections := []struct {
+		offset *uint32
+		write  func(io.Writer) error
+	}{
+		{&header.StringTableOffset, func(w io.Writer) error { return s.writeStringTable(w, &bytecode.StringTable) }},
+		{&header.RegexTableOffset, func(w io.Writer) error { return s.writeRegexTable(w, &bytecode.RegexTable) }},
+		{&header.ScopeTableOffset, func(w io.Writer) error { return s.writeScopeTable(w, &bytecode.ScopeTable) }},
+		{&header.StateTableOffset, func(w io.Writer) error { return s.writeStateTable(w, &bytecode.StateTable) }},
+		{&header.RuleTableOffset, func(w io.Writer) error { return s.writeRuleTable(w, &bytecode.RuleTable) }},
+		{&header.InjectionOffset, func(w io.Writer) error { return s.writeInjectionTable(w, &bytecode.InjectionTable) }},
 	}
 
-	// 3. String table
-	offsets.StringTable = uint32(offsetPos)
-	if err := s.writeStringTable(w, &bytecode.StringTable); err != nil {
-		return err
+	// Optional tables are only written when they have entries, so files
+	// without them keep the layout older readers expect
+	optional := []struct {
+		offset  *uint32
+		entries int
+		write   func(io.Writer) error
+	}{
+		{&header.ScannerOffset, len(bytecode.ScannerTable.Entries), func(w io.Writer) error { return s.writeScannerTable(w, &bytecode.ScannerTable) }},
+		{&header.PrefilterOffset, len(bytecode.PrefilterTable.Entries), func(w io.Writer) error { return s.writePrefilterTable(w, &bytecode.PrefilterTable) }},
+		{&header.KeywordOffset, len(bytecode.KeywordTable.Entries), func(w io.Writer) error { return s.writeKeywordTable(w, &bytecode.KeywordTable) }},
 	}
-
-	// 4. Regex table
-	offsets.RegexTable = uint32(offsetPos)
-	if err := s.writeRegexTable(w, &bytecode.RegexTable); err != nil {
-		return err
+	for _, table := range optional {
+		*table.offset = 0
+		if table.entries > 0 {
+			sections = append(sections, struct {
+				offset *uint32
+				write  func(io.Writer) error
+			}{table.offset, table.write})
+		}
 	}
 
-	// 5. Scope table
-	offsets.ScopeTable = uint32(offsetPos)
-	if err := s.writeScopeTable(w, &bytecode.ScopeTable); err != nil {
-		return err
+	for _, section := range sections {
+		*section.offset = uint32(hsl.HeaderSize + body.Len())
+		if err := section.write(body); err != nil {
+			return err
+		}
 	}
 
-	// 6. State table
-	offsets.StateTable = uint32(offsetPos)
-	if err := s.writeStateTable(w, &bytecode.StateTable); err != nil {
-		return err
-	}
+	header.HeaderSize = hsl.HeaderSize
+	header.TotalSize = uint32(hsl.HeaderSize + body.Len())
+	header.Checksum = computeChecksum(body.Bytes())
 
-	// 7. Rule table
-	offsets.RuleTable = uint32(offsetPos)
-	if err := s.writeRuleTable(w, &bytecode.RuleTable); err != nil {
+	if err := binary.Write(w, s.byteOrder, header); err != nil {
 		return err
 	}
-
-	// 8. Go back and write real offsets
-	if seeker, ok := w.(io.Seeker); ok {
-		seeker.Seek(offsetPos, io.SeekStart)
-		binary.Write(w, s.byteOrder, &offsets)
-	}
-
-	// 9. Write total size
-	if seeker, ok := w.(io.Seeker); ok {
-		endPos, _ := seeker.Seek(0, io.SeekCurrent)
-		seeker.Seek(int64(binary.Size(bytecode.Header)-8), io.SeekStart)
-		binary.Write(w, s.byteOrder, uint32(endPos))
-	}
-
-	return nil
+	_, err := w.Write(body.Bytes())
+	return err
 }
 
 func (s *Serializer) WriteToFile(bytecode *hsl.Bytecode, path string) error {
@@ -100,8 +92,8 @@ func (s *Serializer) ConvertToBytecode(machine *ir.StateMachine) *hsl.Bytecode {
 	bytecode := &hsl.Bytecode{
 		Header: hsl.Header{
 			Magic:      [4]byte{'H', 'S', 'L', '1'},
-			Version:    1,
-			HeaderSize: uint16(binary.Size(hsl.Header{})),
+			Version:    hsl.FormatVersion,
+			HeaderSize: hsl.HeaderSize,
 		},
 		Name:  machine.Name,
 		Scope: "source.test", // TODO: from machine
@@ -114,6 +106,7 @@ func (s *Serializer) ConvertToBytecode(machine *ir.StateMachine) *hsl.Bytecode {
 	bytecode.ScopeTable = hsl.ScopeTable{Count: 0, Entries: []hsl.ScopeEntry{}}
 	bytecode.StateTable = hsl.StateTable{Count: 0, Entries: []hsl.StateEntry{}}
 	bytecode.RuleTable = hsl.RuleTable{Count: 0, Entries: []hsl.RuleEntry{}}
+	bytecode.InjectionTable = hsl.InjectionTable{SelectorID: hsl.NoString, Count: 0, Entries: []hsl.InjectionEntry{}}
 
 	return bytecode
 }
@@ -156,6 +149,9 @@ func (s *Serializer) writeRegexTable(w io.Writer, table *hsl.RegexTable) error {
 		if err := binary.Write(w, s.byteOrder, entry.Flags); err != nil {
 			return err
 		}
+		if err := binary.Write(w, s.byteOrder, entry.PatternID); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -199,6 +195,9 @@ func (s *Serializer) writeStateTable(w io.Writer, table *hsl.StateTable) error {
 		if err := binary.Write(w, s.byteOrder, entry.Flags); err != nil {
 			return err
 		}
+		if err := binary.Write(w, s.byteOrder, entry.ScopeID); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -239,6 +238,114 @@ func (s *Serializer) writeRuleTable(w io.Writer, table *hsl.RuleTable) error {
 				return err
 			}
 		}
+
+		if err := binary.Write(w, s.byteOrder, entry.SourceID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Serializer) writeInjectionTable(w io.Writer, table *hsl.InjectionTable) error {
+	if err := binary.Write(w, s.byteOrder, table.SelectorID); err != nil {
+		return err
+	}
+	if err := binary.Write(w, s.byteOrder, table.Count); err != nil {
+		return err
+	}
+
+	for _, entry := range table.Entries {
+		if err := binary.Write(w, s.byteOrder, entry.SelectorID); err != nil {
+			return err
+		}
+		if err := binary.Write(w, s.byteOrder, entry.StateID); err != nil {
+			return err
+		}
+		if err := binary.Write(w, s.byteOrder, entry.Priority); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Serializer) writeScannerTable(w io.Writer, table *hsl.ScannerTable) error {
+	if err := binary.Write(w, s.byteOrder, table.Count); err != nil {
+		return err
+	}
+
+	for _, entry := range table.Entries {
+		if len(entry.Lows) != len(entry.Atoms) {
+			return fmt.Errorf("scanner of state %d: %d ranges for %d atoms", entry.StateID, len(entry.Lows), len(entry.Atoms))
+		}
+		fields := []interface{}{
+			entry.StateID,
+			uint16(len(entry.Rules)), entry.Rules,
+			uint32(len(entry.Atoms)),
+		}
+		for i, atom := range entry.Atoms {
+			fields = append(fields, entry.Lows[i], atom)
+		}
+		fields = append(fields,
+			entry.AtomCount, entry.Starts,
+			uint32(len(entry.Accept)/hsl.ScannerContexts), entry.Next, entry.Accept,
+		)
+		for _, f := range fields {
+			if err := binary.Write(w, s.byteOrder, f); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Serializer) writePrefilterTable(w io.Writer, table *hsl.PrefilterTable) error {
+	if err := binary.Write(w, s.byteOrder, table.Count); err != nil {
+		return err
+	}
+
+	for _, entry := range table.Entries {
+		fields := []interface{}{entry.StateID, entry.Flags, entry.FirstBytes, uint16(len(entry.Literals))}
+		for _, literal := range entry.Literals {
+			fields = append(fields, uint16(len(literal)), literal)
+		}
+		for _, f := range fields {
+			if err := binary.Write(w, s.byteOrder, f); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Serializer) writeKeywordTable(w io.Writer, table *hsl.KeywordTable) error {
+	if err := binary.Write(w, s.byteOrder, table.Count); err != nil {
+		return err
+	}
+
+	for _, entry := range table.Entries {
+		fields := []interface{}{entry.RegexID, entry.Flags, entry.Groups, uint32(len(entry.Nodes))}
+		for _, node := range entry.Nodes {
+			if len(node.Labels) != len(node.Next) {
+				return fmt.Errorf("keywords of regex %d: %d labels for %d transitions", entry.RegexID, len(node.Labels), len(node.Next))
+			}
+			final := uint8(0)
+			if node.Final {
+				final = 1
+			}
+			fields = append(fields, final, uint16(len(node.Labels)))
+			for i, label := range node.Labels {
+				fields = append(fields, label, node.Next[i])
+			}
+		}
+		for _, f := range fields {
+			if err := binary.Write(w, s.byteOrder, f); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
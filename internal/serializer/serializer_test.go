@@ -0,0 +1,84 @@
+package serializer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ferchd/tm2hsl/internal/codegen"
+	"github.com/ferchd/tm2hsl/internal/ir"
+	"github.com/ferchd/tm2hsl/pkg/hsl"
+)
+
+func TestSerializer_RoundTrip(t *testing.T) {
+	program := ir.NewProgram("test", "source.test")
+	str := program.AddState(nil, ir.StatePush)
+	program.AddState([]ir.RuleEntry{
+		{
+			RegexID:   program.AddRegex(`"`),
+			Action:    ir.RuleActionPushScope,
+			NextState: int32(str),
+			ScopeID:   program.AddScope("string.quoted.test"),
+			CaptureMap: []ir.CaptureMapping{
+				{Group: 0, ScopeID: program.AddScope("punctuation.definition.string.test")},
+			},
+			Source: "patterns[0]",
+		},
+	}, ir.StateFinal)
+	program.AddInjection("comment", -1, 0)
+
+	bc, err := codegen.NewGenerator(program).Generate()
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := NewSerializer().Serialize(bc, &buf); err != nil {
+		t.Fatalf("Serialize: %v", err)
+	}
+
+	decoded, err := hsl.Decode(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if decoded.Name != "test" || decoded.Scope != "source.test" {
+		t.Errorf("metadata = %q/%q", decoded.Name, decoded.Scope)
+	}
+	if got := len(decoded.StateTable.Entries); got != 2 {
+		t.Fatalf("states = %d, want 2", got)
+	}
+	rules := decoded.StateRules(1)
+	if len(rules) != 1 {
+		t.Fatalf("rules = %d, want 1", len(rules))
+	}
+	rule := rules[0]
+	if got := decoded.RegexPattern(rule.RegexID); got != `"` {
+		t.Errorf("regex = %q", got)
+	}
+	if got := decoded.ScopeName(rule.ScopeID); got != "string.quoted.test" {
+		t.Errorf("scope = %q", got)
+	}
+	if len(rule.Captures) != 1 || decoded.ScopeName(rule.Captures[0].ScopeID) != "punctuation.definition.string.test" {
+		t.Errorf("captures = %+v", rule.Captures)
+	}
+	if source, _ := decoded.StringAt(rule.SourceID); source != "patterns[0]" {
+		t.Errorf("source = %q", source)
+	}
+	if inj := decoded.InjectionTable.Entries; len(inj) != 1 || inj[0].Priority != -1 {
+		t.Errorf("injections = %+v", inj)
+	}
+
+	// Files of an older layout are rejected instead of misread
+	old := append([]byte(nil), buf.Bytes()...)
+	old[4], old[5] = 1, 0
+	if _, err := hsl.Decode(old); err == nil {
+		t.Errorf("expected version error")
+	}
+
+	// Corrupted bodies are rejected by the checksum
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xFF
+	if _, err := hsl.Decode(data); err == nil {
+		t.Errorf("expected checksum error")
+	}
+}
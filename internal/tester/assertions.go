@@ -0,0 +1,255 @@
+package tester
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/pkg/engine"
+)
+
+// Inline assertion files, as read by vscode-tmgrammar-test:
+//
+//	// SYNTAX TEST "source.js" "optional description"
+//	let x = 1
+//	// <--- storage.type.js
+//	//  ^ variable.other.js - keyword
+//
+// The header declares the comment token and the root scope. Assertion lines
+// start with the comment token and check the closest source line above:
+// carets mark columns of that line, "<---" marks columns from the start of
+// the line (each leading "~" skips one). Scopes before an optional "-" must
+// appear in order in the token's scope stack, scopes after it must not
+// appear. Columns are byte offsets.
+
+var (
+	headerPattern    = regexp.MustCompile(`^(\S+)\s+SYNTAX\s+TEST\s+"([^"]+)"(?:\s+"([^"]*)")?\s*$`)
+	upArrowPattern   = regexp.MustCompile(`^\s*((?:\^+\s*)+)((?:\s*[\w][-\w.]*)*)(?:\s*-)?((?:\s*[\w][-\w.]*)*)\s*$`)
+	leftArrowPattern = regexp.MustCompile(`^(\s*)<(~*)(-+)((?:\s*[\w][-\w.]*)*)(?:\s*-)?((?:\s*[\w][-\w.]*)*)\s*$`)
+)
+
+// AssertionFile - Source file with inline scope assertions
+type AssertionFile struct {
+	CommentToken string
+	Scope        string
+	Description  string
+	Source       []SourceLine // Lines tokenized, header and assertions removed
+	Assertions   []ScopeAssertion
+}
+
+// SourceLine - Tokenized line and its 1-based line number in the file
+type SourceLine struct {
+	Number int
+	Text   string
+}
+
+// ScopeAssertion - Expected scopes on some columns of a source line
+type ScopeAssertion struct {
+	Line     int // 1-based line of the assertion in the file
+	Source   int // Index in AssertionFile.Source
+	Ranges   []ColumnRange
+	Scopes   []string // Required, in order
+	Excluded []string // Must not appear
+}
+
+// ColumnRange - Columns [Start, End) of a source line
+type ColumnRange struct {
+	Start, End int
+}
+
+// HasAssertionHeader reports whether data starts with a SYNTAX TEST header
+func HasAssertionHeader(data []byte) bool {
+	first, _, _ := strings.Cut(string(data), "\n")
+	return headerPattern.MatchString(strings.TrimSuffix(first, "\r"))
+}
+
+// ParseAssertionFile parses a file in the vscode-tmgrammar-test format
+func ParseAssertionFile(data []byte) (*AssertionFile, error) {
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	header := headerPattern.FindStringSubmatch(lines[0])
+	if header == nil {
+		return nil, fmt.Errorf(`missing header: expected <comment> SYNTAX TEST "<scope>"`)
+	}
+
+	file := &AssertionFile{
+		CommentToken: header[1],
+		Scope:        header[2],
+		Description:  header[3],
+	}
+
+	for i, line := range lines[1:] {
+		number := i + 2
+		if i == len(lines)-2 && line == "" {
+			// Final line break
+			break
+		}
+
+		rest, isComment := strings.CutPrefix(line, file.CommentToken)
+		if !isComment {
+			file.Source = append(file.Source, SourceLine{Number: number, Text: line})
+			continue
+		}
+
+		offset := len(file.CommentToken)
+		assertion, ok := parseAssertion(rest, offset)
+		if !ok {
+			// Plain comment: part of the source
+			file.Source = append(file.Source, SourceLine{Number: number, Text: line})
+			continue
+		}
+		if len(file.Source) == 0 {
+			return nil, fmt.Errorf("line %d: assertion without a source line above", number)
+		}
+		assertion.Line = number
+		assertion.Source = len(file.Source) - 1
+		file.Assertions = append(file.Assertions, assertion)
+	}
+
+	return file, nil
+}
+
+// parseAssertion - Parses the text after the comment token; offset is the
+// column where that text starts
+func parseAssertion(text string, offset int) (ScopeAssertion, bool) {
+	var a ScopeAssertion
+
+	if m := leftArrowPattern.FindStringSubmatch(text); m != nil {
+		start := len(m[2])
+		a.Ranges = []ColumnRange{{Start: start, End: start + len(m[3])}}
+		a.Scopes, a.Excluded = strings.Fields(m[4]), strings.Fields(m[5])
+		return a, true
+	}
+
+	m := upArrowPattern.FindStringSubmatch(text)
+	if m == nil {
+		return a, false
+	}
+	carets := offset + strings.Index(text, m[1])
+	for i := 0; i < len(m[1]); i++ {
+		if m[1][i] != '^' {
+			continue
+		}
+		col := carets + i
+		if n := len(a.Ranges); n > 0 && a.Ranges[n-1].End == col {
+			a.Ranges[n-1].End++
+		} else {
+			a.Ranges = append(a.Ranges, ColumnRange{Start: col, End: col + 1})
+		}
+	}
+	a.Scopes, a.Excluded = strings.Fields(m[2]), strings.Fields(m[3])
+	return a, true
+}
+
+// runAssertionFile - Tokenizes the source lines and checks every
+// assertion; all failures of the file are reported together
+func (t *Tester) runAssertionFile(data []byte) error {
+	file, err := ParseAssertionFile(data)
+	if err != nil {
+		return err
+	}
+	if scope := t.engine.ScopeName(); file.Scope != scope {
+		return fmt.Errorf("test is for %q, grammar scope is %q", file.Scope, scope)
+	}
+
+	texts := make([]string, len(file.Source))
+	for i, line := range file.Source {
+		texts[i] = line.Text
+	}
+	lines, err := t.engine.Tokenize(strings.Join(texts, "\n"))
+	if err != nil {
+		return fmt.Errorf("tokenization failed: %w", err)
+	}
+
+	var failures []string
+	for _, a := range file.Assertions {
+		line := lines[a.Source]
+		if msg := checkAssertion(a, line.Text, scopesByColumn(line.Text, line.Tokens)); msg != "" {
+			failures = append(failures, fmt.Sprintf("line %d: %s", file.Source[a.Source].Number, msg))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d failed assertions\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// scopesByColumn - Scope stack of every byte of the line
+func scopesByColumn(text string, tokens []engine.Token) [][]string {
+	columns := make([][]string, len(text))
+	for _, tok := range tokens {
+		for col := tok.Start; col < tok.End; col++ {
+			columns[col] = tok.Scopes
+		}
+	}
+	return columns
+}
+
+// checkAssertion - Failure message with the source line and carets under
+// the failing columns, or "" when the assertion holds
+func checkAssertion(a ScopeAssertion, text string, columns [][]string) string {
+	var failing []int
+	var problem string
+	var actual []string
+
+	for _, r := range a.Ranges {
+		for col := r.Start; col < r.End; col++ {
+			var msg string
+			if col >= len(columns) {
+				msg = "column beyond end of line"
+			} else {
+				msg = scopeProblem(columns[col], a.Scopes, a.Excluded)
+			}
+			if msg == "" {
+				continue
+			}
+			if problem == "" {
+				problem = msg
+				if col < len(columns) {
+					actual = columns[col]
+				}
+			}
+			failing = append(failing, col)
+		}
+	}
+	if len(failing) == 0 {
+		return ""
+	}
+
+	carets := make([]byte, failing[len(failing)-1]+1)
+	for i := range carets {
+		carets[i] = ' '
+	}
+	for _, col := range failing {
+		carets[col] = '^'
+	}
+
+	var b strings.Builder
+	b.WriteString(problem)
+	fmt.Fprintf(&b, "\n    %s\n    %s", text, carets)
+	if actual != nil {
+		fmt.Fprintf(&b, "\n    actual: %s", strings.Join(actual, " "))
+	}
+	return b.String()
+}
+
+// scopeProblem - Why a scope stack fails the assertion, "" if it passes
+func scopeProblem(stack, required, excluded []string) string {
+	next := 0
+	for _, scope := range stack {
+		if next < len(required) && scope == required[next] {
+			next++
+		}
+	}
+	if next < len(required) {
+		return fmt.Sprintf("missing scopes: %s", strings.Join(required[next:], " "))
+	}
+
+	for _, ex := range excluded {
+		for _, scope := range stack {
+			if scope == ex {
+				return fmt.Sprintf("unexpected scope: %s", ex)
+			}
+		}
+	}
+	return ""
+}
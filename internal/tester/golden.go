@@ -1,46 +1,205 @@
 package tester
 
 import (
+	"bytes"
 	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/ferchd/tm2hsl/internal/compiler"
+	"github.com/ferchd/tm2hsl/internal/parser"
+	"github.com/ferchd/tm2hsl/internal/serializer"
+	"github.com/ferchd/tm2hsl/pkg/engine"
+	"github.com/ferchd/tm2hsl/pkg/hsl"
 )
 
-// RunGoldenTest runs a golden test using compiled grammar
-func RunGoldenTest(configPath, input string) ([]TokenExpectation, error) {
-	// Compile grammar
+// LoadGrammar compiles the grammar of a language config and loads it in
+// the tokenizer. The bytecode goes through the serializer and decoder so
+// tests exercise the same bytes `tm2hsl compile` writes.
+func LoadGrammar(configPath string) (*engine.Engine, error) {
+	bc, _, err := compileGrammar(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return engine.New(bc)
+}
+
+// compileGrammar - Decoded bytecode of a language config and the grammar
+// it was compiled from
+func compileGrammar(configPath string) (*hsl.Bytecode, *parser.TextMateAST, error) {
 	cmp := compiler.NewCompiler()
 	result, err := cmp.Compile(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("compilation failed: %w", err)
+		return nil, nil, fmt.Errorf("compilation failed: %w", err)
 	}
 
-	// TODO: Use compiled bytecode to tokenize input
-	// For now, return stub tokens
-	tokens := []TokenExpectation{
-		{Scope: "source.test", Text: input},
+	var buf bytes.Buffer
+	if err := serializer.NewSerializer().Serialize(result.Bytecode, &buf); err != nil {
+		return nil, nil, fmt.Errorf("serialization failed: %w", err)
 	}
+	bc, err := hsl.Decode(buf.Bytes())
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding failed: %w", err)
+	}
+	return bc, result.Grammar, nil
+}
 
-	_ = result // Use result
-	return tokens, nil
+// Tokenize returns the token stream of input: the innermost scope, scope
+// stack, text and position of every token. Adjacent tokens with the same
+// scope stack are merged and line breaks are not part of any token.
+func Tokenize(eng *engine.Engine, input string) ([]TokenExpectation, error) {
+	lines, err := eng.Tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	return lineTokens(lines), nil
 }
 
-// CompareResults compares actual vs expected tokens
-func (t *Tester) compareResults(actual, expected []TokenExpectation) error {
-	if len(actual) != len(expected) {
-		return fmt.Errorf("token count mismatch: got %d, expected %d", len(actual), len(expected))
+func lineTokens(lines []engine.Line) []TokenExpectation {
+	var tokens []TokenExpectation
+	for i, line := range lines {
+		for _, tok := range mergeTokens(line.Tokens) {
+			start, end := tok.Start, tok.End
+			tokens = append(tokens, TokenExpectation{
+				Scope:  tok.Scopes[len(tok.Scopes)-1],
+				Scopes: tok.Scopes,
+				Text:   line.Text[tok.Start:tok.End],
+				Line:   i + 1,
+				Start:  &start,
+				End:    &end,
+			})
+		}
 	}
+	return tokens
+}
 
+// RunGoldenTest runs a golden test using compiled grammar
+func RunGoldenTest(configPath, input string) ([]TokenExpectation, error) {
+	eng, err := LoadGrammar(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return Tokenize(eng, input)
+}
+
+// CompareResults compares actual vs expected tokens. The error names the
+// first mismatch and shows both token lists side by side.
+func (t *Tester) compareResults(actual []TokenExpectation, tc TestCase) error {
+	expected := tc.Expected
+	first := ""
 	for i, exp := range expected {
 		if i >= len(actual) {
-			return fmt.Errorf("missing token at position %d", i)
+			first = fmt.Sprintf("missing token at position %d: expected %s", i, describe(exp))
+			break
+		}
+		if msg := tokenMismatch(actual[i], exp, tc.Contains); msg != "" {
+			first = fmt.Sprintf("token mismatch at %d: %s", i, msg)
+			break
+		}
+	}
+
+	if first == "" && len(actual) != len(expected) && !(tc.IgnoreRemaining && len(actual) > len(expected)) {
+		first = fmt.Sprintf("token count mismatch: got %d, expected %d", len(actual), len(expected))
+	}
+	if first == "" {
+		return nil
+	}
+	return &MismatchError{Message: first, Diff: tokenTable(actual, tc)}
+}
+
+// tokenMismatch - Which checked field of exp differs from act, "" if none
+func tokenMismatch(act, exp TokenExpectation, contains bool) string {
+	contains = contains || exp.Contains
+
+	if exp.Scope != "" {
+		ok := act.Scope == exp.Scope
+		if contains {
+			ok = containsScopes(act.Scopes, []string{exp.Scope})
 		}
-		act := actual[i]
-		if act.Scope != exp.Scope || act.Text != exp.Text {
-			return fmt.Errorf("token mismatch at %d: got %q/%q, expected %q/%q",
-				i, act.Scope, act.Text, exp.Scope, exp.Text)
+		if !ok {
+			return fmt.Sprintf("got %q/%q, expected %q/%q", act.Scope, act.Text, exp.Scope, exp.Text)
 		}
 	}
+	if len(exp.Scopes) > 0 {
+		ok := strings.Join(act.Scopes, " ") == strings.Join(exp.Scopes, " ")
+		if contains {
+			ok = containsScopes(act.Scopes, exp.Scopes)
+		}
+		if !ok {
+			return fmt.Sprintf("scopes %q, expected %q", strings.Join(act.Scopes, " "), strings.Join(exp.Scopes, " "))
+		}
+	}
+	if exp.Text != "" && act.Text != exp.Text {
+		return fmt.Sprintf("got %q/%q, expected %q/%q", act.Scope, act.Text, exp.Scope, exp.Text)
+	}
+	if exp.Line != 0 && act.Line != exp.Line {
+		return fmt.Sprintf("%q is on line %d, expected %d", act.Text, act.Line, exp.Line)
+	}
+	if exp.Start != nil && *act.Start != *exp.Start || exp.End != nil && *act.End != *exp.End {
+		return fmt.Sprintf("%q spans %s-%s, expected %s-%s", act.Text, column(act.Start), column(act.End), column(exp.Start), column(exp.End))
+	}
+	return ""
+}
 
-	return nil
+// containsScopes - want appears in stack in order, not necessarily
+// contiguous; like a scope selector, "string" matches "string.quoted"
+func containsScopes(stack, want []string) bool {
+	next := 0
+	for _, scope := range stack {
+		if next < len(want) && (scope == want[next] || strings.HasPrefix(scope, want[next]+".")) {
+			next++
+		}
+	}
+	return next == len(want)
+}
+
+func describe(tok TokenExpectation) string {
+	scope := tok.Scope
+	if len(tok.Scopes) > 0 {
+		scope = strings.Join(tok.Scopes, " ")
+	}
+	var pos string
+	if tok.Line != 0 || tok.Start != nil || tok.End != nil {
+		pos = fmt.Sprintf("%d:%s-%s ", tok.Line, column(tok.Start), column(tok.End))
+	}
+	return fmt.Sprintf("%s%q %s", pos, tok.Text, scope)
+}
+
+// column - Column of a token position, "?" when not given
+func column(col *int) string {
+	if col == nil {
+		return "?"
+	}
+	return strconv.Itoa(*col)
+}
+
+// tokenTable - Expected and actual tokens side by side; "!" marks rows that
+// differ, "-" expected tokens with no actual one, "+" extra actual tokens
+func tokenTable(actual []TokenExpectation, tc TestCase) string {
+	rows := len(tc.Expected)
+	if len(actual) > rows && !tc.IgnoreRemaining {
+		rows = len(actual)
+	}
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  \t#\texpected\tactual")
+	for i := 0; i < rows; i++ {
+		var exp, act, mark string
+		switch {
+		case i >= len(actual):
+			exp, mark = describe(tc.Expected[i]), "-"
+		case i >= len(tc.Expected):
+			act, mark = describe(actual[i]), "+"
+		default:
+			exp, act = describe(tc.Expected[i]), describe(actual[i])
+			if tokenMismatch(actual[i], tc.Expected[i], tc.Contains) != "" {
+				mark = "!"
+			}
+		}
+		fmt.Fprintf(w, "%s \t%d\t%s\t%s\n", mark, i, exp, act)
+	}
+	w.Flush()
+	return strings.TrimRight(b.String(), "\n")
 }
@@ -0,0 +1,234 @@
+package tester
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Report formats accepted by WriteReport
+const (
+	ReportJUnit = "junit"
+	ReportTAP   = "tap"
+	ReportJSON  = "json"
+)
+
+// WriteReport - Writes the report in a CI format; name identifies the
+// grammar under test
+func WriteReport(w io.Writer, format string, report *TestReport, name string) error {
+	switch format {
+	case ReportJUnit:
+		return WriteJUnit(w, report, name)
+	case ReportTAP:
+		return WriteTAP(w, report)
+	case ReportJSON:
+		return WriteJSON(w, report)
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",cdata"`
+}
+
+// WriteJUnit - JUnit XML with one testsuite per spec file
+func WriteJUnit(w io.Writer, report *TestReport, name string) error {
+	suites := junitSuites{
+		Name:     name,
+		Tests:    len(report.Results),
+		Failures: report.Failed,
+		Skipped:  report.Skipped,
+		Time:     seconds(report.Duration.Seconds()),
+	}
+
+	index := make(map[string]int)
+	var times []float64
+	for _, r := range report.Results {
+		i, ok := index[r.File]
+		if !ok {
+			i = len(suites.Suites)
+			index[r.File] = i
+			suites.Suites = append(suites.Suites, junitSuite{Name: r.File})
+			times = append(times, 0)
+		}
+		suite := &suites.Suites[i]
+		times[i] += r.Duration.Seconds()
+
+		tc := junitCase{Name: r.Case, Classname: r.File, Time: seconds(r.Duration.Seconds())}
+		if r.Failure != nil {
+			tc.Failure = &junitFailure{
+				Message: r.Failure.Error,
+				Type:    "mismatch",
+				Body:    failureText(r.Failure),
+			}
+			suite.Failures++
+		}
+		if r.Skipped {
+			tc.Skipped = &junitSkipped{Message: skipReason}
+			suite.Skipped++
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, tc)
+	}
+	for i := range suites.Suites {
+		suites.Suites[i].Time = seconds(times[i])
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// skipReason - Why a test in the report did not run
+const skipReason = "not run after an earlier failure (fail fast)"
+
+func seconds(s float64) string {
+	return fmt.Sprintf("%.6f", s)
+}
+
+func failureText(f *TestFailure) string {
+	if f.Diff == "" {
+		return f.Error
+	}
+	return f.Error + "\n" + f.Diff
+}
+
+// WriteTAP - TAP version 13, failures with a YAML diagnostic block and
+// skipped tests with a SKIP directive
+func WriteTAP(w io.Writer, report *TestReport) error {
+	var b strings.Builder
+	b.WriteString("TAP version 13\n")
+	fmt.Fprintf(&b, "1..%d\n", len(report.Results))
+	for i, r := range report.Results {
+		status := "ok"
+		if r.Failure != nil {
+			status = "not ok"
+		}
+		if r.Skipped {
+			fmt.Fprintf(&b, "ok %d - %s # SKIP %s\n", i+1, tapDescription(r), skipReason)
+			continue
+		}
+		fmt.Fprintf(&b, "%s %d - %s\n", status, i+1, tapDescription(r))
+		if r.Failure == nil {
+			continue
+		}
+		b.WriteString("  ---\n")
+		fmt.Fprintf(&b, "  message: %s\n", yamlString(r.Failure.Error))
+		fmt.Fprintf(&b, "  file: %s\n", yamlString(r.File))
+		fmt.Fprintf(&b, "  duration_ms: %.3f\n", float64(r.Duration.Microseconds())/1000)
+		if r.Failure.Diff != "" {
+			b.WriteString("  diff: |\n")
+			for _, line := range strings.Split(r.Failure.Diff, "\n") {
+				fmt.Fprintf(&b, "    %s\n", line)
+			}
+		}
+		b.WriteString("  ...\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// tapDescription - "file: case", without characters TAP gives a meaning
+func tapDescription(r TestResult) string {
+	desc := r.File
+	if r.Case != r.File {
+		desc += ": " + r.Case
+	}
+	return strings.NewReplacer("#", `\#`, "\n", " ").Replace(desc)
+}
+
+// yamlString - Double-quoted YAML scalar
+func yamlString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+type jsonReport struct {
+	Passed   int          `json:"passed"`
+	Failed   int          `json:"failed"`
+	Skipped  int          `json:"skipped,omitempty"`
+	Updated  int          `json:"updated,omitempty"`
+	Duration float64      `json:"duration"`
+	Results  []jsonResult `json:"results"`
+}
+
+type jsonResult struct {
+	File     string  `json:"file"`
+	Case     string  `json:"case"`
+	Passed   bool    `json:"passed"`
+	Skipped  bool    `json:"skipped,omitempty"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+	Diff     string  `json:"diff,omitempty"`
+}
+
+// WriteJSON - Report as JSON; durations are in seconds
+func WriteJSON(w io.Writer, report *TestReport) error {
+	out := jsonReport{
+		Passed:   report.Passed,
+		Failed:   report.Failed,
+		Skipped:  report.Skipped,
+		Updated:  report.Updated,
+		Duration: report.Duration.Seconds(),
+		Results:  []jsonResult{},
+	}
+	for _, r := range report.Results {
+		result := jsonResult{
+			File:     r.File,
+			Case:     r.Case,
+			Passed:   r.Failure == nil && !r.Skipped,
+			Skipped:  r.Skipped,
+			Duration: r.Duration.Seconds(),
+		}
+		if r.Failure != nil {
+			result.Error = r.Failure.Error
+			result.Diff = r.Failure.Diff
+		}
+		out.Results = append(out.Results, result)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -0,0 +1,160 @@
+package tester
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ferchd/tm2hsl/pkg/engine"
+)
+
+// SnapshotExt - Extension of the token dump stored next to each input
+const SnapshotExt = ".snap"
+
+// Snapshot renders tokenized lines in the vscode-tmgrammar-snap format:
+// every source line prefixed with ">", then one "#" line per token with
+// carets under its text and its full scope stack. Adjacent tokens with the
+// same stack are merged.
+//
+//	>if x
+//	#^^ source.simplescript keyword.control.simplescript
+//	#  ^ source.simplescript
+//	#   ^ source.simplescript variable.other.simplescript
+func Snapshot(lines []engine.Line) string {
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(">")
+		b.WriteString(line.Text)
+		b.WriteByte('\n')
+
+		for _, tok := range mergeTokens(line.Tokens) {
+			b.WriteString("#")
+			b.WriteString(strings.Repeat(" ", tok.Start))
+			b.WriteString(strings.Repeat("^", tok.End-tok.Start))
+			b.WriteString(" ")
+			b.WriteString(strings.Join(tok.Scopes, " "))
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+func mergeTokens(tokens []engine.Token) []engine.Token {
+	var out []engine.Token
+	for _, tok := range tokens {
+		if n := len(out); n > 0 && out[n-1].End == tok.Start &&
+			strings.Join(out[n-1].Scopes, " ") == strings.Join(tok.Scopes, " ") {
+			out[n-1].End = tok.End
+			continue
+		}
+		out = append(out, tok)
+	}
+	return out
+}
+
+// snapshotInputs - Files under dir that are not snapshots; hidden entries
+// are skipped
+func snapshotInputs(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && filepath.Ext(path) != SnapshotExt {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// snapshotJobs - One job per input of SnapshotDir: compare it against its
+// .snap file, or rewrite the snapshot in Update mode
+func (t *Tester) snapshotJobs() ([]job, error) {
+	files, err := snapshotInputs(t.SnapshotDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshot inputs: %w", err)
+	}
+
+	jobs := make([]job, 0, len(files))
+	for _, file := range files {
+		file := file
+		name, _ := filepath.Rel(t.SnapshotDir, file)
+		jobs = append(jobs, job{
+			file:     name,
+			name:     name,
+			snapshot: true,
+			run:      func() error { return t.runSnapshot(file) },
+		})
+	}
+	return jobs, nil
+}
+
+func (t *Tester) runSnapshot(file string) error {
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	lines, err := t.engine.Tokenize(string(source))
+	if err != nil {
+		return fmt.Errorf("tokenization failed: %w", err)
+	}
+	actual := Snapshot(lines)
+
+	snapPath := file + SnapshotExt
+	if t.Update {
+		return os.WriteFile(snapPath, []byte(actual), 0o644)
+	}
+
+	expected, err := os.ReadFile(snapPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("missing snapshot %s (run with --update to create it)", filepath.Base(snapPath))
+	}
+	if err != nil {
+		return err
+	}
+	return compareSnapshot(string(expected), actual)
+}
+
+// compareSnapshot - Reports the first differing line of the dumps, with
+// the source line it belongs to
+func compareSnapshot(expected, actual string) error {
+	exp := strings.Split(strings.ReplaceAll(expected, "\r\n", "\n"), "\n")
+	act := strings.Split(actual, "\n")
+
+	source := ""
+	for i := 0; i < len(exp) || i < len(act); i++ {
+		var e, a string
+		if i < len(exp) {
+			e = exp[i]
+		}
+		if i < len(act) {
+			a = act[i]
+		}
+		if e == a {
+			if strings.HasPrefix(a, ">") {
+				source = a
+			}
+			continue
+		}
+
+		var b strings.Builder
+		if source != "" && !strings.HasPrefix(e, ">") {
+			fmt.Fprintf(&b, "  %s\n", source)
+		}
+		fmt.Fprintf(&b, "- %s\n+ %s", e, a)
+		return &MismatchError{
+			Message: fmt.Sprintf("snapshot mismatch at line %d", i+1),
+			Diff:    b.String(),
+		}
+	}
+	return nil
+}
@@ -1,28 +1,71 @@
 package tester
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/BurntSushi/toml"
+
+	"github.com/ferchd/tm2hsl/internal/coverage"
+	"github.com/ferchd/tm2hsl/internal/fuzz"
+	"github.com/ferchd/tm2hsl/pkg/engine"
 )
 
 // TestCase represents a single tokenization test
 type TestCase struct {
 	Name     string             `toml:"name"`
 	Input    string             `toml:"input"`
-	Expected []TokenExpectation `toml:"expected"`
+	Expected []TokenExpectation `toml:"expected,omitempty"`
+
+	// Setup is tokenized before Input to reach its initial state (inside a
+	// block comment, a string...); its tokens are not checked
+	Setup string `toml:"setup,omitempty"`
+	// Contains applies "contains" matching to every expected token
+	Contains bool `toml:"contains,omitempty"`
+	// IgnoreRemaining accepts tokens after the last expected one
+	IgnoreRemaining bool `toml:"ignore_remaining,omitempty"`
+	// Invariants also checks the tokenizer invariants of `tm2hsl fuzz`
+	// on Setup and Input
+	Invariants bool `toml:"invariants,omitempty"`
 }
 
-// TokenExpectation defines expected token
+// TokenExpectation defines expected token. Empty fields are not checked;
+// Start and End are checked when given, even as 0. As an actual token every
+// field is filled.
 type TokenExpectation struct {
-	Scope string `toml:"scope"`
-	Text  string `toml:"text"`
+	Scope  string   `toml:"scope"`  // Innermost scope
+	Scopes []string `toml:"scopes"` // Full scope stack, root first
+	Text   string   `toml:"text"`
+	Line   int      `toml:"line"`  // 1-based line of Input
+	Start  *int     `toml:"start"` // Byte columns [Start, End) in the line
+	End    *int     `toml:"end"`
+
+	// Contains checks that Scope is somewhere in the stack and that Scopes
+	// appear in it in order, instead of exact matches. Scopes match by
+	// prefix: "string" matches "string.quoted.double".
+	Contains bool `toml:"contains"`
 }
 
 // Tester runs tokenization tests
-type Tester struct{}
+type Tester struct {
+	SnapshotDir string         // Inputs compared against their .snap files, "" to skip
+	Update      bool           // Rewrite snapshots instead of comparing them
+	Filter      *regexp.Regexp // Runs only tests whose "file/case" matches
+	Parallel    int            // Tests run at once; <= 1 runs them in order
+	FailFast    bool           // Stop starting tests after the first failure
+	Coverage    bool           // Count rule hits into TestReport.Coverage
+
+	engine *engine.Engine // Grammar under test, compiled once per Run
+}
 
 // NewTester creates a new tester
 func NewTester() *Tester {
@@ -33,68 +76,367 @@ func NewTester() *Tester {
 type TestReport struct {
 	Passed   int
 	Failed   int
+	Skipped  int // Not started because FailFast stopped the run
+	Updated  int // Snapshots written in Update mode
+	Duration time.Duration
+	Results  []TestResult // Every test, skipped ones included, in order
 	Failures []TestFailure
+	Coverage *coverage.Report // Rule hits, when Tester.Coverage is set
+}
+
+// TestResult is the outcome of one test: a TOML case, an assertion file or
+// a snapshot
+type TestResult struct {
+	File     string // Spec file, relative to its directory
+	Case     string
+	Duration time.Duration
+	Failure  *TestFailure // nil when the test passed or was skipped
+	Skipped  bool         // Not started because FailFast stopped the run
 }
 
 // TestFailure describes a failed test
 type TestFailure struct {
 	TestName string
 	Error    string
+	File     string
+	Case     string
+	Duration time.Duration
+	Diff     string // Expected vs actual tokens, when available
+}
+
+// MismatchError is a comparison failure with a detailed diff
+type MismatchError struct {
+	Message string
+	Diff    string
+}
+
+func (e *MismatchError) Error() string {
+	if e.Diff == "" {
+		return e.Message
+	}
+	return e.Message + "\n" + e.Diff
+}
+
+// record - Adds the outcome of a test
+func (r *TestReport) record(file, name string, duration time.Duration, err error) {
+	result := TestResult{File: file, Case: name, Duration: duration}
+	if err == nil {
+		r.Passed++
+		r.Results = append(r.Results, result)
+		return
+	}
+
+	failure := TestFailure{
+		TestName: name,
+		Error:    err.Error(),
+		File:     file,
+		Case:     name,
+		Duration: result.Duration,
+	}
+	var mismatch *MismatchError
+	if errors.As(err, &mismatch) {
+		failure.Error = mismatch.Message
+		failure.Diff = mismatch.Diff
+	}
+	r.Failed++
+	r.Failures = append(r.Failures, failure)
+	result.Failure = &failure
+	r.Results = append(r.Results, result)
 }
 
 // Run executes tests from spec directory
 func (t *Tester) Run(configPath, specDir string) (*TestReport, error) {
-	files, err := filepath.Glob(filepath.Join(specDir, "*.toml"))
+	bc, grammar, err := compileGrammar(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list spec files: %w", err)
+		return nil, err
+	}
+	t.engine, err = engine.New(bc)
+	if err != nil {
+		return nil, err
+	}
+	if t.Coverage {
+		t.engine.CountRuleHits()
+	}
+
+	begin := time.Now()
+	jobs, err := t.collectJobs(specDir)
+	if err != nil {
+		return nil, err
+	}
+	if t.Filter != nil {
+		selected := jobs[:0]
+		for _, j := range jobs {
+			if t.Filter.MatchString(j.file + "/" + j.name) {
+				selected = append(selected, j)
+			}
+		}
+		jobs = selected
 	}
 
 	report := &TestReport{}
-	for _, file := range files {
-		if err := t.runSpecFile(file, report); err != nil {
-			return nil, fmt.Errorf("failed to run spec %s: %w", file, err)
+	for i, out := range t.execute(jobs) {
+		j := jobs[i]
+		switch {
+		case !out.ran:
+			report.Skipped++
+			report.Results = append(report.Results, TestResult{File: j.file, Case: j.name, Skipped: true})
+		case j.snapshot && t.Update && out.err == nil:
+			report.Updated++
+		default:
+			report.record(j.file, j.name, out.duration, out.err)
 		}
 	}
 
+	if t.Coverage {
+		report.Coverage = coverage.New(bc, grammar, t.engine.RuleHits())
+	}
+	report.Duration = time.Since(begin)
 	return report, nil
 }
 
-func (t *Tester) runSpecFile(path string, report *TestReport) error {
-	data, err := os.ReadFile(path)
+// job - One test: a TOML case, an assertion file or a snapshot
+type job struct {
+	file     string
+	name     string
+	snapshot bool // Counts as updated, not passed, in Update mode
+	run      func() error
+}
+
+type outcome struct {
+	ran      bool
+	err      error
+	duration time.Duration
+}
+
+// specFile - TOML spec or assertion file of a spec directory
+type specFile struct {
+	name      string     // Relative to the spec directory
+	cases     []TestCase // Cases of a TOML spec
+	assertion []byte     // Contents of an assertion file, nil for a TOML spec
+}
+
+// readSpecDir - TOML specs of specDir, then the files starting with a
+// SYNTAX TEST header, each in name order
+func readSpecDir(specDir string) ([]specFile, error) {
+	paths, err := filepath.Glob(filepath.Join(specDir, "*.toml"))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to list spec files: %w", err)
 	}
 
-	var specs struct {
-		Cases []TestCase `toml:"cases"`
+	var files []specFile
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cases, err := parseSpec(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read spec %s: %w", path, err)
+		}
+		files = append(files, specFile{name: filepath.Base(path), cases: cases})
 	}
 
-	if err := toml.Unmarshal(data, &specs); err != nil {
-		return fmt.Errorf("failed to parse TOML: %w", err)
+	// Any other file starting with a SYNTAX TEST header is an inline
+	// assertion file
+	entries, err := os.ReadDir(specDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list spec files: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) == ".toml" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(specDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if HasAssertionHeader(data) {
+			files = append(files, specFile{name: entry.Name(), assertion: data})
+		}
+	}
+	return files, nil
+}
+
+// collectJobs - Tests of the spec directory and the snapshot directory, in
+// a stable order: TOML specs, assertion files, then snapshots
+func (t *Tester) collectJobs(specDir string) ([]job, error) {
+	files, err := readSpecDir(specDir)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, tc := range specs.Cases {
-		if err := t.runTestCase(tc, report); err != nil {
-			report.Failed++
-			report.Failures = append(report.Failures, TestFailure{
-				TestName: tc.Name,
-				Error:    err.Error(),
+	var jobs []job
+	for _, f := range files {
+		if f.assertion != nil {
+			data := f.assertion
+			jobs = append(jobs, job{
+				file: f.name,
+				name: f.name,
+				run:  func() error { return t.runAssertionFile(data) },
+			})
+			continue
+		}
+		for _, tc := range f.cases {
+			tc := tc
+			jobs = append(jobs, job{
+				file: f.name,
+				name: tc.Name,
+				run:  func() error { return t.runTestCase(tc) },
 			})
-		} else {
-			report.Passed++
 		}
 	}
 
-	return nil
+	if t.SnapshotDir != "" {
+		snapJobs, err := t.snapshotJobs()
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, snapJobs...)
+	}
+	return jobs, nil
+}
+
+// execute - Runs the jobs on Parallel workers sharing the compiled
+// grammar; outcomes keep the order of jobs. With FailFast no job starts
+// after a failure.
+func (t *Tester) execute(jobs []job) []outcome {
+	outcomes := make([]outcome, len(jobs))
+	var failed atomic.Bool
+	var next atomic.Int64
+
+	worker := func() {
+		for {
+			i := int(next.Add(1)) - 1
+			if i >= len(jobs) || (t.FailFast && failed.Load()) {
+				return
+			}
+			start := time.Now()
+			err := runJob(jobs[i])
+			outcomes[i] = outcome{ran: true, err: err, duration: time.Since(start)}
+			if err != nil {
+				failed.Store(true)
+			}
+		}
+	}
+
+	workers := t.Parallel
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker()
+		}()
+	}
+	wg.Wait()
+	return outcomes
+}
+
+// runJob - Runs a job, reporting a panic of the tokenizer as its failure
+func runJob(j job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return j.run()
 }
 
-func (t *Tester) runTestCase(tc TestCase, report *TestReport) error {
+func parseSpec(data []byte) ([]TestCase, error) {
+	var specs struct {
+		Cases []TestCase `toml:"cases"`
+	}
+
+	if err := toml.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("failed to parse TOML: %w", err)
+	}
+	return specs.Cases, nil
+}
+
+func (t *Tester) runTestCase(tc TestCase) error {
 	// Run tokenization
-	actual, err := RunGoldenTest("dummy-config", tc.Input) // TODO: Pass real config
+	input := tc.Input
+	if tc.Setup != "" {
+		input = strings.TrimSuffix(tc.Setup, "\n") + "\n" + tc.Input
+	}
+	if tc.Invariants {
+		if v := fuzz.Check(t.engine, input); v != nil {
+			return fmt.Errorf("invariant violated: %w", v)
+		}
+	}
+	lines, err := t.engine.Tokenize(input)
 	if err != nil {
 		return fmt.Errorf("tokenization failed: %w", err)
 	}
+	if tc.Setup != "" {
+		lines = lines[strings.Count(strings.TrimSuffix(tc.Setup, "\n"), "\n")+1:]
+	}
 
 	// Compare results
-	return t.compareResults(actual, tc.Expected)
+	return t.compareResults(lineTokens(lines), tc)
+}
+
+// SpecInputs - Source text of the TOML cases (setup and input) and of the
+// assertion files in specDir, used to seed `tm2hsl fuzz`
+func SpecInputs(specDir string) ([]string, error) {
+	files, err := readSpecDir(specDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var inputs []string
+	for _, f := range files {
+		if f.assertion != nil {
+			af, err := ParseAssertionFile(f.assertion)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read spec %s: %w", f.name, err)
+			}
+			var lines []string
+			for _, line := range af.Source {
+				lines = append(lines, line.Text)
+			}
+			inputs = append(inputs, strings.Join(lines, "\n"))
+			continue
+		}
+		for _, tc := range f.cases {
+			input := tc.Input
+			if tc.Setup != "" {
+				input = strings.TrimSuffix(tc.Setup, "\n") + "\n" + tc.Input
+			}
+			inputs = append(inputs, input)
+		}
+	}
+	return inputs, nil
+}
+
+// WriteFuzzSpec - Writes the crashes of `tm2hsl fuzz` as cases checking
+// invariants only to dir/fuzz-<hash>.toml, so `tm2hsl test` keeps checking
+// them; returns the file written
+func WriteFuzzSpec(dir string, crashes []fuzz.Crash) (string, error) {
+	var specs struct {
+		Cases []TestCase `toml:"cases"`
+	}
+	for _, c := range crashes {
+		specs.Cases = append(specs.Cases, TestCase{
+			Name:            fmt.Sprintf("fuzz: %s %q", c.Violation.Invariant, c.Input),
+			Input:           c.Input,
+			Invariants:      true,
+			IgnoreRemaining: true,
+		})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by `tm2hsl fuzz`: minimized inputs breaking tokenizer invariants\n\n")
+	if err := toml.NewEncoder(&buf).Encode(specs); err != nil {
+		return "", fmt.Errorf("failed to encode spec: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("fuzz-%08x.toml", crc32.ChecksumIEEE(buf.Bytes())))
+	return path, os.WriteFile(path, buf.Bytes(), 0o644)
 }
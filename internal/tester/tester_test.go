@@ -0,0 +1,384 @@
+package tester
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/ferchd/tm2hsl/internal/coverage"
+	"github.com/ferchd/tm2hsl/internal/fuzz"
+)
+
+const exampleConfig = "../../examples/language.toml"
+
+func TestTester_Run(t *testing.T) {
+	tstr := NewTester()
+	tstr.SnapshotDir = "../../examples/snapshots"
+	report, err := tstr.Run(exampleConfig, "../../examples/specs")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if report.Failed != 0 || report.Passed == 0 {
+		t.Errorf("report = %d passed, %d failed: %+v", report.Passed, report.Failed, report.Failures)
+	}
+}
+
+func TestTester_RunReportsMismatch(t *testing.T) {
+	dir := t.TempDir()
+	spec := `[[cases]]
+name = "wrong scope"
+input = "if"
+expected = [{ scope = "keyword.other", text = "if" }]
+`
+	if err := os.WriteFile(filepath.Join(dir, "wrong.toml"), []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := NewTester().Run(exampleConfig, dir)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if report.Failed != 1 || len(report.Failures) != 1 {
+		t.Fatalf("report = %d passed, %d failed", report.Passed, report.Failed)
+	}
+	if msg := report.Failures[0].Error; !strings.Contains(msg, "keyword.control.simplescript") {
+		t.Errorf("failure %q does not show the actual scope", msg)
+	}
+}
+
+func TestTester_RunAssertionFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		wantErr string // Substring of the failure, "" when it passes
+	}{
+		{
+			name:   "passes",
+			source: "// SYNTAX TEST \"source.simplescript\"\nif x\n// <-- keyword.control.simplescript\n// ^ variable.other.simplescript - keyword\n",
+		},
+		{
+			name:    "caret under failing column",
+			source:  "// SYNTAX TEST \"source.simplescript\"\nx = if\n//^^^^ keyword.control.simplescript\n",
+			wantErr: "line 2: missing scopes: keyword.control.simplescript\n    x = if\n      ^^\n",
+		},
+		{
+			name:    "excluded scope",
+			source:  "// SYNTAX TEST \"source.simplescript\"\nif\n// <- source.simplescript - keyword.control.simplescript\n",
+			wantErr: "unexpected scope: keyword.control.simplescript",
+		},
+		{
+			name:    "other grammar",
+			source:  "# SYNTAX TEST \"source.python\"\npass\n",
+			wantErr: `test is for "source.python"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "case.ss"), []byte(tt.source), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			report, err := NewTester().Run(exampleConfig, dir)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if tt.wantErr == "" {
+				if report.Failed != 0 || report.Passed != 1 {
+					t.Errorf("report = %d passed, %d failed: %+v", report.Passed, report.Failed, report.Failures)
+				}
+				return
+			}
+			if report.Failed != 1 {
+				t.Fatalf("report = %d passed, %d failed", report.Passed, report.Failed)
+			}
+			if msg := report.Failures[0].Error; !strings.Contains(msg, tt.wantErr) {
+				t.Errorf("failure %q does not contain %q", msg, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTester_RunSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ss")
+	if err := os.WriteFile(input, []byte("if x\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run := func(update bool) *TestReport {
+		t.Helper()
+		tstr := NewTester()
+		tstr.SnapshotDir = dir
+		tstr.Update = update
+		report, err := tstr.Run(exampleConfig, filepath.Join(dir, "specs"))
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		return report
+	}
+
+	if report := run(false); report.Failed != 1 {
+		t.Fatalf("missing snapshot: report = %d passed, %d failed", report.Passed, report.Failed)
+	}
+	if report := run(true); report.Updated != 1 || report.Failed != 0 {
+		t.Fatalf("update: report = %d updated, %d failed", report.Updated, report.Failed)
+	}
+	if report := run(false); report.Passed != 1 || report.Failed != 0 {
+		t.Fatalf("compare: report = %d passed, %d failed: %+v", report.Passed, report.Failed, report.Failures)
+	}
+
+	if err := os.WriteFile(input, []byte("else x\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	report := run(false)
+	if report.Failed != 1 {
+		t.Fatalf("changed input: report = %d passed, %d failed", report.Passed, report.Failed)
+	}
+	want := "snapshot mismatch at line 1\n- >if x\n+ >else x"
+	f := report.Failures[0]
+	if msg := f.Error + "\n" + f.Diff; msg != want {
+		t.Errorf("failure = %q, want %q", msg, want)
+	}
+}
+
+func TestTester_CompareResults(t *testing.T) {
+	eng, err := LoadGrammar(exampleConfig)
+	if err != nil {
+		t.Fatalf("LoadGrammar: %v", err)
+	}
+	tstr := &Tester{engine: eng}
+
+	keyword := TokenExpectation{Scope: "keyword.control.simplescript", Text: "if"}
+	col := func(n int) *int { return &n }
+	tests := []struct {
+		name    string
+		tc      TestCase
+		wantErr string // Substring of the error, "" when it passes
+	}{
+		{"ignore remaining", TestCase{Input: "if x", IgnoreRemaining: true, Expected: []TokenExpectation{keyword}}, ""},
+		{"extra tokens", TestCase{Input: "if x", Expected: []TokenExpectation{keyword}},
+			"+   1  "},
+		{"full stack", TestCase{Input: "if", Expected: []TokenExpectation{
+			{Scopes: []string{"source.simplescript", "keyword.control.simplescript"}},
+		}}, ""},
+		{"stack mismatch", TestCase{Input: "if", Expected: []TokenExpectation{
+			{Scopes: []string{"keyword.control.simplescript"}},
+		}}, `scopes "source.simplescript keyword.control.simplescript"`},
+		{"contains prefix", TestCase{Input: "if", Contains: true, Expected: []TokenExpectation{{Scope: "keyword"}}}, ""},
+		{"position", TestCase{Input: "x\n  if", IgnoreRemaining: true, Expected: []TokenExpectation{
+			{Text: "x", Line: 1}, {Text: "  ", Line: 2}, {Text: "if", Line: 2, Start: col(2), End: col(4)},
+		}}, ""},
+		{"wrong position", TestCase{Input: "x if", IgnoreRemaining: true, Expected: []TokenExpectation{
+			{Text: "x", Line: 1, Start: col(1), End: col(2)},
+		}}, `"x" spans 0-1, expected 1-2`},
+		{"empty span at 0", TestCase{Input: "x if", IgnoreRemaining: true, Expected: []TokenExpectation{
+			{Text: "x", Start: col(0), End: col(0)},
+		}}, `"x" spans 0-1, expected 0-0`},
+		{"start only", TestCase{Input: "x if", IgnoreRemaining: true, Expected: []TokenExpectation{
+			{Text: "x", Start: col(0)}, {Start: col(2)},
+		}}, `" " spans 1-2, expected 2-?`},
+		{"setup state", TestCase{Setup: "\"open", Input: "still\" if", IgnoreRemaining: true, Expected: []TokenExpectation{
+			{Scope: "string.quoted.double.simplescript", Text: "still\"", Line: 1},
+		}}, ""},
+		{"missing token", TestCase{Input: "if", Expected: []TokenExpectation{keyword, keyword}},
+			"missing token at position 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tstr.runTestCase(tt.tc)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected failure: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("expected failure containing %q", tt.wantErr)
+			case err != nil && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("failure %q does not contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	failure := &TestFailure{TestName: "b", Error: "token mismatch at 0", File: "x.toml", Case: "b", Diff: "!  0  a  b"}
+	report := &TestReport{
+		Passed:   1,
+		Failed:   1,
+		Skipped:  1,
+		Results:  []TestResult{{File: "x.toml", Case: "a"}, {File: "x.toml", Case: "b", Failure: failure}, {File: "x.toml", Case: "c", Skipped: true}},
+		Failures: []TestFailure{*failure},
+	}
+
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{ReportJUnit, []string{
+			`<testsuite name="x.toml" tests="3" failures="1" skipped="1"`,
+			`<failure message="token mismatch at 0" type="mismatch"><![CDATA[token mismatch at 0` + "\n" + `!  0  a  b]]></failure>`,
+			`<skipped message="not run after an earlier failure (fail fast)"></skipped>`,
+		}},
+		{ReportTAP, []string{"1..3\nok 1 - x.toml: a\nnot ok 2 - x.toml: b\n", "  diff: |\n    !  0  a  b\n", "ok 3 - x.toml: c # SKIP not run after an earlier failure (fail fast)\n"}},
+		{ReportJSON, []string{`"case": "b"`, `"passed": false`, `"diff": "!  0  a  b"`, `"skipped": 1`, `"case": "c",` + "\n" + `      "passed": false,` + "\n" + `      "skipped": true`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var b strings.Builder
+			if err := WriteReport(&b, tt.format, report, "grammar"); err != nil {
+				t.Fatalf("WriteReport: %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(b.String(), want) {
+					t.Errorf("report does not contain %q:\n%s", want, b.String())
+				}
+			}
+		})
+	}
+}
+
+func TestTester_RunSelection(t *testing.T) {
+	dir := t.TempDir()
+	spec := `[[cases]]
+name = "first"
+input = "if"
+expected = [{ scope = "keyword.control.simplescript", text = "if" }]
+
+[[cases]]
+name = "broken"
+input = "if"
+expected = [{ scope = "keyword.other", text = "if" }]
+
+[[cases]]
+name = "last"
+input = "x"
+expected = [{ scope = "variable.other.simplescript", text = "x" }]
+`
+	if err := os.WriteFile(filepath.Join(dir, "cases.toml"), []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		filter   string
+		parallel int
+		failFast bool
+		want     []string // Cases reported, in order
+	}{
+		{"all in order", "", 1, false, []string{"first", "broken", "last"}},
+		{"parallel keeps order", "", 4, false, []string{"first", "broken", "last"}},
+		{"filter on case", "st$", 4, false, []string{"first", "last"}},
+		{"filter on file", "^cases.toml/b", 1, false, []string{"broken"}},
+		{"fail fast", "", 1, true, []string{"first", "broken", "last (skipped)"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tstr := NewTester()
+			tstr.Parallel = tt.parallel
+			tstr.FailFast = tt.failFast
+			if tt.filter != "" {
+				tstr.Filter = regexp.MustCompile(tt.filter)
+			}
+			report, err := tstr.Run(exampleConfig, dir)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			var got []string
+			for _, r := range report.Results {
+				if r.Skipped {
+					r.Case += " (skipped)"
+				}
+				got = append(got, r.Case)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("cases = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTester_RunCoverage(t *testing.T) {
+	dir := t.TempDir()
+	spec := `[[cases]]
+name = "keyword"
+input = "if x"
+ignore_remaining = true
+expected = [{ scope = "keyword.control.simplescript", text = "if" }]
+`
+	if err := os.WriteFile(filepath.Join(dir, "cases.toml"), []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tstr := NewTester()
+	tstr.Coverage = true
+	report, err := tstr.Run(exampleConfig, dir)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if report.Coverage == nil {
+		t.Fatal("no coverage report")
+	}
+
+	hits := make(map[string]uint64)
+	for _, rule := range report.Coverage.Rules {
+		hits[rule.Source] = rule.Hits
+	}
+	for source, want := range map[string]uint64{
+		"patterns[2]":                     1, // Keywords
+		"patterns[5]":                     1, // Variables
+		"patterns[4]":                     0, // Numbers
+		"repository.strings.end":          0,
+		"repository.comments.patterns[0]": 0,
+	} {
+		if got, ok := hits[source]; !ok || got != want {
+			t.Errorf("hits[%s] = %d (found %v), want %d", source, got, ok, want)
+		}
+	}
+
+	var b strings.Builder
+	if err := coverage.WriteHTML(&b, report.Coverage); err != nil {
+		t.Fatalf("WriteHTML: %v", err)
+	}
+	if !strings.Contains(b.String(), `<div class="rule miss">`+"\n"+`<div class="path">patterns[4]`) {
+		t.Errorf("HTML does not highlight the unmatched number rule")
+	}
+}
+
+func TestWriteFuzzSpec(t *testing.T) {
+	dir := t.TempDir()
+	crashes := []fuzz.Crash{{
+		Input:     "if \"x\ny",
+		Violation: &fuzz.Violation{Invariant: fuzz.InvariantCoverage, Line: 1},
+	}}
+	path, err := WriteFuzzSpec(dir, crashes)
+	if err != nil {
+		t.Fatalf("WriteFuzzSpec: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Generated by `tm2hsl fuzz`: minimized inputs breaking tokenizer invariants\n\n" +
+		"[[cases]]\n" +
+		"  name = \"fuzz: coverage \\\"if \\\\\\\"x\\\\ny\\\"\"\n" +
+		"  input = \"if \\\"x\\ny\"\n" +
+		"  ignore_remaining = true\n" +
+		"  invariants = true\n"
+	if string(data) != want {
+		t.Errorf("spec:\n%s\nwant:\n%s", data, want)
+	}
+
+	// The cases run as written, checking invariants only
+	report, err := NewTester().Run(exampleConfig, dir)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if report.Passed != 1 || report.Failed != 0 {
+		t.Errorf("report = %d passed, %d failed: %+v", report.Passed, report.Failed, report.Failures)
+	}
+}
@@ -0,0 +1,63 @@
+// Package testgrammar compiles a small grammar shared by the engine,
+// reference and fuzz tests: comments with an injection, strings with
+// escapes, a heredoc with a back-referenced end, captures, a recursive
+// group and a pattern that backtracks catastrophically
+package testgrammar
+
+import (
+	"bytes"
+	_ "embed"
+	"strings"
+	"testing"
+
+	"github.com/ferchd/tm2hsl/internal/codegen"
+	"github.com/ferchd/tm2hsl/internal/normalizer"
+	"github.com/ferchd/tm2hsl/internal/optimizer"
+	"github.com/ferchd/tm2hsl/internal/parser"
+	"github.com/ferchd/tm2hsl/internal/serializer"
+	"github.com/ferchd/tm2hsl/pkg/hsl"
+)
+
+// ScopeName - Root scope of the grammar
+const ScopeName = "source.t"
+
+//go:embed testdata/grammar.json
+var source string
+
+// Load - Parsed grammar
+func Load(t testing.TB) *parser.TextMateAST {
+	t.Helper()
+	ast, err := parser.LoadGrammar(strings.NewReader(source))
+	if err != nil {
+		t.Fatalf("LoadGrammar: %v", err)
+	}
+	return ast
+}
+
+// Compile - Bytecode of the grammar after the given passes, read back from
+// its serialized form. Callers load it with engine.New: the engine tests
+// use this package, so it cannot import the engine.
+func Compile(t testing.TB, passes ...optimizer.OptimizationPass) *hsl.Bytecode {
+	t.Helper()
+	program, err := normalizer.NewNormalizer().Lower(Load(t), "T", ScopeName)
+	if err != nil {
+		t.Fatalf("Lower: %v", err)
+	}
+	for _, p := range passes {
+		if _, err := p.Apply(program); err != nil {
+			t.Fatalf("%s: %v", p.Name(), err)
+		}
+	}
+	bc, err := codegen.NewGenerator(program).Generate()
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := serializer.NewSerializer().Serialize(bc, &buf); err != nil {
+		t.Fatalf("Serialize: %v", err)
+	}
+	if bc, err = hsl.Decode(buf.Bytes()); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	return bc
+}
@@ -0,0 +1,436 @@
+// Package engine tokenizes text with compiled HSL bytecode, following the
+// TextMate execution model: the leftmost match among the rules of the
+// current state wins (earlier rules win ties), begin rules push a state
+// that ends with their end pattern, and injections add rules wherever their
+// selector matches the scope stack.
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/ferchd/tm2hsl/pkg/hsl"
+	"github.com/ferchd/tm2hsl/pkg/regex"
+	"github.com/ferchd/tm2hsl/pkg/selector"
+)
+
+// Engine - Loaded grammar, safe for concurrent use
+type Engine struct {
+	name       string
+	rootScope  string
+	states     []state
+	injections []injection
+	warnings   []string
+	stepLimit  int
+
+	// End patterns with backreferences, compiled per begin match
+	dynamicMu  sync.Mutex
+	dynamicEnd map[string]*regex.Regexp
+
+	generation atomic.Uint64
+
+	ruleCount int
+	hits      []atomic.Uint64 // Per rule table entry, nil unless CountRuleHits
+}
+
+type state struct {
+	rules   []*rule
+	content string // contentName, may reference begin captures
+
+	// DFA matching the rules at positions scanned at once; the other rules
+	// are searched one by one
+	scanner *regex.Scanner
+	scanned []int  // Position in rules of each scanner rule
+	covered []bool // By position in rules
+
+	// Prefilter: every match of the rules starts with a byte of first or a
+	// literal of literals; nil when unknown
+	first    *regex.ByteSet
+	literals *regex.Literals
+}
+
+type rule struct {
+	index    uint32 // Position in the rule table
+	regex    *regex.Regexp
+	pattern  string
+	action   uint8
+	next     int16
+	scope    string
+	captures []capture
+	source   string
+
+	// End pattern referencing begin captures (\1), resolved per frame
+	dynamic bool
+
+	// Trie matching the pattern when it is a keyword list, nil otherwise
+	keywords *keywords
+}
+
+// keywords - Keyword list pattern, \b(if|else)\b, matched with a trie
+type keywords struct {
+	trie   *regex.Keywords
+	groups int // Capturing groups, each spanning the whole word
+}
+
+type capture struct {
+	group int
+	scope string
+}
+
+type injection struct {
+	group    selector.Group
+	priority int8
+	state    uint32
+}
+
+// New - Prepares a decoded bytecode for tokenization. Patterns that fail to
+// compile disable their rule and are reported by Warnings.
+func New(bc *hsl.Bytecode) (*Engine, error) {
+	e := &Engine{
+		name:       bc.Name,
+		rootScope:  bc.Scope,
+		stepLimit:  regex.DefaultStepLimit,
+		dynamicEnd: make(map[string]*regex.Regexp),
+		ruleCount:  len(bc.RuleTable.Entries),
+	}
+
+	regexes := make([]*regex.Regexp, len(bc.RegexTable.Entries))
+	regexErrs := make([]error, len(bc.RegexTable.Entries))
+	for i, entry := range bc.RegexTable.Entries {
+		pattern := bc.RegexPattern(uint32(i))
+		if entry.Flags&hsl.RegexProgram != 0 {
+			regexes[i], regexErrs[i] = regex.Decode(pattern, entry.Bytecode)
+		} else {
+			regexes[i], regexErrs[i] = regex.Compile(pattern)
+		}
+	}
+
+	tries := make([]*keywords, len(bc.RegexTable.Entries))
+	for _, entry := range bc.KeywordTable.Entries {
+		if int(entry.RegexID) >= len(tries) {
+			return nil, fmt.Errorf("keywords of regex %d: regex out of range", entry.RegexID)
+		}
+		kw, err := loadKeywords(entry)
+		if err != nil {
+			return nil, fmt.Errorf("keywords of regex %d: %w", entry.RegexID, err)
+		}
+		tries[entry.RegexID] = kw
+	}
+
+	e.states = make([]state, len(bc.StateTable.Entries))
+	for i, entry := range bc.StateTable.Entries {
+		s := state{content: bc.ScopeName(entry.ScopeID)}
+		for j, re := range bc.StateRules(uint32(i)) {
+			r, err := e.loadRule(bc, re, entry.RuleOffset+uint32(j), regexes, regexErrs)
+			if err != nil {
+				return nil, err
+			}
+			r.keywords = tries[re.RegexID]
+			s.rules = append(s.rules, r)
+		}
+		e.states[i] = s
+	}
+
+	for _, entry := range bc.ScannerTable.Entries {
+		if err := e.loadScanner(entry); err != nil {
+			return nil, fmt.Errorf("scanner of state %d: %w", entry.StateID, err)
+		}
+	}
+	for _, entry := range bc.PrefilterTable.Entries {
+		if int(entry.StateID) >= len(e.states) {
+			return nil, fmt.Errorf("prefilter of state %d: state out of range", entry.StateID)
+		}
+		e.loadPrefilter(&e.states[entry.StateID], entry)
+	}
+
+	for _, entry := range bc.InjectionTable.Entries {
+		text, _ := bc.StringAt(entry.SelectorID)
+		sel, err := selector.Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("injection selector %q: %w", text, err)
+		}
+		if int(entry.StateID) >= len(e.states) {
+			return nil, fmt.Errorf("injection %q: state %d out of range", text, entry.StateID)
+		}
+		for _, group := range sel.Groups {
+			e.injections = append(e.injections, injection{group: group, priority: entry.Priority, state: entry.StateID})
+		}
+	}
+	// L: injections are tried first so they win ties among injections
+	sort.SliceStable(e.injections, func(i, j int) bool {
+		return e.injections[i].priority < e.injections[j].priority
+	})
+
+	return e, nil
+}
+
+func (e *Engine) loadRule(bc *hsl.Bytecode, re hsl.RuleEntry, index uint32, regexes []*regex.Regexp, errs []error) (*rule, error) {
+	if int(re.RegexID) >= len(regexes) {
+		return nil, fmt.Errorf("rule %d: regex %d out of range", index, re.RegexID)
+	}
+	if re.NextState >= 0 && int(re.NextState) >= len(bc.StateTable.Entries) {
+		return nil, fmt.Errorf("rule %d: next state %d out of range", index, re.NextState)
+	}
+
+	r := &rule{
+		index:   index,
+		regex:   regexes[re.RegexID],
+		pattern: bc.RegexPattern(re.RegexID),
+		action:  re.Action,
+		next:    re.NextState,
+		scope:   bc.ScopeName(re.ScopeID),
+	}
+	r.source, _ = bc.StringAt(re.SourceID)
+	for _, c := range re.Captures {
+		r.captures = append(r.captures, capture{group: int(c.Group), scope: bc.ScopeName(c.ScopeID)})
+	}
+
+	if re.Action == hsl.ActionPopScope && hasBackReferences(r.pattern) {
+		r.dynamic = true
+		return r, nil
+	}
+	if err := errs[re.RegexID]; err != nil {
+		where := r.source
+		if where == "" {
+			where = fmt.Sprintf("rule %d", index)
+		}
+		e.warnings = append(e.warnings, fmt.Sprintf("%s: %v", where, err))
+	}
+	return r, nil
+}
+
+// loadKeywords - Trie of a keyword table entry
+func loadKeywords(entry hsl.KeywordEntry) (*keywords, error) {
+	t := regex.KeywordTables{Fold: entry.Flags&hsl.KeywordFold != 0, Edges: []uint32{0}}
+	for _, n := range entry.Nodes {
+		if len(n.Labels) != len(n.Next) {
+			return nil, fmt.Errorf("%d labels for %d transitions", len(n.Labels), len(n.Next))
+		}
+		t.Labels = append(t.Labels, n.Labels...)
+		t.Next = append(t.Next, n.Next...)
+		t.Edges = append(t.Edges, uint32(len(t.Labels)))
+		t.Final = append(t.Final, n.Final)
+	}
+	trie, err := regex.NewKeywordsTables(t)
+	if err != nil {
+		return nil, err
+	}
+	return &keywords{trie: trie, groups: int(entry.Groups)}, nil
+}
+
+// loadScanner - Attaches a scanner to its state. Rules the scanner cannot
+// stand in for (disabled or resolved per frame) leave the state without it.
+func (e *Engine) loadScanner(entry hsl.ScannerEntry) error {
+	if int(entry.StateID) >= len(e.states) {
+		return fmt.Errorf("state out of range")
+	}
+	s := &e.states[entry.StateID]
+	t := regex.ScannerTables{
+		Atoms:     entry.Atoms,
+		AtomCount: int(entry.AtomCount),
+		Starts:    entry.Starts,
+		Next:      entry.Next,
+		Accept:    entry.Accept,
+	}
+	for i, lo := range entry.Lows {
+		hi := rune(unicode.MaxRune)
+		if i+1 < len(entry.Lows) {
+			hi = rune(entry.Lows[i+1]) - 1
+		}
+		t.Ranges = append(t.Ranges, rune(lo), hi)
+	}
+	sc, err := regex.NewScanner(t)
+	if err != nil {
+		return err
+	}
+	for i := range entry.Accept {
+		if r := entry.Accept[i]; r != hsl.ScannerNoRule && int(r) >= len(entry.Rules) {
+			return fmt.Errorf("rule %d out of range", r)
+		}
+	}
+
+	covered := make([]bool, len(s.rules))
+	scanned := make([]int, len(entry.Rules))
+	for i, pos := range entry.Rules {
+		if int(pos) >= len(s.rules) || covered[pos] {
+			return fmt.Errorf("rule position %d out of range", pos)
+		}
+		if r := s.rules[pos]; r.regex == nil || r.dynamic {
+			return nil
+		}
+		covered[pos] = true
+		scanned[i] = int(pos)
+	}
+	s.scanner, s.scanned, s.covered = sc, scanned, covered
+	return nil
+}
+
+// loadPrefilter - Attaches a prefilter to its state, unless an end pattern
+// resolved per frame makes it unknown what the rules start with
+func (e *Engine) loadPrefilter(s *state, entry hsl.PrefilterEntry) {
+	for _, r := range s.rules {
+		if r.dynamic {
+			return
+		}
+	}
+	if entry.Flags&hsl.PrefilterFirstBytes != 0 {
+		first := regex.ByteSet(entry.FirstBytes)
+		s.first = &first
+	}
+	if entry.Flags&hsl.PrefilterLiterals != 0 {
+		words := make([]string, len(entry.Literals))
+		for i, l := range entry.Literals {
+			words[i] = string(l)
+		}
+		s.literals = regex.NewLiterals(words)
+	}
+}
+
+// Name - Language name of the grammar
+func (e *Engine) Name() string { return e.name }
+
+// ScopeName - Root scope of the grammar
+func (e *Engine) ScopeName() string { return e.rootScope }
+
+// Warnings - Rules disabled because their pattern did not compile
+func (e *Engine) Warnings() []string { return e.warnings }
+
+// SetStepLimit - Regex step budget per search; n <= 0 removes the limit
+func (e *Engine) SetStepLimit(n int) { e.stepLimit = n }
+
+// CountRuleHits - Starts counting how often each rule matches. Call it
+// before tokenizing; counting is safe with concurrent tokenization.
+func (e *Engine) CountRuleHits() {
+	if e.hits == nil {
+		e.hits = make([]atomic.Uint64, e.ruleCount)
+	}
+}
+
+// RuleHits - Matches of every rule table entry since CountRuleHits, nil
+// when hits are not counted
+func (e *Engine) RuleHits() []uint64 {
+	if e.hits == nil {
+		return nil
+	}
+	hits := make([]uint64, len(e.hits))
+	for i := range e.hits {
+		hits[i] = e.hits[i].Load()
+	}
+	return hits
+}
+
+// endRegex - End pattern of a frame, with backreferences to the begin
+// captures replaced by the captured text
+func (e *Engine) endRegex(r *rule, input string, caps []int) *regex.Regexp {
+	pattern := resolveBackReferences(r.pattern, input, caps)
+
+	e.dynamicMu.Lock()
+	defer e.dynamicMu.Unlock()
+	if re, ok := e.dynamicEnd[pattern]; ok {
+		return re
+	}
+	re, err := regex.Compile(pattern)
+	if err != nil {
+		// Never matches: the frame stays open like in an unclosed block
+		re = nil
+	}
+	e.dynamicEnd[pattern] = re
+	return re
+}
+
+// hasBackReferences - \1..\9 outside escaped backslashes
+func hasBackReferences(pattern string) bool {
+	for i := 0; i+1 < len(pattern); i++ {
+		if pattern[i] == '\\' {
+			if c := pattern[i+1]; c >= '0' && c <= '9' {
+				return true
+			}
+			i++
+		}
+	}
+	return false
+}
+
+func resolveBackReferences(pattern, input string, caps []int) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c != '\\' || i+1 == len(pattern) {
+			b.WriteByte(c)
+			continue
+		}
+		j := i + 1
+		for j < len(pattern) && pattern[j] >= '0' && pattern[j] <= '9' {
+			j++
+		}
+		if j == i+1 {
+			b.WriteString(pattern[i : i+2])
+			i++
+			continue
+		}
+		group := 0
+		fmt.Sscan(pattern[i+1:j], &group)
+		if 2*group+1 < len(caps) && caps[2*group] >= 0 {
+			b.WriteString(regex.QuoteMeta(input[caps[2*group]:caps[2*group+1]]))
+		}
+		i = j - 1
+	}
+	return b.String()
+}
+
+// expandScope - Replaces $n and ${n:/downcase|upcase} with captured text
+func expandScope(name, input string, caps []int) string {
+	if !strings.Contains(name, "$") {
+		return name
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '$' || i+1 == len(name) {
+			b.WriteByte(name[i])
+			continue
+		}
+
+		rest := name[i+1:]
+		group, transform, length := -1, "", 0
+		switch {
+		case rest[0] >= '0' && rest[0] <= '9':
+			length = 1
+			for length < len(rest) && rest[length] >= '0' && rest[length] <= '9' {
+				length++
+			}
+			fmt.Sscan(rest[:length], &group)
+		case rest[0] == '{':
+			end := strings.IndexByte(rest, '}')
+			var n int
+			var op string
+			if end > 0 {
+				if k, err := fmt.Sscanf(strings.Replace(rest[1:end], ":/", " ", 1), "%d %s", &n, &op); err == nil && k == 2 {
+					group, transform, length = n, op, end+1
+				}
+			}
+		}
+		if group < 0 {
+			b.WriteByte('$')
+			continue
+		}
+
+		text := ""
+		if 2*group+1 < len(caps) && caps[2*group] >= 0 {
+			text = strings.TrimLeft(input[caps[2*group]:caps[2*group+1]], ".")
+		}
+		switch transform {
+		case "downcase":
+			text = strings.ToLower(text)
+		case "upcase":
+			text = strings.ToUpper(text)
+		}
+		b.WriteString(text)
+		i += length
+	}
+	return b.String()
+}
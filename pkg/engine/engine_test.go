@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ferchd/tm2hsl/internal/optimizer"
+	"github.com/ferchd/tm2hsl/internal/testgrammar"
+)
+
+// newTestEngine - Engine of the shared test grammar after the given
+// passes, loaded from its serialized form
+func newTestEngine(t *testing.T, passes ...optimizer.OptimizationPass) *Engine {
+	t.Helper()
+	e, err := New(testgrammar.Compile(t, passes...))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return e
+}
+
+// render - "text=scope" per token, innermost scope only
+func render(lines []Line) string {
+	var parts []string
+	for _, line := range lines {
+		for _, tok := range line.Tokens {
+			parts = append(parts, fmt.Sprintf("%s=%s", line.Text[tok.Start:tok.End], tok.Scopes[len(tok.Scopes)-1]))
+		}
+		parts = append(parts, "|")
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestEngine_Tokenize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"keywords", "if x", "if=keyword.control.t  x=source.t |"},
+		{"string with escape", `"a\n"`, `"=string.quoted.t a=string.quoted.t \n=constant.character.escape.t "=string.quoted.t |`},
+		{"captures", "f(", "f=entity.name.function.t (=punctuation.t |"},
+		{"injection in comment", "# a TODO", "#=comment.line.t  a =comment.line.t TODO=keyword.todo.t |"},
+		{"no injection outside comment", "TODO", "TODO=source.t |"},
+		{"backreference end", "<<EOF\nEOFX\nEOF\nif", "<<EOF=string.heredoc.t | EOFX=meta.body.t | EOF=string.heredoc.t | if=keyword.control.t |"},
+		{"multi-line string", "\"a\nb\"", "\"=string.quoted.t a=string.quoted.t | b=string.quoted.t \"=string.quoted.t |"},
+	}
+
+	e := newTestEngine(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines, err := e.Tokenize(tt.input)
+			if err != nil {
+				t.Fatalf("Tokenize: %v", err)
+			}
+			if got := render(lines); got != tt.want {
+				t.Errorf("tokens:\n got  %s\n want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestEngine_FastPaths - Keyword tries, scanners and prefilters must not
+// change tokens
+func TestEngine_FastPaths(t *testing.T) {
+	input := strings.Join([]string{
+		`if x else f(y) "a\"b" # TODO if`,
+		`elsewhere iff(  "x\\" "unterminated`,
+		`more" <<END`,
+		`if "not" END`,
+		`END`,
+		`g(h(i)) # done`,
+		`ünïcödé(x) éif if`,
+	}, "\n")
+
+	// Every regex, keyword lists included
+	plain := newTestEngine(t)
+	for _, st := range plain.states {
+		for _, r := range st.rules {
+			r.keywords = nil
+		}
+	}
+	want, err := plain.Tokenize(input)
+	if err != nil {
+		t.Fatalf("Tokenize: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		passes []optimizer.OptimizationPass
+		check  func(e *Engine) bool // The fast path is in place
+	}{
+		{"keywords", nil, func(e *Engine) bool {
+			return e.states[0].rules[1].keywords != nil
+		}},
+		{"scanners", []optimizer.OptimizationPass{&optimizer.CombineScanners{}}, func(e *Engine) bool {
+			return e.states[0].scanner != nil
+		}},
+		{"prefilters", []optimizer.OptimizationPass{&optimizer.BuildPrefilters{}}, func(e *Engine) bool {
+			// The root state has a rule without literal prefixes
+			return e.states[0].first != nil && e.states[0].literals == nil
+		}},
+		{"both", []optimizer.OptimizationPass{&optimizer.CombineScanners{}, &optimizer.BuildPrefilters{}}, func(e *Engine) bool {
+			return e.states[0].scanner != nil && e.states[0].first != nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEngine(t, tt.passes...)
+			if !tt.check(e) {
+				t.Fatal("fast path not loaded")
+			}
+			got, err := e.Tokenize(input)
+			if err != nil {
+				t.Fatalf("Tokenize: %v", err)
+			}
+			if render(got) != render(want) {
+				t.Errorf("tokens:\n got  %s\n want %s", render(got), render(want))
+			}
+		})
+	}
+}
@@ -0,0 +1,500 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ferchd/tm2hsl/pkg/hsl"
+	"github.com/ferchd/tm2hsl/pkg/regex"
+)
+
+// Token - Range of a line with its scope stack, outermost scope first
+type Token struct {
+	Start  int // Byte offsets in the line
+	End    int
+	Scopes []string
+}
+
+// Line - Tokens of one line of text
+type Line struct {
+	Text   string
+	Tokens []Token
+}
+
+// StateStack - Begin rules still open at the end of a line. Stacks are
+// immutable and can be kept to resume tokenization at any line.
+type StateStack struct {
+	parent        *StateStack
+	state         uint32
+	rule          *rule
+	end           *regex.Regexp // End pattern with begin captures resolved
+	nameScopes    []string      // Scopes of the begin and end tokens
+	contentScopes []string      // Scopes of the text between them
+	depth         int
+
+	// Only meaningful on the line the frame was pushed, see lineTokenizer.fresh
+	generation uint64
+	enterPos   int
+	anchor     int // \G position to restore when the frame is popped
+}
+
+// Depth - Number of open begin rules
+func (s *StateStack) Depth() int { return s.depth }
+
+// Scopes - Scope stack of the text following the line
+func (s *StateStack) Scopes() []string { return s.contentScopes }
+
+// State - Current state in the bytecode state table
+func (s *StateStack) State() uint32 { return s.state }
+
+// InitialState - Stack at the start of a document
+func (e *Engine) InitialState() *StateStack {
+	root := []string{e.rootScope}
+	return &StateStack{nameScopes: root, contentScopes: root, enterPos: -1, anchor: -1}
+}
+
+// Tokenize - Tokenizes a whole text, line by line
+func (e *Engine) Tokenize(text string) ([]Line, error) {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if text == "" {
+		lines = nil
+	}
+
+	result := make([]Line, 0, len(lines))
+	var stack *StateStack
+	for i, line := range lines {
+		tokens, next, err := e.TokenizeLine(line, stack)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		result = append(result, Line{Text: line, Tokens: tokens})
+		stack = next
+	}
+	return result, nil
+}
+
+// TokenizeLine - Tokenizes one line (without its line break) starting from
+// stack, the state returned for the previous line. A nil stack starts a
+// document; \A only matches on that first line.
+func (e *Engine) TokenizeLine(line string, stack *StateStack) ([]Token, *StateStack, error) {
+	firstLine := stack == nil
+	if firstLine {
+		stack = e.InitialState()
+	}
+
+	// Like vscode-textmate, patterns see the line with its line break
+	t := &lineTokenizer{
+		e:          e,
+		input:      line + "\n",
+		firstLine:  firstLine,
+		generation: e.generation.Add(1),
+		cache:      make(map[*regex.Regexp]cachedSearch),
+		scans:      make(map[*regex.Scanner]cachedSearch),
+		skips:      make(map[*state]cachedSearch),
+		words:      make(map[*keywords]cachedSearch),
+	}
+	stack = t.run(stack)
+	if t.err != nil {
+		return nil, nil, t.err
+	}
+
+	// Clip to the line: the line break itself is not reported
+	tokens := t.tokens[:0]
+	for _, tok := range t.tokens {
+		if tok.End > len(line) {
+			tok.End = len(line)
+		}
+		if tok.Start < tok.End {
+			tokens = append(tokens, tok)
+		}
+	}
+	return tokens, stack, nil
+}
+
+// lineTokenizer - Tokenization of a single line
+type lineTokenizer struct {
+	e          *Engine
+	input      string
+	firstLine  bool
+	generation uint64
+	tokens     []Token
+	last       int // End of the last produced token
+	cache      map[*regex.Regexp]cachedSearch
+	scans      map[*regex.Scanner]cachedSearch // caps: match start, rule position
+	skips      map[*state]cachedSearch         // caps: next prefilter candidate
+	words      map[*keywords]cachedSearch
+	err        error
+}
+
+// cachedSearch - Result of a search from position from; it stays valid for
+// any later search position up to the match start
+type cachedSearch struct {
+	from int
+	caps []int
+}
+
+// match - Winning rule at a position
+type match struct {
+	rule *rule
+	caps []int
+}
+
+func (t *lineTokenizer) run(stack *StateStack) *StateStack {
+	pos, anchor := 0, -1
+	for t.err == nil {
+		m := t.scan(stack, pos, anchor)
+		if m == nil {
+			t.produce(stack.contentScopes, len(t.input))
+			break
+		}
+
+		start, end := m.caps[0], m.caps[1]
+		advanced := end > pos
+		r := m.rule
+		if t.e.hits != nil {
+			t.e.hits[r.index].Add(1)
+		}
+
+		switch {
+		case r.action == hsl.ActionPopScope && stack.parent != nil:
+			popped := stack
+			t.produce(popped.contentScopes, start)
+			t.captures(popped.nameScopes, r, m.caps)
+			t.produce(popped.nameScopes, end)
+			stack = popped.parent
+			anchor = t.anchorOf(popped)
+
+			if !advanced && t.enterPos(popped) == pos {
+				// Pushed and popped without consuming input: give up the line
+				stack = popped
+				t.produce(stack.contentScopes, len(t.input))
+				return stack
+			}
+
+		case r.action == hsl.ActionPushScope && r.next >= 0:
+			t.produce(stack.contentScopes, start)
+			nameScopes := pushScopes(stack.contentScopes, expandScope(r.scope, t.input, m.caps))
+			t.captures(nameScopes, r, m.caps)
+			t.produce(nameScopes, end)
+
+			next := t.e.states[r.next]
+			frame := &StateStack{
+				parent:        stack,
+				state:         uint32(r.next),
+				rule:          r,
+				nameScopes:    nameScopes,
+				contentScopes: pushScopes(nameScopes, expandScope(next.content, t.input, m.caps)),
+				depth:         stack.depth + 1,
+				generation:    t.generation,
+				enterPos:      pos,
+				anchor:        anchor,
+			}
+			if len(next.rules) > 0 && next.rules[0].dynamic {
+				frame.end = t.e.endRegex(next.rules[0], t.input, m.caps)
+			}
+
+			if !advanced && t.sameRuleAt(stack, r, pos) {
+				// The same rule entered again at the same position would loop
+				t.produce(stack.contentScopes, len(t.input))
+				return stack
+			}
+			stack = frame
+			anchor = end
+
+		default:
+			t.produce(stack.contentScopes, start)
+			scopes := pushScopes(stack.contentScopes, expandScope(r.scope, t.input, m.caps))
+			t.captures(scopes, r, m.caps)
+			t.produce(scopes, end)
+
+			if !advanced {
+				// An empty match cannot make progress; vscode-textmate drops
+				// the innermost frame and the rest of the line
+				if stack.parent != nil {
+					stack = stack.parent
+				}
+				t.produce(stack.contentScopes, len(t.input))
+				return stack
+			}
+		}
+		pos = end
+	}
+	return stack
+}
+
+// scan - Leftmost match among the state rules and the injections whose
+// selector matches the scope stack. An injection wins over the state rules
+// when it matches earlier, or at the same position with L: priority.
+func (t *lineTokenizer) scan(stack *StateStack, pos, anchor int) *match {
+	best := t.scanRules(stack, &t.e.states[stack.state], pos, anchor)
+	if best != nil && best.caps[0] == pos && !t.hasLeftInjection(stack) {
+		return best
+	}
+
+	var injected *match
+	left := false
+	for _, inj := range t.e.injections {
+		if !inj.group.Match(stack.contentScopes) {
+			continue
+		}
+		m := t.scanRules(stack, &t.e.states[inj.state], pos, anchor)
+		if m != nil && (injected == nil || m.caps[0] < injected.caps[0]) {
+			injected, left = m, inj.priority < 0
+			if m.caps[0] == pos {
+				break
+			}
+		}
+	}
+
+	switch {
+	case injected == nil:
+		return best
+	case best == nil, injected.caps[0] < best.caps[0], injected.caps[0] == best.caps[0] && left:
+		return injected
+	}
+	return best
+}
+
+// scanRules - Leftmost match among the rules of st, earlier rules winning
+// ties. The scanner picks the winner among the rules it covers, and only
+// that rule is searched for its captures, from where the scanner found it.
+func (t *lineTokenizer) scanRules(stack *StateStack, st *state, pos, anchor int) *match {
+	// No rule can match before the prefilter's next candidate
+	if st.first != nil || st.literals != nil {
+		if pos = t.skip(st, pos); pos < 0 {
+			return nil
+		}
+	}
+
+	winner, from := -1, pos
+	if st.scanner != nil {
+		from, winner = t.scanFrom(st, pos)
+	}
+
+	var best *match
+	for i, r := range st.rules {
+		re := r.regex
+		if i == 0 && r.dynamic {
+			re = stack.end
+		}
+		if re == nil && r.keywords == nil || st.scanner != nil && st.covered[i] && i != winner {
+			continue
+		}
+		at := pos
+		if i == winner {
+			at = from
+		}
+		var caps []int
+		if r.keywords != nil {
+			caps = t.findKeyword(r.keywords, at)
+		} else {
+			caps = t.search(re, at, anchor)
+		}
+		if caps == nil {
+			continue
+		}
+		if best == nil || caps[0] < best.caps[0] {
+			best = &match{rule: r, caps: caps}
+			if caps[0] == pos {
+				break
+			}
+		}
+	}
+	return best
+}
+
+// skip - First position at or after pos where a rule of st may match, by
+// its prefilter; -1 if none
+func (t *lineTokenizer) skip(st *state, pos int) int {
+	c, ok := t.skips[st]
+	if ok && c.from <= pos && (c.caps == nil || c.caps[0] >= pos) {
+		if c.caps == nil {
+			return -1
+		}
+		return c.caps[0]
+	}
+
+	next := -1
+	if st.literals != nil {
+		next = st.literals.Index(t.input, pos)
+	} else {
+		// Rune by rune, so only rune starts are candidates
+		for i := pos; i < len(t.input); {
+			b := t.input[i]
+			if st.first.Has(b) {
+				next = i
+				break
+			}
+			if b < utf8.RuneSelf {
+				i++
+			} else {
+				_, size := utf8.DecodeRuneInString(t.input[i:])
+				i += size
+			}
+		}
+	}
+
+	c = cachedSearch{from: pos}
+	if next >= 0 {
+		c.caps = []int{next}
+	}
+	t.skips[st] = c
+	return next
+}
+
+// scanFrom - Start of the leftmost scanner match at or after pos and the
+// position of its rule in st, -1 if no covered rule matches
+func (t *lineTokenizer) scanFrom(st *state, pos int) (int, int) {
+	c, ok := t.scans[st.scanner]
+	if !ok || c.from > pos || c.caps != nil && c.caps[0] < pos {
+		start, rule := st.scanner.Match(t.input, pos)
+		c = cachedSearch{from: pos}
+		if rule >= 0 {
+			c.caps = []int{start, st.scanned[rule]}
+		}
+		t.scans[st.scanner] = c
+	}
+	if c.caps == nil {
+		return pos, -1
+	}
+	return c.caps[0], c.caps[1]
+}
+
+func (t *lineTokenizer) hasLeftInjection(stack *StateStack) bool {
+	for _, inj := range t.e.injections {
+		if inj.priority < 0 && inj.group.Match(stack.contentScopes) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *lineTokenizer) search(re *regex.Regexp, pos, anchor int) []int {
+	cacheable := !re.UsesSearchAnchor()
+	if cacheable {
+		if c, ok := t.cache[re]; ok && c.from <= pos && (c.caps == nil || c.caps[0] >= pos) {
+			return c.caps
+		}
+	}
+
+	caps, err := re.Search(t.input, pos, regex.SearchOptions{
+		Anchor:      anchor,
+		NoTextStart: !t.firstLine,
+		StepLimit:   t.e.stepLimit,
+	})
+	if err != nil {
+		t.err = fmt.Errorf("pattern %q: %w", re.String(), err)
+		return nil
+	}
+	if cacheable {
+		t.cache[re] = cachedSearch{from: pos, caps: caps}
+	}
+	return caps
+}
+
+// findKeyword - search for a keyword list pattern, with the trie
+func (t *lineTokenizer) findKeyword(kw *keywords, pos int) []int {
+	if c, ok := t.words[kw]; ok && c.from <= pos && (c.caps == nil || c.caps[0] >= pos) {
+		return c.caps
+	}
+
+	var caps []int
+	if start, end := kw.trie.Find(t.input, pos); start >= 0 {
+		caps = make([]int, 0, 2*(kw.groups+1))
+		for g := 0; g <= kw.groups; g++ {
+			caps = append(caps, start, end)
+		}
+	}
+	t.words[kw] = cachedSearch{from: pos, caps: caps}
+	return caps
+}
+
+// produce - Emits the text from the last token up to end with scopes
+func (t *lineTokenizer) produce(scopes []string, end int) {
+	if end <= t.last {
+		return
+	}
+	t.tokens = append(t.tokens, Token{Start: t.last, End: end, Scopes: scopes})
+	t.last = end
+}
+
+// captures - Nested capture tokens inside a match, as vscode-textmate
+// handleCaptures: a capture contained in a previous one extends its scopes
+func (t *lineTokenizer) captures(base []string, r *rule, caps []int) {
+	if len(r.captures) == 0 {
+		return
+	}
+
+	type open struct {
+		scopes []string
+		end    int
+	}
+	var local []open
+	for _, c := range r.captures {
+		if 2*c.group+1 >= len(caps) {
+			continue
+		}
+		start, end := caps[2*c.group], caps[2*c.group+1]
+		if start < 0 || end <= start {
+			continue
+		}
+
+		for len(local) > 0 && local[len(local)-1].end <= start {
+			top := local[len(local)-1]
+			t.produce(top.scopes, top.end)
+			local = local[:len(local)-1]
+		}
+		parent := base
+		if len(local) > 0 {
+			parent = local[len(local)-1].scopes
+		}
+		t.produce(parent, start)
+		local = append(local, open{scopes: pushScopes(parent, expandScope(c.scope, t.input, caps)), end: end})
+	}
+	for len(local) > 0 {
+		top := local[len(local)-1]
+		t.produce(top.scopes, top.end)
+		local = local[:len(local)-1]
+	}
+}
+
+// fresh - Frames pushed on earlier lines have no enter or anchor position
+func (t *lineTokenizer) fresh(s *StateStack) bool {
+	return s.generation == t.generation
+}
+
+func (t *lineTokenizer) enterPos(s *StateStack) int {
+	if t.fresh(s) {
+		return s.enterPos
+	}
+	return -1
+}
+
+func (t *lineTokenizer) anchorOf(s *StateStack) int {
+	if t.fresh(s) {
+		return s.anchor
+	}
+	return -1
+}
+
+// sameRuleAt - Whether r is already open among the frames entered at pos
+func (t *lineTokenizer) sameRuleAt(s *StateStack, r *rule, pos int) bool {
+	for ; s != nil && t.enterPos(s) == pos; s = s.parent {
+		if s.rule == r {
+			return true
+		}
+	}
+	return false
+}
+
+// pushScopes - New stack with the space-separated scopes of name appended
+func pushScopes(stack []string, name string) []string {
+	if name == "" {
+		return stack
+	}
+	parts := strings.Fields(name)
+	out := make([]string, len(stack), len(stack)+len(parts))
+	copy(out, stack)
+	return append(out, parts...)
+}
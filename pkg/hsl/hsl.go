@@ -16,11 +16,26 @@ type Header struct {
 	ScopeTableOffset  uint32
 	StateTableOffset  uint32
 	RuleTableOffset   uint32
+	InjectionOffset   uint32
 	TotalSize         uint32
-	Checksum          uint32
+	Checksum          uint32 // CRC32 de todo lo que sigue a la cabecera
 	Flags             uint32
+	NameID            uint32 // Nombre del lenguaje en StringTable
+	ScopeNameID       uint32 // Scope raíz en StringTable
+	ScannerOffset     uint32 // Tabla de scanners, 0 si no hay
+	PrefilterOffset   uint32 // Tabla de prefiltros, 0 si no hay
+	KeywordOffset     uint32 // Tabla de palabras clave, 0 si no hay
 }
 
+// HeaderSize - Tamaño fijo de la cabecera en bytes
+const HeaderSize = 64
+
+// FormatVersion - Versión del formato escrita en la cabecera. Cambia con
+// cada cambio incompatible del diseño; la 2 añadió InjectionOffset antes de
+// TotalSize y los campos que siguen a Flags, así que los archivos de la 1 no
+// se pueden leer con este diseño y se rechazan.
+const FormatVersion = 2
+
 // Flags de cabecera
 const (
 	FlagValidated = 1 << iota
@@ -39,6 +54,18 @@ type Bytecode struct {
 	ScopeTable  ScopeTable
 	StateTable  StateTable
 	RuleTable   RuleTable
+
+	// Inyecciones: reglas que se prueban donde la pila de scopes coincide
+	InjectionTable InjectionTable
+
+	// Scanners: DFAs que prueban a la vez varias reglas de un estado
+	ScannerTable ScannerTable
+
+	// Prefiltros: posiciones donde ninguna regla de un estado puede empezar
+	PrefilterTable PrefilterTable
+
+	// Palabras clave: tries que sustituyen regex como \b(if|else)\b
+	KeywordTable KeywordTable
 }
 
 // Tablas
@@ -68,14 +95,44 @@ type RuleTable struct {
 	Entries []RuleEntry
 }
 
+type InjectionTable struct {
+	SelectorID uint32 // injectionSelector de la gramática, NoString si no hay
+	Count      uint32
+	Entries    []InjectionEntry
+}
+
+type ScannerTable struct {
+	Count   uint32
+	Entries []ScannerEntry
+}
+
+type PrefilterTable struct {
+	Count   uint32
+	Entries []PrefilterEntry
+}
+
+type KeywordTable struct {
+	Count   uint32
+	Entries []KeywordEntry
+}
+
 // Entradas
+// RegexEntry - Expresión regular. Con RegexProgram, Bytecode es el programa
+// compilado (ver regex.Decode) y el motor no necesita analizar el patrón;
+// sin flags Bytecode está vacío y el patrón se compila al cargar.
 type RegexEntry struct {
 	ID          uint32
 	PatternHash uint32
 	Bytecode    []byte
-	Flags       uint8
+	Flags       uint8  // Codificación de Bytecode
+	PatternID   uint32 // Patrón original en StringTable
 }
 
+// Flags de regex
+const (
+	RegexProgram = 1 << iota // Bytecode es un programa de regex.Encode
+)
+
 type ScopeEntry struct {
 	ID       uint16
 	NameID   uint32
@@ -87,6 +144,7 @@ type StateEntry struct {
 	RuleOffset uint32
 	RuleCount  uint16
 	Flags      uint8
+	ScopeID    uint16 // Scope de contenido (contentName), NoScope si no hay
 }
 
 type RuleEntry struct {
@@ -97,6 +155,7 @@ type RuleEntry struct {
 	Priority     uint8
 	CaptureCount uint8
 	Captures     []CaptureMapping
+	SourceID     uint32 // Ruta de la regla en la gramática, NoString si no hay
 }
 
 type CaptureMapping struct {
@@ -104,13 +163,112 @@ type CaptureMapping struct {
 	ScopeID uint16
 }
 
+// InjectionEntry - Las reglas del estado StateID se prueban en cada
+// posición donde el selector coincide con la pila de scopes actual
+type InjectionEntry struct {
+	SelectorID uint32 // Selector sin prefijo de prioridad, en StringTable
+	StateID    uint32
+	Priority   int8 // -1: L: (gana empates), 0: por defecto, 1: R:
+}
+
+// ScannerEntry - DFA sobre las reglas Rules del estado StateID: encuentra la
+// posición más a la izquierda donde alguna coincide y la primera de ellas
+// que coincide ahí (ver regex.ScannerTables). Las runas se agrupan en
+// átomos por rangos; las aserciones ^ $ \b \B dependen del contexto de
+// los caracteres vecinos (ver ScannerContexts).
+type ScannerEntry struct {
+	StateID   uint32
+	Rules     []uint16 // Posiciones de las reglas cubiertas en el estado, ascendentes
+	Lows      []uint32 // Primera runa de cada rango: empieza en 0 y cada uno llega hasta el siguiente
+	Atoms     []uint16 // Átomo de cada rango
+	AtomCount uint16
+	Starts    [ScannerContexts]uint32 // Estado inicial según el carácter anterior
+	Next      []uint32                // Next[estado*AtomCount+átomo], ScannerDead si ninguna regla sigue
+	Accept    []uint16                // Accept[estado*ScannerContexts+ctx], ScannerNoRule si ninguna acepta
+}
+
+// PrefilterEntry - Con qué empieza toda coincidencia de las reglas del
+// estado StateID: un byte de FirstBytes, uno de los literales de Literals
+type PrefilterEntry struct {
+	StateID    uint32
+	Flags      uint8    // PrefilterFirstBytes, PrefilterLiterals
+	FirstBytes [32]byte // Bitmap, bit b&7 del byte b>>3
+	Literals   [][]byte
+}
+
+// Flags de prefiltro: qué partes de la entrada son válidas
+const (
+	PrefilterFirstBytes = 1 << iota
+	PrefilterLiterals
+)
+
+// KeywordEntry - Trie de bytes equivalente a la regex RegexID, de la forma
+// \b(w1|w2|...)\b: coincide con las secuencias completas de caracteres de
+// palabra que están en el trie (ver regex.KeywordList). El nodo 0 es la raíz.
+type KeywordEntry struct {
+	RegexID uint32
+	Flags   uint8  // KeywordFold
+	Groups  uint16 // Grupos de captura, todos abarcan la palabra entera
+	Nodes   []KeywordNode
+}
+
+// KeywordNode - Nodo del trie con sus transiciones
+type KeywordNode struct {
+	Final  bool     // Termina una palabra
+	Labels []byte   // Byte de cada transición, ascendentes
+	Next   []uint32 // Nodo destino de cada transición
+}
+
+// Flags de palabras clave
+const (
+	KeywordFold = 1 << iota // (?i): las runas se pliegan con regex.FoldRune
+)
+
+// ScannerContexts - Contextos de carácter, en este orden: inicio o fin de
+// texto, '\n', carácter de palabra, cualquier otro
+const ScannerContexts = 4
+
+// Valores especiales de ScannerEntry
+const (
+	ScannerDead   uint32 = 0xFFFFFFFF
+	ScannerNoRule uint16 = 0xFFFF
+)
+
+// NoScope - ScopeID de reglas y estados sin scope
+const NoScope uint16 = 0xFFFF
+
+// NoString - Índice de StringTable ausente
+const NoString uint32 = 0xFFFFFFFF
+
+// Acciones de regla
+const (
+	ActionMatch      = iota // Token con scope y capturas
+	ActionPushScope         // begin: entra en NextState
+	ActionPopScope          // end: vuelve al estado anterior
+	ActionTransition        // Cambia de estado sin apilar
+)
+
+// Valores especiales de RuleEntry.NextState
+const (
+	NextStatePop  = -1
+	NextStateStay = -2
+)
+
+// Flags de estado
+const (
+	StateFinal = 1 << iota
+	StatePush
+	StatePop
+	StateInjection
+)
+
 // Validación
 func (h *Header) Validate() error {
 	if string(h.Magic[:]) != "HSL1" {
 		return fmt.Errorf("magic number inválido")
 	}
-	if h.Version != 1 {
-		return fmt.Errorf("versión no soportada: %d", h.Version)
+	if h.Version != FormatVersion {
+		return fmt.Errorf("versión no soportada: %d (se espera %d, recompila la gramática)", h.Version, FormatVersion)
 	}
 	return nil
 }
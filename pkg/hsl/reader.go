@@ -0,0 +1,436 @@
+package hsl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// ReadFile - Carga y decodifica un archivo .hsl
+func ReadFile(path string) (*Bytecode, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	bc, err := Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return bc, nil
+}
+
+// Decode - Decodifica un bytecode completo, verificando cabecera y checksum
+func Decode(data []byte) (*Bytecode, error) {
+	header, err := ReadHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := header.Validate(); err != nil {
+		return nil, err
+	}
+	if header.HeaderSize != HeaderSize {
+		return nil, fmt.Errorf("tamaño de cabecera no soportado: %d", header.HeaderSize)
+	}
+	if int(header.TotalSize) != len(data) {
+		return nil, fmt.Errorf("tamaño inválido: cabecera indica %d bytes, archivo tiene %d", header.TotalSize, len(data))
+	}
+	if sum := crc32.ChecksumIEEE(data[header.HeaderSize:]); sum != header.Checksum {
+		return nil, fmt.Errorf("checksum inválido: 0x%08x, esperado 0x%08x", sum, header.Checksum)
+	}
+
+	bc := &Bytecode{Header: *header}
+
+	// Cada tabla ocupa desde su offset hasta el de la siguiente; las
+	// opcionales con offset 0 no existen
+	sections := []struct {
+		name     string
+		offset   uint32
+		optional bool
+		decode   func(*reader) error
+	}{
+		{"strings", header.StringTableOffset, false, bc.decodeStringTable},
+		{"regex", header.RegexTableOffset, false, bc.decodeRegexTable},
+		{"scopes", header.ScopeTableOffset, false, bc.decodeScopeTable},
+		{"states", header.StateTableOffset, false, bc.decodeStateTable},
+		{"rules", header.RuleTableOffset, false, bc.decodeRuleTable},
+		{"injections", header.InjectionOffset, false, bc.decodeInjectionTable},
+		{"scanners", header.ScannerOffset, true, bc.decodeScannerTable},
+		{"prefilters", header.PrefilterOffset, true, bc.decodePrefilterTable},
+		{"keywords", header.KeywordOffset, true, bc.decodeKeywordTable},
+	}
+	present := sections[:0]
+	for _, s := range sections {
+		if !s.optional || s.offset != 0 {
+			present = append(present, s)
+		}
+	}
+	for i, s := range present {
+		end := header.TotalSize
+		if i+1 < len(present) {
+			end = present[i+1].offset
+		}
+		if end < s.offset || s.offset < uint32(header.HeaderSize) {
+			return nil, fmt.Errorf("offsets de tablas inválidos")
+		}
+		r := &reader{data: data[s.offset:end]}
+		if err := s.decode(r); err != nil {
+			return nil, fmt.Errorf("tabla %s: %w", s.name, err)
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("tabla %s: %w", s.name, r.err)
+		}
+	}
+
+	bc.Name, _ = bc.StringAt(header.NameID)
+	bc.Scope, _ = bc.StringAt(header.ScopeNameID)
+
+	return bc, nil
+}
+
+// StringAt - Resuelve un índice de StringTable
+func (b *Bytecode) StringAt(id uint32) (string, bool) {
+	t := &b.StringTable
+	if id >= uint32(len(t.Offsets)) {
+		return "", false
+	}
+	start := t.Offsets[id]
+	if start > uint32(len(t.Data)) {
+		return "", false
+	}
+	end := bytes.IndexByte(t.Data[start:], 0)
+	if end < 0 {
+		return "", false
+	}
+	return string(t.Data[start : start+uint32(end)]), true
+}
+
+// ScopeName - Nombre de un scope, "" para NoScope o IDs desconocidos
+func (b *Bytecode) ScopeName(id uint16) string {
+	if id == NoScope || int(id) >= len(b.ScopeTable.Entries) {
+		return ""
+	}
+	name, _ := b.StringAt(b.ScopeTable.Entries[id].NameID)
+	return name
+}
+
+// RegexPattern - Patrón original de una regex
+func (b *Bytecode) RegexPattern(id uint32) string {
+	if int(id) >= len(b.RegexTable.Entries) {
+		return ""
+	}
+	pattern, _ := b.StringAt(b.RegexTable.Entries[id].PatternID)
+	return pattern
+}
+
+// StateRules - Reglas de un estado, en orden de prueba
+func (b *Bytecode) StateRules(id uint32) []RuleEntry {
+	if int(id) >= len(b.StateTable.Entries) {
+		return nil
+	}
+	state := b.StateTable.Entries[id]
+	end := int(state.RuleOffset) + int(state.RuleCount)
+	if end > len(b.RuleTable.Entries) {
+		return nil
+	}
+	return b.RuleTable.Entries[state.RuleOffset:end]
+}
+
+func (b *Bytecode) decodeStringTable(r *reader) error {
+	t := &b.StringTable
+	t.Count = r.u32()
+	if !r.fits(t.Count, 4) {
+		return r.fail()
+	}
+	t.Offsets = make([]uint32, t.Count)
+	for i := range t.Offsets {
+		t.Offsets[i] = r.u32()
+	}
+	t.Data = r.rest()
+	return nil
+}
+
+func (b *Bytecode) decodeRegexTable(r *reader) error {
+	t := &b.RegexTable
+	t.Count = r.u32()
+	if !r.fits(t.Count, 17) {
+		return r.fail()
+	}
+	t.Entries = make([]RegexEntry, t.Count)
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		e.ID = r.u32()
+		e.PatternHash = r.u32()
+		e.Bytecode = r.bytes(r.u32())
+		e.Flags = r.u8()
+		e.PatternID = r.u32()
+	}
+	return nil
+}
+
+func (b *Bytecode) decodeScopeTable(r *reader) error {
+	t := &b.ScopeTable
+	t.Count = r.u32()
+	if !r.fits(t.Count, 8) {
+		return r.fail()
+	}
+	t.Entries = make([]ScopeEntry, t.Count)
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		e.ID = r.u16()
+		e.NameID = r.u32()
+		e.ParentID = r.u16()
+	}
+	return nil
+}
+
+func (b *Bytecode) decodeStateTable(r *reader) error {
+	t := &b.StateTable
+	t.Count = r.u32()
+	if !r.fits(t.Count, 13) {
+		return r.fail()
+	}
+	t.Entries = make([]StateEntry, t.Count)
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		e.ID = r.u32()
+		e.RuleOffset = r.u32()
+		e.RuleCount = r.u16()
+		e.Flags = r.u8()
+		e.ScopeID = r.u16()
+	}
+	return nil
+}
+
+func (b *Bytecode) decodeRuleTable(r *reader) error {
+	t := &b.RuleTable
+	t.Count = r.u32()
+	if !r.fits(t.Count, 15) {
+		return r.fail()
+	}
+	t.Entries = make([]RuleEntry, t.Count)
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		e.RegexID = r.u32()
+		e.Action = r.u8()
+		e.NextState = int16(r.u16())
+		e.ScopeID = r.u16()
+		e.Priority = r.u8()
+		e.CaptureCount = r.u8()
+		for j := uint8(0); j < e.CaptureCount && r.err == nil; j++ {
+			e.Captures = append(e.Captures, CaptureMapping{
+				Group:   r.u8(),
+				ScopeID: r.u16(),
+			})
+		}
+		e.SourceID = r.u32()
+	}
+	return nil
+}
+
+func (b *Bytecode) decodeInjectionTable(r *reader) error {
+	t := &b.InjectionTable
+	t.SelectorID = r.u32()
+	t.Count = r.u32()
+	if !r.fits(t.Count, 9) {
+		return r.fail()
+	}
+	t.Entries = make([]InjectionEntry, t.Count)
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		e.SelectorID = r.u32()
+		e.StateID = r.u32()
+		e.Priority = int8(r.u8())
+	}
+	return nil
+}
+
+func (b *Bytecode) decodeScannerTable(r *reader) error {
+	t := &b.ScannerTable
+	t.Count = r.u32()
+	if !r.fits(t.Count, 32) {
+		return r.fail()
+	}
+	t.Entries = make([]ScannerEntry, t.Count)
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		e.StateID = r.u32()
+		e.Rules = r.u16s(uint64(r.u16()))
+		ranges := r.u32()
+		if !r.fits(ranges, 6) {
+			return r.fail()
+		}
+		for j := uint32(0); j < ranges; j++ {
+			e.Lows = append(e.Lows, r.u32())
+			e.Atoms = append(e.Atoms, r.u16())
+		}
+		e.AtomCount = r.u16()
+		for j := range e.Starts {
+			e.Starts[j] = r.u32()
+		}
+		states := uint64(r.u32())
+		e.Next = r.u32s(states * uint64(e.AtomCount))
+		e.Accept = r.u16s(states * ScannerContexts)
+	}
+	return nil
+}
+
+func (b *Bytecode) decodePrefilterTable(r *reader) error {
+	t := &b.PrefilterTable
+	t.Count = r.u32()
+	if !r.fits(t.Count, 39) {
+		return r.fail()
+	}
+	t.Entries = make([]PrefilterEntry, t.Count)
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		e.StateID = r.u32()
+		e.Flags = r.u8()
+		copy(e.FirstBytes[:], r.bytes(32))
+		count := r.u16()
+		for j := uint16(0); j < count && r.err == nil; j++ {
+			e.Literals = append(e.Literals, r.bytes(uint32(r.u16())))
+		}
+	}
+	return nil
+}
+
+func (b *Bytecode) decodeKeywordTable(r *reader) error {
+	t := &b.KeywordTable
+	t.Count = r.u32()
+	if !r.fits(t.Count, 14) {
+		return r.fail()
+	}
+	t.Entries = make([]KeywordEntry, t.Count)
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		e.RegexID = r.u32()
+		e.Flags = r.u8()
+		e.Groups = r.u16()
+		nodes := r.u32()
+		if !r.fits(nodes, 3) {
+			return r.fail()
+		}
+		e.Nodes = make([]KeywordNode, nodes)
+		for j := range e.Nodes {
+			n := &e.Nodes[j]
+			n.Final = r.u8() != 0
+			edges := r.u16()
+			if !r.fits(uint32(edges), 5) {
+				return r.fail()
+			}
+			n.Labels = make([]byte, edges)
+			n.Next = make([]uint32, edges)
+			for k := range n.Labels {
+				n.Labels[k] = r.u8()
+				n.Next[k] = r.u32()
+			}
+		}
+	}
+	return nil
+}
+
+// reader - Cursor little-endian sobre una sección; el primer error se
+// conserva y las lecturas posteriores devuelven cero
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *reader) need(n int) bool {
+	if r.err != nil {
+		return false
+	}
+	if r.pos+n > len(r.data) {
+		r.err = fmt.Errorf("datos truncados en offset %d", r.pos)
+		return false
+	}
+	return true
+}
+
+// fits - Comprueba que count entradas de al menos size bytes caben
+func (r *reader) fits(count uint32, size int) bool {
+	return r.err == nil && uint64(count)*uint64(size) <= uint64(len(r.data)-r.pos)
+}
+
+func (r *reader) fail() error {
+	if r.err != nil {
+		return r.err
+	}
+	return fmt.Errorf("número de entradas inválido")
+}
+
+func (r *reader) u8() uint8 {
+	if !r.need(1) {
+		return 0
+	}
+	v := r.data[r.pos]
+	r.pos++
+	return v
+}
+
+func (r *reader) u16() uint16 {
+	if !r.need(2) {
+		return 0
+	}
+	v := binary.LittleEndian.Uint16(r.data[r.pos:])
+	r.pos += 2
+	return v
+}
+
+func (r *reader) u32() uint32 {
+	if !r.need(4) {
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(r.data[r.pos:])
+	r.pos += 4
+	return v
+}
+
+func (r *reader) u16s(n uint64) []uint16 {
+	if r.err == nil && n*2 > uint64(len(r.data)-r.pos) {
+		r.err = fmt.Errorf("datos truncados en offset %d", r.pos)
+	}
+	if r.err != nil {
+		return nil
+	}
+	v := make([]uint16, n)
+	for i := range v {
+		v[i] = r.u16()
+	}
+	return v
+}
+
+func (r *reader) u32s(n uint64) []uint32 {
+	if r.err == nil && n*4 > uint64(len(r.data)-r.pos) {
+		r.err = fmt.Errorf("datos truncados en offset %d", r.pos)
+	}
+	if r.err != nil {
+		return nil
+	}
+	v := make([]uint32, n)
+	for i := range v {
+		v[i] = r.u32()
+	}
+	return v
+}
+
+func (r *reader) bytes(n uint32) []byte {
+	if r.err == nil && uint64(n) > uint64(len(r.data)-r.pos) {
+		r.err = fmt.Errorf("datos truncados en offset %d", r.pos)
+	}
+	if r.err != nil {
+		return nil
+	}
+	v := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return v
+}
+
+func (r *reader) rest() []byte {
+	v := r.data[r.pos:]
+	r.pos = len(r.data)
+	return v
+}
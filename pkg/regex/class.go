@@ -0,0 +1,207 @@
+package regex
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Class - Set of runes as sorted, non-overlapping [lo, hi] pairs
+type Class struct {
+	Ranges []rune
+}
+
+func newClass(pairs ...rune) *Class {
+	c := &Class{Ranges: append([]rune(nil), pairs...)}
+	c.normalize()
+	return c
+}
+
+// Contains - Reports whether r is in the set
+func (c *Class) Contains(r rune) bool {
+	n := len(c.Ranges) / 2
+	i := sort.Search(n, func(i int) bool { return c.Ranges[2*i+1] >= r })
+	return i < n && c.Ranges[2*i] <= r
+}
+
+// ContainsFold - Contains under simple case folding
+func (c *Class) ContainsFold(r rune) bool {
+	if c.Contains(r) {
+		return true
+	}
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if c.Contains(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize - Sorts and merges overlapping or adjacent ranges
+func (c *Class) normalize() {
+	n := len(c.Ranges) / 2
+	pairs := make([][2]rune, n)
+	for i := range pairs {
+		pairs[i] = [2]rune{c.Ranges[2*i], c.Ranges[2*i+1]}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+	merged := c.Ranges[:0]
+	for _, p := range pairs {
+		last := len(merged) - 1
+		if len(merged) > 0 && p[0] <= merged[last]+1 {
+			if p[1] > merged[last] {
+				merged[last] = p[1]
+			}
+			continue
+		}
+		merged = append(merged, p[0], p[1])
+	}
+	c.Ranges = merged
+}
+
+func (c *Class) negate() *Class {
+	out := &Class{}
+	next := rune(0)
+	for i := 0; i < len(c.Ranges); i += 2 {
+		if c.Ranges[i] > next {
+			out.Ranges = append(out.Ranges, next, c.Ranges[i]-1)
+		}
+		next = c.Ranges[i+1] + 1
+	}
+	if next <= unicode.MaxRune {
+		out.Ranges = append(out.Ranges, next, unicode.MaxRune)
+	}
+	return out
+}
+
+func (c *Class) union(other *Class) *Class {
+	out := &Class{Ranges: append(append([]rune(nil), c.Ranges...), other.Ranges...)}
+	out.normalize()
+	return out
+}
+
+func (c *Class) intersect(other *Class) *Class {
+	// A ∩ B = ¬(¬A ∪ ¬B)
+	return c.negate().union(other.negate()).negate()
+}
+
+func unicodeClass(tables ...*unicode.RangeTable) *Class {
+	c := &Class{}
+	add := func(lo, hi, stride rune) {
+		if stride == 1 {
+			c.Ranges = append(c.Ranges, lo, hi)
+			return
+		}
+		for r := lo; r <= hi; r += stride {
+			c.Ranges = append(c.Ranges, r, r)
+		}
+	}
+	for _, table := range tables {
+		for _, r := range table.R16 {
+			add(rune(r.Lo), rune(r.Hi), rune(r.Stride))
+		}
+		for _, r := range table.R32 {
+			add(rune(r.Lo), rune(r.Hi), rune(r.Stride))
+		}
+	}
+	c.normalize()
+	return c
+}
+
+var (
+	wordTables = []*unicode.RangeTable{unicode.L, unicode.M, unicode.Nd, unicode.Pc}
+
+	// Built once; callers get a copy of the header, never mutate Ranges
+	cachedWord  = sync.OnceValue(func() *Class { return unicodeClass(wordTables...) })
+	cachedSpace = sync.OnceValue(func() *Class { return unicodeClass(unicode.White_Space) })
+)
+
+// wordClass - \w: letters, marks, decimal digits and connector punctuation
+func wordClass() *Class {
+	return &Class{Ranges: cachedWord().Ranges}
+}
+
+// spaceClass - \s
+func spaceClass() *Class {
+	return &Class{Ranges: cachedSpace().Ranges}
+}
+
+// IsWordRune - Word characters as used by \w and \b
+func IsWordRune(r rune) bool {
+	if r < 0x80 {
+		return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_'
+	}
+	return unicode.In(r, wordTables...)
+}
+
+// propertyClass - \p{Name}: general categories, scripts and a few aliases
+func propertyClass(name string) *Class {
+	key := strings.ReplaceAll(strings.ToLower(name), "_", "")
+	switch key {
+	case "alpha", "alphabetic":
+		return unicodeClass(unicode.L, unicode.M)
+	case "digit":
+		return unicodeClass(unicode.Nd)
+	case "alnum":
+		return unicodeClass(unicode.L, unicode.M, unicode.Nd)
+	case "space", "whitespace":
+		return spaceClass()
+	case "word":
+		return wordClass()
+	case "upper", "uppercase":
+		return unicodeClass(unicode.Lu)
+	case "lower", "lowercase":
+		return unicodeClass(unicode.Ll)
+	case "punct":
+		return unicodeClass(unicode.P)
+	case "any":
+		return newClass(0, unicode.MaxRune)
+	case "ascii":
+		return newClass(0, 0x7F)
+	}
+	for _, tables := range []map[string]*unicode.RangeTable{unicode.Categories, unicode.Scripts} {
+		for n, t := range tables {
+			if strings.EqualFold(n, name) {
+				return unicodeClass(t)
+			}
+		}
+	}
+	return nil
+}
+
+// posixClass - [:name:] inside bracket expressions
+func posixClass(name string) *Class {
+	switch name {
+	case "alpha":
+		return unicodeClass(unicode.L, unicode.M)
+	case "digit":
+		return newClass('0', '9')
+	case "alnum":
+		return unicodeClass(unicode.L, unicode.M, unicode.Nd)
+	case "upper":
+		return unicodeClass(unicode.Lu)
+	case "lower":
+		return unicodeClass(unicode.Ll)
+	case "space":
+		return spaceClass()
+	case "blank":
+		return newClass(' ', ' ', '\t', '\t')
+	case "punct":
+		return unicodeClass(unicode.P).union(unicodeClass(unicode.S).intersect(newClass(0, 0x7F)))
+	case "cntrl":
+		return unicodeClass(unicode.Cc)
+	case "xdigit":
+		return newClass('0', '9', 'A', 'F', 'a', 'f')
+	case "word":
+		return wordClass()
+	case "print":
+		return unicodeClass(unicode.L, unicode.M, unicode.N, unicode.P, unicode.S, unicode.Zs)
+	case "graph":
+		return unicodeClass(unicode.L, unicode.M, unicode.N, unicode.P, unicode.S)
+	case "ascii":
+		return newClass(0, 0x7F)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package regex
+
+import "fmt"
+
+// InstOp - Instruction opcode of a compiled program
+type InstOp uint8
+
+const (
+	InstMatch          InstOp = iota // Success of the current (sub)program
+	InstRune                         // Match Rune; Fold for case-insensitive
+	InstClass                        // Match a rune of Classes[Arg]; Fold
+	InstAny                          // Any rune except '\n'
+	InstAnyNL                        // Any rune
+	InstSplit                        // Try X, backtrack to Y
+	InstJmp                          // Continue at X
+	InstSave                         // Record the position in slot Arg
+	InstAssert                       // Zero-width assertion AssertKind(Arg)
+	InstBackref                      // Match the text of group Arg; Fold
+	InstLook                         // Lookaround of kind LookKind(Arg): body at X, continue at Y
+	InstAtomic                       // Run body at X without backtracking into it, continue at Y
+	InstNullCheckStart               // Record the position in register Arg
+	InstNullCheckEnd                 // If no progress since register Arg, exit the loop at X
+	InstFail                         // Always fails
+)
+
+// LookKind - Lookaround variant of InstLook
+type LookKind uint8
+
+const (
+	LookAhead LookKind = iota
+	LookAheadNeg
+	LookBehind
+	LookBehindNeg
+)
+
+// Inst - One instruction. For lookbehinds Rune holds the maximum width of
+// the body in runes, or -1 when unbounded.
+type Inst struct {
+	Op   InstOp
+	Fold bool
+	Rune rune
+	Arg  int
+	X, Y int
+}
+
+// Prog - Compiled program. Slots 0..2*NumCap-1 hold capture positions,
+// the following NumReg slots hold null-check registers.
+type Prog struct {
+	Inst    []Inst
+	Classes []*Class
+	NumCap  int // Groups including group 0
+	NumReg  int
+	Names   []string
+}
+
+// maxProgSize - Instruction budget, reached by nested counted repeats
+const maxProgSize = 200000
+
+type compiler struct {
+	prog *Prog
+}
+
+// NewProg - Compiles a syntax tree into a program
+func NewProg(tree *Tree) (*Prog, error) {
+	c := &compiler{prog: &Prog{NumCap: tree.Captures + 1, Names: tree.Names}}
+	c.emit(Inst{Op: InstSave, Arg: 0})
+	if err := c.compile(tree.Root); err != nil {
+		return nil, err
+	}
+	c.emit(Inst{Op: InstSave, Arg: 1})
+	c.emit(Inst{Op: InstMatch})
+	return c.prog, nil
+}
+
+func (c *compiler) emit(inst Inst) int {
+	c.prog.Inst = append(c.prog.Inst, inst)
+	return len(c.prog.Inst) - 1
+}
+
+func (c *compiler) pc() int { return len(c.prog.Inst) }
+
+func (c *compiler) compile(n *Node) error {
+	fold := n.Flags&FoldCase != 0
+	switch n.Op {
+	case OpEmpty:
+	case OpLiteral:
+		c.emit(Inst{Op: InstRune, Rune: n.Rune, Fold: fold})
+	case OpClass:
+		c.prog.Classes = append(c.prog.Classes, n.Class)
+		c.emit(Inst{Op: InstClass, Arg: len(c.prog.Classes) - 1, Fold: fold})
+	case OpAnyChar:
+		if n.Flags&DotNL != 0 {
+			c.emit(Inst{Op: InstAnyNL})
+		} else {
+			c.emit(Inst{Op: InstAny})
+		}
+	case OpConcat:
+		for _, sub := range n.Sub {
+			if err := c.compile(sub); err != nil {
+				return err
+			}
+		}
+	case OpAlternate:
+		return c.compileAlternate(n.Sub)
+	case OpCapture:
+		c.emit(Inst{Op: InstSave, Arg: 2 * n.Index})
+		if err := c.compile(n.Sub[0]); err != nil {
+			return err
+		}
+		c.emit(Inst{Op: InstSave, Arg: 2*n.Index + 1})
+	case OpRepeat:
+		if n.Possessive {
+			// x*+ is (?>x*)
+			greedy := *n
+			greedy.Possessive = false
+			return c.compileSub(InstAtomic, 0, &greedy)
+		}
+		return c.compileRepeat(n)
+	case OpLookahead:
+		return c.compileSub(InstLook, int(LookAhead), n.Sub[0])
+	case OpNegLookahead:
+		return c.compileSub(InstLook, int(LookAheadNeg), n.Sub[0])
+	case OpLookbehind, OpNegLookbehind:
+		kind := LookBehind
+		if n.Op == OpNegLookbehind {
+			kind = LookBehindNeg
+		}
+		at := c.pc()
+		if err := c.compileSub(InstLook, int(kind), n.Sub[0]); err != nil {
+			return err
+		}
+		c.prog.Inst[at].Rune = rune(MaxWidth(n.Sub[0]))
+		return nil
+	case OpAtomic:
+		return c.compileSub(InstAtomic, 0, n.Sub[0])
+	case OpAssert:
+		c.emit(Inst{Op: InstAssert, Arg: int(n.Assert)})
+	case OpBackref:
+		c.emit(Inst{Op: InstBackref, Arg: n.Index, Fold: fold})
+	default:
+		return fmt.Errorf("regex: unknown node op %d", n.Op)
+	}
+	return nil
+}
+
+func (c *compiler) compileAlternate(alts []*Node) error {
+	var jumps []int
+	for i, alt := range alts {
+		split := -1
+		if i < len(alts)-1 {
+			split = c.emit(Inst{Op: InstSplit})
+			c.prog.Inst[split].X = c.pc()
+		}
+		if err := c.compile(alt); err != nil {
+			return err
+		}
+		if split >= 0 {
+			jumps = append(jumps, c.emit(Inst{Op: InstJmp}))
+			c.prog.Inst[split].Y = c.pc()
+		}
+	}
+	for _, j := range jumps {
+		c.prog.Inst[j].X = c.pc()
+	}
+	return nil
+}
+
+// compileSub - Body as a subprogram ending in InstMatch, run by op
+func (c *compiler) compileSub(op InstOp, arg int, body *Node) error {
+	at := c.emit(Inst{Op: op, Arg: arg})
+	c.prog.Inst[at].X = c.pc()
+	if err := c.compile(body); err != nil {
+		return err
+	}
+	c.emit(Inst{Op: InstMatch})
+	c.prog.Inst[at].Y = c.pc()
+	return nil
+}
+
+func (c *compiler) compileRepeat(n *Node) error {
+	body := n.Sub[0]
+	for i := 0; i < n.Min; i++ {
+		if err := c.compile(body); err != nil {
+			return err
+		}
+		if c.pc() > maxProgSize {
+			return fmt.Errorf("regex: pattern too large")
+		}
+	}
+
+	if n.Max < 0 {
+		return c.compileStar(body, n.Greedy)
+	}
+
+	// x{n,m}: m-n nested optionals, each exit jumps past the rest
+	var exits []int
+	for i := n.Min; i < n.Max; i++ {
+		split := c.emit(Inst{Op: InstSplit})
+		exits = append(exits, split)
+		body0 := c.pc()
+		if err := c.compile(body); err != nil {
+			return err
+		}
+		if c.pc() > maxProgSize {
+			return fmt.Errorf("regex: pattern too large")
+		}
+		if n.Greedy {
+			c.prog.Inst[split].X = body0
+		} else {
+			c.prog.Inst[split].Y = body0
+		}
+	}
+	for _, split := range exits {
+		if n.Greedy {
+			c.prog.Inst[split].Y = c.pc()
+		} else {
+			c.prog.Inst[split].X = c.pc()
+		}
+	}
+	return nil
+}
+
+// compileStar - x* with a null check so empty iterations cannot loop
+func (c *compiler) compileStar(body *Node, greedy bool) error {
+	nullable := canBeEmpty(body)
+	loop := c.emit(Inst{Op: InstSplit})
+	start := c.pc()
+
+	reg := -1
+	if nullable {
+		reg = c.prog.NumReg
+		c.prog.NumReg++
+		c.emit(Inst{Op: InstNullCheckStart, Arg: reg})
+	}
+	if err := c.compile(body); err != nil {
+		return err
+	}
+	check := -1
+	if nullable {
+		check = c.emit(Inst{Op: InstNullCheckEnd, Arg: reg})
+	}
+	c.emit(Inst{Op: InstJmp, X: loop})
+
+	exit := c.pc()
+	if greedy {
+		c.prog.Inst[loop].X, c.prog.Inst[loop].Y = start, exit
+	} else {
+		c.prog.Inst[loop].X, c.prog.Inst[loop].Y = exit, start
+	}
+	if check >= 0 {
+		c.prog.Inst[check].X = exit
+	}
+	return nil
+}
+
+// canBeEmpty - Conservative check for nodes that may match ""
+func canBeEmpty(n *Node) bool {
+	switch n.Op {
+	case OpLiteral, OpClass, OpAnyChar:
+		return false
+	case OpConcat:
+		for _, sub := range n.Sub {
+			if !canBeEmpty(sub) {
+				return false
+			}
+		}
+		return true
+	case OpAlternate:
+		for _, sub := range n.Sub {
+			if canBeEmpty(sub) {
+				return true
+			}
+		}
+		return false
+	case OpRepeat:
+		return n.Min == 0 || canBeEmpty(n.Sub[0])
+	case OpCapture, OpAtomic:
+		return canBeEmpty(n.Sub[0])
+	}
+	// Assertions, lookarounds, backreferences and empty nodes
+	return true
+}
+
+// MaxWidth - Maximum number of runes n can consume, -1 if unbounded
+func MaxWidth(n *Node) int {
+	switch n.Op {
+	case OpLiteral, OpClass, OpAnyChar:
+		return 1
+	case OpConcat:
+		total := 0
+		for _, sub := range n.Sub {
+			w := MaxWidth(sub)
+			if w < 0 {
+				return -1
+			}
+			total += w
+		}
+		return total
+	case OpAlternate:
+		max := 0
+		for _, sub := range n.Sub {
+			w := MaxWidth(sub)
+			if w < 0 {
+				return -1
+			}
+			if w > max {
+				max = w
+			}
+		}
+		return max
+	case OpRepeat:
+		w := MaxWidth(n.Sub[0])
+		if w < 0 || n.Max < 0 {
+			return -1
+		}
+		return w * n.Max
+	case OpCapture, OpAtomic:
+		return MaxWidth(n.Sub[0])
+	case OpBackref:
+		return -1
+	}
+	return 0
+}
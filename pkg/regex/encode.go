@@ -0,0 +1,290 @@
+package regex
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ProgVersion - Version of the program encoding written by Encode
+const ProgVersion = 1
+
+// Leading anchor byte of an encoded program
+const (
+	leadNone = iota
+	leadTextStart
+	leadSearchAnchor
+)
+
+// foldBit - Opcode bit of case-insensitive instructions
+const foldBit = 0x80
+
+// Encode - Program of re in the binary form read back by Decode, so it can
+// run without parsing or compiling the pattern. Integers are unsigned
+// LEB128; the layout is described in docs/HSL_SPEC.md.
+func (re *Regexp) Encode() []byte {
+	p := re.prog
+	lead := leadNone
+	if re.hasLead {
+		lead = leadTextStart
+		if re.anchored == AssertSearchAnchor {
+			lead = leadSearchAnchor
+		}
+	}
+	out := []byte{ProgVersion, byte(lead)}
+	out = binary.AppendUvarint(out, uint64(p.NumCap))
+	out = binary.AppendUvarint(out, uint64(p.NumReg))
+
+	// Repeats copy their classes; each distinct class is written once
+	index := make(map[string]int)
+	remap := make([]int, len(p.Classes))
+	var classes []*Class
+	for i, c := range p.Classes {
+		key := classKey(c)
+		id, ok := index[key]
+		if !ok {
+			id = len(classes)
+			index[key] = id
+			classes = append(classes, c)
+		}
+		remap[i] = id
+	}
+	out = binary.AppendUvarint(out, uint64(len(classes)))
+	for _, c := range classes {
+		out = binary.AppendUvarint(out, uint64(len(c.Ranges)/2))
+		prev := rune(0)
+		for i := 0; i < len(c.Ranges); i += 2 {
+			out = binary.AppendUvarint(out, uint64(c.Ranges[i]-prev))
+			out = binary.AppendUvarint(out, uint64(c.Ranges[i+1]-c.Ranges[i]))
+			prev = c.Ranges[i+1]
+		}
+	}
+
+	out = binary.AppendUvarint(out, uint64(len(p.Inst)))
+	for _, inst := range p.Inst {
+		op := byte(inst.Op)
+		if inst.Fold {
+			op |= foldBit
+		}
+		out = append(out, op)
+		for _, v := range operands(inst, remap) {
+			out = binary.AppendUvarint(out, v)
+		}
+	}
+	return out
+}
+
+func classKey(c *Class) string {
+	var b strings.Builder
+	for _, r := range c.Ranges {
+		b.WriteString(strconv.Itoa(int(r)))
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// operands - Encoded operands of an instruction, in the order Decode reads
+// them
+func operands(inst Inst, classes []int) []uint64 {
+	switch inst.Op {
+	case InstRune:
+		return []uint64{uint64(inst.Rune)}
+	case InstClass:
+		return []uint64{uint64(classes[inst.Arg])}
+	case InstSplit, InstAtomic:
+		return []uint64{uint64(inst.X), uint64(inst.Y)}
+	case InstJmp:
+		return []uint64{uint64(inst.X)}
+	case InstSave, InstAssert, InstBackref, InstNullCheckStart:
+		return []uint64{uint64(inst.Arg)}
+	case InstNullCheckEnd:
+		return []uint64{uint64(inst.Arg), uint64(inst.X)}
+	case InstLook:
+		// Lookbehind width + 1, 0 when unbounded or not a lookbehind
+		return []uint64{uint64(inst.Arg), uint64(inst.X), uint64(inst.Y), uint64(inst.Rune + 1)}
+	}
+	return nil
+}
+
+// Decode - Regexp running an encoded program; pattern is only kept for
+// String and error messages. The program is checked so that running it
+// cannot go out of bounds. The result has no syntax tree.
+func Decode(pattern string, data []byte) (*Regexp, error) {
+	d := &progDecoder{data: data}
+	version, lead := d.byte(), d.byte()
+	if d.err == nil && version != ProgVersion {
+		return nil, fmt.Errorf("regex program: unsupported version %d", version)
+	}
+	p := &Prog{NumCap: d.int(), NumReg: d.int()}
+
+	classes := d.int()
+	for i := 0; i < classes && d.err == nil; i++ {
+		ranges := d.int()
+		c := &Class{}
+		prev := rune(0)
+		for j := 0; j < ranges && d.err == nil; j++ {
+			lo := prev + d.rune()
+			hi := lo + d.rune()
+			if j > 0 && lo <= prev || hi < lo || hi > unicode.MaxRune {
+				d.fail("class %d: invalid range", i)
+			}
+			c.Ranges = append(c.Ranges, lo, hi)
+			prev = hi
+		}
+		p.Classes = append(p.Classes, c)
+	}
+
+	count := d.int()
+	for i := 0; i < count && d.err == nil; i++ {
+		op := d.byte()
+		inst := Inst{Op: InstOp(op &^ foldBit), Fold: op&foldBit != 0}
+		switch inst.Op {
+		case InstMatch, InstAny, InstAnyNL, InstFail:
+		case InstRune:
+			inst.Rune = d.rune()
+		case InstClass, InstSave, InstAssert, InstBackref, InstNullCheckStart:
+			inst.Arg = d.int()
+		case InstSplit, InstAtomic:
+			inst.X, inst.Y = d.int(), d.int()
+		case InstJmp:
+			inst.X = d.int()
+		case InstNullCheckEnd:
+			inst.Arg, inst.X = d.int(), d.int()
+		case InstLook:
+			inst.Arg, inst.X, inst.Y = d.int(), d.int(), d.int()
+			inst.Rune = d.rune() - 1
+		default:
+			d.fail("instruction %d: unknown opcode %d", i, op)
+		}
+		p.Inst = append(p.Inst, inst)
+	}
+	if d.err == nil && d.pos != len(data) {
+		d.fail("%d trailing bytes", len(data)-d.pos)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := p.check(); err != nil {
+		return nil, fmt.Errorf("regex program: %w", err)
+	}
+
+	re := &Regexp{pattern: pattern, prog: p}
+	switch lead {
+	case leadNone:
+	case leadTextStart:
+		re.anchored, re.hasLead = AssertTextStart, true
+	case leadSearchAnchor:
+		re.anchored, re.hasLead = AssertSearchAnchor, true
+	default:
+		return nil, fmt.Errorf("regex program: invalid leading anchor %d", lead)
+	}
+	for _, inst := range p.Inst {
+		if inst.Op == InstAssert && AssertKind(inst.Arg) == AssertSearchAnchor {
+			re.usesG = true
+		}
+	}
+	return re, nil
+}
+
+// check - Every operand within bounds, no instruction falling through past
+// the end of the program, and lookaround and atomic bodies laid out as
+// NewProg does: right after their instruction, ending before its
+// continuation, with no jump leaving them. Subprograms then nest and never
+// run their own instruction again.
+func (p *Prog) check() error {
+	if len(p.Inst) == 0 || p.NumCap < 1 {
+		return fmt.Errorf("empty program")
+	}
+	type body struct{ start, end int }
+	open := []body{{0, len(p.Inst)}}
+	for pc, inst := range p.Inst {
+		for pc >= open[len(open)-1].end {
+			open = open[:len(open)-1]
+		}
+		in := open[len(open)-1]
+		target := func(t int) bool { return t >= in.start && t < in.end }
+		ok := true
+		switch inst.Op {
+		case InstMatch, InstFail:
+		case InstRune, InstAny, InstAnyNL:
+			ok = target(pc + 1)
+		case InstClass:
+			ok = inst.Arg < len(p.Classes) && target(pc+1)
+		case InstSplit:
+			ok = target(inst.X) && target(inst.Y)
+		case InstJmp:
+			ok = target(inst.X)
+		case InstSave:
+			ok = inst.Arg < 2*p.NumCap && target(pc+1)
+		case InstAssert:
+			ok = inst.Arg <= int(AssertNonWordBoundary) && target(pc+1)
+		case InstBackref:
+			ok = inst.Arg < p.NumCap && target(pc+1)
+		case InstNullCheckStart:
+			ok = inst.Arg < p.NumReg && target(pc+1)
+		case InstNullCheckEnd:
+			ok = inst.Arg < p.NumReg && target(inst.X) && target(pc+1)
+		case InstLook, InstAtomic:
+			ok = inst.X == pc+1 && inst.Y > inst.X && target(inst.Y)
+			if inst.Op == InstLook {
+				ok = ok && inst.Arg <= int(LookBehindNeg)
+			}
+			if ok {
+				open = append(open, body{inst.X, inst.Y})
+			}
+		}
+		if !ok {
+			return fmt.Errorf("instruction %d: operand out of range", pc)
+		}
+	}
+	return nil
+}
+
+// progDecoder - Cursor over an encoded program; the first error is kept
+// and later reads return zero
+type progDecoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (d *progDecoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("regex program: "+format, args...)
+	}
+}
+
+func (d *progDecoder) byte() byte {
+	if d.err != nil || d.pos >= len(d.data) {
+		d.fail("truncated at offset %d", d.pos)
+		return 0
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *progDecoder) uvarint(max uint64) uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail("invalid integer at offset %d", d.pos)
+		return 0
+	}
+	if v > max {
+		d.fail("integer %d out of range at offset %d", v, d.pos)
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+// int - Count or index; bounded by the size of the data so allocations
+// driven by it stay small
+func (d *progDecoder) int() int { return int(d.uvarint(uint64(len(d.data)) * 8)) }
+
+func (d *progDecoder) rune() rune { return rune(d.uvarint(unicode.MaxRune + 1)) }
@@ -0,0 +1,620 @@
+package regex
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrUnsupported - The pattern is outside the subset the language analyses
+// understand exactly (lookaround, backreferences, anchors, atomic groups),
+// or its automaton grew past the analysis budget
+var ErrUnsupported = errors.New("regex: pattern outside the analyzable subset")
+
+// Limits of the language analyses; past them the answer is ErrUnsupported
+const (
+	maxNFAStates     = 4096
+	maxProductStates = 10000
+	maxExpandRepeat  = 32 // Counted repetitions unrolled exactly up to this count
+	maxFoldClass     = 512
+)
+
+// Language - Automata of a pattern for the language analyses, built once
+// so a pattern can be compared against many others. Not safe for
+// concurrent use.
+type Language struct {
+	tree  *Tree
+	exact *nfa  // Exact language; nil if outside the simple subset
+	over  *nfa  // Language with assertions taken as always true; nil if too large
+	err   error // Why exact is nil
+}
+
+// NewLanguage - Builds the automata of t
+func NewLanguage(t *Tree) *Language {
+	l := &Language{tree: t}
+	l.exact, l.err = newNFA(t.Root, false)
+	if l.exact != nil {
+		l.over = l.exact // Nothing to approximate
+	} else {
+		l.over, _ = newNFA(t.Root, true)
+	}
+	return l
+}
+
+// Shadows - Reports whether first matches at every position where later
+// matches: every string later can match has a prefix first can match. A
+// searcher trying first before later then never picks later.
+//
+// first must be in the simple subset (literals, classes, '.', groups,
+// alternation and greedy or lazy repetition); later may use anything, its
+// assertions and lookarounds only narrow where it matches and are treated
+// as always true. Patterns outside the subset give ErrUnsupported, never a
+// wrong true.
+func Shadows(first, later *Tree) (bool, error) {
+	return NewLanguage(first).Shadows(NewLanguage(later))
+}
+
+// Shadows - Shadows(first, later) on prebuilt languages
+func (first *Language) Shadows(later *Language) (bool, error) {
+	if first.exact == nil {
+		return false, first.err
+	}
+	if later.over == nil {
+		return false, ErrUnsupported
+	}
+	sup, sub := first.exact, later.over
+	atoms := mergeAtoms(sub, sup)
+
+	// Explores pairs of NFA state sets over the strings later can match,
+	// looking for one accepted by later without first having accepted a
+	// prefix of it
+	type pair struct{ sub, sup []int }
+	start := pair{sub.closure([]int{sub.start}), sup.closure([]int{sup.start})}
+	seen := map[string]bool{setKey(start.sub, start.sup): true}
+	queue := []pair{start}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if sup.accepts(p.sup) {
+			continue
+		}
+		if sub.accepts(p.sub) {
+			return false, nil
+		}
+
+		for _, atom := range atoms {
+			next := pair{sub.step(p.sub, atom[0]), sup.step(p.sup, atom[1])}
+			if len(next.sub) == 0 {
+				continue
+			}
+			key := setKey(next.sub, next.sup)
+			if seen[key] {
+				continue
+			}
+			if len(seen) >= maxProductStates {
+				return false, ErrUnsupported
+			}
+			seen[key] = true
+			queue = append(queue, next)
+		}
+	}
+	return true, nil
+}
+
+// Overlaps - Reports whether a and b can match at the same position: a
+// string one of them matches is a prefix of, or equal to, a string the
+// other matches. When they cannot, a searcher may try them in either order
+// and still picks the same rule everywhere.
+//
+// Assertions and lookarounds are treated as always true, so a false answer
+// holds for any pattern; automata past the analysis budget give
+// ErrUnsupported.
+func Overlaps(a, b *Tree) (bool, error) {
+	return NewLanguage(a).Overlaps(NewLanguage(b))
+}
+
+// Overlaps - Overlaps(a, b) on prebuilt languages
+func (l *Language) Overlaps(other *Language) (bool, error) {
+	if l.over == nil || other.over == nil {
+		return false, ErrUnsupported
+	}
+	na, nb := l.over, other.over
+	atoms := mergeAtoms(na, nb)
+
+	// Explores pairs of NFA state sets over common prefixes; a side that
+	// has accepted becomes done and follows any input from then on, so the
+	// languages overlap once both sides are done
+	done := []int{-1}
+	advance := func(n *nfa, set []int) []int {
+		if n.accepts(set) {
+			return done
+		}
+		return set
+	}
+	type pair struct{ a, b []int }
+	start := pair{advance(na, na.closure([]int{na.start})), advance(nb, nb.closure([]int{nb.start}))}
+	seen := map[string]bool{setKey(start.a, start.b): true}
+	queue := []pair{start}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		aDone, bDone := len(p.a) > 0 && p.a[0] < 0, len(p.b) > 0 && p.b[0] < 0
+		if aDone && bDone {
+			return true, nil
+		}
+
+		for _, atom := range atoms {
+			next := p
+			if !aDone {
+				next.a = advance(na, na.step(p.a, atom[0]))
+			}
+			if !bDone {
+				next.b = advance(nb, nb.step(p.b, atom[1]))
+			}
+			if len(next.a) == 0 || len(next.b) == 0 {
+				continue
+			}
+			key := setKey(next.a, next.b)
+			if seen[key] {
+				continue
+			}
+			if len(seen) >= maxProductStates {
+				return false, ErrUnsupported
+			}
+			seen[key] = true
+			queue = append(queue, next)
+		}
+	}
+	return false, nil
+}
+
+// EmptyMatch - How a pattern can match the empty string
+type EmptyMatch uint8
+
+const (
+	EmptyNever     EmptyMatch = iota // Always consumes input
+	EmptySometimes                   // Depending on the surrounding text (assertions, lookaround)
+	EmptyAlways                      // Matches "" at any position
+)
+
+// MatchesEmpty - Whether t can match without consuming input
+func MatchesEmpty(t *Tree) EmptyMatch {
+	return NewLanguage(t).MatchesEmpty()
+}
+
+// MatchesEmpty - MatchesEmpty of the pattern
+func (l *Language) MatchesEmpty() EmptyMatch {
+	switch {
+	case l.exact != nil && l.exact.accepts(l.exact.closure([]int{l.exact.start})):
+		return EmptyAlways
+	case canBeEmpty(l.tree.Root):
+		return EmptySometimes
+	}
+	return EmptyNever
+}
+
+// nfa - Thompson automaton over runes. A state has either a rune set edge
+// to out or only epsilon edges.
+type nfa struct {
+	states []nfaState
+	start  int
+	accept int
+	over   bool // Over-approximate unsupported constructs instead of failing
+	scan   bool // Keep ^, $, \b and \B as assertion states (see BuildScanner)
+
+	// Alphabet partition: runes in the same atom take the same edges.
+	// Atom atomIDs[i] covers [atomStarts[i], atomStarts[i+1]).
+	atomStarts []rune
+	atomIDs    []int
+
+	mark []int // closure visit marks, by state
+	gen  int
+}
+
+type nfaState struct {
+	ranges []rune // Sorted [lo, hi] pairs; nil for epsilon-only states
+	out    int
+	eps    []int
+	atoms  []bool // Atoms inside ranges, by atom ID
+
+	assert   AssertKind // Epsilon edge to out taken where the assertion holds
+	isAssert bool
+	rule     int // Scanner rule accepted here plus one, 0 for none
+}
+
+// newNFA - Automaton of n. With over set the language may be larger than
+// the pattern's (assertions become empty, backreferences any text); without
+// it the language is exact or the result ErrUnsupported.
+func newNFA(n *Node, over bool) (*nfa, error) {
+	a := &nfa{over: over}
+	start, end, err := a.compile(n)
+	if err != nil {
+		return nil, err
+	}
+	a.start, a.accept = start, end
+	a.partition(nil)
+	return a, nil
+}
+
+func (a *nfa) state() (int, error) {
+	if len(a.states) >= maxNFAStates {
+		return 0, ErrUnsupported
+	}
+	a.states = append(a.states, nfaState{out: -1})
+	return len(a.states) - 1, nil
+}
+
+func (a *nfa) edge(ranges []rune) (int, int, error) {
+	s, err := a.state()
+	if err != nil {
+		return 0, 0, err
+	}
+	e, err := a.state()
+	if err != nil {
+		return 0, 0, err
+	}
+	a.states[s].ranges, a.states[s].out = ranges, e
+	return s, e, nil
+}
+
+func (a *nfa) compile(n *Node) (int, int, error) {
+	fold := n.Flags&FoldCase != 0
+	switch n.Op {
+	case OpEmpty:
+		return a.empty()
+	case OpLiteral:
+		pairs := []rune{n.Rune, n.Rune}
+		if fold {
+			for f := unicode.SimpleFold(n.Rune); f != n.Rune; f = unicode.SimpleFold(f) {
+				pairs = append(pairs, f, f)
+			}
+		}
+		return a.edge(newClass(pairs...).Ranges)
+	case OpClass:
+		if !fold {
+			return a.edge(n.Class.Ranges)
+		}
+		if folded := foldClass(n.Class); folded != nil {
+			return a.edge(folded.Ranges)
+		}
+		if !a.over {
+			return 0, 0, ErrUnsupported
+		}
+		return a.edge([]rune{0, unicode.MaxRune})
+	case OpAnyChar:
+		if n.Flags&DotNL != 0 {
+			return a.edge([]rune{0, unicode.MaxRune})
+		}
+		return a.edge([]rune{0, '\n' - 1, '\n' + 1, unicode.MaxRune})
+	case OpConcat:
+		start, end, err := a.empty()
+		for _, sub := range n.Sub {
+			if err != nil {
+				return 0, 0, err
+			}
+			var s, e int
+			s, e, err = a.compile(sub)
+			if err == nil {
+				a.states[end].eps = append(a.states[end].eps, s)
+				end = e
+			}
+		}
+		return start, end, err
+	case OpAlternate:
+		start, end, err := a.empty2()
+		for _, sub := range n.Sub {
+			if err != nil {
+				return 0, 0, err
+			}
+			var s, e int
+			s, e, err = a.compile(sub)
+			if err == nil {
+				a.states[start].eps = append(a.states[start].eps, s)
+				a.states[e].eps = append(a.states[e].eps, end)
+			}
+		}
+		return start, end, err
+	case OpCapture:
+		return a.compile(n.Sub[0])
+	case OpRepeat:
+		if n.Possessive && !a.over {
+			return 0, 0, ErrUnsupported
+		}
+		return a.repeat(n)
+	case OpAtomic:
+		if !a.over {
+			return 0, 0, ErrUnsupported
+		}
+		return a.compile(n.Sub[0])
+	case OpBackref:
+		if !a.over {
+			return 0, 0, ErrUnsupported
+		}
+		return a.star(&Node{Op: OpAnyChar, Flags: DotNL})
+	}
+	// Assertions and lookaround
+	if a.scan && n.Op == OpAssert {
+		switch n.Assert {
+		case AssertLineStart, AssertLineEnd, AssertWordBoundary, AssertNonWordBoundary:
+			s, e, err := a.empty2()
+			if err == nil {
+				a.states[s].isAssert, a.states[s].assert, a.states[s].out = true, n.Assert, e
+			}
+			return s, e, err
+		}
+	}
+	if !a.over {
+		return 0, 0, ErrUnsupported
+	}
+	return a.empty()
+}
+
+// empty - Single state matching ""
+func (a *nfa) empty() (int, int, error) {
+	s, err := a.state()
+	return s, s, err
+}
+
+// empty2 - Start and end states joined by nothing, for alternations
+func (a *nfa) empty2() (int, int, error) {
+	s, err := a.state()
+	if err != nil {
+		return 0, 0, err
+	}
+	e, err := a.state()
+	return s, e, err
+}
+
+func (a *nfa) repeat(n *Node) (int, int, error) {
+	min, max := n.Min, n.Max
+	if min > maxExpandRepeat || max > maxExpandRepeat {
+		if !a.over {
+			return 0, 0, ErrUnsupported
+		}
+		// x{40,50} is contained in x{32,}: a larger language, never a smaller one
+		if min > maxExpandRepeat {
+			min = maxExpandRepeat
+		}
+		max = -1
+	}
+
+	start, end, err := a.empty()
+	if err != nil {
+		return 0, 0, err
+	}
+	link := func(s, e int) {
+		a.states[end].eps = append(a.states[end].eps, s)
+		end = e
+	}
+	for i := 0; i < min; i++ {
+		s, e, err := a.compile(n.Sub[0])
+		if err != nil {
+			return 0, 0, err
+		}
+		link(s, e)
+	}
+	if max < 0 {
+		s, e, err := a.star(n.Sub[0])
+		if err != nil {
+			return 0, 0, err
+		}
+		link(s, e)
+		return start, end, nil
+	}
+	for i := min; i < max; i++ {
+		s, e, err := a.compile(n.Sub[0])
+		if err != nil {
+			return 0, 0, err
+		}
+		skip, err := a.state()
+		if err != nil {
+			return 0, 0, err
+		}
+		a.states[skip].eps = []int{s, e} // Optional copy
+		link(skip, e)
+	}
+	return start, end, nil
+}
+
+func (a *nfa) star(body *Node) (int, int, error) {
+	start, end, err := a.empty2()
+	if err != nil {
+		return 0, 0, err
+	}
+	s, e, err := a.compile(body)
+	if err != nil {
+		return 0, 0, err
+	}
+	a.states[start].eps = append(a.states[start].eps, s, end)
+	a.states[e].eps = append(a.states[e].eps, s, end)
+	return start, end, nil
+}
+
+// closure - States reachable through epsilon edges, sorted
+func (a *nfa) closure(set []int) []int {
+	if len(set) == 0 {
+		return nil
+	}
+	if a.mark == nil {
+		a.mark = make([]int, len(a.states))
+	}
+	a.gen++
+	stack := append([]int(nil), set...)
+	var out []int
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if a.mark[s] == a.gen {
+			continue
+		}
+		a.mark[s] = a.gen
+		out = append(out, s)
+		stack = append(stack, a.states[s].eps...)
+	}
+	sort.Ints(out)
+	return out
+}
+
+func (a *nfa) accepts(set []int) bool {
+	i := sort.SearchInts(set, a.accept)
+	return i < len(set) && set[i] == a.accept
+}
+
+// partition - Splits the runes into atoms, the classes of runes taking the
+// same edges, so the searches step once per atom however many ranges a
+// class like \w has. Atoms also never straddle the bounds of the extra
+// range sets.
+func (a *nfa) partition(extra [][]rune) {
+	type event struct {
+		at    rune
+		state int
+		start bool
+	}
+	var events []event
+	var labeled []int
+	for s, st := range a.states {
+		if st.ranges == nil {
+			continue
+		}
+		labeled = append(labeled, s)
+		for i := 0; i < len(st.ranges); i += 2 {
+			events = append(events, event{st.ranges[i], s, true}, event{st.ranges[i+1] + 1, s, false})
+		}
+	}
+	for k, ranges := range extra {
+		id := -2 - k
+		labeled = append(labeled, id)
+		for i := 0; i < len(ranges); i += 2 {
+			events = append(events, event{ranges[i], id, true}, event{ranges[i+1] + 1, id, false})
+		}
+	}
+	events = append(events, event{0, -1, false}, event{unicode.MaxRune + 1, -1, false}) // Bounds
+	sort.Slice(events, func(i, j int) bool { return events[i].at < events[j].at })
+
+	active := make(map[int]bool)
+	ids := make(map[string]int)
+	var sets [][]int // Active states of each atom
+	for i := 0; i < len(events); {
+		at := events[i].at
+		for ; i < len(events) && events[i].at == at; i++ {
+			if e := events[i]; e.start {
+				active[e.state] = true
+			} else if e.state != -1 {
+				delete(active, e.state)
+			}
+		}
+		if at > unicode.MaxRune {
+			break
+		}
+
+		var key []byte
+		var set []int
+		for _, s := range labeled {
+			if active[s] {
+				key = strconv.AppendInt(append(key, ','), int64(s), 10)
+				set = append(set, s)
+			}
+		}
+		id, ok := ids[string(key)]
+		if !ok {
+			id = len(sets)
+			ids[string(key)] = id
+			sets = append(sets, set)
+		}
+		if n := len(a.atomIDs); n > 0 && a.atomIDs[n-1] == id {
+			continue // Same atom as the previous interval
+		}
+		a.atomStarts = append(a.atomStarts, at)
+		a.atomIDs = append(a.atomIDs, id)
+	}
+
+	for _, s := range labeled {
+		if s >= 0 {
+			a.states[s].atoms = make([]bool, len(sets))
+		}
+	}
+	for id, set := range sets {
+		for _, s := range set {
+			if s >= 0 {
+				a.states[s].atoms[id] = true
+			}
+		}
+	}
+}
+
+// mergeAtoms - Distinct (atom of a, atom of b) pairs over all runes
+func mergeAtoms(a, b *nfa) [][2]int {
+	end := func(starts []rune, i int) rune {
+		if i+1 < len(starts) {
+			return starts[i+1]
+		}
+		return unicode.MaxRune + 1
+	}
+	seen := make(map[[2]int]bool)
+	var out [][2]int
+	i, j := 0, 0
+	for i < len(a.atomIDs) && j < len(b.atomIDs) {
+		p := [2]int{a.atomIDs[i], b.atomIDs[j]}
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+		ea, eb := end(a.atomStarts, i), end(b.atomStarts, j)
+		if ea <= eb {
+			i++
+		}
+		if eb <= ea {
+			j++
+		}
+	}
+	return out
+}
+
+// step - States after reading a rune of atom from set
+func (a *nfa) step(set []int, atom int) []int {
+	var next []int
+	for _, s := range set {
+		if st := a.states[s]; st.atoms != nil && st.atoms[atom] {
+			next = append(next, st.out)
+		}
+	}
+	return a.closure(next)
+}
+
+// foldClass - c closed under simple case folding; nil once c is too large
+// to fold rune by rune
+func foldClass(c *Class) *Class {
+	size := 0
+	for i := 0; i < len(c.Ranges); i += 2 {
+		size += int(c.Ranges[i+1]-c.Ranges[i]) + 1
+	}
+	if size > maxFoldClass {
+		return nil
+	}
+	var pairs []rune
+	for i := 0; i < len(c.Ranges); i += 2 {
+		for r := c.Ranges[i]; r <= c.Ranges[i+1]; r++ {
+			pairs = append(pairs, r, r)
+			for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+				pairs = append(pairs, f, f)
+			}
+		}
+	}
+	return newClass(pairs...)
+}
+
+func setKey(a, b []int) string {
+	var sb strings.Builder
+	for _, s := range a {
+		sb.WriteString(strconv.Itoa(s))
+		sb.WriteByte(',')
+	}
+	sb.WriteByte('|')
+	for _, s := range b {
+		sb.WriteString(strconv.Itoa(s))
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
@@ -0,0 +1,377 @@
+package regex
+
+import (
+	"fmt"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits of KeywordList; larger lists stay regexes
+const (
+	maxKeywords    = 4096
+	maxKeywordLen  = 64
+	maxKeywordSet  = 16 // Runes a class inside a keyword can expand to
+	maxKeywordRept = 8  // Largest bounded repetition inside a keyword
+)
+
+// KeywordList - Words of a keyword pattern, \b(if|else|while)\b: word
+// boundaries around a finite set of words made of word characters. Such a
+// pattern matches exactly the whole runs of word characters that are in
+// the set, whatever the order of the alternatives, so a trie can stand in
+// for it. fold is set for (?i) patterns, whose words come folded (see
+// FoldRune); groups is the number of capturing groups, each spanning the
+// whole match. False for any other pattern.
+func KeywordList(t *Tree) (words []string, fold bool, groups int, ok bool) {
+	n := t.Root
+	for n.Op == OpCapture {
+		n, groups = n.Sub[0], groups+1
+	}
+	if n.Op != OpConcat || len(n.Sub) < 3 || !isWordBoundary(n.Sub[0]) || !isWordBoundary(n.Sub[len(n.Sub)-1]) {
+		return nil, false, 0, false
+	}
+	mid := &Node{Op: OpConcat, Sub: n.Sub[1 : len(n.Sub)-1]}
+	if len(mid.Sub) == 1 {
+		mid = mid.Sub[0]
+		for mid.Op == OpCapture {
+			mid, groups = mid.Sub[0], groups+1
+		}
+	}
+	if groups != t.Captures {
+		return nil, false, 0, false // Groups inside the words
+	}
+
+	k := &keywordWalk{}
+	set, ok := k.words(mid)
+	if !ok || len(set) == 0 {
+		return nil, false, 0, false
+	}
+	seen := make(map[string]bool)
+	for _, w := range set {
+		if w == "" {
+			return nil, false, 0, false
+		}
+		for _, r := range w {
+			if !IsWordRune(r) {
+				return nil, false, 0, false
+			}
+		}
+		if !seen[w] {
+			seen[w] = true
+			words = append(words, w)
+		}
+	}
+	sort.Strings(words)
+	return words, k.fold, groups, true
+}
+
+func isWordBoundary(n *Node) bool {
+	return n.Op == OpAssert && n.Assert == AssertWordBoundary
+}
+
+// keywordWalk - Finite language of a node; every rune must agree on case
+// folding
+type keywordWalk struct {
+	fold, seen bool
+}
+
+func (k *keywordWalk) flags(f Flags) bool {
+	fold := f&FoldCase != 0
+	if k.seen && fold != k.fold {
+		return false
+	}
+	k.fold, k.seen = fold, true
+	return true
+}
+
+func (k *keywordWalk) words(n *Node) ([]string, bool) {
+	switch n.Op {
+	case OpEmpty:
+		return []string{""}, true
+	case OpLiteral:
+		if !k.flags(n.Flags) {
+			return nil, false
+		}
+		return []string{k.runeString(n.Rune)}, true
+	case OpClass:
+		if !k.flags(n.Flags) {
+			return nil, false
+		}
+		var out []string
+		seen := make(map[string]bool)
+		for i := 0; i < len(n.Class.Ranges); i += 2 {
+			for r := n.Class.Ranges[i]; r <= n.Class.Ranges[i+1]; r++ {
+				if s := k.runeString(r); !seen[s] {
+					if len(out) == maxKeywordSet {
+						return nil, false
+					}
+					seen[s] = true
+					out = append(out, s)
+				}
+			}
+		}
+		return out, true
+	case OpConcat:
+		acc := []string{""}
+		for _, sub := range n.Sub {
+			next, ok := k.words(sub)
+			if !ok {
+				return nil, false
+			}
+			if acc, ok = product(acc, next); !ok {
+				return nil, false
+			}
+		}
+		return acc, true
+	case OpAlternate:
+		var out []string
+		for _, sub := range n.Sub {
+			w, ok := k.words(sub)
+			if !ok || len(out)+len(w) > maxKeywords {
+				return nil, false
+			}
+			out = append(out, w...)
+		}
+		return out, true
+	case OpRepeat:
+		// Backtracking tries every count, and the boundaries keep only the
+		// one spanning the word; possessive repeats do not backtrack
+		if n.Possessive || n.Max < 0 || n.Max > maxKeywordRept {
+			return nil, false
+		}
+		sub, ok := k.words(n.Sub[0])
+		if !ok {
+			return nil, false
+		}
+		var out []string
+		acc := []string{""}
+		for count := 0; count <= n.Max; count++ {
+			if count >= n.Min {
+				if len(out)+len(acc) > maxKeywords {
+					return nil, false
+				}
+				out = append(out, acc...)
+			}
+			if acc, ok = product(acc, sub); !ok {
+				return nil, false
+			}
+		}
+		return out, true
+	}
+	// Captures inside the words, lookaround, atomic groups, assertions,
+	// backreferences and '.'
+	return nil, false
+}
+
+func (k *keywordWalk) runeString(r rune) string {
+	if k.fold {
+		r = FoldRune(r)
+	}
+	return string(r)
+}
+
+// product - Every word of a followed by every word of b, within the limits
+func product(a, b []string) ([]string, bool) {
+	if len(a)*len(b) > maxKeywords {
+		return nil, false
+	}
+	out := make([]string, 0, len(a)*len(b))
+	for _, x := range a {
+		for _, y := range b {
+			if len(x)+len(y) > maxKeywordLen {
+				return nil, false
+			}
+			out = append(out, x+y)
+		}
+	}
+	return out, true
+}
+
+// FoldRune - Representative of the simple case folding orbit of r, the
+// smallest rune of it: runes equal under (?i) fold to the same rune
+func FoldRune(r rune) rune {
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return min
+}
+
+// KeywordTables - Serializable form of Keywords: a byte trie whose node 0
+// is the root
+type KeywordTables struct {
+	Fold   bool     // Runes are folded with FoldRune before the lookup
+	Edges  []uint32 // Transitions of node i are Edges[i]..Edges[i+1]
+	Labels []byte   // Byte of each transition, ascending within a node
+	Next   []uint32 // Target node of each transition
+	Final  []bool   // A keyword ends at the node
+}
+
+// Keywords - Matcher of a keyword pattern (see KeywordList): the leftmost
+// whole run of word characters that is one of the words. Safe for
+// concurrent use.
+type Keywords struct {
+	t KeywordTables
+}
+
+// NewKeywords - Trie over words; fold as returned by KeywordList
+func NewKeywords(words []string, fold bool) *Keywords {
+	type node struct {
+		next  map[byte]int
+		final bool
+	}
+	nodes := []node{{next: map[byte]int{}}}
+	for _, w := range words {
+		s := 0
+		for i := 0; i < len(w); i++ {
+			next, ok := nodes[s].next[w[i]]
+			if !ok {
+				next = len(nodes)
+				nodes = append(nodes, node{next: map[byte]int{}})
+				nodes[s].next[w[i]] = next
+			}
+			s = next
+		}
+		nodes[s].final = true
+	}
+
+	t := KeywordTables{Fold: fold, Edges: []uint32{0}}
+	for _, n := range nodes {
+		labels := make([]int, 0, len(n.next))
+		for b := range n.next {
+			labels = append(labels, int(b))
+		}
+		sort.Ints(labels)
+		for _, b := range labels {
+			t.Labels = append(t.Labels, byte(b))
+			t.Next = append(t.Next, uint32(n.next[byte(b)]))
+		}
+		t.Edges = append(t.Edges, uint32(len(t.Labels)))
+		t.Final = append(t.Final, n.final)
+	}
+	return &Keywords{t: t}
+}
+
+// NewKeywordsTables - Keywords from tables, as read back from bytecode
+func NewKeywordsTables(t KeywordTables) (*Keywords, error) {
+	nodes := len(t.Final)
+	if nodes == 0 || len(t.Edges) != nodes+1 || t.Edges[0] != 0 || int(t.Edges[nodes]) != len(t.Labels) || len(t.Labels) != len(t.Next) {
+		return nil, fmt.Errorf("keywords: table sizes do not match %d nodes", nodes)
+	}
+	for i := 0; i < nodes; i++ {
+		if t.Edges[i] > t.Edges[i+1] {
+			return nil, fmt.Errorf("keywords: invalid transitions of node %d", i)
+		}
+		for j := t.Edges[i]; j < t.Edges[i+1]; j++ {
+			if j > t.Edges[i] && t.Labels[j] <= t.Labels[j-1] {
+				return nil, fmt.Errorf("keywords: transitions of node %d not sorted", i)
+			}
+		}
+	}
+	// Children come after their parent, so the trie has no cycles
+	for i := 0; i < nodes; i++ {
+		for _, n := range t.Next[t.Edges[i]:t.Edges[i+1]] {
+			if int(n) >= nodes || int(n) <= i {
+				return nil, fmt.Errorf("keywords: invalid transition from node %d to %d", i, n)
+			}
+		}
+	}
+	return &Keywords{t: t}, nil
+}
+
+// Tables - Serializable form of the trie
+func (k *Keywords) Tables() KeywordTables { return k.t }
+
+// Nodes - Number of trie nodes
+func (k *Keywords) Nodes() int { return len(k.t.Final) }
+
+// Words - Keywords of the trie, in byte order
+func (k *Keywords) Words() []string {
+	var words []string
+	var walk func(s uint32, prefix []byte)
+	walk = func(s uint32, prefix []byte) {
+		if k.t.Final[s] {
+			words = append(words, string(prefix))
+		}
+		for j := k.t.Edges[s]; j < k.t.Edges[s+1]; j++ {
+			walk(k.t.Next[j], append(prefix, k.t.Labels[j]))
+		}
+	}
+	walk(0, nil)
+	return words
+}
+
+// step - Node after reading b from s, false if the trie has no such edge
+func (k *Keywords) step(s uint32, b byte) (uint32, bool) {
+	lo, hi := int(k.t.Edges[s]), int(k.t.Edges[s+1])
+	for lo < hi {
+		mid := (lo + hi) / 2
+		switch l := k.t.Labels[mid]; {
+		case l == b:
+			return k.t.Next[mid], true
+		case l < b:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return 0, false
+}
+
+// Find - Start and end of the leftmost keyword at or after start, -1, -1 if
+// none. Word boundaries look at the text before start, as Search does.
+func (k *Keywords) Find(input string, start int) (int, int) {
+	p := start
+	if p > 0 && p <= len(input) {
+		// A run that began before start has no boundary at start
+		if r, _ := utf8.DecodeLastRuneInString(input[:p]); IsWordRune(r) {
+			p = k.runEnd(input, p)
+		}
+	}
+	var buf [utf8.UTFMax]byte
+	for p < len(input) {
+		r, size := utf8.DecodeRuneInString(input[p:])
+		if !IsWordRune(r) {
+			p += size
+			continue
+		}
+
+		s, alive := uint32(0), true
+		q := p
+		for q < len(input) {
+			r, size := utf8.DecodeRuneInString(input[q:])
+			if !IsWordRune(r) {
+				break
+			}
+			if alive {
+				if k.t.Fold {
+					r = FoldRune(r)
+				}
+				for _, b := range buf[:utf8.EncodeRune(buf[:], r)] {
+					if s, alive = k.step(s, b); !alive {
+						break
+					}
+				}
+			}
+			q += size
+		}
+		if alive && k.t.Final[s] {
+			return p, q
+		}
+		p = q
+	}
+	return -1, -1
+}
+
+func (k *Keywords) runEnd(input string, p int) int {
+	for p < len(input) {
+		r, size := utf8.DecodeRuneInString(input[p:])
+		if !IsWordRune(r) {
+			break
+		}
+		p += size
+	}
+	return p
+}
@@ -0,0 +1,413 @@
+package regex
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits of the literal prefixes of a pattern; past them the prefixes stop
+// growing or the pattern gets none
+const (
+	maxPrefixes   = 64
+	maxPrefixLen  = 16
+	maxFoldPrefix = 8 // Case variants a folded rune can expand to
+)
+
+// ByteSet - Set of bytes as a 256-bit bitmap
+type ByteSet [32]byte
+
+// Add - Adds b to the set
+func (s *ByteSet) Add(b byte) { s[b>>3] |= 1 << (b & 7) }
+
+// Has - Reports whether b is in the set
+func (s *ByteSet) Has(b byte) bool { return s[b>>3]&(1<<(b&7)) != 0 }
+
+// Union - Adds every byte of other to the set
+func (s *ByteSet) Union(other ByteSet) {
+	for i := range s {
+		s[i] |= other[i]
+	}
+}
+
+// String - Bytes of the set as ranges, like [0-9A-Z_a-z\xc2-\xf4]
+func (s *ByteSet) String() string {
+	name := func(c int) string {
+		if c > ' ' && c < utf8.RuneSelf-1 && c != '-' && c != ']' && c != '\\' {
+			return string(rune(c))
+		}
+		return fmt.Sprintf("\\x%02x", c)
+	}
+	var b strings.Builder
+	b.WriteByte('[')
+	for lo := 0; lo < 256; lo++ {
+		if !s.Has(byte(lo)) {
+			continue
+		}
+		hi := lo
+		for hi+1 < 256 && s.Has(byte(hi+1)) {
+			hi++
+		}
+		b.WriteString(name(lo))
+		if hi > lo {
+			b.WriteString("-" + name(hi))
+		}
+		lo = hi
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// addRunes - Adds the first UTF-8 byte of every rune of c. Invalid input
+// bytes decode as utf8.RuneError, so a class holding it adds every
+// non-ASCII byte.
+func (s *ByteSet) addRunes(c *Class) {
+	for i := 0; i < len(c.Ranges); i += 2 {
+		lo, hi := c.Ranges[i], c.Ranges[i+1]
+		if lo <= utf8.RuneError && utf8.RuneError <= hi {
+			for b := 0x80; b <= 0xFF; b++ {
+				s.Add(byte(b))
+			}
+		}
+		for b := int(leadByte(lo)); b <= int(leadByte(hi)); b++ {
+			if b < utf8.RuneSelf || b >= 0xC2 && b <= 0xF4 {
+				s.Add(byte(b))
+			}
+		}
+	}
+}
+
+// leadByte - First byte of the UTF-8 encoding of r; surrogates and runes
+// past unicode.MaxRune are clamped to a neighbour with the same lead byte
+func leadByte(r rune) byte {
+	if r > unicode.MaxRune {
+		r = unicode.MaxRune
+	}
+	if 0xD800 <= r && r <= 0xDFFF {
+		r = 0xD7FF // Lead byte 0xED, as every surrogate
+	}
+	var buf [utf8.UTFMax]byte
+	utf8.EncodeRune(buf[:], r)
+	return buf[0]
+}
+
+// FirstBytes - Bytes a match of t can start with, as the first byte of the
+// first rune it consumes; false when t can match the empty string, so any
+// position may match. Lookaround and assertions are ignored, which only
+// makes the set larger.
+func FirstBytes(t *Tree) (ByteSet, bool) {
+	var s ByteSet
+	if firstBytes(t.Root, &s) {
+		return s, false
+	}
+	return s, true
+}
+
+// firstBytes - Adds the first bytes of n to s and reports whether n can
+// match the empty string
+func firstBytes(n *Node, s *ByteSet) bool {
+	switch n.Op {
+	case OpLiteral:
+		s.addRunes(foldRunes(newClass(n.Rune, n.Rune), n.Flags))
+		return false
+	case OpClass:
+		s.addRunes(foldRunes(n.Class, n.Flags))
+		return false
+	case OpAnyChar:
+		s.addRunes(newClass(0, unicode.MaxRune))
+		return false
+	case OpConcat:
+		for _, sub := range n.Sub {
+			if !firstBytes(sub, s) {
+				return false
+			}
+		}
+		return true
+	case OpAlternate:
+		nullable := false
+		for _, sub := range n.Sub {
+			nullable = firstBytes(sub, s) || nullable
+		}
+		return nullable
+	case OpRepeat:
+		return firstBytes(n.Sub[0], s) || n.Min == 0
+	case OpCapture, OpAtomic:
+		return firstBytes(n.Sub[0], s)
+	}
+	// Empty, lookaround, assertions and backreferences (the group may be
+	// empty) consume nothing for sure
+	return true
+}
+
+// foldRunes - c with every case variant under (?i), or every rune when
+// that would be too large
+func foldRunes(c *Class, flags Flags) *Class {
+	if flags&FoldCase == 0 {
+		return c
+	}
+	if folded := foldClass(c); folded != nil {
+		return folded
+	}
+	return newClass(0, unicode.MaxRune)
+}
+
+// Prefixes - Literals every match of t starts with, one of them per match;
+// false if some match may start with no literal known. Case-insensitive
+// runes expand to their case variants.
+func Prefixes(t *Tree) ([]string, bool) {
+	p := prefixes(t.Root)
+	if len(p.words) == 0 {
+		return nil, false
+	}
+	for _, w := range p.words {
+		if w == "" {
+			return nil, false
+		}
+	}
+	return p.words, true
+}
+
+// prefixSet - Literal prefixes of a node; complete when every match of the
+// node is exactly one of the words, so whatever follows can extend them
+type prefixSet struct {
+	words    []string
+	complete bool
+}
+
+func prefixes(n *Node) prefixSet {
+	switch n.Op {
+	case OpEmpty, OpAssert, OpLookahead, OpNegLookahead, OpLookbehind, OpNegLookbehind:
+		return prefixSet{words: []string{""}, complete: true}
+	case OpLiteral:
+		return runePrefixes(newClass(n.Rune, n.Rune), n.Flags)
+	case OpClass:
+		return runePrefixes(n.Class, n.Flags)
+	case OpCapture, OpAtomic:
+		return prefixes(n.Sub[0]) // An atomic group matches a subset of its content
+	case OpConcat:
+		acc := prefixSet{words: []string{""}, complete: true}
+		for _, sub := range n.Sub {
+			if !acc.complete {
+				break
+			}
+			acc = acc.concat(prefixes(sub))
+		}
+		return acc
+	case OpAlternate:
+		acc := prefixSet{complete: true}
+		for _, sub := range n.Sub {
+			p := prefixes(sub)
+			acc.words = append(acc.words, p.words...)
+			acc.complete = acc.complete && p.complete
+		}
+		if len(acc.words) > maxPrefixes {
+			return prefixSet{words: []string{""}}
+		}
+		return acc
+	case OpRepeat:
+		if n.Min == 0 {
+			return prefixSet{words: []string{""}}
+		}
+		p := prefixes(n.Sub[0])
+		if n.Min == 1 && n.Max == 1 {
+			return p
+		}
+		p.complete = false
+		return p
+	}
+	// '.' and backreferences
+	return prefixSet{words: []string{""}}
+}
+
+// runePrefixes - One-rune words for a small class, with their case variants
+func runePrefixes(c *Class, flags Flags) prefixSet {
+	size := 0
+	for i := 0; i < len(c.Ranges); i += 2 {
+		size += int(c.Ranges[i+1]-c.Ranges[i]) + 1
+		if size > maxFoldPrefix {
+			return prefixSet{words: []string{""}}
+		}
+	}
+	c = foldRunes(c, flags)
+	var words []string
+	for i := 0; i < len(c.Ranges); i += 2 {
+		for r := c.Ranges[i]; r <= c.Ranges[i+1]; r++ {
+			if r == utf8.RuneError || !utf8.ValidRune(r) || len(words) == maxFoldPrefix {
+				return prefixSet{words: []string{""}}
+			}
+			words = append(words, string(r))
+		}
+	}
+	return prefixSet{words: words, complete: true}
+}
+
+// concat - Words of p followed by words of next, kept while the product
+// stays small; past that p is returned as it was, incomplete
+func (p prefixSet) concat(next prefixSet) prefixSet {
+	if len(p.words)*len(next.words) > maxPrefixes {
+		return prefixSet{words: p.words}
+	}
+	out := prefixSet{complete: next.complete}
+	for _, a := range p.words {
+		for _, b := range next.words {
+			w := a + b
+			if len(w) > maxPrefixLen {
+				return prefixSet{words: p.words}
+			}
+			out.words = append(out.words, w)
+		}
+	}
+	return out
+}
+
+// LiteralString - The only string t matches, for patterns made of
+// case-sensitive literals alone
+func LiteralString(t *Tree) (string, bool) {
+	var b []rune
+	var walk func(n *Node) bool
+	walk = func(n *Node) bool {
+		switch n.Op {
+		case OpLiteral:
+			b = append(b, n.Rune)
+			return n.Flags&FoldCase == 0
+		case OpConcat:
+			for _, sub := range n.Sub {
+				if !walk(sub) {
+					return false
+				}
+			}
+			return true
+		case OpCapture:
+			return walk(n.Sub[0])
+		case OpEmpty:
+			return true
+		}
+		return false
+	}
+	if !walk(t.Root) || len(b) == 0 {
+		return "", false
+	}
+	return string(b), true
+}
+
+// SingleClass - Runes t matches when it is one character class (or one
+// case-insensitive rune), case variants included
+func SingleClass(t *Tree) (*Class, bool) {
+	n := t.Root
+	for n.Op == OpCapture {
+		n = n.Sub[0]
+	}
+	switch {
+	case n.Op == OpClass:
+		return foldRunes(n.Class, n.Flags), true
+	case n.Op == OpLiteral && n.Flags&FoldCase != 0:
+		return foldRunes(newClass(n.Rune, n.Rune), n.Flags), true
+	}
+	return nil, false
+}
+
+// Literals - Aho-Corasick automaton over a set of literals, to find where
+// the first of them occurs in a text. Safe for concurrent use.
+type Literals struct {
+	words  []string
+	nodes  []acNode
+	maxLen int
+}
+
+type acNode struct {
+	next  map[byte]int32
+	fail  int32 // Longest proper suffix in the trie
+	dict  int32 // Longest proper suffix ending a word, -1 if none
+	depth int
+	word  bool // A word ends here
+}
+
+// NewLiterals - Automaton over words; empty words are ignored
+func NewLiterals(words []string) *Literals {
+	l := &Literals{nodes: []acNode{{next: map[byte]int32{}, dict: -1}}}
+	for _, w := range words {
+		if w == "" {
+			continue
+		}
+		l.words = append(l.words, w)
+		if len(w) > l.maxLen {
+			l.maxLen = len(w)
+		}
+		s := int32(0)
+		for i := 0; i < len(w); i++ {
+			next, ok := l.nodes[s].next[w[i]]
+			if !ok {
+				next = int32(len(l.nodes))
+				l.nodes = append(l.nodes, acNode{next: map[byte]int32{}, dict: -1, depth: i + 1})
+				l.nodes[s].next[w[i]] = next
+			}
+			s = next
+		}
+		l.nodes[s].word = true
+	}
+
+	// Links in breadth-first order: the suffixes of a node are shallower
+	queue := []int32{0}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for b, child := range l.nodes[s].next {
+			queue = append(queue, child)
+			fail := int32(0)
+			for f := l.nodes[s].fail; s != 0; f = l.nodes[f].fail {
+				if next, ok := l.nodes[f].next[b]; ok {
+					fail = next
+					break
+				}
+				if f == 0 {
+					break
+				}
+			}
+			l.nodes[child].fail = fail
+			if l.nodes[fail].word {
+				l.nodes[child].dict = fail
+			} else {
+				l.nodes[child].dict = l.nodes[fail].dict
+			}
+		}
+	}
+	return l
+}
+
+// Words - Literals of the automaton
+func (l *Literals) Words() []string { return l.words }
+
+// Index - Start of the leftmost occurrence of a literal at or after start,
+// -1 if none
+func (l *Literals) Index(text string, start int) int {
+	best := -1
+	s := int32(0)
+	for i := start; i < len(text); i++ {
+		// No word ending later can begin before the best start found
+		if best >= 0 && i-best >= l.maxLen {
+			break
+		}
+		for {
+			if next, ok := l.nodes[s].next[text[i]]; ok {
+				s = next
+				break
+			}
+			if s == 0 {
+				break
+			}
+			s = l.nodes[s].fail
+		}
+		// The longest word ending here starts first
+		w := s
+		if !l.nodes[w].word {
+			w = l.nodes[w].dict
+		}
+		if w > 0 {
+			if at := i + 1 - l.nodes[w].depth; best < 0 || at < best {
+				best = at
+			}
+		}
+	}
+	return best
+}
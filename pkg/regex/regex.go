@@ -0,0 +1,451 @@
+package regex
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrStepLimit - The search exceeded its step budget (catastrophic backtracking)
+var ErrStepLimit = errors.New("regex: step limit exceeded")
+
+// DefaultStepLimit - Instruction budget of FindAt
+const DefaultStepLimit = 1000000
+
+// Regexp - Compiled pattern, safe for concurrent use
+type Regexp struct {
+	pattern  string
+	tree     *Tree
+	prog     *Prog
+	anchored AssertKind // Leading \A or \G, see leadingAnchor
+	hasLead  bool
+	usesG    bool
+	machines sync.Pool
+}
+
+// Compile - Parses and compiles a pattern
+func Compile(pattern string) (*Regexp, error) {
+	tree, err := Parse(pattern)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := NewProg(tree)
+	if err != nil {
+		return nil, err
+	}
+	re := &Regexp{pattern: pattern, tree: tree, prog: prog}
+	re.anchored, re.hasLead = leadingAnchor(tree.Root)
+	for _, inst := range prog.Inst {
+		if inst.Op == InstAssert && AssertKind(inst.Arg) == AssertSearchAnchor {
+			re.usesG = true
+		}
+	}
+	return re, nil
+}
+
+// MustCompile - Compile that panics on error, for static patterns
+func MustCompile(pattern string) *Regexp {
+	re, err := Compile(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+// String - Source pattern
+func (re *Regexp) String() string { return re.pattern }
+
+// NumSubexp - Number of capturing groups
+func (re *Regexp) NumSubexp() int { return re.prog.NumCap - 1 }
+
+// Syntax - Parsed tree, for analyses; nil for programs from Decode
+func (re *Regexp) Syntax() *Tree { return re.tree }
+
+// Prog - Compiled program
+func (re *Regexp) Prog() *Prog { return re.prog }
+
+// UsesSearchAnchor - Reports whether the pattern contains \G, whose result
+// depends on the anchor passed to the search
+func (re *Regexp) UsesSearchAnchor() bool { return re.usesG }
+
+// SearchOptions - Context of a search
+type SearchOptions struct {
+	Anchor      int  // Position \G matches at, -1 for none
+	NoTextStart bool // \A never matches (input is not the start of the text)
+	StepLimit   int  // Instruction budget, <= 0 for unlimited
+}
+
+// FindAt - Leftmost match starting at or after start. The result holds
+// start/end byte offsets of every group (-1 when unset) or nil when there is
+// no match. anchor is the position \G matches at, -1 for none. A search that
+// exceeds DefaultStepLimit reports no match.
+func (re *Regexp) FindAt(input string, start, anchor int) []int {
+	m, _ := re.Search(input, start, SearchOptions{Anchor: anchor, StepLimit: DefaultStepLimit})
+	return m
+}
+
+// Search - FindAt with explicit options; fails with ErrStepLimit when the
+// budget runs out
+func (re *Regexp) Search(input string, start int, opts SearchOptions) ([]int, error) {
+	m := re.machine()
+	defer re.machines.Put(m)
+	m.input, m.anchor, m.noBOS = input, opts.Anchor, opts.NoTextStart
+	m.steps, m.limit, m.err = 0, opts.StepLimit, nil
+	anchor := opts.Anchor
+
+	for s := start; s <= len(input); {
+		if re.hasLead {
+			switch re.anchored {
+			case AssertTextStart:
+				if s != 0 || opts.NoTextStart {
+					return nil, nil
+				}
+			case AssertSearchAnchor:
+				if anchor < s || anchor > len(input) {
+					return nil, nil
+				}
+				s = anchor
+			}
+		}
+
+		for i := range m.slots {
+			m.slots[i] = -1
+		}
+		m.stack = m.stack[:0]
+		if _, ok := m.run(0, s, -1); ok {
+			return append([]int(nil), m.slots[:2*re.prog.NumCap]...), nil
+		}
+		if m.err != nil {
+			return nil, m.err
+		}
+		if s == len(input) || re.hasLead {
+			break
+		}
+		_, size := utf8.DecodeRuneInString(input[s:])
+		s += size
+	}
+	return nil, nil
+}
+
+func (re *Regexp) machine() *machine {
+	if m, ok := re.machines.Get().(*machine); ok {
+		return m
+	}
+	return &machine{prog: re.prog, slots: make([]int, 2*re.prog.NumCap+re.prog.NumReg)}
+}
+
+// leadingAnchor - \A or \G that every match must start with
+func leadingAnchor(n *Node) (AssertKind, bool) {
+	for {
+		switch n.Op {
+		case OpAssert:
+			if n.Assert == AssertTextStart || n.Assert == AssertSearchAnchor {
+				return n.Assert, true
+			}
+			return 0, false
+		case OpConcat:
+			if len(n.Sub) == 0 {
+				return 0, false
+			}
+			n = n.Sub[0]
+		case OpCapture:
+			n = n.Sub[0]
+		default:
+			return 0, false
+		}
+	}
+}
+
+// QuoteMeta - Escapes s so it matches literally, also in (?x) mode
+func QuoteMeta(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < utf8.RuneSelf && !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// entry - Backtrack stack entry: a branch to resume (slot < 0) or a slot
+// value to restore
+type entry struct {
+	pc, pos int
+	slot    int
+	old     int
+}
+
+type machine struct {
+	prog   *Prog
+	input  string
+	anchor int
+	noBOS  bool
+	slots  []int
+	stack  []entry
+	steps  int
+	limit  int
+	err    error
+}
+
+// run - Executes from pc at pos until InstMatch; backtracking never goes
+// below the stack height at entry. needEnd >= 0 requires the match to end
+// there (lookbehind bodies).
+func (m *machine) run(pc, pos, needEnd int) (int, bool) {
+	base := len(m.stack)
+	for {
+		if end, ok := m.thread(pc, pos, needEnd); ok {
+			return end, true
+		}
+		resumed := false
+		for len(m.stack) > base && m.err == nil {
+			e := m.stack[len(m.stack)-1]
+			m.stack = m.stack[:len(m.stack)-1]
+			if e.slot >= 0 {
+				m.slots[e.slot] = e.old
+				continue
+			}
+			pc, pos, resumed = e.pc, e.pos, true
+			break
+		}
+		if !resumed {
+			return -1, false
+		}
+	}
+}
+
+func (m *machine) thread(pc, pos, needEnd int) (int, bool) {
+	prog := m.prog
+	for {
+		m.steps++
+		if m.limit > 0 && m.steps > m.limit {
+			m.err = ErrStepLimit
+			return -1, false
+		}
+
+		inst := &prog.Inst[pc]
+		switch inst.Op {
+		case InstMatch:
+			if needEnd >= 0 && pos != needEnd {
+				return -1, false
+			}
+			return pos, true
+
+		case InstRune:
+			r, size := utf8.DecodeRuneInString(m.input[pos:])
+			if size == 0 || (r != inst.Rune && !(inst.Fold && equalFold(r, inst.Rune))) {
+				return -1, false
+			}
+			pos += size
+			pc++
+
+		case InstClass:
+			r, size := utf8.DecodeRuneInString(m.input[pos:])
+			class := prog.Classes[inst.Arg]
+			if size == 0 || !(class.Contains(r) || inst.Fold && class.ContainsFold(r)) {
+				return -1, false
+			}
+			pos += size
+			pc++
+
+		case InstAny, InstAnyNL:
+			r, size := utf8.DecodeRuneInString(m.input[pos:])
+			if size == 0 || (r == '\n' && inst.Op == InstAny) {
+				return -1, false
+			}
+			pos += size
+			pc++
+
+		case InstSplit:
+			m.stack = append(m.stack, entry{pc: inst.Y, pos: pos, slot: -1})
+			pc = inst.X
+
+		case InstJmp:
+			pc = inst.X
+
+		case InstSave:
+			m.set(inst.Arg, pos)
+			pc++
+
+		case InstNullCheckStart:
+			m.set(2*prog.NumCap+inst.Arg, pos)
+			pc++
+
+		case InstNullCheckEnd:
+			if m.slots[2*prog.NumCap+inst.Arg] == pos {
+				pc = inst.X
+			} else {
+				pc++
+			}
+
+		case InstAssert:
+			if !m.assert(AssertKind(inst.Arg), pos) {
+				return -1, false
+			}
+			pc++
+
+		case InstBackref:
+			end, ok := m.backref(inst.Arg, pos, inst.Fold)
+			if !ok {
+				return -1, false
+			}
+			pos = end
+			pc++
+
+		case InstLook:
+			if !m.look(inst, pos) {
+				return -1, false
+			}
+			pc = inst.Y
+
+		case InstAtomic:
+			end, ok := m.sub(inst.X, pos, -1, true)
+			if !ok {
+				return -1, false
+			}
+			pos = end
+			pc = inst.Y
+
+		default:
+			return -1, false
+		}
+	}
+}
+
+// set - Writes a slot, recording the old value for backtracking
+func (m *machine) set(slot, pos int) {
+	m.stack = append(m.stack, entry{slot: slot, old: m.slots[slot]})
+	m.slots[slot] = pos
+}
+
+// sub - Runs a subprogram. On success the branches it left are dropped so
+// it cannot be re-entered; slot changes are kept (keep) or undone.
+func (m *machine) sub(pc, pos, needEnd int, keep bool) (int, bool) {
+	base := len(m.stack)
+	end, ok := m.run(pc, pos, needEnd)
+	if !ok {
+		return -1, false
+	}
+	if keep {
+		out := m.stack[:base]
+		for _, e := range m.stack[base:] {
+			if e.slot >= 0 {
+				out = append(out, e)
+			}
+		}
+		m.stack = out
+	} else {
+		for len(m.stack) > base {
+			e := m.stack[len(m.stack)-1]
+			m.stack = m.stack[:len(m.stack)-1]
+			if e.slot >= 0 {
+				m.slots[e.slot] = e.old
+			}
+		}
+	}
+	return end, true
+}
+
+func (m *machine) look(inst *Inst, pos int) bool {
+	kind := LookKind(inst.Arg)
+	switch kind {
+	case LookAhead:
+		_, ok := m.sub(inst.X, pos, -1, true)
+		return ok
+	case LookAheadNeg:
+		_, ok := m.sub(inst.X, pos, -1, false)
+		return !ok && m.err == nil
+	}
+
+	// Lookbehind: try start positions going back, up to the body width
+	found := false
+	width := int(inst.Rune)
+	for start, n := pos, 0; start >= 0 && (width < 0 || n <= width); n++ {
+		if _, ok := m.sub(inst.X, start, pos, kind == LookBehind); ok {
+			found = true
+			break
+		}
+		if m.err != nil || start == 0 {
+			break
+		}
+		_, size := utf8.DecodeLastRuneInString(m.input[:start])
+		start -= size
+	}
+	if kind == LookBehindNeg {
+		return !found && m.err == nil
+	}
+	return found
+}
+
+func (m *machine) assert(kind AssertKind, pos int) bool {
+	in := m.input
+	switch kind {
+	case AssertLineStart:
+		return pos == 0 || in[pos-1] == '\n'
+	case AssertLineEnd:
+		return pos == len(in) || in[pos] == '\n'
+	case AssertTextStart:
+		return pos == 0 && !m.noBOS
+	case AssertTextEnd:
+		return pos == len(in)
+	case AssertTextEndNL:
+		return pos == len(in) || (pos == len(in)-1 && in[pos] == '\n')
+	case AssertSearchAnchor:
+		return pos == m.anchor
+	case AssertWordBoundary, AssertNonWordBoundary:
+		before, after := false, false
+		if pos > 0 {
+			r, _ := utf8.DecodeLastRuneInString(in[:pos])
+			before = IsWordRune(r)
+		}
+		if pos < len(in) {
+			r, _ := utf8.DecodeRuneInString(in[pos:])
+			after = IsWordRune(r)
+		}
+		return (before != after) == (kind == AssertWordBoundary)
+	}
+	return false
+}
+
+func (m *machine) backref(group, pos int, fold bool) (int, bool) {
+	start, end := m.slots[2*group], m.slots[2*group+1]
+	if start < 0 || end < 0 {
+		return -1, false
+	}
+	text := m.input[start:end]
+	if !fold {
+		if strings.HasPrefix(m.input[pos:], text) {
+			return pos + len(text), true
+		}
+		return -1, false
+	}
+	for _, want := range text {
+		r, size := utf8.DecodeRuneInString(m.input[pos:])
+		if size == 0 || !equalFold(r, want) {
+			return -1, false
+		}
+		pos += size
+	}
+	return pos, true
+}
+
+func equalFold(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	for f := unicode.SimpleFold(a); f != a; f = unicode.SimpleFold(f) {
+		if f == b {
+			return true
+		}
+	}
+	return false
+}
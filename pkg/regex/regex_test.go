@@ -0,0 +1,442 @@
+package regex
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRegexp_FindAt(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		input   string
+		start   int
+		anchor  int
+		want    []int
+	}{
+		{"literal", `abc`, "xxabc", 0, -1, []int{2, 5}},
+		{"leftmost alternative", `a|ab`, "ab", 0, -1, []int{0, 1}},
+		{"greedy star", `a*`, "aaab", 0, -1, []int{0, 3}},
+		{"lazy star", `a*?b`, "aaab", 0, -1, []int{0, 4}},
+		{"captures", `(\w+)\s*=\s*(\d+)`, "x = 42", 0, -1, []int{0, 6, 0, 1, 4, 6}},
+		{"unset group", `(a)|b`, "b", 0, -1, []int{0, 1, -1, -1}},
+		{"start offset", `\d+`, "12 34", 2, -1, []int{3, 5}},
+		{"lookbehind sees text before start", `(?<=\.)\w+`, "a.b", 1, -1, []int{2, 3}},
+		{"negative lookbehind", `(?<!\$)\b\w+`, "$a b", 0, -1, []int{3, 4}},
+		{"lookahead", `\w+(?=\()`, "f(x)", 0, -1, []int{0, 1}},
+		{"negative lookahead", `\d+(?!px)\b`, "10px 20", 0, -1, []int{5, 7}},
+		{"backref", `(['"]).*?\1`, `say "hi" now`, 0, -1, []int{4, 8, 4, 5}},
+		{"named backref", `(?<q>')x\k<q>`, "'x'", 0, -1, []int{0, 3, 0, 1}},
+		{"search anchor", `\G\s*x`, "a  x", 1, 1, []int{1, 4}},
+		{"search anchor miss", `\Gx`, "ax", 0, 0, nil},
+		{"atomic group", `(?>a+)a`, "aaa", 0, -1, nil},
+		{"possessive", `a++b`, "aab", 0, -1, []int{0, 3}},
+		{"hex class", `\h+`, "zz0fA9g", 0, -1, []int{2, 6}},
+		{"case fold", `(?i)select`, "SeLeCt", 0, -1, []int{0, 6}},
+		{"scoped flags", `a(?i:b)c`, "aBc aBC", 0, -1, []int{0, 3}},
+		{"extended", "(?x) a \\  b # comment", "a b", 0, -1, []int{0, 3}},
+		{"class set ops", `[a-z&&[^aeiou]]+`, "street", 0, -1, []int{0, 3}},
+		{"posix class", `[[:digit:]]+`, "ab12", 0, -1, []int{2, 4}},
+		{"unicode property", `\p{Lu}\p{Ll}+`, "über Ärger", 0, -1, []int{6, 12}},
+		{"counted", `\d{2,3}`, "1 1234", 0, -1, []int{2, 5}},
+		{"line end before newline", `x$`, "x\n", 0, -1, []int{0, 1}},
+		{"empty loop terminates", `(a*)*b`, "aab", 0, -1, []int{0, 3, 2, 2}},
+		{"no match", `q`, "abc", 0, -1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			re, err := Compile(tt.pattern)
+			if err != nil {
+				t.Fatalf("Compile(%q): %v", tt.pattern, err)
+			}
+			if got := re.FindAt(tt.input, tt.start, tt.anchor); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FindAt(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+
+			// The encoded program runs the same
+			dec, err := Decode(tt.pattern, re.Encode())
+			if err != nil {
+				t.Fatalf("Decode(%q): %v", tt.pattern, err)
+			}
+			if got := dec.FindAt(tt.input, tt.start, tt.anchor); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded FindAt(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompile_Errors(t *testing.T) {
+	for _, pattern := range []string{`(a`, `a)`, `*a`, `[a`, `\1(a)(b)\3`, `\k<nope>`, `a{1001}`, `(?z)`, `[[:]]`, `[a[:]b]`, `[x[:]`, `[[:alpha]`, `[[::]]`, `[[:^:]]`} {
+		if _, err := Compile(pattern); err == nil {
+			t.Errorf("Compile(%q) succeeded, want error", pattern)
+		}
+	}
+}
+
+func TestDecode_Errors(t *testing.T) {
+	valid := MustCompile(`(a|b)\1`).Encode()
+	tests := map[string][]byte{
+		"empty":     nil,
+		"version":   append([]byte{ProgVersion + 1}, valid[1:]...),
+		"truncated": valid[:len(valid)-1],
+		"trailing":  append(append([]byte(nil), valid...), 0),
+		"opcode":    {ProgVersion, leadNone, 1, 0, 0, 1, byte(InstFail) + 1},
+		"jump":      {ProgVersion, leadNone, 1, 0, 0, 2, byte(InstJmp), 2, byte(InstMatch)},
+		"slot":      {ProgVersion, leadNone, 1, 0, 0, 2, byte(InstSave), 2, byte(InstMatch)},
+		"class":     {ProgVersion, leadNone, 1, 0, 0, 2, byte(InstClass), 0, byte(InstMatch)},
+		"falls off": {ProgVersion, leadNone, 1, 0, 0, 1, byte(InstRune), 'a'},
+		"look body": {ProgVersion, leadNone, 1, 0, 0, 2, byte(InstLook), 0, 0, 1, 0, byte(InstMatch)},
+		"ranges":    {ProgVersion, leadNone, 1, 0, 1, 2, 'b', 0, 0, 0, 1, byte(InstMatch)},
+	}
+	for name, data := range tests {
+		if _, err := Decode("x", data); err == nil {
+			t.Errorf("Decode(%s) succeeded, want error", name)
+		}
+	}
+}
+
+func TestRegexp_StepLimit(t *testing.T) {
+	re := MustCompile(`(a|aa)+$`)
+	input := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaab"
+	if _, err := re.Search(input, 0, SearchOptions{Anchor: -1, StepLimit: 10000}); err != ErrStepLimit {
+		t.Errorf("Search() error = %v, want ErrStepLimit", err)
+	}
+}
+
+func TestShadows(t *testing.T) {
+	tests := []struct {
+		first, later string
+		want         bool
+		wantErr      error
+	}{
+		{`\w+`, `\bif\b`, true, nil},
+		{`\w+`, `(?i)select`, true, nil},
+		{`[a-z]+`, `(?i)select`, false, nil},
+		{`[a-z]+`, `(?i)[a-b]x`, false, nil},
+		{`(?i)[a-z]+`, `[A-B]x`, true, nil},
+		{`a`, `abc|ax`, true, nil},
+		{`ab`, `a|ab`, false, nil},
+		{`"`, `"(?:[^"\\]|\\.)*"`, true, nil},
+		{`\d+`, `\d+\.\d+`, true, nil},
+		{`\d+\.\d+`, `\d+`, false, nil},
+		{`a{2,3}`, `a{3}`, true, nil},
+		{`a{3}`, `a{2,3}`, false, nil},
+		{`x*`, `y`, true, nil}, // Empty match at every position
+		{`if`, `\bif\b`, true, nil},
+		{`\bif\b`, `if`, false, ErrUnsupported},
+		{`(?=a)`, `a`, false, ErrUnsupported},
+		{`(a)\1`, `aa`, false, ErrUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.first+" "+tt.later, func(t *testing.T) {
+			first, later := MustCompile(tt.first).Syntax(), MustCompile(tt.later).Syntax()
+			got, err := Shadows(first, later)
+			if got != tt.want || err != tt.wantErr {
+				t.Errorf("Shadows(%q, %q) = %v, %v, want %v, %v", tt.first, tt.later, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		want    bool
+		wantErr error
+	}{
+		{`a`, `b`, false, nil},
+		{`ab`, `a`, true, nil},
+		{`abc`, `abd`, false, nil},
+		{`\w+`, `\bif\b`, true, nil},
+		{`\d+`, `[a-z]+`, false, nil},
+		{`"[^"]*"`, `'[^']*'`, false, nil},
+		{`(?i)if`, `IF`, true, nil},
+		{`x*`, `y`, true, nil},      // Empty match at every position
+		{`a(?=b)`, `ac`, true, nil}, // Lookahead taken as always true
+		{`(a)\1`, `b`, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			a, b := MustCompile(tt.a).Syntax(), MustCompile(tt.b).Syntax()
+			got, err := Overlaps(a, b)
+			if got != tt.want || err != tt.wantErr {
+				t.Errorf("Overlaps(%q, %q) = %v, %v, want %v, %v", tt.a, tt.b, got, err, tt.want, tt.wantErr)
+			}
+			if back, _ := Overlaps(b, a); back != got {
+				t.Errorf("Overlaps(%q, %q) = %v, not symmetric", tt.b, tt.a, back)
+			}
+		})
+	}
+}
+
+func TestMatchesEmpty(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    EmptyMatch
+	}{
+		{`a`, EmptyNever},
+		{`a*`, EmptyAlways},
+		{`(a|)`, EmptyAlways},
+		{`(?=a)`, EmptySometimes},
+		{`^\s*`, EmptySometimes},
+		{`\b\w+`, EmptyNever},
+	}
+	for _, tt := range tests {
+		if got := MatchesEmpty(MustCompile(tt.pattern).Syntax()); got != tt.want {
+			t.Errorf("MatchesEmpty(%q) = %d, want %d", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestScanner(t *testing.T) {
+	// Match must pick what trying every pattern with Search picks: the
+	// leftmost start, then the lowest rule
+	tests := [][]string{
+		{`\bif\b`, `\w+`, `\d+(?:\.\d+)?`, `"`, `\s+`},
+		{`^\s*#`, `#.*$`, `$`, `\B_`},
+		{`(?i)select|from`, `[a-z]+`, `.`},
+		{`a*`, `b`},
+		{`x{2,4}y?`, `(?:xy)+`, `\S+`},
+		{`^\w+`, `\w+$`, `[^\n]$`, `é`}, // Anchors without \b: word characters share atoms
+		{`abcd`, `b`, `a+b`, `x.*y`},    // Later starts matching while an earlier one still runs
+	}
+	inputs := []string{"", "if x1 = 3.14 \"s\"\n", "  # c # d\n", "SELECT from_x __y_\n", "bbaab", "xxyxyxy z\n", "é if\tÉ9\n", "aaabcx abcd xxay\n"}
+	for _, patterns := range tests {
+		var trees []*Tree
+		var res []*Regexp
+		for _, p := range patterns {
+			re := MustCompile(p)
+			if !ScannerCompatible(re.Syntax()) {
+				t.Fatalf("%q not scanner compatible", p)
+			}
+			trees, res = append(trees, re.Syntax()), append(res, re)
+		}
+		sc, err := BuildScanner(trees)
+		if err != nil {
+			t.Fatalf("BuildScanner(%q): %v", patterns, err)
+		}
+		for _, input := range inputs {
+			for pos := 0; pos <= len(input); pos++ {
+				wantStart, wantRule := -1, -1
+				for i, re := range res {
+					if m := re.FindAt(input, pos, -1); m != nil && (wantStart < 0 || m[0] < wantStart) {
+						wantStart, wantRule = m[0], i
+					}
+				}
+				if start, rule := sc.Match(input, pos); start != wantStart || rule != wantRule {
+					t.Errorf("%q: Match(%q, %d) = %d, %d, want %d, %d", patterns, input, pos, start, rule, wantStart, wantRule)
+				}
+			}
+		}
+	}
+
+	for _, p := range []string{`(?=a)`, `(a)\1`, `\Ga`, `(?>a)`, `\Aa`} {
+		if ScannerCompatible(MustCompile(p).Syntax()) {
+			t.Errorf("%q is scanner compatible", p)
+		}
+	}
+}
+
+func BenchmarkScanner_LongLine(b *testing.B) {
+	// Every start runs to the end of the line without a match, the worst
+	// case for running the DFA once per start position
+	var trees []*Tree
+	for _, p := range []string{`a[^;]*;`, `"[^"]*"`, `\d+`} {
+		trees = append(trees, MustCompile(p).Syntax())
+	}
+	sc, err := BuildScanner(trees)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, n := range []int{1000, 4000, 16000} {
+		input := strings.Repeat("a", n)
+		b.Run(fmt.Sprintf("len=%d", n), func(b *testing.B) {
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				if start, _ := sc.Match(input, 0); start != -1 {
+					b.Fatalf("Match = %d, want -1", start)
+				}
+			}
+		})
+	}
+}
+
+func TestPrefilter(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		prefixes string // "" when every position may match
+		first    bool   // Whether FirstBytes gives a set
+	}{
+		{`\b(if|else)\b`, "[if else]", true},
+		{`(?i)if`, "[IF If iF if]", true},
+		{`"`, `["]`, true},
+		{`(//).*$`, "[//]", true},
+		{`0[xX][0-9a-f]+`, "[0X 0x]", true},
+		{`[+-]?\d+`, "", true},
+		{`\w+`, "", true},
+		{`a*`, "", false},
+		{`(?<=\.)é+`, "[é]", true},
+		{`(?>ab|a)c`, "[abc ac]", true},
+		{`$`, "", false},
+	}
+	inputs := []string{"if else x\n", "SeLeCt 0X1f -12 é.éé\n", "// \"a\" abc\n", "\xffa\xc3"}
+	for _, tt := range tests {
+		re := MustCompile(tt.pattern)
+		words, ok := Prefixes(re.Syntax())
+		if got := fmt.Sprint(words); ok != (tt.prefixes != "") || ok && got != tt.prefixes {
+			t.Errorf("Prefixes(%q) = %v, %v, want %s", tt.pattern, words, ok, tt.prefixes)
+		}
+		first, firstOK := FirstBytes(re.Syntax())
+		if firstOK != tt.first {
+			t.Errorf("FirstBytes(%q) ok = %v, want %v", tt.pattern, firstOK, tt.first)
+		}
+
+		// Every match must start at a byte of the set and with a prefix
+		for _, input := range inputs {
+			for pos := 0; pos <= len(input); pos++ {
+				m := re.FindAt(input, pos, -1)
+				if m == nil || m[0] == len(input) {
+					continue
+				}
+				if firstOK && !first.Has(input[m[0]]) {
+					t.Errorf("%q matches %q at %d, first byte not in FirstBytes", tt.pattern, input, m[0])
+				}
+				if ok && NewLiterals(words).Index(input, pos) != m[0] && !hasPrefix(input[m[0]:], words) {
+					t.Errorf("%q matches %q at %d, no prefix starts there", tt.pattern, input, m[0])
+				}
+			}
+		}
+	}
+}
+
+func hasPrefix(s string, words []string) bool {
+	for _, w := range words {
+		if strings.HasPrefix(s, w) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLiterals(t *testing.T) {
+	words := []string{"he", "she", "hers", "his", "ushe", "x"}
+	l := NewLiterals(words)
+	text := "ahishers ushers xhe"
+	for start := 0; start <= len(text); start++ {
+		want := -1
+		for i := start; i < len(text) && want < 0; i++ {
+			if hasPrefix(text[i:], words) {
+				want = i
+			}
+		}
+		if got := l.Index(text, start); got != want {
+			t.Errorf("Index(%q, %d) = %d, want %d", text, start, got, want)
+		}
+	}
+	if got := NewLiterals(nil).Index(text, 0); got != -1 {
+		t.Errorf("empty set Index = %d", got)
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	tests := []struct {
+		pattern string
+		words   string // "" if not a keyword list
+	}{
+		{`\b(if|else|elif)\b`, "[elif else if]"},
+		{`\b(?:true|false)\b`, "[false true]"},
+		{`(\b(?:do|done)\b)`, "[do done]"},
+		{`\bcolou?r\b`, "[color colour]"},
+		{`\b[Tt]rue\b`, "[True true]"},
+		{`(?i)\b(select|from)\b`, "[FROM SELECT]"},
+		{`\bünï\b`, "[ünï]"},
+		{`\b(if|else)`, ""},        // No boundary after
+		{`\b(if|\w+)\b`, ""},       // Not finite
+		{`\b(i)(f)\b`, ""},         // Groups inside the word
+		{`\b(if|a-b)\b`, ""},       // Not a word
+		{`\b(if|)\b`, ""},          // Empty word
+		{`\b(?i:if)(?-i:x)\b`, ""}, // Mixed case folding
+	}
+	for _, tt := range tests {
+		tree, err := Parse(tt.pattern)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.pattern, err)
+		}
+		words, fold, _, ok := KeywordList(tree)
+		got := ""
+		if ok {
+			got = fmt.Sprint(words)
+		}
+		if got != tt.words {
+			t.Errorf("KeywordList(%q) = %s, want %s", tt.pattern, got, tt.words)
+		}
+		if !ok {
+			continue
+		}
+
+		// Same matches as the regex at every position
+		re := MustCompile(tt.pattern)
+		kw := NewKeywords(words, fold)
+		for _, text := range []string{"if else_ elif xif ifx", "colour colr color_ (color)", "True true TRUE", "Select FROM fRoM selects", "ünï xünï ünïx", ""} {
+			for start := 0; start <= len(text); start++ {
+				if start < len(text) && !utf8.RuneStart(text[start]) {
+					continue
+				}
+				want := re.FindAt(text, start, -1)
+				s, e := kw.Find(text, start)
+				if want == nil && s >= 0 || want != nil && (want[0] != s || want[1] != e) {
+					t.Errorf("%q: Find(%q, %d) = %d, %d, want %v", tt.pattern, text, start, s, e, want)
+				}
+			}
+		}
+	}
+}
+
+func FuzzCompile(f *testing.F) {
+	for _, seed := range []string{`\b(if|else)\b`, `(?<=\$)\w+`, `(a|aa)+$`, `\G"(?:[^"\\]|\\.)*"`, `[[:alpha:]&&[^aeiou]]`, `(?i)\k<x>(?<x>a)`} {
+		f.Add(seed, "if x = \"a\\\"b\" $y aaaab")
+	}
+	f.Fuzz(func(t *testing.T, pattern, input string) {
+		re, err := Compile(pattern)
+		if err != nil {
+			return
+		}
+		dec, err := Decode(pattern, re.Encode())
+		if err != nil {
+			t.Fatalf("Decode(%q): %v", pattern, err)
+		}
+		for start := 0; start <= len(input); start += 1 + len(input)/4 {
+			loc, err := re.Search(input, start, SearchOptions{Anchor: -1, StepLimit: 100000})
+			if err != nil {
+				continue
+			}
+			if loc != nil && (loc[0] < start || loc[1] < loc[0] || loc[1] > len(input)) {
+				t.Fatalf("Search(%q, %d) = %v for %q", input, start, loc, pattern)
+			}
+			if got, _ := dec.Search(input, start, SearchOptions{Anchor: -1, StepLimit: 100000}); !reflect.DeepEqual(got, loc) {
+				t.Fatalf("decoded Search(%q, %d) = %v, want %v for %q", input, start, got, loc, pattern)
+			}
+		}
+	})
+}
+
+// FuzzDecode - Programs that pass Decode run without panicking
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []string{`\b(if|else)\b`, `(?<=\$)\w+`, `\G"(?:[^"\\]|\\.)*"`, `(?i)(a)(?>a+)(?!b)\1`, `(a*)*b`} {
+		f.Add(MustCompile(seed).Encode())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		re, err := Decode("fuzz", data)
+		if err != nil {
+			return
+		}
+		input := "if x = \"a\\\"b\" $y aaaab"
+		for start := 0; start <= len(input); start += 5 {
+			re.Search(input, start, SearchOptions{Anchor: start, StepLimit: 10000})
+		}
+	})
+}
@@ -0,0 +1,418 @@
+package regex
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Context of the character before or after a position, the only thing the
+// scanner assertions (^, $, \b, \B) depend on
+const (
+	CtxNone    = iota // Start of input before, end of input after
+	CtxNewline        // '\n'
+	CtxWord           // IsWordRune
+	CtxOther
+	NumCtx
+)
+
+// ScannerDead - Next entry of a transition no rule can continue through
+const ScannerDead = ^uint32(0)
+
+// ScannerNoRule - Accept entry of a state where no rule matches
+const ScannerNoRule = ^uint16(0)
+
+// maxScannerStates - DFA size past which BuildScanner gives up
+const maxScannerStates = 4096
+
+// ScannerTables - Serializable form of a Scanner. Runes are grouped into
+// atoms that every rule treats alike; the DFA steps once per rune on its
+// atom.
+type ScannerTables struct {
+	Ranges    []rune   // Sorted [lo, hi] pairs covering every rune
+	Atoms     []uint16 // Atom of each range
+	AtomCount int
+	Starts    [NumCtx]uint32 // Start state by context of the previous character
+	Next      []uint32       // Next[state*AtomCount+atom], ScannerDead if no rule continues
+	Accept    []uint16       // Accept[state*NumCtx+ctx]: lowest rule matching here when ctx follows
+}
+
+// Scanner - Multi-pattern DFA over the rules of a state: Match returns the
+// leftmost position where any rule matches and the lowest rule matching
+// there, the same choice as trying every pattern with Search. Rules must be
+// RE2-compatible: no lookaround, backreferences, atomic groups, possessive
+// quantifiers, \A, \z, \Z or \G; ^, $, \b and \B are supported. Safe for
+// concurrent use.
+type Scanner struct {
+	t        ScannerTables
+	states   int
+	minReach []uint16 // Lowest rule any path from the state can accept
+	ascii    [utf8.RuneSelf]uint16
+}
+
+// ScannerCompatible - Whether t can be part of a Scanner
+func ScannerCompatible(t *Tree) bool {
+	a := &nfa{scan: true}
+	_, _, err := a.compile(t.Root)
+	return err == nil
+}
+
+// BuildScanner - Compiles the patterns into one DFA; rule i of Match is
+// trees[i]. Fails with ErrUnsupported if a pattern is not RE2-compatible or
+// the DFA grows too large.
+func BuildScanner(trees []*Tree) (*Scanner, error) {
+	if len(trees) >= int(ScannerNoRule) {
+		return nil, ErrUnsupported
+	}
+	a := &nfa{scan: true}
+	start, err := a.state()
+	if err != nil {
+		return nil, err
+	}
+	for i, t := range trees {
+		s, e, err := a.compile(t.Root)
+		if err != nil {
+			return nil, err
+		}
+		a.states[start].eps = append(a.states[start].eps, s)
+		a.states[e].rule = i + 1
+	}
+	a.start, a.accept = start, -1
+
+	// Atoms must not mix characters of different contexts; word characters
+	// only need their own atoms for \b and \B
+	words := false
+	for _, st := range a.states {
+		words = words || st.isAssert && (st.assert == AssertWordBoundary || st.assert == AssertNonWordBoundary)
+	}
+	ctxOf := func(ctx int) int {
+		if ctx == CtxWord && !words {
+			return CtxOther
+		}
+		return ctx
+	}
+	extra := [][]rune{{'\n', '\n'}}
+	if words {
+		extra = append(extra, wordClass().Ranges)
+	}
+	a.partition(extra)
+
+	var t ScannerTables
+	atomCtx := make(map[int]int)
+	for i, id := range a.atomIDs {
+		hi := rune(unicode.MaxRune)
+		if i+1 < len(a.atomStarts) {
+			hi = a.atomStarts[i+1] - 1
+		}
+		t.Ranges = append(t.Ranges, a.atomStarts[i], hi)
+		t.Atoms = append(t.Atoms, uint16(id))
+		atomCtx[id] = ctxOf(runeCtx(a.atomStarts[i])) // The same for every rune of the atom
+	}
+	t.AtomCount = len(atomCtx)
+
+	// DFA states are NFA sets closed over plain epsilon edges, with the
+	// context of the character read last; assertions are resolved when the
+	// next character is known
+	type dstate struct {
+		set  []int
+		prev int
+	}
+	var states []dstate
+	index := make(map[string]uint32)
+	add := func(set []int, prev int) (uint32, error) {
+		if !a.hasAsserts(set) {
+			prev = CtxOther // Irrelevant, keep one copy
+		}
+		key := strconv.Itoa(prev) + ":" + setKey(set, nil)
+		if id, ok := index[key]; ok {
+			return id, nil
+		}
+		if len(states) >= maxScannerStates {
+			return 0, ErrUnsupported
+		}
+		id := uint32(len(states))
+		index[key] = id
+		states = append(states, dstate{set, prev})
+		return id, nil
+	}
+	for ctx := 0; ctx < NumCtx; ctx++ {
+		if t.Starts[ctx], err = add(a.closure([]int{a.start}), ctxOf(ctx)); err != nil {
+			return nil, err
+		}
+	}
+
+	for id := 0; id < len(states); id++ {
+		st := states[id]
+		for ctx := 0; ctx < NumCtx; ctx++ {
+			best := ScannerNoRule
+			for _, s := range a.resolve(st.set, st.prev, ctx) {
+				if r := a.states[s].rule; r > 0 && uint16(r-1) < best {
+					best = uint16(r - 1)
+				}
+			}
+			t.Accept = append(t.Accept, best)
+		}
+		for atom := 0; atom < t.AtomCount; atom++ {
+			ctx := atomCtx[atom]
+			next := a.step(a.resolve(st.set, st.prev, ctx), atom)
+			if len(next) == 0 {
+				t.Next = append(t.Next, ScannerDead)
+				continue
+			}
+			to, err := add(next, ctx)
+			if err != nil {
+				return nil, err
+			}
+			t.Next = append(t.Next, to)
+		}
+	}
+	return NewScanner(t)
+}
+
+// hasAsserts - Whether set holds assertion states
+func (a *nfa) hasAsserts(set []int) bool {
+	for _, s := range set {
+		if a.states[s].isAssert {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve - set closed over epsilon edges and the assertions that hold
+// between characters of contexts prev and next
+func (a *nfa) resolve(set []int, prev, next int) []int {
+	if !a.hasAsserts(set) {
+		return set
+	}
+	seen := make(map[int]bool)
+	stack := append([]int(nil), set...)
+	var out []int
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		out = append(out, s)
+		st := a.states[s]
+		stack = append(stack, st.eps...)
+		if st.isAssert && assertHolds(st.assert, prev, next) {
+			stack = append(stack, st.out)
+		}
+	}
+	sort.Ints(out)
+	return out
+}
+
+func assertHolds(kind AssertKind, prev, next int) bool {
+	switch kind {
+	case AssertLineStart:
+		return prev == CtxNone || prev == CtxNewline
+	case AssertLineEnd:
+		return next == CtxNone || next == CtxNewline
+	case AssertWordBoundary:
+		return (prev == CtxWord) != (next == CtxWord)
+	case AssertNonWordBoundary:
+		return (prev == CtxWord) == (next == CtxWord)
+	}
+	return false
+}
+
+func runeCtx(r rune) int {
+	switch {
+	case r == '\n':
+		return CtxNewline
+	case IsWordRune(r):
+		return CtxWord
+	}
+	return CtxOther
+}
+
+// NewScanner - Scanner from tables, as read back from bytecode
+func NewScanner(t ScannerTables) (*Scanner, error) {
+	if len(t.Ranges) != 2*len(t.Atoms) || len(t.Ranges) == 0 || t.Ranges[0] != 0 || t.Ranges[len(t.Ranges)-1] != unicode.MaxRune {
+		return nil, fmt.Errorf("scanner: ranges do not cover every rune")
+	}
+	for i, atom := range t.Atoms {
+		if int(atom) >= t.AtomCount || t.Ranges[2*i] > t.Ranges[2*i+1] || i > 0 && t.Ranges[2*i] != t.Ranges[2*i-1]+1 {
+			return nil, fmt.Errorf("scanner: invalid range %d", i)
+		}
+	}
+	states := len(t.Accept) / NumCtx
+	if states == 0 || len(t.Accept) != states*NumCtx || len(t.Next) != states*t.AtomCount {
+		return nil, fmt.Errorf("scanner: table sizes do not match %d states", states)
+	}
+	for _, s := range t.Starts {
+		if int(s) >= states {
+			return nil, fmt.Errorf("scanner: start state %d out of range", s)
+		}
+	}
+	for _, s := range t.Next {
+		if s != ScannerDead && int(s) >= states {
+			return nil, fmt.Errorf("scanner: state %d out of range", s)
+		}
+	}
+
+	sc := &Scanner{t: t, states: states}
+	for r := rune(0); r < utf8.RuneSelf; r++ {
+		sc.ascii[r] = sc.lookup(r)
+	}
+
+	// Lowest rule reachable from each state, to stop once nothing can beat
+	// the rule already found
+	sc.minReach = make([]uint16, states)
+	for s := range sc.minReach {
+		sc.minReach[s] = ScannerNoRule
+		for _, r := range t.Accept[s*NumCtx : (s+1)*NumCtx] {
+			if r < sc.minReach[s] {
+				sc.minReach[s] = r
+			}
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for s := 0; s < states; s++ {
+			for _, next := range t.Next[s*t.AtomCount : (s+1)*t.AtomCount] {
+				if next != ScannerDead && sc.minReach[next] < sc.minReach[s] {
+					sc.minReach[s] = sc.minReach[next]
+					changed = true
+				}
+			}
+		}
+	}
+	return sc, nil
+}
+
+// Tables - Serializable form of the scanner
+func (sc *Scanner) Tables() ScannerTables { return sc.t }
+
+// States - Number of DFA states
+func (sc *Scanner) States() int { return sc.states }
+
+func (sc *Scanner) lookup(r rune) uint16 {
+	n := len(sc.t.Atoms)
+	i := sort.Search(n, func(i int) bool { return sc.t.Ranges[2*i+1] >= r })
+	if i == n {
+		i = n - 1
+	}
+	return sc.t.Atoms[i]
+}
+
+func (sc *Scanner) atom(r rune) int {
+	if r < utf8.RuneSelf {
+		return int(sc.ascii[r])
+	}
+	return int(sc.lookup(r))
+}
+
+// scanThread - Run of the DFA from one start position
+type scanThread struct {
+	start int
+	state uint32
+	best  uint16 // Lowest rule accepted so far
+	done  bool   // best is final
+}
+
+// scanScratch - Per-call buffers of Match, pooled to keep the scanner safe
+// for concurrent use
+type scanScratch struct {
+	threads []scanThread
+	mark    []uint32 // Generation that last claimed each DFA state
+	gen     uint32
+}
+
+var scanScratchPool sync.Pool
+
+// Match - Leftmost position at or after start where a rule matches and the
+// lowest rule matching there; -1, -1 if no rule matches. Positions advance
+// by runes, as Search does.
+//
+// The input is read once: every start position gets a thread, stepped
+// together with the others, and a thread reaching the DFA state of an
+// earlier one is dropped, since from then on it can only match where the
+// earlier one does. Live threads never outnumber the DFA states, and none
+// are started past a position already known to match.
+func (sc *Scanner) Match(input string, start int) (int, int) {
+	if start > len(input) {
+		return -1, -1
+	}
+	scratch, _ := scanScratchPool.Get().(*scanScratch)
+	if scratch == nil || len(scratch.mark) < sc.states {
+		scratch = &scanScratch{mark: make([]uint32, sc.states)}
+	}
+	defer scanScratchPool.Put(scratch)
+
+	prev := CtxNone
+	if start > 0 {
+		r, _ := utf8.DecodeLastRuneInString(input[:start])
+		prev = runeCtx(r)
+	}
+	threads := scratch.threads[:0]
+	defer func() { scratch.threads = threads[:0] }()
+	for q := start; q <= len(input); {
+		next := CtxNone
+		var r rune
+		size := 0
+		if q < len(input) {
+			r, size = utf8.DecodeRuneInString(input[q:])
+			next = runeCtx(r)
+		}
+
+		// Threads are ordered by start; only the last can have accepted,
+		// and then no later start can win
+		if n := len(threads); n == 0 || threads[n-1].best == ScannerNoRule {
+			if s := sc.t.Starts[prev]; n == 0 || scratch.mark[s] != scratch.gen {
+				threads = append(threads, scanThread{start: q, state: s, best: ScannerNoRule})
+			}
+		}
+
+		scratch.gen++
+		if scratch.gen == 0 {
+			clear(scratch.mark)
+			scratch.gen = 1
+		}
+		live := threads[:0]
+		for _, th := range threads {
+			if !th.done {
+				if rule := sc.t.Accept[int(th.state)*NumCtx+next]; rule < th.best {
+					th.best = rule
+				}
+				th.done = th.best <= sc.minReach[th.state] || size == 0
+				if !th.done {
+					if th.state = sc.t.Next[int(th.state)*sc.t.AtomCount+sc.atom(r)]; th.state == ScannerDead {
+						th.done = true
+					}
+				}
+			}
+			switch {
+			case th.done && th.best == ScannerNoRule:
+				continue // No match from this start
+			case th.best == ScannerNoRule:
+				if scratch.mark[th.state] == scratch.gen {
+					continue // An earlier start is in the same state
+				}
+				scratch.mark[th.state] = scratch.gen
+			}
+			live = append(live, th)
+			if th.best != ScannerNoRule {
+				break
+			}
+		}
+		threads = live
+		if len(threads) > 0 && threads[0].done {
+			return threads[0].start, int(threads[0].best)
+		}
+
+		if size == 0 {
+			break
+		}
+		prev = runeCtx(r)
+		q += size
+	}
+	return -1, -1
+}
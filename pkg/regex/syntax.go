@@ -0,0 +1,801 @@
+// Package regex implements the Oniguruma regex subset used by TextMate
+// grammars: lookahead, lookbehind, backreferences, atomic groups,
+// possessive quantifiers, \G and the \h class, on top of the usual syntax.
+// Patterns are parsed into a syntax tree, compiled to an instruction
+// program and run by a backtracking matcher that can start a search at any
+// offset while still seeing the text before it.
+package regex
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Flags - Options active while parsing a node
+type Flags uint8
+
+const (
+	FoldCase Flags = 1 << iota // (?i)
+	Extended                   // (?x) free spacing and # comments
+	DotNL                      // (?m) in Ruby syntax: '.' matches '\n'
+)
+
+// Op - Syntax tree node kind
+type Op uint8
+
+const (
+	OpEmpty         Op = iota // Matches the empty string
+	OpLiteral                 // Rune
+	OpClass                   // Class
+	OpAnyChar                 // '.'
+	OpConcat                  // Sub in sequence
+	OpAlternate               // Sub as alternatives
+	OpRepeat                  // Sub[0]{Min,Max}
+	OpCapture                 // Capturing group Index
+	OpLookahead               // (?=...)
+	OpNegLookahead            // (?!...)
+	OpLookbehind              // (?<=...)
+	OpNegLookbehind           // (?<!...)
+	OpAtomic                  // (?>...)
+	OpAssert                  // Zero-width assertion Assert
+	OpBackref                 // \N, \k<name>
+)
+
+// AssertKind - Zero-width assertions
+type AssertKind uint8
+
+const (
+	AssertLineStart       AssertKind = iota // ^
+	AssertLineEnd                           // $
+	AssertTextStart                         // \A
+	AssertTextEnd                           // \z
+	AssertTextEndNL                         // \Z
+	AssertSearchAnchor                      // \G
+	AssertWordBoundary                      // \b
+	AssertNonWordBoundary                   // \B
+)
+
+// Node - Syntax tree node
+type Node struct {
+	Op         Op
+	Flags      Flags
+	Rune       rune
+	Class      *Class
+	Sub        []*Node
+	Min, Max   int // Max -1: unbounded
+	Greedy     bool
+	Possessive bool
+	Index      int // Capture or backreference group
+	Name       string
+	Assert     AssertKind
+}
+
+// Tree - Parsed pattern
+type Tree struct {
+	Root     *Node
+	Captures int      // Capturing groups, group 0 excluded
+	Names    []string // Name of each group, "" if unnamed; Names[0] is unused
+}
+
+// Error - Pattern syntax error
+type Error struct {
+	Pattern string
+	Offset  int
+	Msg     string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("regex %q at offset %d: %s", e.Pattern, e.Offset, e.Msg)
+}
+
+// maxRepeat - Largest counted repetition, bounded to keep programs small
+const maxRepeat = 1000
+
+// Parse - Parses an Oniguruma (Ruby syntax) pattern
+func Parse(pattern string) (*Tree, error) {
+	p := &parser{src: pattern, tree: &Tree{Names: []string{""}}}
+	root, err := p.parseAlternation()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unmatched ')'")
+	}
+
+	// Backreferences can point forward, so they are checked at the end
+	if err := p.checkBackrefs(root); err != nil {
+		return nil, err
+	}
+	p.tree.Root = root
+	return p.tree, nil
+}
+
+type parser struct {
+	src      string
+	pos      int
+	flags    Flags
+	tree     *Tree
+	namedRef []*Node // \k<name> nodes resolved after parsing
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &Error{Pattern: p.src, Offset: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) more() bool { return p.pos < len(p.src) }
+
+func (p *parser) peek() rune {
+	r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+	return r
+}
+
+func (p *parser) next() rune {
+	r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += size
+	return r
+}
+
+func (p *parser) lookingAt(s string) bool {
+	return strings.HasPrefix(p.src[p.pos:], s)
+}
+
+// skipExtended - Whitespace and comments are ignored in (?x) mode
+func (p *parser) skipExtended() {
+	if p.flags&Extended == 0 {
+		return
+	}
+	for p.more() {
+		c := p.src[p.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			p.pos++
+		case c == '#':
+			for p.more() && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) parseAlternation() (*Node, error) {
+	// Inline flags like (?i) last until the end of the enclosing group
+	saved := p.flags
+	defer func() { p.flags = saved }()
+
+	var alts []*Node
+	for {
+		seq, err := p.parseSequence()
+		if err != nil {
+			return nil, err
+		}
+		alts = append(alts, seq)
+		if !p.more() || p.peek() != '|' {
+			break
+		}
+		p.next()
+	}
+	if len(alts) == 1 {
+		return alts[0], nil
+	}
+	return &Node{Op: OpAlternate, Sub: alts}, nil
+}
+
+func (p *parser) parseSequence() (*Node, error) {
+	var items []*Node
+	for {
+		p.skipExtended()
+		if !p.more() || p.peek() == '|' || p.peek() == ')' {
+			break
+		}
+		atom, err := p.parseAtom()
+		if err != nil {
+			return nil, err
+		}
+		if atom == nil {
+			// Flag group or comment, nothing to match
+			continue
+		}
+		atom, err = p.parseQuantifiers(atom)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, atom)
+	}
+	switch len(items) {
+	case 0:
+		return &Node{Op: OpEmpty}, nil
+	case 1:
+		return items[0], nil
+	}
+	return &Node{Op: OpConcat, Sub: items}, nil
+}
+
+func (p *parser) parseQuantifiers(atom *Node) (*Node, error) {
+	for {
+		p.skipExtended()
+		if !p.more() {
+			return atom, nil
+		}
+		start := p.pos
+		min, max := 0, 0
+		switch p.peek() {
+		case '*':
+			p.next()
+			min, max = 0, -1
+		case '+':
+			p.next()
+			min, max = 1, -1
+		case '?':
+			p.next()
+			min, max = 0, 1
+		case '{':
+			var ok bool
+			min, max, ok = p.parseInterval()
+			if !ok {
+				return atom, nil
+			}
+		default:
+			return atom, nil
+		}
+
+		if atom.Op == OpAssert || atom.Op == OpLookahead || atom.Op == OpNegLookahead ||
+			atom.Op == OpLookbehind || atom.Op == OpNegLookbehind {
+			p.pos = start
+			return nil, p.errorf("target of repeat operator is invalid")
+		}
+		if min > maxRepeat || max > maxRepeat {
+			p.pos = start
+			return nil, p.errorf("repeat count too large")
+		}
+
+		node := &Node{Op: OpRepeat, Sub: []*Node{atom}, Min: min, Max: max, Greedy: true}
+		if p.more() {
+			switch p.peek() {
+			case '?':
+				p.next()
+				node.Greedy = false
+			case '+':
+				p.next()
+				node.Possessive = true
+			}
+		}
+		atom = node
+	}
+}
+
+// parseInterval - {n}, {n,}, {n,m} and {,m}; anything else is a literal '{'
+func (p *parser) parseInterval() (int, int, bool) {
+	end := strings.IndexByte(p.src[p.pos:], '}')
+	if end < 0 {
+		return 0, 0, false
+	}
+	body := p.src[p.pos+1 : p.pos+end]
+	lo, hi, hasComma := body, body, false
+	if i := strings.IndexByte(body, ','); i >= 0 {
+		lo, hi, hasComma = body[:i], body[i+1:], true
+	}
+	if lo == "" && (!hasComma || hi == "") {
+		return 0, 0, false
+	}
+
+	min, max := 0, -1
+	var err error
+	if lo != "" {
+		if min, err = strconv.Atoi(lo); err != nil || min < 0 {
+			return 0, 0, false
+		}
+	}
+	switch {
+	case !hasComma:
+		max = min
+	case hi != "":
+		if max, err = strconv.Atoi(hi); err != nil || max < min {
+			return 0, 0, false
+		}
+	}
+	p.pos += end + 1
+	return min, max, true
+}
+
+func (p *parser) parseAtom() (*Node, error) {
+	start := p.pos
+	c := p.next()
+	switch c {
+	case '(':
+		return p.parseGroup()
+	case '[':
+		class, err := p.parseClass()
+		if err != nil {
+			return nil, err
+		}
+		return &Node{Op: OpClass, Class: class, Flags: p.flags}, nil
+	case '.':
+		return &Node{Op: OpAnyChar, Flags: p.flags}, nil
+	case '^':
+		return &Node{Op: OpAssert, Assert: AssertLineStart}, nil
+	case '$':
+		return &Node{Op: OpAssert, Assert: AssertLineEnd}, nil
+	case '\\':
+		return p.parseEscape()
+	case '*', '+', '?':
+		p.pos = start
+		return nil, p.errorf("target of repeat operator is not specified")
+	}
+	return &Node{Op: OpLiteral, Rune: c, Flags: p.flags}, nil
+}
+
+func (p *parser) parseGroup() (*Node, error) {
+	var node *Node
+	switch {
+	case p.lookingAt("?#"):
+		end := strings.IndexByte(p.src[p.pos:], ')')
+		if end < 0 {
+			return nil, p.errorf("end pattern in group")
+		}
+		p.pos += end + 1
+		return nil, nil
+	case p.lookingAt("?:"):
+		p.pos += 2
+		node = &Node{Op: OpConcat}
+	case p.lookingAt("?="):
+		p.pos += 2
+		node = &Node{Op: OpLookahead}
+	case p.lookingAt("?!"):
+		p.pos += 2
+		node = &Node{Op: OpNegLookahead}
+	case p.lookingAt("?<="):
+		p.pos += 3
+		node = &Node{Op: OpLookbehind}
+	case p.lookingAt("?<!"):
+		p.pos += 3
+		node = &Node{Op: OpNegLookbehind}
+	case p.lookingAt("?>"):
+		p.pos += 2
+		node = &Node{Op: OpAtomic}
+	case p.lookingAt("?<"), p.lookingAt("?'"), p.lookingAt("?P<"):
+		if p.lookingAt("?P") {
+			p.pos++
+		}
+		p.pos++
+		closing := byte('>')
+		if p.next() == '\'' {
+			closing = '\''
+		}
+		end := strings.IndexByte(p.src[p.pos:], closing)
+		if end <= 0 {
+			return nil, p.errorf("invalid group name")
+		}
+		name := p.src[p.pos : p.pos+end]
+		p.pos += end + 1
+		node = p.newCapture(name)
+	case p.lookingAt("?"):
+		p.next()
+		return p.parseFlagGroup()
+	default:
+		node = p.newCapture("")
+	}
+
+	body, err := p.parseAlternation()
+	if err != nil {
+		return nil, err
+	}
+	if !p.more() || p.next() != ')' {
+		return nil, p.errorf("end pattern with unmatched parenthesis")
+	}
+
+	if node.Op == OpConcat {
+		// Non-capturing group: the body itself
+		return body, nil
+	}
+	node.Sub = []*Node{body}
+	return node, nil
+}
+
+func (p *parser) newCapture(name string) *Node {
+	p.tree.Captures++
+	p.tree.Names = append(p.tree.Names, name)
+	return &Node{Op: OpCapture, Index: p.tree.Captures, Name: name}
+}
+
+// parseFlagGroup - (?imx-imx) or (?imx-imx:...)
+func (p *parser) parseFlagGroup() (*Node, error) {
+	flags := p.flags
+	negate := false
+	for p.more() {
+		c := p.next()
+		var f Flags
+		switch c {
+		case 'i':
+			f = FoldCase
+		case 'x':
+			f = Extended
+		case 'm':
+			f = DotNL
+		case '-':
+			negate = true
+			continue
+		case ')':
+			p.flags = flags
+			return nil, nil
+		case ':':
+			saved := p.flags
+			p.flags = flags
+			body, err := p.parseAlternation()
+			p.flags = saved
+			if err != nil {
+				return nil, err
+			}
+			if !p.more() || p.next() != ')' {
+				return nil, p.errorf("end pattern with unmatched parenthesis")
+			}
+			return body, nil
+		default:
+			return nil, p.errorf("undefined group option %q", c)
+		}
+		if negate {
+			flags &^= f
+		} else {
+			flags |= f
+		}
+	}
+	return nil, p.errorf("end pattern in group")
+}
+
+func (p *parser) parseEscape() (*Node, error) {
+	if !p.more() {
+		return nil, p.errorf("end pattern at escape")
+	}
+	start := p.pos
+	c := p.next()
+	switch c {
+	case 'b':
+		return &Node{Op: OpAssert, Assert: AssertWordBoundary}, nil
+	case 'B':
+		return &Node{Op: OpAssert, Assert: AssertNonWordBoundary}, nil
+	case 'A':
+		return &Node{Op: OpAssert, Assert: AssertTextStart}, nil
+	case 'z':
+		return &Node{Op: OpAssert, Assert: AssertTextEnd}, nil
+	case 'Z':
+		return &Node{Op: OpAssert, Assert: AssertTextEndNL}, nil
+	case 'G':
+		return &Node{Op: OpAssert, Assert: AssertSearchAnchor}, nil
+	case 'k':
+		return p.parseNamedBackref()
+	case 'R':
+		// Generic linebreak: \r\n or any vertical space
+		crlf := &Node{Op: OpConcat, Sub: []*Node{{Op: OpLiteral, Rune: '\r'}, {Op: OpLiteral, Rune: '\n'}}}
+		vspace := &Node{Op: OpClass, Class: newClass('\n', '\r', 0x85, 0x85, 0x2028, 0x2029)}
+		return &Node{Op: OpAtomic, Sub: []*Node{{Op: OpAlternate, Sub: []*Node{crlf, vspace}}}}, nil
+	case 'K', 'X', 'g':
+		p.pos = start
+		return nil, p.errorf("unsupported escape \\%c", c)
+	}
+
+	if c >= '1' && c <= '9' {
+		n := int(c - '0')
+		for p.more() && p.peek() >= '0' && p.peek() <= '9' && n*10+int(p.peek()-'0') <= p.tree.Captures {
+			n = n*10 + int(p.next()-'0')
+		}
+		return &Node{Op: OpBackref, Index: n, Flags: p.flags}, nil
+	}
+
+	p.pos = start
+	class, r, err := p.parseClassEscape(false)
+	if err != nil {
+		return nil, err
+	}
+	if class != nil {
+		return &Node{Op: OpClass, Class: class, Flags: p.flags}, nil
+	}
+	return &Node{Op: OpLiteral, Rune: r, Flags: p.flags}, nil
+}
+
+func (p *parser) parseNamedBackref() (*Node, error) {
+	if !p.more() || (p.peek() != '<' && p.peek() != '\'') {
+		return nil, p.errorf("invalid backref")
+	}
+	closing := byte('>')
+	if p.next() == '\'' {
+		closing = '\''
+	}
+	end := strings.IndexByte(p.src[p.pos:], closing)
+	if end <= 0 {
+		return nil, p.errorf("invalid backref name")
+	}
+	name := p.src[p.pos : p.pos+end]
+	p.pos += end + 1
+
+	if n, err := strconv.Atoi(name); err == nil {
+		return &Node{Op: OpBackref, Index: n, Flags: p.flags}, nil
+	}
+	node := &Node{Op: OpBackref, Name: name, Flags: p.flags}
+	p.namedRef = append(p.namedRef, node)
+	return node, nil
+}
+
+func (p *parser) checkBackrefs(root *Node) error {
+	for _, ref := range p.namedRef {
+		for i, name := range p.tree.Names {
+			if i > 0 && name == ref.Name {
+				ref.Index = i
+			}
+		}
+		if ref.Index == 0 {
+			return &Error{Pattern: p.src, Msg: fmt.Sprintf("undefined name <%s> reference", ref.Name)}
+		}
+	}
+
+	var err error
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		if n.Op == OpBackref && n.Index > p.tree.Captures && err == nil {
+			err = &Error{Pattern: p.src, Msg: fmt.Sprintf("invalid backref number \\%d", n.Index)}
+		}
+		for _, sub := range n.Sub {
+			walk(sub)
+		}
+	}
+	walk(root)
+	return err
+}
+
+// parseClassEscape - Escape shared by atoms and bracket classes. Returns
+// either a class (\d, \p{L}, ...) or a single rune.
+func (p *parser) parseClassEscape(inClass bool) (*Class, rune, error) {
+	start := p.pos
+	c := p.next()
+	switch c {
+	case 'd':
+		return unicodeClass(unicode.Nd), 0, nil
+	case 'D':
+		return unicodeClass(unicode.Nd).negate(), 0, nil
+	case 'w':
+		return wordClass(), 0, nil
+	case 'W':
+		return wordClass().negate(), 0, nil
+	case 's':
+		return spaceClass(), 0, nil
+	case 'S':
+		return spaceClass().negate(), 0, nil
+	case 'h':
+		return newClass('0', '9', 'A', 'F', 'a', 'f'), 0, nil
+	case 'H':
+		return newClass('0', '9', 'A', 'F', 'a', 'f').negate(), 0, nil
+	case 'p', 'P':
+		return p.parseProperty(c == 'P')
+	case 't':
+		return nil, '\t', nil
+	case 'n':
+		return nil, '\n', nil
+	case 'r':
+		return nil, '\r', nil
+	case 'f':
+		return nil, '\f', nil
+	case 'v':
+		return nil, '\v', nil
+	case 'a':
+		return nil, '\a', nil
+	case 'e':
+		return nil, 0x1B, nil
+	case 'b':
+		if inClass {
+			return nil, '\b', nil
+		}
+	case 'x':
+		return p.parseHex()
+	case 'u':
+		if len(p.src)-p.pos >= 4 {
+			if v, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32); err == nil {
+				p.pos += 4
+				return nil, rune(v), nil
+			}
+		}
+		p.pos = start
+		return nil, 0, p.errorf("invalid Unicode escape")
+	case 'c':
+		if !p.more() {
+			return nil, 0, p.errorf("end pattern at control")
+		}
+		return nil, p.next() & 0x1F, nil
+	case '0':
+		// Octal: \0, \0nn
+		v := 0
+		for i := 0; i < 2 && p.more() && p.peek() >= '0' && p.peek() <= '7'; i++ {
+			v = v*8 + int(p.next()-'0')
+		}
+		return nil, rune(v), nil
+	}
+	if c < utf8.RuneSelf && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+		p.pos = start
+		return nil, 0, p.errorf("unsupported escape \\%c", c)
+	}
+	return nil, c, nil
+}
+
+func (p *parser) parseHex() (*Class, rune, error) {
+	if p.lookingAt("{") {
+		end := strings.IndexByte(p.src[p.pos:], '}')
+		if end < 0 {
+			return nil, 0, p.errorf("invalid code point value")
+		}
+		v, err := strconv.ParseUint(p.src[p.pos+1:p.pos+end], 16, 32)
+		if err != nil || v > unicode.MaxRune {
+			return nil, 0, p.errorf("invalid code point value")
+		}
+		p.pos += end + 1
+		return nil, rune(v), nil
+	}
+	v := 0
+	for i := 0; i < 2 && p.more(); i++ {
+		d, err := strconv.ParseUint(string(p.src[p.pos]), 16, 8)
+		if err != nil {
+			break
+		}
+		v = v*16 + int(d)
+		p.pos++
+	}
+	return nil, rune(v), nil
+}
+
+func (p *parser) parseProperty(negated bool) (*Class, rune, error) {
+	if !p.lookingAt("{") {
+		return nil, 0, p.errorf("invalid property name")
+	}
+	end := strings.IndexByte(p.src[p.pos:], '}')
+	if end < 0 {
+		return nil, 0, p.errorf("invalid property name")
+	}
+	name := p.src[p.pos+1 : p.pos+end]
+	if strings.HasPrefix(name, "^") {
+		negated = !negated
+		name = name[1:]
+	}
+	class := propertyClass(name)
+	if class == nil {
+		return nil, 0, p.errorf("invalid character property name {%s}", name)
+	}
+	p.pos += end + 1
+	if negated {
+		class = class.negate()
+	}
+	return class, 0, nil
+}
+
+// parseClass - Bracket expression, after the opening '['
+func (p *parser) parseClass() (*Class, error) {
+	negated := false
+	if p.lookingAt("^") {
+		p.next()
+		negated = true
+	}
+
+	class := &Class{}
+	first := true
+	for {
+		if !p.more() {
+			return nil, p.errorf("premature end of char-class")
+		}
+		if p.peek() == ']' && !first {
+			p.next()
+			break
+		}
+		first = false
+
+		if p.lookingAt("&&") {
+			p.pos += 2
+			rest, err := p.parseClassRest()
+			if err != nil {
+				return nil, err
+			}
+			class = class.intersect(rest)
+			break
+		}
+
+		item, err := p.parseClassItem()
+		if err != nil {
+			return nil, err
+		}
+		class = class.union(item)
+	}
+
+	if negated {
+		class = class.negate()
+	}
+	return class, nil
+}
+
+// parseClassRest - Right operand of '&&', up to and including the ']'
+func (p *parser) parseClassRest() (*Class, error) {
+	class := &Class{}
+	for {
+		if !p.more() {
+			return nil, p.errorf("premature end of char-class")
+		}
+		if p.peek() == ']' {
+			p.next()
+			return class, nil
+		}
+		if p.lookingAt("&&") {
+			p.pos += 2
+			rest, err := p.parseClassRest()
+			if err != nil {
+				return nil, err
+			}
+			return class.intersect(rest), nil
+		}
+		item, err := p.parseClassItem()
+		if err != nil {
+			return nil, err
+		}
+		class = class.union(item)
+	}
+}
+
+func (p *parser) parseClassItem() (*Class, error) {
+	switch {
+	case p.lookingAt("[:"):
+		// The ':' of "[:" cannot close the name, as in [[:]]
+		end := strings.Index(p.src[p.pos+2:], ":]")
+		if end < 0 {
+			return nil, p.errorf("POSIX bracket without closing ':]'")
+		}
+		if end == 0 || end == 1 && p.src[p.pos+2] == '^' {
+			return nil, p.errorf("empty POSIX bracket name")
+		}
+		name := p.src[p.pos+2 : p.pos+2+end]
+		negated := strings.HasPrefix(name, "^")
+		if class := posixClass(strings.TrimPrefix(name, "^")); class != nil {
+			p.pos += end + 4
+			if negated {
+				class = class.negate()
+			}
+			return class, nil
+		}
+	case p.lookingAt("["):
+		p.next()
+		return p.parseClass()
+	}
+
+	lo, class, err := p.parseClassAtom()
+	if err != nil || class != nil {
+		return class, err
+	}
+
+	// Range a-z, unless '-' is the last character of the class
+	if p.lookingAt("-") && !p.lookingAt("-]") && len(p.src)-p.pos > 1 {
+		save := p.pos
+		p.next()
+		hi, hiClass, err := p.parseClassAtom()
+		if err != nil {
+			return nil, err
+		}
+		if hiClass != nil {
+			// [a-\d] is a literal '-' followed by a class
+			p.pos = save
+			return newClass(lo, lo), nil
+		}
+		if hi < lo {
+			return nil, p.errorf("empty range in char class")
+		}
+		return newClass(lo, hi), nil
+	}
+	return newClass(lo, lo), nil
+}
+
+func (p *parser) parseClassAtom() (rune, *Class, error) {
+	c := p.next()
+	if c != '\\' {
+		return c, nil, nil
+	}
+	if !p.more() {
+		return 0, nil, p.errorf("end pattern at escape")
+	}
+	class, r, err := p.parseClassEscape(true)
+	return r, class, err
+}
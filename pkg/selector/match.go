@@ -0,0 +1,178 @@
+package selector
+
+// Rank - Specificity of a match, used to pick the best of several
+// matching selectors. Following TextMate:
+//  1. A match on a deeper scope wins ("string" beats "source.php" on
+//     "source.php string").
+//  2. A match on more atoms of that scope wins ("string.quoted" beats
+//     "string").
+//  3. On a tie, the same rules are applied to the preceding selector
+//     elements ("text source string" beats "source string").
+type Rank struct {
+	parts []rankPart // Deepest element first
+}
+
+type rankPart struct {
+	depth int // 1-based index in the scope stack
+	atoms int // Matched atoms of the selector element
+}
+
+// Compare returns -1, 0 or 1 if r ranks lower, equal or higher than other
+func (r Rank) Compare(other Rank) int {
+	for i := 0; i < len(r.parts) && i < len(other.parts); i++ {
+		a, b := r.parts[i], other.parts[i]
+		if a.depth != b.depth {
+			return sign(a.depth - b.depth)
+		}
+		if a.atoms != b.atoms {
+			return sign(a.atoms - b.atoms)
+		}
+	}
+	return sign(len(r.parts) - len(other.parts))
+}
+
+func sign(v int) int {
+	switch {
+	case v < 0:
+		return -1
+	case v > 0:
+		return 1
+	}
+	return 0
+}
+
+func maxRank(a, b Rank) Rank {
+	if b.Compare(a) > 0 {
+		return b
+	}
+	return a
+}
+
+// Match reports whether any group of the selector matches the scope stack
+func (s *Selector) Match(scopes []string) bool {
+	_, ok := s.Rank(scopes)
+	return ok
+}
+
+// Rank returns the best rank among the matching groups
+func (s *Selector) Rank(scopes []string) (Rank, bool) {
+	_, rank, ok := s.MatchGroup(scopes)
+	return rank, ok
+}
+
+// MatchGroup returns the highest ranked matching group. Ties go to the
+// group that appears first.
+func (s *Selector) MatchGroup(scopes []string) (Group, Rank, bool) {
+	var best Group
+	var bestRank Rank
+	found := false
+	for _, g := range s.Groups {
+		rank, ok := g.expr.match(scopes)
+		if !ok {
+			continue
+		}
+		if !found || rank.Compare(bestRank) > 0 {
+			best, bestRank, found = g, rank, true
+		}
+	}
+	return best, bestRank, found
+}
+
+// Match reports whether the group matches the scope stack
+func (g Group) Match(scopes []string) bool {
+	_, ok := g.expr.match(scopes)
+	return ok
+}
+
+// expression - Node of a parsed selector
+type expression interface {
+	match(scopes []string) (Rank, bool)
+}
+
+// pathExpr - Space separated scope names matched as an ordered
+// subsequence of the stack
+type pathExpr struct {
+	elements [][]string // Atoms of each element
+}
+
+func (e *pathExpr) match(scopes []string) (Rank, bool) {
+	// Greedy from the deepest element: binding each element to the deepest
+	// possible scope both decides the match and maximizes its rank.
+	parts := make([]rankPart, 0, len(e.elements))
+	i := len(scopes) - 1
+	for j := len(e.elements) - 1; j >= 0; j-- {
+		for i >= 0 && !matchScope(e.elements[j], scopes[i]) {
+			i--
+		}
+		if i < 0 {
+			return Rank{}, false
+		}
+		parts = append(parts, rankPart{depth: i + 1, atoms: len(e.elements[j])})
+		i--
+	}
+	return Rank{parts: parts}, true
+}
+
+// matchScope - The selector atoms must be a prefix of the scope atoms;
+// "*" matches any single atom.
+func matchScope(atoms []string, scope string) bool {
+	pos := 0
+	for _, atom := range atoms {
+		if pos > len(scope) {
+			return false
+		}
+		end := pos
+		for end < len(scope) && scope[end] != '.' {
+			end++
+		}
+		if atom != "*" && scope[pos:end] != atom {
+			return false
+		}
+		pos = end + 1
+	}
+	return true
+}
+
+// notExpr - Exclusion; contributes nothing to the rank
+type notExpr struct {
+	expr expression
+}
+
+func (e *notExpr) match(scopes []string) (Rank, bool) {
+	_, ok := e.expr.match(scopes)
+	return Rank{}, !ok
+}
+
+// andExpr - Every operand must match; ranks as its best operand
+type andExpr struct {
+	exprs []expression
+}
+
+func (e *andExpr) match(scopes []string) (Rank, bool) {
+	var rank Rank
+	for _, expr := range e.exprs {
+		r, ok := expr.match(scopes)
+		if !ok {
+			return Rank{}, false
+		}
+		rank = maxRank(rank, r)
+	}
+	return rank, true
+}
+
+// orExpr - Any operand may match; ranks as its best matching operand
+type orExpr struct {
+	exprs []expression
+}
+
+func (e *orExpr) match(scopes []string) (Rank, bool) {
+	var rank Rank
+	found := false
+	for _, expr := range e.exprs {
+		if r, ok := expr.match(scopes); ok {
+			rank = maxRank(rank, r)
+			found = true
+		}
+	}
+	return rank, found
+}
@@ -0,0 +1,259 @@
+// Package selector implements TextMate scope selectors.
+//
+// A selector is a comma separated list of groups. Each group may carry a
+// priority prefix (`L:` or `R:`, used by grammar injections) followed by an
+// expression built from scope paths, `-` (exclusion), `&` (conjunction),
+// `|` (alternation) and parentheses:
+//
+//	source.js meta.function - comment, L:text.html (string | comment)
+package selector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Priority - Injection priority declared by a group prefix
+type Priority int
+
+const (
+	PriorityDefault Priority = 0  // No prefix
+	PriorityLeft    Priority = -1 // L: injected rules win ties
+	PriorityRight   Priority = 1  // R: injected rules lose ties
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLeft:
+		return "L"
+	case PriorityRight:
+		return "R"
+	default:
+		return ""
+	}
+}
+
+// Selector - Parsed scope selector
+type Selector struct {
+	Groups []Group
+	source string
+}
+
+// Group - One comma separated alternative of a selector
+type Group struct {
+	Priority Priority
+	expr     expression
+	source   string
+}
+
+// String returns the group expression without its priority prefix
+func (g Group) String() string {
+	return g.source
+}
+
+// Parse parses a scope selector. An empty selector has no groups and
+// matches nothing.
+func Parse(source string) (*Selector, error) {
+	p := &parser{tokens: tokenize(source)}
+	sel := &Selector{source: source}
+
+	for !p.done() {
+		priority := PriorityDefault
+		switch p.peek() {
+		case "L:":
+			priority = PriorityLeft
+			p.next()
+		case "R:":
+			priority = PriorityRight
+			p.next()
+		case "B:":
+			p.next()
+		}
+
+		start := p.pos
+		expr, err := p.parseAlternation()
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %w", source, err)
+		}
+		sel.Groups = append(sel.Groups, Group{
+			Priority: priority,
+			expr:     expr,
+			source:   strings.Join(p.tokens[start:p.pos], " "),
+		})
+
+		if p.done() {
+			break
+		}
+		if p.peek() != "," {
+			return nil, fmt.Errorf("invalid selector %q: unexpected %q", source, p.peek())
+		}
+		p.next()
+	}
+
+	return sel, nil
+}
+
+// MustParse is like Parse but panics on invalid input
+func MustParse(source string) *Selector {
+	sel, err := Parse(source)
+	if err != nil {
+		panic(err)
+	}
+	return sel
+}
+
+func (s *Selector) String() string {
+	return s.source
+}
+
+// Stack splits a space separated scope list ("source.js string.quoted")
+// into a scope stack, root first.
+func Stack(scopes string) []string {
+	return strings.Fields(scopes)
+}
+
+// tokenize splits a selector into operators and scope names. Scope names
+// may contain '-', so an exclusion needs surrounding whitespace or must
+// start an operand ("a -b", "a - b").
+func tokenize(source string) []string {
+	var tokens []string
+	i := 0
+	for i < len(source) {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case (c == 'L' || c == 'R' || c == 'B') && i+1 < len(source) && source[i+1] == ':':
+			tokens = append(tokens, source[i:i+2])
+			i += 2
+		case strings.IndexByte(",|&-()", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			start := i
+			for i < len(source) && isScopeChar(source[i], i == start) {
+				i++
+			}
+			if i == start {
+				// Unknown character, keep it so the parser can report it
+				i++
+			}
+			tokens = append(tokens, source[start:i])
+		}
+	}
+	return tokens
+}
+
+func isScopeChar(c byte, first bool) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	case c == '_' || c == '.' || c == ':' || c == '*' || c >= 0x80:
+		return true
+	case c == '-':
+		return !first
+	}
+	return false
+}
+
+func isScopeName(token string) bool {
+	return token != "" && isScopeChar(token[0], true) && !strings.HasSuffix(token, ":")
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) done() bool   { return p.pos >= len(p.tokens) }
+func (p *parser) next()        { p.pos++ }
+func (p *parser) peek() string { return p.tokens[p.pos] }
+
+// parseAlternation - conjunction ('|' conjunction)*
+func (p *parser) parseAlternation() (expression, error) {
+	var exprs []expression
+	for {
+		expr, err := p.parseConjunction()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if p.done() || p.peek() != "|" {
+			break
+		}
+		p.next()
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return &orExpr{exprs: exprs}, nil
+}
+
+// parseConjunction - operand (['&'] operand)*
+func (p *parser) parseConjunction() (expression, error) {
+	var exprs []expression
+	for !p.done() {
+		tok := p.peek()
+		if tok == "&" {
+			if len(exprs) == 0 {
+				return nil, fmt.Errorf("unexpected %q", tok)
+			}
+			p.next()
+			continue
+		}
+		if tok != "-" && tok != "(" && !isScopeName(tok) {
+			break
+		}
+		expr, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	switch len(exprs) {
+	case 0:
+		if p.done() {
+			return nil, fmt.Errorf("unexpected end of selector")
+		}
+		return nil, fmt.Errorf("unexpected %q", p.peek())
+	case 1:
+		return exprs[0], nil
+	}
+	return &andExpr{exprs: exprs}, nil
+}
+
+// parseOperand - '-' operand | '(' alternation ')' | path
+func (p *parser) parseOperand() (expression, error) {
+	tok := p.peek()
+	switch {
+	case tok == "-":
+		p.next()
+		if p.done() {
+			return nil, fmt.Errorf("missing operand after '-'")
+		}
+		expr, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{expr: expr}, nil
+	case tok == "(":
+		p.next()
+		expr, err := p.parseAlternation()
+		if err != nil {
+			return nil, err
+		}
+		if p.done() || p.peek() != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		p.next()
+		return expr, nil
+	case isScopeName(tok):
+		path := &pathExpr{}
+		for !p.done() && isScopeName(p.peek()) {
+			path.elements = append(path.elements, strings.Split(p.peek(), "."))
+			p.next()
+		}
+		return path, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", tok)
+}
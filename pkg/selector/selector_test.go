@@ -0,0 +1,143 @@
+package selector
+
+import (
+	"testing"
+)
+
+func TestSelector_Match(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		scopes   string
+		want     bool
+	}{
+		{name: "exact scope", selector: "string", scopes: "source.js string", want: true},
+		{name: "atom prefix", selector: "string", scopes: "source.js string.quoted.double", want: true},
+		{name: "partial atom", selector: "str", scopes: "source.js string", want: false},
+		{name: "longer selector", selector: "string.quoted.double", scopes: "source.js string.quoted", want: false},
+		{name: "wildcard atom", selector: "string.*.double", scopes: "string.quoted.double.js", want: true},
+		{name: "path in order", selector: "source.js string", scopes: "source.js meta.block string.quoted", want: true},
+		{name: "path out of order", selector: "string source.js", scopes: "source.js string", want: false},
+		{name: "path ancestor only", selector: "source.js comment", scopes: "source.js string", want: false},
+		{name: "exclusion", selector: "source.js - comment", scopes: "source.js comment.line", want: false},
+		{name: "exclusion not present", selector: "source.js - comment", scopes: "source.js string", want: true},
+		{name: "exclusion of path", selector: "source.js meta.function - comment", scopes: "source.js meta.function.js", want: true},
+		{name: "leading exclusion", selector: "-comment", scopes: "source.js", want: true},
+		{name: "comma groups", selector: "comment, string", scopes: "source.js string", want: true},
+		{name: "alternation", selector: "comment | string", scopes: "source.js string", want: true},
+		{name: "parentheses", selector: "source.js (comment | string) - string.regexp", scopes: "source.js string.regexp", want: false},
+		{name: "conjunction", selector: "meta.function & string", scopes: "source.js meta.function string", want: true},
+		{name: "conjunction miss", selector: "meta.function & string", scopes: "source.js string", want: false},
+		{name: "dashed scope name", selector: "meta.function-call", scopes: "source.js meta.function-call.js", want: true},
+		{name: "priority prefix", selector: "L:comment.block - string", scopes: "source.js comment.block", want: true},
+		{name: "empty selector", selector: "", scopes: "source.js", want: false},
+		{name: "empty stack", selector: "source", scopes: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel, err := Parse(tt.selector)
+			if err != nil {
+				t.Fatalf("Parse(%q) error: %v", tt.selector, err)
+			}
+			if got := sel.Match(Stack(tt.scopes)); got != tt.want {
+				t.Errorf("%q.Match(%q) = %v, want %v", tt.selector, tt.scopes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelector_Alternation(t *testing.T) {
+	// "source.js (comment | string)" is a path followed by a parenthesized
+	// operand: both must match independently.
+	sel := MustParse("source.js (comment | string)")
+	if !sel.Match(Stack("source.js string")) {
+		t.Errorf("expected match")
+	}
+	if sel.Match(Stack("source.python string")) {
+		t.Errorf("expected no match")
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []string{
+		"(string",
+		"string)",
+		"a, ,b",
+		"& string",
+		"string -",
+		"a ! b",
+	}
+
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if _, err := Parse(input); err == nil {
+				t.Errorf("Parse(%q) expected error", input)
+			}
+		})
+	}
+}
+
+func TestSelector_Priority(t *testing.T) {
+	tests := []struct {
+		selector string
+		scopes   string
+		want     Priority
+	}{
+		{selector: "L:comment", scopes: "source comment", want: PriorityLeft},
+		{selector: "R:comment", scopes: "source comment", want: PriorityRight},
+		{selector: "comment", scopes: "source comment", want: PriorityDefault},
+		{selector: "L:string, R:comment", scopes: "source comment", want: PriorityRight},
+		{selector: "L:string, R:comment", scopes: "source string", want: PriorityLeft},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			group, _, ok := MustParse(tt.selector).MatchGroup(Stack(tt.scopes))
+			if !ok {
+				t.Fatalf("expected match")
+			}
+			if group.Priority != tt.want {
+				t.Errorf("priority = %v, want %v", group.Priority, tt.want)
+			}
+		})
+	}
+}
+
+func TestRank_Specificity(t *testing.T) {
+	// Each case lists a stack and two selectors; the first must outrank
+	// the second.
+	tests := []struct {
+		name   string
+		scopes string
+		better string
+		worse  string
+	}{
+		{name: "deeper scope", scopes: "source.php string.quoted", better: "string", worse: "source.php"},
+		{name: "more atoms", scopes: "source.php string.quoted", better: "string.quoted", worse: "string"},
+		{name: "longer path", scopes: "text.html source.php string", better: "text source string", worse: "source string"},
+		{name: "ancestor depth", scopes: "text.html source.php string", better: "source string", worse: "text string"},
+		{name: "alternation takes best", scopes: "source.js string", better: "source.js | string", worse: "source.js"},
+		{name: "exclusion adds nothing", scopes: "source.js string", better: "string", worse: "source.js - comment"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scopes := Stack(tt.scopes)
+			better, ok := MustParse(tt.better).Rank(scopes)
+			if !ok {
+				t.Fatalf("%q does not match", tt.better)
+			}
+			worse, ok := MustParse(tt.worse).Rank(scopes)
+			if !ok {
+				t.Fatalf("%q does not match", tt.worse)
+			}
+			if better.Compare(worse) <= 0 {
+				t.Errorf("%q should outrank %q on %q", tt.better, tt.worse, tt.scopes)
+			}
+			if worse.Compare(better) >= 0 {
+				t.Errorf("Compare is not antisymmetric")
+			}
+		})
+	}
+}